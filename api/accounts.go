@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 
 	"github.com/JamesClonk/compose-broker/log"
@@ -14,9 +15,13 @@ type Account struct {
 }
 
 func (c *Client) GetAccounts() (Accounts, error) {
-	body, err := c.Get("accounts")
+	return c.GetAccountsContext(context.Background())
+}
+
+func (c *Client) GetAccountsContext(ctx context.Context) (Accounts, error) {
+	body, err := c.GetContext(ctx, "accounts")
 	if err != nil {
-		log.Errorf("could not get Compose.io accounts: %s", err)
+		log.Ctx(ctx).Errorf("could not get Compose.io accounts: %s", err)
 		return nil, err
 	}
 
@@ -26,7 +31,7 @@ func (c *Client) GetAccounts() (Accounts, error) {
 		} `json:"_embedded"`
 	}{}
 	if err := json.Unmarshal([]byte(body), &response); err != nil {
-		log.Errorf("could not unmarshal accounts response: %#v", body)
+		log.Ctx(ctx).Errorf("could not unmarshal accounts response: %#v", body)
 		return nil, err
 	}
 	return response.Embedded.Accounts, nil
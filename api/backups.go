@@ -0,0 +1,131 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/JamesClonk/compose-broker/log"
+)
+
+type Backups []Backup
+type Backup struct {
+	ID             string    `json:"id"`
+	DeploymentID   string    `json:"deployment_id"`
+	Name           string    `json:"name"`
+	Type           string    `json:"type"`   // can be on_demand, daily, weekly or monthly
+	Status         string    `json:"status"` // can be running, complete or failed
+	IsDownloadable bool      `json:"is_downloadable"`
+	IsRestorable   bool      `json:"is_restorable"`
+	CreatedAt      time.Time `json:"created_at"`
+	Links          struct {
+		DownloadLink struct {
+			HREF      string `json:"href"`
+			Templated bool   `json:"templated"`
+		} `json:"download_link"`
+	} `json:"_links"`
+}
+type RestoredDeployment struct {
+	Name       string `json:"name"`
+	Datacenter string `json:"datacenter,omitempty"`
+	Version    string `json:"version,omitempty"`
+}
+
+func (c *Client) GetBackups(deploymentID string) (Backups, error) {
+	return c.GetBackupsContext(context.Background(), deploymentID)
+}
+
+func (c *Client) GetBackupsContext(ctx context.Context, deploymentID string) (Backups, error) {
+	body, err := c.GetContext(ctx, fmt.Sprintf("deployments/%s/backups", deploymentID))
+	if err != nil {
+		log.Ctx(ctx).Errorf("could not get Compose.io backups for deployment %s: %s", deploymentID, err)
+		return nil, err
+	}
+
+	response := struct {
+		Embedded struct {
+			Backups Backups `json:"backups"`
+		} `json:"_embedded"`
+	}{}
+	if err := json.Unmarshal([]byte(body), &response); err != nil {
+		log.Ctx(ctx).Errorf("could not unmarshal backups response: %#v", body)
+		return nil, err
+	}
+	return response.Embedded.Backups, nil
+}
+
+func (c *Client) GetBackup(deploymentID, backupID string) (*Backup, error) {
+	return c.GetBackupContext(context.Background(), deploymentID, backupID)
+}
+
+func (c *Client) GetBackupContext(ctx context.Context, deploymentID, backupID string) (*Backup, error) {
+	body, err := c.GetContext(ctx, fmt.Sprintf("deployments/%s/backups/%s", deploymentID, backupID))
+	if err != nil {
+		log.Ctx(ctx).Errorf("could not get Compose.io backup %s of deployment %s: %s", backupID, deploymentID, err)
+		return nil, err
+	}
+
+	backup := &Backup{}
+	if err := json.Unmarshal([]byte(body), backup); err != nil {
+		log.Ctx(ctx).Errorf("could not unmarshal backup response: %#v", body)
+		return nil, err
+	}
+	return backup, nil
+}
+
+func (c *Client) StartBackup(deploymentID string) (*Recipe, error) {
+	return c.StartBackupContext(context.Background(), deploymentID)
+}
+
+func (c *Client) StartBackupContext(ctx context.Context, deploymentID string) (*Recipe, error) {
+	body, err := c.PostAsyncContext(ctx, fmt.Sprintf("deployments/%s/backups", deploymentID), "")
+	if err != nil {
+		log.Ctx(ctx).Errorf("could not start Compose.io backup for deployment %s: %s", deploymentID, err)
+		return nil, err
+	}
+
+	recipe := &Recipe{}
+	if err := json.Unmarshal([]byte(body), recipe); err != nil {
+		log.Ctx(ctx).Errorf("could not unmarshal recipe response: %#v", body)
+		return nil, err
+	}
+	return recipe, nil
+}
+
+func (c *Client) RestoreBackup(deploymentID, backupID string, restored RestoredDeployment) (*Deployment, error) {
+	return c.RestoreBackupContext(context.Background(), deploymentID, backupID, restored)
+}
+
+// RestoreBackupContext creates a new deployment from the backup of an existing deployment
+func (c *Client) RestoreBackupContext(ctx context.Context, deploymentID, backupID string, restored RestoredDeployment) (*Deployment, error) {
+	// set defaults
+	if len(restored.Datacenter) == 0 {
+		restored.Datacenter = c.Config.DefaultDatacenter
+	}
+
+	data := struct {
+		Deployment RestoredDeployment `json:"deployment"`
+	}{
+		Deployment: restored,
+	}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		log.Ctx(ctx).Errorf("could not marshal restore payload: %#v", restored)
+		return nil, err
+	}
+
+	body, err := c.PostAsyncContext(ctx, fmt.Sprintf("deployments/%s/backups/%s/restore", deploymentID, backupID), string(payload))
+	if err != nil {
+		log.Ctx(ctx).Errorf("could not restore Compose.io backup %s of deployment %s: %s", backupID, deploymentID, err)
+		return nil, err
+	}
+
+	deployment := &Deployment{}
+	if err := json.Unmarshal([]byte(body), deployment); err != nil {
+		log.Ctx(ctx).Errorf("could not unmarshal deployment response: %#v", body)
+		return nil, err
+	}
+	c.Index.Add(deployment.Name, deployment.ID)
+	return deployment, nil
+}
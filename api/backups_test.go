@@ -0,0 +1,105 @@
+package api
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/JamesClonk/compose-broker/log"
+	"github.com/JamesClonk/compose-broker/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+}
+
+func TestAPI_GetBackups(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/backups", Code: 200, Body: util.Body("../_fixtures/api_get_backups.json"), Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	c := NewClient(util.TestConfig(apiServer.URL))
+
+	backups, err := c.GetBackups("5854017e89d50f424e000192")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, len(backups))
+	assert.Equal(t, "5a3a1f5e8c3c8f001a3e4d21", backups[0].ID)
+	assert.Equal(t, "daily", backups[0].Type)
+	assert.Equal(t, "complete", backups[0].Status)
+	assert.True(t, backups[0].IsRestorable)
+	assert.Equal(t, "https://s3.amazonaws.com/compose-backups/fizz-production_2017-12-20_09-00-14_daily.tar.gz", backups[0].Links.DownloadLink.HREF)
+	assert.Equal(t, "on_demand", backups[1].Type)
+	assert.False(t, backups[1].IsRestorable)
+}
+
+func TestAPI_GetBackup(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/backups/5a3a1f5e8c3c8f001a3e4d21", Code: 200, Body: util.Body("../_fixtures/api_get_backup.json"), Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	c := NewClient(util.TestConfig(apiServer.URL))
+
+	backup, err := c.GetBackup("5854017e89d50f424e000192", "5a3a1f5e8c3c8f001a3e4d21")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "5a3a1f5e8c3c8f001a3e4d21", backup.ID)
+	assert.Equal(t, "5854017e89d50f424e000192", backup.DeploymentID)
+	assert.Equal(t, "fizz-production_2017-12-20_09-00-14_daily", backup.Name)
+}
+
+func TestAPI_GetBackup_NotFound(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/backups/deadbeef", Code: 404, Body: `{"errors":"Not Found"}`, Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	c := NewClient(util.TestConfig(apiServer.URL))
+
+	_, err := c.GetBackup("5854017e89d50f424e000192", "deadbeef")
+	assert.Error(t, err)
+	assert.True(t, IsNotFound(err))
+}
+
+func TestAPI_StartBackup(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "POST", Path: "/deployments/5854017e89d50f424e000192/backups", Code: 202, Body: util.Body("../_fixtures/api_start_backup.json"), Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	c := NewClient(util.TestConfig(apiServer.URL))
+
+	recipe, err := c.StartBackup("5854017e89d50f424e000192")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "5a3b7e2c9b1e5d001a3e4f90", recipe.ID)
+	assert.Equal(t, "Backup deployment", recipe.Name)
+	assert.Equal(t, "running", recipe.Status)
+}
+
+func TestAPI_RestoreBackup(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "POST", Path: "/deployments/5854017e89d50f424e000192/backups/5a3a1f5e8c3c8f001a3e4d21/restore", Code: 202, Body: util.Body("../_fixtures/api_restore_backup.json"), Test: func(body string) {
+			assert.Equal(t, `{"deployment":{"name":"c9f2a0b4-6e1d-4f7a-9b3c-2d8e5f1a7b60","datacenter":"gce:europe-west1"}}`, body)
+		}},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	c := NewClient(util.TestConfig(apiServer.URL))
+
+	deployment, err := c.RestoreBackup("5854017e89d50f424e000192", "5a3a1f5e8c3c8f001a3e4d21", RestoredDeployment{Name: "c9f2a0b4-6e1d-4f7a-9b3c-2d8e5f1a7b60"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "5a3c0d4e7f2a1b001a3e5012", deployment.ID)
+	assert.Equal(t, "5a3c0d4e7f2a1b001a3e5013", deployment.ProvisionRecipeID)
+
+	id, ok := c.Index.Lookup("c9f2a0b4-6e1d-4f7a-9b3c-2d8e5f1a7b60")
+	assert.True(t, ok)
+	assert.Equal(t, "5a3c0d4e7f2a1b001a3e5012", id)
+}
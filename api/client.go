@@ -1,33 +1,55 @@
 package api
 
 import (
-	"encoding/json"
-	"errors"
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/JamesClonk/compose-broker/config"
 	"github.com/JamesClonk/compose-broker/log"
+	"github.com/JamesClonk/compose-broker/metrics"
 	"github.com/JamesClonk/compose-broker/util"
-	"github.com/parnurzeal/gorequest"
+	"golang.org/x/time/rate"
 )
 
 type Client struct {
 	Config           config.API
-	Mutex            *sync.Mutex
 	HTTPClient       *http.Client
 	Retries          int
 	RetryInterval    time.Duration
 	RetryStatusCodes []int
+	Index            *DeploymentIndex
+	Limiter          *rate.Limiter
+	workers          chan struct{}
+	backoffUntil     time.Time
+	backoffMutex     sync.RWMutex
+	stop             chan struct{}
+	stopOnce         sync.Once
 }
 
 func NewClient(c *config.Config) *Client {
+	limit := rate.Limit(c.API.RateLimit)
+	if c.API.RateLimit <= 0 {
+		limit = rate.Inf
+	}
+	burst := c.API.RateBurst
+	if burst < 1 {
+		burst = 1
+	}
+	workers := c.API.MaxConcurrentRequests
+	if workers < 1 {
+		workers = 1
+	}
+
 	client := &Client{
 		Config:        c.API,
-		Mutex:         &sync.Mutex{},
 		HTTPClient:    util.NewHttpClient(c),
 		Retries:       c.API.Retries,
 		RetryInterval: c.API.RetryInterval,
@@ -39,89 +61,268 @@ func NewClient(c *config.Config) *Client {
 			http.StatusGatewayTimeout,
 			http.StatusInternalServerError,
 		},
+		Index:   NewDeploymentIndex(c.API.IndexTTL),
+		Limiter: rate.NewLimiter(limit, burst),
+		workers: make(chan struct{}, workers),
+		stop:    make(chan struct{}),
+	}
+	if c.API.IndexRefreshInterval > 0 {
+		go client.refreshIndex(c.API.IndexRefreshInterval)
 	}
 	return client
 }
 
-func (c *Client) newRequest(method, endpoint string) *gorequest.SuperAgent {
+// refreshIndex keeps rebuilding the deployment index in the background, so that lookups by name rarely miss,
+// until the client is closed
+func (c *Client) refreshIndex(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			if _, err := c.GetDeployments(); err != nil {
+				log.Warnf("could not refresh deployment index: %v", err)
+			}
+		}
+	}
+}
+
+// Close stops everything the client does in the background
+func (c *Client) Close() {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+}
+
+func (c *Client) newRequest(ctx context.Context, method, endpoint, payload string) (*http.Request, error) {
 	targetURL := fmt.Sprintf("%s/%s", c.Config.URL, endpoint)
-	log.Debugf("Compose.io API HTTP request [%v:%v]", method, targetURL)
+	log.Ctx(ctx).Debugf("Compose.io API HTTP request [%v:%v]", method, targetURL)
 
-	return gorequest.New().
-		CustomMethod(method, targetURL).
-		Set("Authorization", "Bearer "+c.Config.Token).
-		Set("Content-type", "application/json; charset=utf-8").
-		Retry(c.Retries, c.RetryInterval, c.RetryStatusCodes...)
+	var body io.Reader
+	if len(payload) > 0 {
+		body = strings.NewReader(payload)
+	}
+	req, err := http.NewRequest(method, targetURL, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+c.Config.Token)
+	req.Header.Set("Content-type", "application/json; charset=utf-8")
+	return req, nil
 }
 
 func (c *Client) Get(endpoint string) (string, error) {
-	return c.Do("GET", endpoint, "", 200)
+	return c.GetContext(context.Background(), endpoint)
+}
+
+func (c *Client) GetContext(ctx context.Context, endpoint string) (string, error) {
+	return c.DoContext(ctx, "GET", endpoint, "", 200)
 }
 
 func (c *Client) Post(endpoint, payload string) (string, error) {
-	return c.Do("POST", endpoint, payload, 200)
+	return c.PostContext(context.Background(), endpoint, payload)
+}
+
+func (c *Client) PostContext(ctx context.Context, endpoint, payload string) (string, error) {
+	return c.DoContext(ctx, "POST", endpoint, payload, 200)
 }
 
 func (c *Client) PostAsync(endpoint, payload string) (string, error) {
-	return c.Do("POST", endpoint, payload, 202)
+	return c.PostAsyncContext(context.Background(), endpoint, payload)
+}
+
+func (c *Client) PostAsyncContext(ctx context.Context, endpoint, payload string) (string, error) {
+	return c.DoContext(ctx, "POST", endpoint, payload, 202)
+}
+
+func (c *Client) Patch(endpoint, payload string) (string, error) {
+	return c.PatchContext(context.Background(), endpoint, payload)
+}
+
+func (c *Client) PatchContext(ctx context.Context, endpoint, payload string) (string, error) {
+	return c.DoContext(ctx, "PATCH", endpoint, payload, 200)
 }
 
 func (c *Client) Delete(endpoint string) (string, error) {
-	return c.Do("DELETE", endpoint, "", 202)
+	return c.DeleteContext(context.Background(), endpoint)
+}
+
+func (c *Client) DeleteContext(ctx context.Context, endpoint string) (string, error) {
+	return c.DoContext(ctx, "DELETE", endpoint, "", 202)
 }
 
 func (c *Client) Do(method, endpoint, payload string, code int) (string, error) {
-	c.Mutex.Lock()
-	defer c.Mutex.Unlock()
+	return c.DoContext(context.Background(), method, endpoint, payload, code)
+}
 
-	request := c.newRequest(method, endpoint)
-	if method == "POST" {
-		request = request.Send(payload)
+func (c *Client) DoContext(ctx context.Context, method, endpoint, payload string, code int) (body string, err error) {
+	// every call gets its own deadline, on top of whatever deadline the caller already has
+	if c.Config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Config.Timeout)
+		defer cancel()
 	}
-	response, body, errs := request.End()
-	if response != nil && response.StatusCode != code {
-		errs = append(errs, fmt.Errorf("unexpected status code: %d", response.StatusCode))
-		errs = append(errs, composeErrors(body)...)
-	}
-
-	var err error
-	if len(errs) > 0 {
-		var errorMessage string
-		for _, err := range errs {
-			if len(errorMessage) > 0 {
-				errorMessage = fmt.Sprintf("%s, %s", errorMessage, err.Error())
-			} else {
-				errorMessage = err.Error()
+
+	// only a limited number of requests can be in flight at the same time
+	select {
+	case c.workers <- struct{}{}:
+		defer func() { <-c.workers }()
+	case <-ctx.Done():
+		return "", &CancelledError{Method: method, Endpoint: endpoint, Err: ctx.Err()}
+	}
+
+	var response *http.Response
+	label := endpointLabel(endpoint)
+	defer func(start time.Time) {
+		metrics.APIRequestDuration.WithLabelValues(label, method).Observe(time.Since(start).Seconds())
+		metrics.APIRequests.WithLabelValues(label, method, statusLabel(response, err)).Inc()
+	}(time.Now())
+
+	for attempt := 0; ; attempt++ {
+		response, body, err = c.send(ctx, method, endpoint, payload)
+		if IsCancelled(err) {
+			return body, err
+		}
+		if ctx.Err() != nil {
+			return body, &CancelledError{Method: method, Endpoint: endpoint, Err: ctx.Err()}
+		}
+
+		wait := c.RetryInterval
+		retries := c.Retries
+		if response != nil && response.StatusCode == http.StatusTooManyRequests {
+			// we are being rate limited, every other request has to back off too, whether this one is retried or not
+			if retryAfter := parseRetryAfter(response.Header.Get("Retry-After")); retryAfter > 0 {
+				wait = retryAfter
 			}
+			c.backoff(wait)
+
+			// and since the Compose.io API told us when to try again, it is worth retrying at least once
+			if retries < 1 {
+				retries = 1
+			}
+		}
+		if attempt >= retries || !c.retryable(response, err) {
+			break
+		}
+		log.Ctx(ctx).Warnf("retrying Compose.io API HTTP request [%v:%v] in %v", method, endpoint, wait)
+		metrics.APIRetries.WithLabelValues(label, method).Inc()
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return body, &CancelledError{Method: method, Endpoint: endpoint, Err: ctx.Err()}
 		}
-		err = errors.New(errorMessage)
+	}
+
+	if err != nil {
+		return body, err
+	}
+	if response != nil && response.StatusCode != code {
+		return body, NewError(response.StatusCode, body)
 	}
 	return body, err
 }
 
-func composeErrors(body string) []error {
-	errs := make([]error, 0)
+// send does a single HTTP request, after waiting for the rate limiter and any backoff imposed by the Compose.io API
+func (c *Client) send(ctx context.Context, method, endpoint, payload string) (*http.Response, string, error) {
+	if err := c.waitForBackoff(ctx); err != nil {
+		return nil, "", &CancelledError{Method: method, Endpoint: endpoint, Err: err}
+	}
+	if err := c.Limiter.Wait(ctx); err != nil {
+		// the limiter refuses to wait at all if the deadline would pass in the meantime
+		if ctx.Err() == nil {
+			err = context.DeadlineExceeded
+		}
+		return nil, "", &CancelledError{Method: method, Endpoint: endpoint, Err: err}
+	}
 
-	// Compose.io error types
-	type multiErrors struct {
-		Error map[string][]string `json:"errors,omitempty"`
+	req, err := c.newRequest(ctx, method, endpoint, payload)
+	if err != nil {
+		return nil, "", err
 	}
-	type singleError struct {
-		Error string `json:"errors"`
+	response, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, "", err
 	}
+	defer response.Body.Close()
 
-	multi := multiErrors{}
-	if err := json.Unmarshal([]byte(body), &multi); err != nil {
-		single := singleError{}
-		if err := json.Unmarshal([]byte(body), &single); err != nil {
-			errs = append(errs, fmt.Errorf("could not parse API response: %s", body))
-		} else {
-			errs = append(errs, fmt.Errorf("%s", single.Error))
-		}
-	} else {
-		for key, value := range multi.Error {
-			errs = append(errs, fmt.Errorf("%s: %s", key, strings.Join(value, ", ")))
+	data, err := ioutil.ReadAll(response.Body)
+	return response, string(data), err
+}
+
+func (c *Client) retryable(response *http.Response, err error) bool {
+	if response == nil {
+		return err != nil
+	}
+	for _, code := range c.RetryStatusCodes {
+		if response.StatusCode == code {
+			return true
 		}
 	}
-	return errs
+	return false
+}
+
+func (c *Client) backoff(duration time.Duration) {
+	c.backoffMutex.Lock()
+	defer c.backoffMutex.Unlock()
+
+	if until := time.Now().Add(duration); until.After(c.backoffUntil) {
+		c.backoffUntil = until
+	}
+}
+
+func (c *Client) waitForBackoff(ctx context.Context) error {
+	c.backoffMutex.RLock()
+	wait := time.Until(c.backoffUntil)
+	c.backoffMutex.RUnlock()
+	if wait <= 0 {
+		return nil
+	}
+
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// parseRetryAfter understands both variants of the Retry-After header, seconds or a HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if len(value) == 0 {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
+
+// IDs in API endpoints are replaced, so that metrics have a label per endpoint and not one per deployment
+var endpointIDPattern = regexp.MustCompile(`/([0-9a-fA-F]{24}|[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12})(/|$)`)
+
+func endpointLabel(endpoint string) string {
+	endpoint = "/" + strings.SplitN(endpoint, "?", 2)[0]
+	// applied twice since matches can't overlap, as in "/{id}/{id}"
+	endpoint = endpointIDPattern.ReplaceAllString(endpoint, "/{id}$2")
+	endpoint = endpointIDPattern.ReplaceAllString(endpoint, "/{id}$2")
+	return strings.TrimPrefix(endpoint, "/")
+}
+
+func statusLabel(response *http.Response, err error) string {
+	switch {
+	case IsCancelled(err):
+		return "cancelled"
+	case response != nil:
+		return strconv.Itoa(response.StatusCode)
+	case err != nil:
+		return "error"
+	}
+	return ""
 }
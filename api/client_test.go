@@ -1,8 +1,15 @@
 package api
 
 import (
+	"context"
+	"errors"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/JamesClonk/compose-broker/log"
 	"github.com/JamesClonk/compose-broker/util"
@@ -120,3 +127,171 @@ func TestAPI_Get_NilResponse(t *testing.T) {
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), `Get /api: unsupported protocol scheme ""`)
 }
+
+func TestAPI_Get_RetryAfter(t *testing.T) {
+	var calls int32
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(429)
+			_, _ = w.Write([]byte(`{"errors":"too many requests"}`))
+			return
+		}
+		w.WriteHeader(200)
+		_, _ = w.Write([]byte(util.Body("../_fixtures/api_example_valid.json")))
+	}))
+	defer apiServer.Close()
+	c := NewClient(util.TestConfig(apiServer.URL))
+
+	start := time.Now()
+	body, err := c.Get("api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	assert.True(t, time.Since(start) >= time.Second) // must have waited for Retry-After, not RetryInterval
+	assert.Equal(t, util.Body("../_fixtures/api_example_valid.json"), body)
+}
+
+func TestAPI_Get_RetryAfterWithoutRetries(t *testing.T) {
+	var calls int32
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(429)
+			_, _ = w.Write([]byte(`{"errors":"too many requests"}`))
+			return
+		}
+		w.WriteHeader(200)
+		_, _ = w.Write([]byte(util.Body("../_fixtures/api_example_valid.json")))
+	}))
+	defer apiServer.Close()
+	config := util.TestConfig(apiServer.URL)
+	config.API.Retries = 0
+	c := NewClient(config)
+
+	start := time.Now()
+	body, err := c.Get("api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	assert.True(t, time.Since(start) >= time.Second)
+	assert.Equal(t, util.Body("../_fixtures/api_example_valid.json"), body)
+}
+
+func TestAPI_Close(t *testing.T) {
+	var calls int32
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(200)
+		_, _ = w.Write([]byte(util.Body("../_fixtures/api_get_deployments.json")))
+	}))
+	defer apiServer.Close()
+	config := util.TestConfig(apiServer.URL)
+	config.API.IndexRefreshInterval = 10 * time.Millisecond
+	c := NewClient(config)
+
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&calls) > 0
+	}, time.Second, 10*time.Millisecond)
+
+	// the deployment index is no longer refreshed once the client is closed
+	c.Close()
+	c.Close()
+	time.Sleep(50 * time.Millisecond)
+	refreshed := atomic.LoadInt32(&calls)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, refreshed, atomic.LoadInt32(&calls))
+}
+
+func TestAPI_Do_MaxConcurrentRequests(t *testing.T) {
+	var current, max int32
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&current, 1)
+		defer atomic.AddInt32(&current, -1)
+		for {
+			m := atomic.LoadInt32(&max)
+			if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		w.WriteHeader(200)
+	}))
+	defer apiServer.Close()
+	config := util.TestConfig(apiServer.URL)
+	config.API.MaxConcurrentRequests = 2
+	c := NewClient(config)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = c.Get("api")
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&max))
+}
+
+func TestAPI_GetContext_Cancelled(t *testing.T) {
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer apiServer.Close()
+	c := NewClient(util.TestConfig(apiServer.URL))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	_, err := c.GetContext(ctx, "api")
+	assert.Error(t, err)
+	assert.True(t, IsCancelled(err))
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.False(t, err.(*CancelledError).Timeout())
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestAPI_Get_Timeout(t *testing.T) {
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer apiServer.Close()
+	config := util.TestConfig(apiServer.URL)
+	config.API.Timeout = 50 * time.Millisecond
+	c := NewClient(config)
+
+	_, err := c.GetDeployments()
+	assert.Error(t, err)
+	assert.True(t, IsCancelled(err))
+	assert.True(t, err.(*CancelledError).Timeout())
+	assert.Equal(t, "Compose.io API request [GET:deployments] exceeded its deadline", err.Error())
+}
+
+func TestAPI_ParseRetryAfter(t *testing.T) {
+	assert.Equal(t, time.Duration(0), parseRetryAfter(""))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon"))
+	assert.Equal(t, 7*time.Second, parseRetryAfter("7"))
+
+	later := parseRetryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	assert.True(t, later > 50*time.Second && later <= time.Minute)
+}
+
+func TestAPI_EndpointLabel(t *testing.T) {
+	assert.Equal(t, "deployments", endpointLabel("deployments"))
+	assert.Equal(t, "deployments/{id}/recipes", endpointLabel("deployments/5854017e89d50f424e000192/recipes"))
+	assert.Equal(t, "deployments/{id}/backups/{id}/restore", endpointLabel("deployments/5854017e89d50f424e000192/backups/5a3a1f5e8c3c8f001a3e4d21/restore"))
+	assert.Equal(t, "recipes/{id}", endpointLabel("recipes/5821fd28a4b549d06e39886d?embed=true"))
+	assert.Equal(t, "databases", endpointLabel("databases"))
+}
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 
 	"github.com/JamesClonk/compose-broker/log"
@@ -22,9 +23,13 @@ type Version struct {
 }
 
 func (c *Client) GetDatabases() (Databases, error) {
-	body, err := c.Get("databases")
+	return c.GetDatabasesContext(context.Background())
+}
+
+func (c *Client) GetDatabasesContext(ctx context.Context) (Databases, error) {
+	body, err := c.GetContext(ctx, "databases")
 	if err != nil {
-		log.Errorf("could not get Compose.io databases: %s", err)
+		log.Ctx(ctx).Errorf("could not get Compose.io databases: %s", err)
 		return nil, err
 	}
 
@@ -34,7 +39,7 @@ func (c *Client) GetDatabases() (Databases, error) {
 		} `json:"_embedded"`
 	}{}
 	if err := json.Unmarshal([]byte(body), &response); err != nil {
-		log.Errorf("could not unmarshal databases response: %#v", body)
+		log.Ctx(ctx).Errorf("could not unmarshal databases response: %#v", body)
 		return nil, err
 	}
 	return response.Embedded.Databases, nil
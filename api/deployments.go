@@ -1,11 +1,14 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"time"
 
 	"github.com/JamesClonk/compose-broker/log"
+	"github.com/JamesClonk/compose-broker/metrics"
 )
 
 type Deployments []Deployment
@@ -37,17 +40,26 @@ type Deployment struct {
 	} `json:"_links"`
 }
 type NewDeployment struct {
-	Name       string `json:"name"`
-	AccountID  string `json:"account_id"`
-	Datacenter string `json:"datacenter"`
-	Type       string `json:"type"`
-	Version    string `json:"version,omitempty"`
-	Units      int    `json:"units,omitempty"`
-	CacheMode  bool   `json:"cache_mode,omitempty"`
-	Notes      string `json:"notes,omitempty"`
+	Name                string `json:"name"`
+	AccountID           string `json:"account_id"`
+	Datacenter          string `json:"datacenter"`
+	Type                string `json:"type"`
+	Version             string `json:"version,omitempty"`
+	Units               int    `json:"units,omitempty"`
+	CacheMode           bool   `json:"cache_mode,omitempty"`
+	Notes               string `json:"notes,omitempty"`
+	CustomerBillingCode string `json:"customer_billing_code,omitempty"`
+}
+type DeploymentUpdate struct {
+	Notes               string `json:"notes,omitempty"`
+	CustomerBillingCode string `json:"customer_billing_code,omitempty"`
 }
 
 func (c *Client) CreateDeployment(newDeployment NewDeployment) (*Deployment, error) {
+	return c.CreateDeploymentContext(context.Background(), newDeployment)
+}
+
+func (c *Client) CreateDeploymentContext(ctx context.Context, newDeployment NewDeployment) (*Deployment, error) {
 	// set defaults
 	if len(newDeployment.Datacenter) == 0 {
 		newDeployment.Datacenter = c.Config.DefaultDatacenter
@@ -63,28 +75,34 @@ func (c *Client) CreateDeployment(newDeployment NewDeployment) (*Deployment, err
 	}
 	payload, err := json.Marshal(data)
 	if err != nil {
-		log.Errorf("could not marshal deployment payload: %#v", newDeployment)
+		log.Ctx(ctx).Errorf("could not marshal deployment payload: %#v", newDeployment)
 		return nil, err
 	}
 
-	body, err := c.PostAsync("deployments", string(payload))
+	body, err := c.PostAsyncContext(ctx, "deployments", string(payload))
 	if err != nil {
-		log.Errorf("could not create Compose.io deployment: %s", err)
+		log.Ctx(ctx).Errorf("could not create Compose.io deployment: %s", err)
 		return nil, err
 	}
 
 	deployment := &Deployment{}
 	if err := json.Unmarshal([]byte(body), deployment); err != nil {
-		log.Errorf("could not unmarshal deployment response: %#v", body)
+		log.Ctx(ctx).Errorf("could not unmarshal deployment response: %#v", body)
 		return nil, err
 	}
+	c.Index.Add(deployment.Name, deployment.ID)
 	return deployment, nil
 }
 
 func (c *Client) GetDeployments() (Deployments, error) {
-	body, err := c.Get("deployments")
+	return c.GetDeploymentsContext(context.Background())
+}
+
+func (c *Client) GetDeploymentsContext(ctx context.Context) (Deployments, error) {
+	body, err := c.GetContext(ctx, "deployments")
 	if err != nil {
-		log.Errorf("could not get Compose.io deployments: %s", err)
+		log.Ctx(ctx).Errorf("could not get Compose.io deployments: %s", err)
+		metrics.DeploymentIndexRefreshes.WithLabelValues("failure").Inc()
 		return nil, err
 	}
 
@@ -94,51 +112,112 @@ func (c *Client) GetDeployments() (Deployments, error) {
 		} `json:"_embedded"`
 	}{}
 	if err := json.Unmarshal([]byte(body), &response); err != nil {
-		log.Errorf("could not unmarshal deployments response: %#v", body)
+		log.Ctx(ctx).Errorf("could not unmarshal deployments response: %#v", body)
+		metrics.DeploymentIndexRefreshes.WithLabelValues("failure").Inc()
 		return nil, err
 	}
+
+	// every full listing of deployments is a chance to refresh the index
+	c.Index.Set(response.Embedded.Deployments)
+	metrics.DeploymentIndexRefreshes.WithLabelValues("success").Inc()
 	return response.Embedded.Deployments, nil
 }
 
 func (c *Client) GetDeployment(deploymentID string) (*Deployment, error) {
-	body, err := c.Get(fmt.Sprintf("deployments/%s", deploymentID))
+	return c.GetDeploymentContext(context.Background(), deploymentID)
+}
+
+func (c *Client) GetDeploymentContext(ctx context.Context, deploymentID string) (*Deployment, error) {
+	body, err := c.GetContext(ctx, fmt.Sprintf("deployments/%s", deploymentID))
 	if err != nil {
-		log.Errorf("could not find Compose.io deployment %s: %s", deploymentID, err)
+		log.Ctx(ctx).Errorf("could not find Compose.io deployment %s: %s", deploymentID, err)
 		return nil, err
 	}
 
 	deployment := &Deployment{}
 	if err := json.Unmarshal([]byte(body), deployment); err != nil {
-		log.Errorf("could not unmarshal deployment response: %#v", body)
+		log.Ctx(ctx).Errorf("could not unmarshal deployment response: %#v", body)
 		return nil, err
 	}
 	return deployment, nil
 }
 
 func (c *Client) GetDeploymentByName(name string) (*Deployment, error) {
-	deployments, err := c.GetDeployments()
+	return c.GetDeploymentByNameContext(context.Background(), name)
+}
+
+func (c *Client) GetDeploymentByNameContext(ctx context.Context, name string) (*Deployment, error) {
+	if deploymentID, ok := c.Index.Lookup(name); ok {
+		deployment, err := c.GetDeploymentContext(ctx, deploymentID)
+		if err == nil && deployment.Name == name {
+			return deployment, nil
+		}
+		if IsCancelled(err) {
+			return nil, err
+		}
+		log.Ctx(ctx).Warnf("deployment index entry %s for %s seems to be stale: %v", deploymentID, name, err)
+		c.Index.Remove(deploymentID)
+	}
+
+	deployments, err := c.GetDeploymentsContext(ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	for _, deployment := range deployments {
 		if deployment.Name == name {
-			return c.GetDeployment(deployment.ID)
+			return c.GetDeploymentContext(ctx, deployment.ID)
 		}
 	}
-	return nil, fmt.Errorf("could not find Compose.io deployment %s", name)
+	return nil, &Error{StatusCode: http.StatusNotFound, Message: fmt.Sprintf("could not find Compose.io deployment %s", name)}
+}
+
+func (c *Client) UpdateDeployment(deploymentID string, update DeploymentUpdate) (*Deployment, error) {
+	return c.UpdateDeploymentContext(context.Background(), deploymentID, update)
+}
+
+// UpdateDeploymentContext changes the notes and customer billing code of a deployment
+func (c *Client) UpdateDeploymentContext(ctx context.Context, deploymentID string, update DeploymentUpdate) (*Deployment, error) {
+	data := struct {
+		Deployment DeploymentUpdate `json:"deployment"`
+	}{
+		Deployment: update,
+	}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		log.Ctx(ctx).Errorf("could not marshal deployment update payload: %#v", update)
+		return nil, err
+	}
+
+	body, err := c.PatchContext(ctx, fmt.Sprintf("deployments/%s", deploymentID), string(payload))
+	if err != nil {
+		log.Ctx(ctx).Errorf("could not update Compose.io deployment %s: %s", deploymentID, err)
+		return nil, err
+	}
+
+	deployment := &Deployment{}
+	if err := json.Unmarshal([]byte(body), deployment); err != nil {
+		log.Ctx(ctx).Errorf("could not unmarshal deployment response: %#v", body)
+		return nil, err
+	}
+	return deployment, nil
 }
 
 func (c *Client) DeleteDeployment(deploymentID string) (*Recipe, error) {
-	body, err := c.Delete(fmt.Sprintf("deployments/%s", deploymentID))
+	return c.DeleteDeploymentContext(context.Background(), deploymentID)
+}
+
+func (c *Client) DeleteDeploymentContext(ctx context.Context, deploymentID string) (*Recipe, error) {
+	body, err := c.DeleteContext(ctx, fmt.Sprintf("deployments/%s", deploymentID))
 	if err != nil {
-		log.Errorf("could not delete Compose.io deployment %s: %s", deploymentID, err)
+		log.Ctx(ctx).Errorf("could not delete Compose.io deployment %s: %s", deploymentID, err)
 		return nil, err
 	}
+	c.Index.Remove(deploymentID)
 
 	recipe := &Recipe{}
 	if err := json.Unmarshal([]byte(body), recipe); err != nil {
-		log.Errorf("could not unmarshal recipe response: %#v", body)
+		log.Ctx(ctx).Errorf("could not unmarshal recipe response: %#v", body)
 		return nil, err
 	}
 	return recipe, nil
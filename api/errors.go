@@ -0,0 +1,130 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// CancelledError is returned if a Compose.io API call was cancelled or ran out of time before it could be answered,
+// which says nothing about the state of the requested resource
+type CancelledError struct {
+	Method   string
+	Endpoint string
+	Err      error
+}
+
+func (e *CancelledError) Error() string {
+	if e.Timeout() {
+		return fmt.Sprintf("Compose.io API request [%s:%s] exceeded its deadline", e.Method, e.Endpoint)
+	}
+	return fmt.Sprintf("Compose.io API request [%s:%s] was cancelled", e.Method, e.Endpoint)
+}
+
+func (e *CancelledError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout reports whether the call ran into a deadline, as opposed to being cancelled by the caller
+func (e *CancelledError) Timeout() bool {
+	return errors.Is(e.Err, context.DeadlineExceeded)
+}
+
+func IsCancelled(err error) bool {
+	var cancelled *CancelledError
+	return errors.As(err, &cancelled)
+}
+
+// Error is returned for every Compose.io API response with an unexpected status code
+type Error struct {
+	StatusCode int
+	Message    string              // the error message, if Compose.io returned a single one
+	Errors     map[string][]string // errors by field, if Compose.io returned multiple ones
+	Body       string
+}
+
+func NewError(statusCode int, body string) *Error {
+	e := &Error{StatusCode: statusCode, Body: body}
+
+	// Compose.io error types, either {"errors":"message"} or {"errors":{"field":["message"]}}
+	multi := struct {
+		Errors map[string][]string `json:"errors,omitempty"`
+	}{}
+	if err := json.Unmarshal([]byte(body), &multi); err == nil {
+		e.Errors = multi.Errors
+		if e.Errors == nil {
+			e.Errors = make(map[string][]string)
+		}
+		return e
+	}
+	single := struct {
+		Errors string `json:"errors"`
+	}{}
+	if err := json.Unmarshal([]byte(body), &single); err == nil {
+		e.Message = single.Errors
+	}
+	return e
+}
+
+func (e *Error) Error() string {
+	if description := e.Description(); len(description) > 0 {
+		return fmt.Sprintf("unexpected status code: %d, %s", e.StatusCode, description)
+	}
+	return fmt.Sprintf("unexpected status code: %d", e.StatusCode)
+}
+
+// Description returns what Compose.io had to say about the error, suitable to be passed on to the platform
+func (e *Error) Description() string {
+	if len(e.Message) > 0 {
+		return e.Message
+	}
+	if e.Errors == nil {
+		return fmt.Sprintf("could not parse API response: %s", e.Body)
+	}
+
+	fields := make([]string, 0, len(e.Errors))
+	for field := range e.Errors {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	errs := make([]string, 0, len(fields))
+	for _, field := range fields {
+		errs = append(errs, fmt.Sprintf("%s: %s", field, strings.Join(e.Errors[field], ", ")))
+	}
+	return strings.Join(errs, ", ")
+}
+
+// StatusCode returns the HTTP status code of a Compose.io API error, or 0 if err is none
+func StatusCode(err error) int {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.StatusCode
+	}
+	return 0
+}
+
+func IsNotFound(err error) bool {
+	return StatusCode(err) == http.StatusNotFound
+}
+
+func IsConflict(err error) bool {
+	return StatusCode(err) == http.StatusConflict
+}
+
+func IsValidation(err error) bool {
+	code := StatusCode(err)
+	return code == http.StatusBadRequest || code == http.StatusUnprocessableEntity
+}
+
+func IsUnauthorized(err error) bool {
+	code := StatusCode(err)
+	return code == http.StatusUnauthorized || code == http.StatusForbidden
+}
+
+func IsRateLimited(err error) bool {
+	return StatusCode(err) == http.StatusTooManyRequests
+}
@@ -0,0 +1,46 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/JamesClonk/compose-broker/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPI_NewError(t *testing.T) {
+	err := NewError(422, util.Body("../_fixtures/api_example_errors.json"))
+	assert.Equal(t, 422, err.StatusCode)
+	assert.Equal(t, []string{"mistake!", "big time!"}, err.Errors["api_error"])
+	assert.Equal(t, "api_error: mistake!, big time!, server_error: fatality!", err.Description())
+	assert.Equal(t, "unexpected status code: 422, api_error: mistake!, big time!, server_error: fatality!", err.Error())
+
+	err = NewError(500, util.Body("../_fixtures/api_example_error.json"))
+	assert.Equal(t, "we've encountered a problem!", err.Message)
+	assert.Equal(t, "unexpected status code: 500, we've encountered a problem!", err.Error())
+
+	err = NewError(502, "<html>Bad Gateway</html>")
+	assert.Equal(t, "unexpected status code: 502, could not parse API response: <html>Bad Gateway</html>", err.Error())
+
+	err = NewError(404, "{}")
+	assert.Equal(t, "unexpected status code: 404", err.Error())
+}
+
+func TestAPI_ErrorHelpers(t *testing.T) {
+	wrapped := fmt.Errorf("could not do it: %w", NewError(404, "{}"))
+	assert.Equal(t, 404, StatusCode(wrapped))
+	assert.True(t, IsNotFound(wrapped))
+	assert.False(t, IsConflict(wrapped))
+
+	assert.True(t, IsConflict(NewError(409, "{}")))
+	assert.True(t, IsValidation(NewError(400, "{}")))
+	assert.True(t, IsValidation(NewError(422, "{}")))
+	assert.True(t, IsUnauthorized(NewError(403, "{}")))
+	assert.True(t, IsRateLimited(NewError(429, "{}")))
+
+	assert.Equal(t, 0, StatusCode(errors.New("connection refused")))
+	assert.Equal(t, 0, StatusCode(nil))
+	assert.False(t, IsNotFound(&CancelledError{Err: context.Canceled}))
+}
@@ -0,0 +1,74 @@
+package api
+
+import (
+	"sync"
+	"time"
+
+	"github.com/JamesClonk/compose-broker/metrics"
+)
+
+// DeploymentIndex maps deployment names to deployment IDs, so that looking up a service instance
+// does not require listing all deployments of the account every single time
+type DeploymentIndex struct {
+	TTL     time.Duration
+	entries map[string]indexEntry
+	mutex   sync.RWMutex
+}
+type indexEntry struct {
+	ID        string
+	UpdatedAt time.Time
+}
+
+func NewDeploymentIndex(ttl time.Duration) *DeploymentIndex {
+	return &DeploymentIndex{
+		TTL:     ttl,
+		entries: make(map[string]indexEntry),
+	}
+}
+
+// Lookup returns the deployment ID for a name, entries older than the TTL are treated as missing
+func (i *DeploymentIndex) Lookup(name string) (string, bool) {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	entry, ok := i.entries[name]
+	if !ok || time.Since(entry.UpdatedAt) > i.TTL {
+		metrics.DeploymentIndexLookups.WithLabelValues("miss").Inc()
+		return "", false
+	}
+	metrics.DeploymentIndexLookups.WithLabelValues("hit").Inc()
+	return entry.ID, true
+}
+
+// Set replaces the whole index with the given list of deployments
+func (i *DeploymentIndex) Set(deployments Deployments) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	now := time.Now()
+	i.entries = make(map[string]indexEntry)
+	for _, deployment := range deployments {
+		i.entries[deployment.Name] = indexEntry{ID: deployment.ID, UpdatedAt: now}
+	}
+	metrics.DeploymentIndexSize.Set(float64(len(i.entries)))
+}
+
+func (i *DeploymentIndex) Add(name, deploymentID string) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	i.entries[name] = indexEntry{ID: deploymentID, UpdatedAt: time.Now()}
+	metrics.DeploymentIndexSize.Set(float64(len(i.entries)))
+}
+
+func (i *DeploymentIndex) Remove(deploymentID string) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	for name, entry := range i.entries {
+		if entry.ID == deploymentID {
+			delete(i.entries, name)
+		}
+	}
+	metrics.DeploymentIndexSize.Set(float64(len(i.entries)))
+}
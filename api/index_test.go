@@ -0,0 +1,51 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPI_DeploymentIndex(t *testing.T) {
+	index := NewDeploymentIndex(time.Minute)
+
+	_, ok := index.Lookup("fizz")
+	assert.False(t, ok)
+
+	index.Set(Deployments{
+		Deployment{ID: "1", Name: "fizz"},
+		Deployment{ID: "2", Name: "buzz"},
+	})
+	id, ok := index.Lookup("fizz")
+	assert.True(t, ok)
+	assert.Equal(t, "1", id)
+
+	index.Add("fizzbuzz", "3")
+	id, ok = index.Lookup("fizzbuzz")
+	assert.True(t, ok)
+	assert.Equal(t, "3", id)
+
+	index.Remove("1")
+	_, ok = index.Lookup("fizz")
+	assert.False(t, ok)
+	id, ok = index.Lookup("buzz")
+	assert.True(t, ok)
+	assert.Equal(t, "2", id)
+
+	// a new listing replaces everything
+	index.Set(Deployments{Deployment{ID: "4", Name: "fizz"}})
+	id, ok = index.Lookup("fizz")
+	assert.True(t, ok)
+	assert.Equal(t, "4", id)
+	_, ok = index.Lookup("buzz")
+	assert.False(t, ok)
+}
+
+func TestAPI_DeploymentIndex_Expired(t *testing.T) {
+	index := NewDeploymentIndex(0)
+	index.Add("fizz", "1")
+
+	_, ok := index.Lookup("fizz")
+	assert.False(t, ok)
+}
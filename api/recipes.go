@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"sort"
@@ -41,24 +42,32 @@ func (r Recipes) SortByUpdatedAt() {
 }
 
 func (c *Client) GetRecipe(recipeID string) (*Recipe, error) {
-	body, err := c.Get(fmt.Sprintf("recipes/%s", recipeID))
+	return c.GetRecipeContext(context.Background(), recipeID)
+}
+
+func (c *Client) GetRecipeContext(ctx context.Context, recipeID string) (*Recipe, error) {
+	body, err := c.GetContext(ctx, fmt.Sprintf("recipes/%s", recipeID))
 	if err != nil {
-		log.Errorf("could not get Compose.io recipe %s: %s", recipeID, err)
+		log.Ctx(ctx).Errorf("could not get Compose.io recipe %s: %s", recipeID, err)
 		return nil, err
 	}
 
 	recipe := &Recipe{}
 	if err := json.Unmarshal([]byte(body), recipe); err != nil {
-		log.Errorf("could not unmarshal recipe response: %#v", body)
+		log.Ctx(ctx).Errorf("could not unmarshal recipe response: %#v", body)
 		return nil, err
 	}
 	return recipe, nil
 }
 
 func (c *Client) GetRecipes(deploymentID string) (Recipes, error) {
-	body, err := c.Get(fmt.Sprintf("deployments/%s/recipes", deploymentID))
+	return c.GetRecipesContext(context.Background(), deploymentID)
+}
+
+func (c *Client) GetRecipesContext(ctx context.Context, deploymentID string) (Recipes, error) {
+	body, err := c.GetContext(ctx, fmt.Sprintf("deployments/%s/recipes", deploymentID))
 	if err != nil {
-		log.Errorf("could not get Compose.io recipes for deployment %s: %s", deploymentID, err)
+		log.Ctx(ctx).Errorf("could not get Compose.io recipes for deployment %s: %s", deploymentID, err)
 		return nil, err
 	}
 
@@ -68,7 +77,7 @@ func (c *Client) GetRecipes(deploymentID string) (Recipes, error) {
 		} `json:"_embedded"`
 	}{}
 	if err := json.Unmarshal([]byte(body), &response); err != nil {
-		log.Errorf("could not unmarshal recipes response: %#v", body)
+		log.Ctx(ctx).Errorf("could not unmarshal recipes response: %#v", body)
 		return nil, err
 	}
 
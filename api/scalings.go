@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 
@@ -19,30 +20,38 @@ type Scaling struct {
 }
 
 func (c *Client) GetScaling(deploymentID string) (*Scaling, error) {
-	body, err := c.Get(fmt.Sprintf("deployments/%s/scalings", deploymentID))
+	return c.GetScalingContext(context.Background(), deploymentID)
+}
+
+func (c *Client) GetScalingContext(ctx context.Context, deploymentID string) (*Scaling, error) {
+	body, err := c.GetContext(ctx, fmt.Sprintf("deployments/%s/scalings", deploymentID))
 	if err != nil {
-		log.Errorf("could not get Compose.io scaling for deployment %s: %s", deploymentID, err)
+		log.Ctx(ctx).Errorf("could not get Compose.io scaling for deployment %s: %s", deploymentID, err)
 		return nil, err
 	}
 
 	scaling := &Scaling{}
 	if err := json.Unmarshal([]byte(body), scaling); err != nil {
-		log.Errorf("could not unmarshal scaling response: %#v", body)
+		log.Ctx(ctx).Errorf("could not unmarshal scaling response: %#v", body)
 		return nil, err
 	}
 	return scaling, nil
 }
 
 func (c *Client) UpdateScaling(deploymentID string, units int) (*Recipe, error) {
-	body, err := c.Post(fmt.Sprintf("deployments/%s/scalings", deploymentID), fmt.Sprintf(`{"deployment":{"units":%d}}`, units))
+	return c.UpdateScalingContext(context.Background(), deploymentID, units)
+}
+
+func (c *Client) UpdateScalingContext(ctx context.Context, deploymentID string, units int) (*Recipe, error) {
+	body, err := c.PostContext(ctx, fmt.Sprintf("deployments/%s/scalings", deploymentID), fmt.Sprintf(`{"deployment":{"units":%d}}`, units))
 	if err != nil {
-		log.Errorf("could not update Compose.io scaling for deployment %s to %d units: %s", deploymentID, units, err)
+		log.Ctx(ctx).Errorf("could not update Compose.io scaling for deployment %s to %d units: %s", deploymentID, units, err)
 		return nil, err
 	}
 
 	recipe := &Recipe{}
 	if err := json.Unmarshal([]byte(body), recipe); err != nil {
-		log.Errorf("could not unmarshal recipe response: %#v", body)
+		log.Ctx(ctx).Errorf("could not unmarshal recipe response: %#v", body)
 		return nil, err
 	}
 	return recipe, nil
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/JamesClonk/compose-broker/log"
+)
+
+type Transitions []Transition
+type Transition struct {
+	Application string `json:"application"`
+	Method      string `json:"method"` // can be in_place or migration
+	FromVersion string `json:"from_version"`
+	ToVersion   string `json:"to_version"`
+}
+
+func (c *Client) GetVersionTransitions(deploymentID string) (Transitions, error) {
+	return c.GetVersionTransitionsContext(context.Background(), deploymentID)
+}
+
+func (c *Client) GetVersionTransitionsContext(ctx context.Context, deploymentID string) (Transitions, error) {
+	body, err := c.GetContext(ctx, fmt.Sprintf("deployments/%s/versions", deploymentID))
+	if err != nil {
+		log.Ctx(ctx).Errorf("could not get Compose.io version transitions for deployment %s: %s", deploymentID, err)
+		return nil, err
+	}
+
+	response := struct {
+		Embedded struct {
+			Transitions Transitions `json:"transitions"`
+		} `json:"_embedded"`
+	}{}
+	if err := json.Unmarshal([]byte(body), &response); err != nil {
+		log.Ctx(ctx).Errorf("could not unmarshal version transitions response: %#v", body)
+		return nil, err
+	}
+	return response.Embedded.Transitions, nil
+}
+
+func (c *Client) UpdateVersion(deploymentID, version string) (*Recipe, error) {
+	return c.UpdateVersionContext(context.Background(), deploymentID, version)
+}
+
+func (c *Client) UpdateVersionContext(ctx context.Context, deploymentID, version string) (*Recipe, error) {
+	body, err := c.PatchContext(ctx, fmt.Sprintf("deployments/%s/versions", deploymentID), fmt.Sprintf(`{"deployment":{"version":%q}}`, version))
+	if err != nil {
+		log.Ctx(ctx).Errorf("could not update Compose.io deployment %s to version %s: %s", deploymentID, version, err)
+		return nil, err
+	}
+
+	recipe := &Recipe{}
+	if err := json.Unmarshal([]byte(body), recipe); err != nil {
+		log.Ctx(ctx).Errorf("could not unmarshal recipe response: %#v", body)
+		return nil, err
+	}
+	return recipe, nil
+}
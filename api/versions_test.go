@@ -0,0 +1,68 @@
+package api
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/JamesClonk/compose-broker/log"
+	"github.com/JamesClonk/compose-broker/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+}
+
+func TestAPI_GetVersionTransitions(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/versions", Code: 200, Body: util.Body("../_fixtures/api_get_version_transitions.json"), Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	c := NewClient(util.TestConfig(apiServer.URL))
+
+	transitions, err := c.GetVersionTransitions("5854017e89d50f424e000192")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, len(transitions))
+	assert.Equal(t, "postgresql", transitions[1].Application)
+	assert.Equal(t, "in_place", transitions[1].Method)
+	assert.Equal(t, "9.6.3", transitions[1].FromVersion)
+	assert.Equal(t, "9.6.12", transitions[1].ToVersion)
+}
+
+func TestAPI_UpdateVersion(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "PATCH", Path: "/deployments/5854017e89d50f424e000192/versions", Code: 200, Body: util.Body("../_fixtures/api_update_version.json"), Test: func(body string) {
+			assert.Contains(t, body, `{"deployment":{"version":"9.6.12"}}`)
+		}},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	c := NewClient(util.TestConfig(apiServer.URL))
+
+	recipe, err := c.UpdateVersion("5854017e89d50f424e000192", "9.6.12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "5a2f0e1b7c9d4e000e000003", recipe.ID)
+	assert.Equal(t, "Upgrade deployment to 9.6.12", recipe.Name)
+	assert.Equal(t, "Recipes::Deployment::Upgrade", recipe.Template)
+	assert.Equal(t, "running", recipe.Status)
+	assert.Equal(t, "5854017e89d50f424e000192", recipe.DeploymentID)
+}
+
+func TestAPI_UpdateVersion_Rejected(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "PATCH", Path: "/deployments/5854017e89d50f424e000192/versions", Code: 422, Body: `{"errors":"version 8.0 is not a valid upgrade target"}`, Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	c := NewClient(util.TestConfig(apiServer.URL))
+
+	_, err := c.UpdateVersion("5854017e89d50f424e000192", "8.0")
+	assert.Error(t, err)
+	assert.True(t, IsValidation(err))
+	assert.Contains(t, err.Error(), "version 8.0 is not a valid upgrade target")
+}
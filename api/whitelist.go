@@ -0,0 +1,95 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/JamesClonk/compose-broker/log"
+)
+
+type Whitelist []WhitelistEntry
+type WhitelistEntry struct {
+	ID          string    `json:"id"`
+	IP          string    `json:"ip"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func (c *Client) GetWhitelist(deploymentID string) (Whitelist, error) {
+	return c.GetWhitelistContext(context.Background(), deploymentID)
+}
+
+func (c *Client) GetWhitelistContext(ctx context.Context, deploymentID string) (Whitelist, error) {
+	body, err := c.GetContext(ctx, fmt.Sprintf("deployments/%s/whitelist", deploymentID))
+	if err != nil {
+		log.Ctx(ctx).Errorf("could not get Compose.io whitelist for deployment %s: %s", deploymentID, err)
+		return nil, err
+	}
+
+	response := struct {
+		Embedded struct {
+			Whitelist Whitelist `json:"whitelist"`
+		} `json:"_embedded"`
+	}{}
+	if err := json.Unmarshal([]byte(body), &response); err != nil {
+		log.Ctx(ctx).Errorf("could not unmarshal whitelist response: %#v", body)
+		return nil, err
+	}
+	return response.Embedded.Whitelist, nil
+}
+
+func (c *Client) AddWhitelist(deploymentID, ip, description string) (*Recipe, error) {
+	return c.AddWhitelistContext(context.Background(), deploymentID, ip, description)
+}
+
+func (c *Client) AddWhitelistContext(ctx context.Context, deploymentID, ip, description string) (*Recipe, error) {
+	data := struct {
+		Deployment struct {
+			Whitelist struct {
+				IP          string `json:"ip"`
+				Description string `json:"description"`
+			} `json:"whitelist"`
+		} `json:"deployment"`
+	}{}
+	data.Deployment.Whitelist.IP = ip
+	data.Deployment.Whitelist.Description = description
+	payload, err := json.Marshal(data)
+	if err != nil {
+		log.Ctx(ctx).Errorf("could not marshal whitelist payload: %s", ip)
+		return nil, err
+	}
+
+	body, err := c.PostAsyncContext(ctx, fmt.Sprintf("deployments/%s/whitelist", deploymentID), string(payload))
+	if err != nil {
+		log.Ctx(ctx).Errorf("could not add %s to Compose.io whitelist of deployment %s: %s", ip, deploymentID, err)
+		return nil, err
+	}
+
+	recipe := &Recipe{}
+	if err := json.Unmarshal([]byte(body), recipe); err != nil {
+		log.Ctx(ctx).Errorf("could not unmarshal recipe response: %#v", body)
+		return nil, err
+	}
+	return recipe, nil
+}
+
+func (c *Client) DeleteWhitelist(deploymentID, entryID string) (*Recipe, error) {
+	return c.DeleteWhitelistContext(context.Background(), deploymentID, entryID)
+}
+
+func (c *Client) DeleteWhitelistContext(ctx context.Context, deploymentID, entryID string) (*Recipe, error) {
+	body, err := c.DeleteContext(ctx, fmt.Sprintf("deployments/%s/whitelist/%s", deploymentID, entryID))
+	if err != nil {
+		log.Ctx(ctx).Errorf("could not delete whitelist entry %s of Compose.io deployment %s: %s", entryID, deploymentID, err)
+		return nil, err
+	}
+
+	recipe := &Recipe{}
+	if err := json.Unmarshal([]byte(body), recipe); err != nil {
+		log.Ctx(ctx).Errorf("could not unmarshal recipe response: %#v", body)
+		return nil, err
+	}
+	return recipe, nil
+}
@@ -0,0 +1,67 @@
+package api
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/JamesClonk/compose-broker/log"
+	"github.com/JamesClonk/compose-broker/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+}
+
+func TestAPI_GetWhitelist(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/whitelist", Code: 200, Body: util.Body("../_fixtures/api_get_whitelist.json"), Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	c := NewClient(util.TestConfig(apiServer.URL))
+
+	whitelist, err := c.GetWhitelist("5854017e89d50f424e000192")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 3, len(whitelist))
+	assert.Equal(t, "5a4b1c2d3e4f5a001a3e6001", whitelist[0].ID)
+	assert.Equal(t, "10.0.0.0/8", whitelist[0].IP)
+	assert.Equal(t, "compose-broker", whitelist[0].Description)
+	assert.Equal(t, "office network", whitelist[1].Description)
+}
+
+func TestAPI_AddWhitelist(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "POST", Path: "/deployments/5854017e89d50f424e000192/whitelist", Code: 202, Body: util.Body("../_fixtures/api_add_whitelist.json"), Test: func(body string) {
+			assert.Equal(t, `{"deployment":{"whitelist":{"ip":"172.16.0.0/12","description":"compose-broker"}}}`, body)
+		}},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	c := NewClient(util.TestConfig(apiServer.URL))
+
+	recipe, err := c.AddWhitelist("5854017e89d50f424e000192", "172.16.0.0/12", "compose-broker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "5a4b1c2d3e4f5a001a3e6101", recipe.ID)
+	assert.Equal(t, "Add whitelist entry", recipe.Name)
+}
+
+func TestAPI_DeleteWhitelist(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "DELETE", Path: "/deployments/5854017e89d50f424e000192/whitelist/5a4b1c2d3e4f5a001a3e6001", Code: 202, Body: util.Body("../_fixtures/api_delete_whitelist.json"), Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	c := NewClient(util.TestConfig(apiServer.URL))
+
+	recipe, err := c.DeleteWhitelist("5854017e89d50f424e000192", "5a4b1c2d3e4f5a001a3e6001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "5a4b1c2d3e4f5a001a3e6102", recipe.ID)
+	assert.Equal(t, "Remove whitelist entry", recipe.Name)
+}
@@ -0,0 +1,272 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/JamesClonk/compose-broker/api"
+	"github.com/JamesClonk/compose-broker/log"
+	"github.com/gorilla/mux"
+)
+
+// AdminDeployment is everything an operator needs to know about a deployment of this service broker
+type AdminDeployment struct {
+	InstanceID  string              `json:"instance_id"`
+	ServiceID   string              `json:"service_id,omitempty"`
+	ServiceName string              `json:"service_name,omitempty"`
+	PlanID      string              `json:"plan_id,omitempty"`
+	PlanName    string              `json:"plan_name,omitempty"`
+	Deployment  AdminDeploymentInfo `json:"deployment"`
+	Scaling     *api.Scaling        `json:"scaling,omitempty"`
+	Recipes     api.Recipes         `json:"recipes"`
+	Bindings    []Binding           `json:"bindings"`
+}
+
+// AdminDeploymentInfo is a deployment without its connection strings and CA certificate
+type AdminDeploymentInfo struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Version   string    `json:"version"`
+	Status    string    `json:"status,omitempty"` // of its most recent recipe
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// number of most recent recipes shown per deployment
+const adminRecipes = 5
+
+// managedPlan finds the service plan of a deployment, it returns no plan if the deployment does not belong to this service broker
+func (b *Broker) managedPlan(deployment api.Deployment) (*Instance, *Service, *ServicePlan) {
+	stored, err := b.Store.GetInstance(deployment.Name)
+	if err != nil {
+		stored = nil
+	}
+	if stored != nil && len(stored.PlanID) > 0 {
+		if service, plan := b.ServiceCatalog().Plan(stored.ServiceID, stored.PlanID); plan != nil {
+			return stored, service, plan
+		}
+	}
+	service, plan := b.planFromNotes(deployment.Notes)
+	if plan == nil && stored != nil {
+		return stored, &Service{ID: stored.ServiceID}, &ServicePlan{ID: stored.PlanID} // plan is gone from the catalog
+	}
+	return stored, service, plan
+}
+
+// managedDeployment is what is known about a deployment of this service broker at one point in time
+type managedDeployment struct {
+	Deployment api.Deployment
+	Stored     *Instance
+	Service    *Service
+	Plan       *ServicePlan
+	Scaling    *api.Scaling
+	Recipes    api.Recipes // most recently updated first
+}
+
+// inspectDeployment collects scaling and recipes of a deployment, it returns nil if the deployment does not belong to this service broker
+func (b *Broker) inspectDeployment(ctx context.Context, deployment api.Deployment) (*managedDeployment, error) {
+	stored, service, plan := b.managedPlan(deployment)
+	if plan == nil {
+		return nil, nil
+	}
+	managed := &managedDeployment{
+		Deployment: deployment,
+		Stored:     stored,
+		Service:    service,
+		Plan:       plan,
+		Recipes:    api.Recipes{},
+	}
+
+	scaling, err := b.Client.GetScalingContext(ctx, deployment.ID)
+	if err != nil && !api.IsNotFound(err) {
+		return nil, err
+	}
+	managed.Scaling = scaling
+
+	recipes, err := b.Client.GetRecipesContext(ctx, deployment.ID)
+	if err != nil && !api.IsNotFound(err) {
+		return nil, err
+	}
+	if recipes != nil {
+		managed.Recipes = recipes
+	}
+	return managed, nil
+}
+
+// managedDeployments inspects all deployments of this service broker, recognized by the store or by their notes
+func (b *Broker) managedDeployments(ctx context.Context) ([]managedDeployment, error) {
+	deployments, err := b.Client.GetDeploymentsContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	managed := make([]managedDeployment, 0)
+	for _, deployment := range deployments {
+		details, err := b.inspectDeployment(ctx, deployment)
+		if err != nil {
+			return nil, err
+		}
+		if details != nil {
+			managed = append(managed, *details)
+		}
+	}
+	return managed, nil
+}
+
+func (b *Broker) adminDeployment(managed managedDeployment) AdminDeployment {
+	details := AdminDeployment{
+		InstanceID:  managed.Deployment.Name,
+		ServiceID:   managed.Service.ID,
+		ServiceName: managed.Service.Name,
+		PlanID:      managed.Plan.ID,
+		PlanName:    managed.Plan.Name,
+		Deployment: AdminDeploymentInfo{
+			ID:        managed.Deployment.ID,
+			Name:      managed.Deployment.Name,
+			Type:      managed.Deployment.Type,
+			Version:   managed.Deployment.Version,
+			CreatedAt: managed.Deployment.CreatedAt,
+		},
+		Scaling:  managed.Scaling,
+		Recipes:  managed.Recipes,
+		Bindings: []Binding{},
+	}
+	if len(managed.Recipes) > 0 {
+		details.Deployment.Status = managed.Recipes[0].Status
+	}
+	if len(details.Recipes) > adminRecipes {
+		details.Recipes = details.Recipes[:adminRecipes]
+	}
+	if bindings, err := b.Store.GetBindings(managed.Deployment.Name); err == nil {
+		details.Bindings = bindings
+	} else {
+		log.Warnf("could not read service bindings of service instance %s from store: %v", managed.Deployment.Name, err)
+	}
+	return details
+}
+
+// AdminDeployments lists all deployments of this service broker
+func (b *Broker) AdminDeployments(rw http.ResponseWriter, req *http.Request) {
+	managed, err := b.managedDeployments(req.Context())
+	if err != nil {
+		log.Ctx(req.Context()).Errorf("could not query deployments: %v", err)
+		b.apiError(rw, req, err, 500, "UnknownError", "Could not query deployments")
+		return
+	}
+
+	list := make([]AdminDeployment, 0)
+	for _, m := range managed {
+		list = append(list, b.adminDeployment(m))
+	}
+	b.write(rw, req, 200, list)
+}
+
+// getManagedDeployment looks up a deployment by ID, answering the request itself if it is not a deployment of this service broker
+func (b *Broker) getManagedDeployment(rw http.ResponseWriter, req *http.Request) (*api.Deployment, *Instance, *Service, *ServicePlan) {
+	deploymentID := mux.Vars(req)["deploymentID"]
+
+	deployment, err := b.Client.GetDeploymentContext(req.Context(), deploymentID)
+	if api.IsNotFound(err) {
+		log.Ctx(req.Context()).Errorf("could not find deployment %s: %v", deploymentID, err)
+		b.Error(rw, req, 404, "NotFound", "The deployment does not exist")
+		return nil, nil, nil, nil
+	}
+	if err != nil {
+		log.Ctx(req.Context()).Errorf("could not query deployment %s: %v", deploymentID, err)
+		b.apiError(rw, req, err, 500, "UnknownError", "Could not query deployment")
+		return nil, nil, nil, nil
+	}
+	stored, service, plan := b.managedPlan(*deployment)
+	if plan == nil {
+		log.Ctx(req.Context()).Errorf("deployment %s does not belong to this service broker", deploymentID)
+		b.Error(rw, req, 404, "NotFound", "The deployment does not belong to this service broker")
+		return nil, nil, nil, nil
+	}
+	return deployment, stored, service, plan
+}
+
+func (b *Broker) AdminDeployment(rw http.ResponseWriter, req *http.Request) {
+	deployment, _, _, _ := b.getManagedDeployment(rw, req)
+	if deployment == nil {
+		return
+	}
+	managed, err := b.inspectDeployment(req.Context(), *deployment)
+	if err != nil {
+		log.Ctx(req.Context()).Errorf("could not query deployment %s: %v", deployment.ID, err)
+		b.apiError(rw, req, err, 500, "UnknownError", "Could not query deployment")
+		return
+	}
+	b.write(rw, req, 200, b.adminDeployment(*managed))
+}
+
+// AdminRetryRecipe starts a failed recipe again, which is only possible for recipes whose intent is known
+func (b *Broker) AdminRetryRecipe(rw http.ResponseWriter, req *http.Request) {
+	recipeID := mux.Vars(req)["recipeID"]
+
+	deployment, stored, _, plan := b.getManagedDeployment(rw, req)
+	if deployment == nil {
+		return
+	}
+	recipe, err := b.Client.GetRecipeContext(req.Context(), recipeID)
+	if err != nil && !api.IsNotFound(err) {
+		log.Ctx(req.Context()).Errorf("could not query recipe %s: %v", recipeID, err)
+		b.apiError(rw, req, err, 500, "UnknownError", "Could not query recipe")
+		return
+	}
+	if err != nil || recipe.DeploymentID != deployment.ID {
+		log.Ctx(req.Context()).Errorf("recipe %s does not belong to deployment %s: %v", recipeID, deployment.ID, err)
+		b.Error(rw, req, 404, "NotFound", "The recipe does not exist")
+		return
+	}
+	if recipe.Status != "failed" {
+		log.Ctx(req.Context()).Errorf("recipe %s of deployment %s has not failed: %s", recipeID, deployment.ID, recipe.Status)
+		b.Error(rw, req, 422, "NotFailed", fmt.Sprintf("Recipe %s has not failed, it is %s", recipeID, recipe.Status))
+		return
+	}
+
+	var retry *api.Recipe
+	switch recipe.Template {
+	case "Recipes::Deployment::Scaling":
+		retry, err = b.Client.UpdateScalingContext(req.Context(), deployment.ID, expectedUnits(plan, stored))
+	case "Recipes::Deployment::Backup":
+		retry, err = b.Client.StartBackupContext(req.Context(), deployment.ID)
+	default:
+		log.Ctx(req.Context()).Errorf("recipe %s of deployment %s can not be retried: %s", recipeID, deployment.ID, recipe.Template)
+		b.Error(rw, req, 422, "NotRetryable", fmt.Sprintf("Recipes of type %s can not be retried", recipe.Template))
+		return
+	}
+	if err != nil {
+		log.Ctx(req.Context()).Errorf("could not retry recipe %s of deployment %s: %v", recipeID, deployment.ID, err)
+		b.apiError(rw, req, err, 500, "UnknownError", "Could not retry recipe")
+		return
+	}
+	log.Ctx(req.Context()).Infof("retrying recipe %s of deployment %s: %s", recipeID, deployment.ID, retry.ID)
+	b.write(rw, req, 202, retry)
+}
+
+// AdminRefresh rebuilds the deployment index and checks for drift right away, it only reports drift and never corrects it
+func (b *Broker) AdminRefresh(rw http.ResponseWriter, req *http.Request) {
+	drift, err := b.findDrift(req.Context()) // reading all deployments rebuilds the index
+	if err != nil {
+		log.Ctx(req.Context()).Errorf("could not refresh deployments: %v", err)
+		b.apiError(rw, req, err, 500, "UnknownError", "Could not refresh deployments")
+		return
+	}
+	b.write(rw, req, 200, b.saveDriftReport(drift))
+}
+
+// AdminPurgeOrphans deletes all orphaned deployments right away, or only lists them with ?dry_run=true
+func (b *Broker) AdminPurgeOrphans(rw http.ResponseWriter, req *http.Request) {
+	dryRun, _ := strconv.ParseBool(req.URL.Query().Get("dry_run"))
+
+	orphans, err := b.mitigateOrphans(req.Context(), dryRun)
+	if err != nil {
+		log.Ctx(req.Context()).Errorf("could not purge orphaned deployments: %v", err)
+		b.apiError(rw, req, err, 500, "UnknownError", "Could not purge orphaned deployments")
+		return
+	}
+	b.write(rw, req, 200, orphans)
+}
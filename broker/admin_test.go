@@ -0,0 +1,228 @@
+package broker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/JamesClonk/compose-broker/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBroker_AdminAuth(t *testing.T) {
+	r := NewRouter(NewBroker(util.TestConfig("")))
+
+	// the credentials of the platform are not good enough
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/admin/drift", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 401, rec.Code)
+	assert.Equal(t, `Basic realm="compose-broker admin"`, rec.Header().Get("WWW-Authenticate"))
+	assert.Contains(t, rec.Body.String(), `"error": "Unauthorized"`)
+}
+
+func TestBroker_AdminDisabled(t *testing.T) {
+	config := util.TestConfig("")
+	config.AdminPassword = ""
+	r := NewRouter(NewBroker(config))
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/admin/deployments", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("admin", "")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 404, rec.Code)
+}
+
+func TestBroker_AdminDeployments(t *testing.T) {
+	test := driftTestCases(func(string) {
+		t.Error("must not scale any deployment")
+	})
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	r := NewRouter(b)
+	_ = b.Store.PutBinding(Binding{ID: "f2d9a5c1-6b3e-4d7a-9c8f-0e1b2a3d4c5e", InstanceID: "3d7e1b2a-9c4f-4a6e-b8d1-5f2a7c9e0b01"})
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/admin/deployments", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("admin", "adminpw")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 200, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"instance_id": "3d7e1b2a-9c4f-4a6e-b8d1-5f2a7c9e0b01"`)
+	assert.Contains(t, rec.Body.String(), `"instance_id": "3d7e1b2a-9c4f-4a6e-b8d1-5f2a7c9e0b05"`)
+	assert.Contains(t, rec.Body.String(), `"service_name": "scylla"`)
+	assert.Contains(t, rec.Body.String(), `"allocated_units": 5`)
+	assert.Contains(t, rec.Body.String(), `"id": "f2d9a5c1-6b3e-4d7a-9c8f-0e1b2a3d4c5e"`)
+	assert.NotContains(t, rec.Body.String(), `"analytics-db"`) // not a deployment of the service broker
+}
+
+func TestBroker_AdminDeployment(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/scalings", Code: 200, Body: util.Body("../_fixtures/api_get_scaling.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/recipes", Code: 200, Body: util.Body("../_fixtures/api_get_recipes.json"), Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	r := NewRouter(b)
+
+	// unknown to the store and without notes of the service broker
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/admin/deployments/5854017e89d50f424e000192", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("admin", "adminpw")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 404, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"description": "The deployment does not belong to this service broker"`)
+
+	b.saveInstance(context.Background(), Instance{
+		ID:           "8dcdf609-36c9-4b22-bb16-d97e48c50f26",
+		DeploymentID: "5854017e89d50f424e000192",
+		ServiceID:    "b0d27854-06e0-426e-9e8d-79f4c53078c7",
+		PlanID:       "b937f316-ac62-4010-927a-59155778b086",
+	})
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 200, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"service_name": "elastic_search"`)
+	assert.Contains(t, rec.Body.String(), `"plan_name": "default"`)
+	assert.Contains(t, rec.Body.String(), `"allocated_units": 4`)
+	assert.Contains(t, rec.Body.String(), `"template": "Recipes::Deployment::Run"`)
+	assert.Contains(t, rec.Body.String(), `"status": "complete"`)
+	assert.NotContains(t, rec.Body.String(), `connection_strings`)
+	assert.NotContains(t, rec.Body.String(), `postgres://`)
+}
+
+func TestBroker_AdminRetryRecipe(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/recipes/5821fd28a4b549d06e39886d", Code: 200, Body: util.Body("../_fixtures/api_get_recipe_for_immediate_service_update_failure.json"), Test: nil},
+		util.HttpTestCase{Method: "POST", Path: "/deployments/5854017e89d50f424e000192/scalings", Code: 200, Body: util.Body("../_fixtures/api_update_scaling.json"), Test: func(body string) {
+			assert.Equal(t, `{"deployment":{"units":3}}`, body)
+		}},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	r := NewRouter(b)
+	b.saveInstance(context.Background(), Instance{
+		ID:           "8dcdf609-36c9-4b22-bb16-d97e48c50f26",
+		DeploymentID: "5854017e89d50f424e000192",
+		ServiceID:    "b0d27854-06e0-426e-9e8d-79f4c53078c7",
+		PlanID:       "b937f316-ac62-4010-927a-59155778b086",
+		Parameters:   []byte(`{"units":3}`),
+	})
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "/admin/deployments/5854017e89d50f424e000192/recipes/5821fd28a4b549d06e39886d/retry", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("admin", "adminpw")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 202, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"id": "570bcb3fee4cde000e000002"`)
+}
+
+func TestBroker_AdminRetryRecipe_NotFailed(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/recipes/5821fd28a4b549d06e39886d", Code: 200, Body: util.Body("../_fixtures/api_get_recipe_for_immediate_service_update.json"), Test: nil},
+		util.HttpTestCase{Method: "POST", Path: "/deployments/5854017e89d50f424e000192/scalings", Code: 500, Body: "", Test: func(string) {
+			t.Error("must not retry a recipe that has not failed")
+		}},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	r := NewRouter(b)
+	b.saveInstance(context.Background(), Instance{
+		ID:           "8dcdf609-36c9-4b22-bb16-d97e48c50f26",
+		DeploymentID: "5854017e89d50f424e000192",
+		ServiceID:    "b0d27854-06e0-426e-9e8d-79f4c53078c7",
+		PlanID:       "b937f316-ac62-4010-927a-59155778b086",
+	})
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "/admin/deployments/5854017e89d50f424e000192/recipes/5821fd28a4b549d06e39886d/retry", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("admin", "adminpw")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 422, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"error": "NotFailed"`)
+}
+
+func TestBroker_AdminRefresh(t *testing.T) {
+	apiServer := util.TestServer("deadbeef", driftTestCases(func(string) {
+		t.Error("must not scale any deployment")
+	}))
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	b.Drift.AutoCorrect = true // only the background check corrects drift
+	b.saveInstance(context.Background(), Instance{
+		ID:        "3d7e1b2a-9c4f-4a6e-b8d1-5f2a7c9e0b01",
+		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
+		PlanID:    "d6222855-17c6-448c-885a-e9d931cd221b",
+	})
+	r := NewRouter(b)
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "/admin/refresh", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("admin", "adminpw")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 200, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"deployment_id": "5c2e5f3a4b5c6d001a3e8001"`)
+	assert.NotContains(t, rec.Body.String(), `"correction"`)
+	_, ok := b.Client.Index.Lookup("3d7e1b2a-9c4f-4a6e-b8d1-5f2a7c9e0b01")
+	assert.True(t, ok)
+}
+
+func TestBroker_AdminPurgeOrphans_DryRun(t *testing.T) {
+	apiServer := util.TestServer("deadbeef", orphanTestCases(func(msg string) {
+		t.Errorf("must not delete anything in dry-run mode: %s", msg)
+	}))
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	storeOrphanTestInstances(b)
+	r := NewRouter(b)
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "/admin/orphans/purge?dry_run=true", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("admin", "adminpw")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 200, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"deployment_id": "5c1d4e2f3a4b5c001a3e7001"`)
+}
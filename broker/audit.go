@@ -0,0 +1,118 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/JamesClonk/compose-broker/config"
+	"github.com/JamesClonk/compose-broker/log"
+	"github.com/gorilla/mux"
+)
+
+// AuditEvent is a state-changing request of the platform, and how it turned out
+type AuditEvent struct {
+	Time       time.Time            `json:"time"`
+	RequestID  string               `json:"request_id,omitempty"`
+	Identity   *OriginatingIdentity `json:"identity,omitempty"`
+	InstanceID string               `json:"instance_id"`
+	BindingID  string               `json:"binding_id,omitempty"`
+	Operation  string               `json:"operation"`
+	StatusCode int                  `json:"status_code"`
+	Outcome    string               `json:"outcome"` // succeeded, accepted if it continues asynchronously, or failed
+}
+
+// AuditLog keeps a record of who did what to which service instance
+type AuditLog interface {
+	Record(event AuditEvent) error
+	Close() error
+}
+
+func NewAuditLog(c *config.Config) AuditLog {
+	if len(c.AuditLogFilename) == 0 {
+		return &discardAuditLog{}
+	}
+	audit, err := NewFileAuditLog(c.AuditLogFilename)
+	if err != nil {
+		log.Errorf("could not open audit log %s", c.AuditLogFilename)
+		log.Fatalln(err)
+	}
+	return audit
+}
+
+// FileAuditLog appends every event as a line of JSON to a file
+type FileAuditLog struct {
+	file  *os.File
+	mutex sync.Mutex
+}
+
+func NewFileAuditLog(filename string) (*FileAuditLog, error) {
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileAuditLog{file: file}, nil
+}
+
+func (a *FileAuditLog) Record(event AuditEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	_, err = a.file.Write(append(data, '\n'))
+	return err
+}
+
+func (a *FileAuditLog) Close() error {
+	return a.file.Close()
+}
+
+type discardAuditLog struct{}
+
+func (a *discardAuditLog) Record(event AuditEvent) error {
+	return nil
+}
+
+func (a *discardAuditLog) Close() error {
+	return nil
+}
+
+// Audited records the outcome of a state-changing request in the audit log
+func (b *Broker) Audited(operation string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: rw, code: http.StatusOK}
+		handler(recorder, req)
+
+		event := AuditEvent{
+			Time:       time.Now(),
+			Identity:   originatingIdentity(req.Context()),
+			InstanceID: mux.Vars(req)["instanceID"],
+			BindingID:  mux.Vars(req)["bindingID"],
+			Operation:  operation,
+			StatusCode: recorder.code,
+			Outcome:    auditOutcome(recorder.code),
+		}
+		if requestID, ok := log.FieldsFromContext(req.Context())["request_id"].(string); ok {
+			event.RequestID = requestID
+		}
+		if err := b.Audit.Record(event); err != nil {
+			log.Ctx(req.Context()).Errorf("could not record %s of service instance %s in audit log: %v", operation, event.InstanceID, err)
+		}
+	}
+}
+
+func auditOutcome(code int) string {
+	switch {
+	case code == http.StatusAccepted:
+		return "accepted"
+	case code >= 200 && code < 300:
+		return "succeeded"
+	default:
+		return "failed"
+	}
+}
@@ -0,0 +1,105 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/JamesClonk/compose-broker/log"
+	"github.com/JamesClonk/compose-broker/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+}
+
+func TestBroker_Audit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compose-broker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "audit.jsonl")
+
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "POST", Path: "/deployments", Code: 202, Body: util.Body("../_fixtures/api_create_deployment_for_service_provisioning.json"), Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	c := util.TestConfig(apiServer.URL)
+	c.AuditLogFilename = filename
+	b := NewBroker(c)
+	defer b.Audit.Close()
+	r := NewRouter(b)
+
+	provision := func(serviceID string) int {
+		data, _ := json.Marshal(ServiceInstanceProvisioning{
+			ServiceID: serviceID,
+			PlanID:    "d6222855-17c6-448c-885a-e9d931cd221b",
+		})
+		rec := httptest.NewRecorder()
+		req, err := http.NewRequest("PUT", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26?accepts_incomplete=true", bytes.NewBuffer(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("broker", "pw")
+		req.Header.Set("X-Broker-API-Version", "2.15")
+		req.Header.Set("X-Broker-API-Request-Identity", "e26cde4c-a5a1-4b4f-8a3f-35b7a1d0f9a0")
+		req.Header.Set("X-Broker-API-Originating-Identity", "cloudfoundry eyJ1c2VyX2lkIjogIjY4M2VhNzQ4LTMwOTItNGZmNC1iNjU2LTM5Y2FjYzRkNTM2MCJ9")
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	assert.Equal(t, 202, provision("9b4ee86b-3876-469f-a531-062e71bc5859"))
+	assert.Equal(t, 400, provision("unknown"))
+
+	// read-only requests are not audited
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26/last_operation", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if assert.Len(t, lines, 2) {
+		var event AuditEvent
+		assert.NoError(t, json.Unmarshal([]byte(lines[0]), &event))
+		assert.False(t, event.Time.IsZero())
+		assert.Equal(t, "e26cde4c-a5a1-4b4f-8a3f-35b7a1d0f9a0", event.RequestID)
+		assert.Equal(t, &OriginatingIdentity{Platform: "cloudfoundry", UserID: "683ea748-3092-4ff4-b656-39cacc4d5360"}, event.Identity)
+		assert.Equal(t, "8dcdf609-36c9-4b22-bb16-d97e48c50f26", event.InstanceID)
+		assert.Equal(t, "provision", event.Operation)
+		assert.Equal(t, 202, event.StatusCode)
+		assert.Equal(t, "accepted", event.Outcome)
+
+		assert.NoError(t, json.Unmarshal([]byte(lines[1]), &event))
+		assert.Equal(t, 400, event.StatusCode)
+		assert.Equal(t, "failed", event.Outcome)
+	}
+
+	// the audit log is only ever appended to
+	audit, err := NewFileAuditLog(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, audit.Record(AuditEvent{InstanceID: "0f6c1a7e-2b3d-4c5e-8f9a-1b2c3d4e5f02", Operation: "deprovision", StatusCode: 200, Outcome: "succeeded"}))
+	assert.NoError(t, audit.Close())
+	data, err = ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, strings.Split(strings.TrimSpace(string(data)), "\n"), 3)
+}
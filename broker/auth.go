@@ -23,3 +23,16 @@ func (b *Broker) verifyBasicAuth(rw http.ResponseWriter, req *http.Request) bool
 	}
 	return true
 }
+
+// AdminAuth protects the admin API with its own credentials, so that the platform can't use it
+func (b *Broker) AdminAuth(handler http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		username, password, ok := req.BasicAuth()
+		if !ok || len(b.AdminPassword) == 0 || subtle.ConstantTimeCompare([]byte(username), []byte(b.AdminUsername)) != 1 || subtle.ConstantTimeCompare([]byte(password), []byte(b.AdminPassword)) != 1 {
+			rw.Header().Set("WWW-Authenticate", `Basic realm="compose-broker admin"`)
+			b.Error(rw, req, 401, "Unauthorized", "You are not authorized to access the admin API of this service broker")
+			return
+		}
+		handler(rw, req)
+	}
+}
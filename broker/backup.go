@@ -0,0 +1,33 @@
+package broker
+
+import (
+	"context"
+
+	"github.com/JamesClonk/compose-broker/api"
+)
+
+// findBackup looks for a backup among the other service instances of the same service in the same space or namespace,
+// which are the only ones a new service instance may be restored from, it returns nil if there is no such backup
+func (b *Broker) findBackup(ctx context.Context, serviceID, scope, backupID string) (*api.Backup, error) {
+	if len(scope) == 0 {
+		return nil, nil
+	}
+	instances, err := b.Store.GetInstances()
+	if err != nil {
+		return nil, err
+	}
+	for _, instance := range instances {
+		if instance.ServiceID != serviceID || instance.scope() != scope || len(instance.DeploymentID) == 0 {
+			continue
+		}
+		backup, err := b.Client.GetBackupContext(ctx, instance.DeploymentID, backupID)
+		if api.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return backup, nil
+	}
+	return nil, nil
+}
@@ -1,35 +1,80 @@
 package broker
 
 import (
+	"context"
+	"crypto/rand"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/JamesClonk/compose-broker/api"
 	"github.com/JamesClonk/compose-broker/config"
+	"github.com/JamesClonk/compose-broker/credentials"
 	"github.com/JamesClonk/compose-broker/log"
+	"github.com/gorilla/mux"
 )
 
 type Broker struct {
 	Username       string
 	Password       string
+	AdminUsername  string
+	AdminPassword  string
+	BindingSecret  string
+	RequestTimeout time.Duration
 	APIConfig      config.API
 	Client         *api.Client
-	ServiceCatalog *ServiceCatalog
+	Provisioners   credentials.Provisioners
+	Store          Store
+	Audit          AuditLog
+	Quotas         *Quotas
+	Orphans        config.Orphans
+	Drift          config.Drift
+
+	catalog    catalogState
+	lastDrift  driftState
+	quotaMutex sync.Mutex // serializes quota checks until the service instance or its new units are stored
 }
 
 func NewBroker(c *config.Config) *Broker {
 	b := &Broker{
 		Username:       c.Username,
 		Password:       c.Password,
+		AdminUsername:  c.AdminUsername,
+		AdminPassword:  c.AdminPassword,
+		BindingSecret:  c.BindingSecret,
+		RequestTimeout: c.RequestTimeout,
 		APIConfig:      c.API,
 		Client:         api.NewClient(c),
-		ServiceCatalog: LoadServiceCatalog(c.CatalogFilename),
+		Provisioners:   credentials.NewProvisioners(c),
+		Store:          NewStore(c),
+		Audit:          NewAuditLog(c),
+		Quotas:         LoadQuotas(c.QuotasFilename),
+		Orphans:        c.Orphans,
+		Drift:          c.Drift,
+	}
+
+	b.loadServiceCatalog(c.CatalogFilename)
+
+	// the default whitelist is applied to every new deployment, better fail early if it is invalid
+	whitelist, err := normalizeWhitelist(c.API.DefaultWhitelist)
+	if err != nil {
+		log.Errorln("invalid COMPOSE_API_DEFAULT_WHITELIST")
+		log.Fatalln(err)
+	}
+	b.APIConfig.DefaultWhitelist = whitelist
+
+	if c.MetricsInterval > 0 {
+		go b.watchDeployments(c.MetricsInterval)
 	}
 	return b
 }
 
 func (b *Broker) write(rw http.ResponseWriter, req *http.Request, code int, content interface{}) {
-	log.InfoWithFields(log.Fields{
+	log.Ctx(req.Context()).InfoWithFields(log.Fields{
 		"remote_addr":      req.RemoteAddr,
 		"method":           req.Method,
 		"request_uri":      req.URL.RequestURI(),
@@ -39,13 +84,13 @@ func (b *Broker) write(rw http.ResponseWriter, req *http.Request, code int, cont
 
 	data, err := json.MarshalIndent(content, "", "  ")
 	if err != nil {
-		log.Errorf("could not marshal content into json: %#v", content)
-		log.Errorln(err)
+		log.Ctx(req.Context()).Errorf("could not marshal content into json: %#v", content)
+		log.Ctx(req.Context()).Errorln(err)
 	}
 
-	rw.WriteHeader(code)
 	rw.Header().Set("X-Compose-Broker", "compose-broker")
 	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
 	rw.Write(data)
 }
 
@@ -59,7 +104,83 @@ func (b *Broker) Error(rw http.ResponseWriter, req *http.Request, code int, err,
 	if len(desc) == 0 {
 		err = "An unknown error has occured"
 	}
-	b.write(rw, req, code, map[string]string{"error": err, "description": desc})
+	b.write(rw, req, code, map[string]string{"error": err, "description": log.Redact(desc)}) // descriptions can quote Compose.io API responses
+}
+
+// Deadline limits the time a request can take, so that the platform gets an answer before it gives up on its own
+func (b *Broker) Deadline(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if b.RequestTimeout <= 0 {
+			handler.ServeHTTP(rw, req)
+			return
+		}
+		ctx, cancel := context.WithTimeout(req.Context(), b.RequestTimeout)
+		defer cancel()
+		handler.ServeHTTP(rw, req.WithContext(ctx))
+	})
+}
+
+// RequestID tags all logging of a request with the ID the platform sent along with it, or a new one if there is none,
+// plus the IDs of the service instance and binding it is about
+func (b *Broker) RequestID(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requestID := req.Header.Get("X-Broker-API-Request-Identity")
+		if len(requestID) == 0 {
+			requestID = req.Header.Get("X-Request-ID")
+		}
+		if len(requestID) == 0 || len(requestID) > 128 {
+			requestID = newRequestID()
+		}
+		rw.Header().Set("X-Request-ID", requestID)
+
+		fields := log.Fields{"request_id": requestID}
+		if instanceID := mux.Vars(req)["instanceID"]; len(instanceID) > 0 {
+			fields["instance_id"] = instanceID
+		}
+		if bindingID := mux.Vars(req)["bindingID"]; len(bindingID) > 0 {
+			fields["binding_id"] = bindingID
+		}
+		handler.ServeHTTP(rw, req.WithContext(log.WithFields(req.Context(), fields)))
+	})
+}
+
+// newRequestID generates a random UUID
+func newRequestID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		log.Errorf("could not generate request ID: %v", err)
+	}
+	id[6] = (id[6] & 0x0f) | 0x40 // version 4
+	id[8] = (id[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:])
+}
+
+// apiError answers a request that failed because of the Compose.io API, with a more specific error than the given one if possible
+func (b *Broker) apiError(rw http.ResponseWriter, req *http.Request, err error, code int, errorName, description string) {
+	var apiErr *api.Error
+	errors.As(err, &apiErr)
+
+	switch {
+	case api.IsCancelled(err):
+		// must never be mistaken for a missing service instance or binding
+		b.Error(rw, req, 504, "Timeout", "The Compose.io API did not answer in time")
+	case api.IsRateLimited(err):
+		b.Error(rw, req, 503, "RateLimited", "The Compose.io API is rate limiting requests, please try again later")
+	case api.IsUnauthorized(err):
+		b.Error(rw, req, 500, "UnknownError", "The service broker is not authorized to access the Compose.io API")
+	case api.IsValidation(err):
+		b.Error(rw, req, 400, "ValidationError", apiErr.Description())
+	case api.IsConflict(err):
+		b.Error(rw, req, 422, "ConcurrencyError", apiErr.Description())
+	default:
+		b.Error(rw, req, code, errorName, description)
+	}
+}
+
+// lookupFailed tells if looking up a deployment failed because of the Compose.io API, rather than the deployment not existing
+func lookupFailed(err error) bool {
+	var netErr net.Error
+	return api.IsCancelled(err) || errors.As(err, &netErr) || (api.StatusCode(err) > 0 && !api.IsNotFound(err))
 }
 
 func (b *Broker) Health(rw http.ResponseWriter, req *http.Request) {
@@ -1,9 +1,9 @@
 package broker
 
 import (
+	"fmt"
 	"io/ioutil"
 	"net/http"
-	"os"
 
 	"github.com/JamesClonk/compose-broker/log"
 	yaml "gopkg.in/yaml.v2"
@@ -49,110 +49,176 @@ type ServicePlan struct {
 		Bullets          []string `json:"bullets" yaml:"bullets"`
 		HighAvailability bool     `json:"highAvailability" yaml:"highAvailability"`
 		Units            int      `json:"units" yaml:"units"`
+		MinUnits         int      `json:"min_units,omitempty" yaml:"min_units,omitempty"`
+		MaxUnits         int      `json:"max_units,omitempty" yaml:"max_units,omitempty"`
+		UnitsStep        int      `json:"units_step,omitempty" yaml:"units_step,omitempty"` // units must be a multiple of it
 		CacheMode        bool     `json:"cache_mode,omitempty" yaml:"cache_mode,omitempty"`
 		Version          string   `json:"version,omitempty" yaml:"version,omitempty"`
 		Datacenter       string   `json:"datacenter,omitempty" yaml:"datacenter,omitempty"`
 	} `json:"metadata" yaml:"metadata"`
+	Schemas         *ServicePlanSchemas `json:"schemas,omitempty" yaml:"schemas,omitempty"`
+	MaintenanceInfo *MaintenanceInfo    `json:"maintenance_info,omitempty" yaml:"maintenance_info,omitempty"`
+}
+type MaintenanceInfo struct {
+	Version     string `json:"version" yaml:"version"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
 }
 
 func LoadServiceCatalog(filename string) *ServiceCatalog {
+	catalog, err := ParseServiceCatalog(filename)
+	if err != nil {
+		log.Errorf("could not load %s", filename)
+		log.Fatalln(err)
+	}
+	return catalog
+}
+
+// ParseServiceCatalog reads and validates a catalog file, setting the default values of everything left out
+func ParseServiceCatalog(filename string) (*ServiceCatalog, error) {
 	var catalog ServiceCatalog
 
-	if _, err := os.Stat(filename); err == nil {
-		data, err := ioutil.ReadFile(filename)
-		if err != nil {
-			log.Errorf("could not load %s", filename)
-			log.Fatalln(err)
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, &catalog); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %v", filename, err)
+	}
+
+	// expect & hardcode certain default values
+	if len(catalog.Services) < 1 {
+		return nil, fmt.Errorf("invalid catalog, no service offerings defined")
+	}
+	for sx, service := range catalog.Services {
+		if len(service.ID) == 0 {
+			return nil, fmt.Errorf("service #%d: ID is missing in catalog %s", sx, filename)
 		}
-		if err := yaml.Unmarshal(data, &catalog); err != nil {
-			log.Errorf("could not parse %s", filename)
-			log.Fatalln(err)
+		if len(service.Name) == 0 {
+			return nil, fmt.Errorf("service #%d: name is missing in catalog %s", sx, filename)
 		}
 
-		// expect & hardcode certain default values
-		if len(catalog.Services) < 1 {
-			log.Errorln("invalid catalog, no service offerings defined")
-			log.Fatalln(catalog)
-		}
-		for sx, service := range catalog.Services {
-			if len(service.ID) == 0 {
-				log.Errorf("service #%d: ID is missing in catalog %s", sx, filename)
-				log.Fatalln(catalog)
+		// check for duplicates
+		for s := range catalog.Services {
+			if s != sx && catalog.Services[s].ID == service.ID {
+				return nil, fmt.Errorf("service duplicate found: %s", service.ID)
 			}
-			if len(service.Name) == 0 {
-				log.Errorf("service #%d: name is missing in catalog %s", sx, filename)
-				log.Fatalln(catalog)
+			if s != sx && catalog.Services[s].Name == service.Name {
+				return nil, fmt.Errorf("service duplicate found: %s", service.Name)
 			}
+		}
 
-			// check for duplicates
-			for s := range catalog.Services {
-				if s != sx && catalog.Services[s].ID == service.ID {
-					log.Errorf("service duplicate found: %s", service.ID)
-					log.Fatalln(catalog)
-				}
-				if s != sx && catalog.Services[s].Name == service.Name {
-					log.Errorf("service duplicate found: %s", service.Name)
-					log.Fatalln(catalog)
-				}
-			}
+		// displayName
+		if len(service.Metadata.DisplayName) == 0 {
+			catalog.Services[sx].Metadata.DisplayName = service.Name
+		}
+		// enforce flags
+		catalog.Services[sx].Bindable = true
+		catalog.Services[sx].InstancesRetrievable = true
+		catalog.Services[sx].BindingsRetrievable = true
+		// catalog.Services[sx].PlanUpdateable = true // don't enforce "plan_updateable", some databases might truly not support scaling
 
-			// displayName
-			if len(service.Metadata.DisplayName) == 0 {
-				catalog.Services[sx].Metadata.DisplayName = service.Name
+		if len(service.Plans) < 1 {
+			return nil, fmt.Errorf("invalid catalog, at least one service plan has to be defined")
+		}
+		for px, plan := range service.Plans {
+			if len(plan.ID) == 0 {
+				return nil, fmt.Errorf("service #%d, plan #%d: ID is missing in catalog %s", sx, px, filename)
 			}
-			// enforce flags
-			catalog.Services[sx].Bindable = true
-			catalog.Services[sx].InstancesRetrievable = true
-			catalog.Services[sx].BindingsRetrievable = true
-			// catalog.Services[sx].PlanUpdateable = true // don't enforce "plan_updateable", some databases might truly not support scaling
-
-			if len(service.Plans) < 1 {
-				log.Errorln("invalid catalog, at least one service plan has to be defined")
-				log.Fatalln(catalog)
+			if len(plan.Name) == 0 {
+				return nil, fmt.Errorf("service #%d, plan #%d: name is missing in catalog %s", sx, px, filename)
 			}
-			for px, plan := range service.Plans {
-				if len(plan.ID) == 0 {
-					log.Errorf("service #%d, plan #%d: ID is missing in catalog %s", sx, px, filename)
-					log.Fatalln(catalog)
+			if plan.Metadata.Units < 1 {
+				catalog.Services[sx].Plans[px].Metadata.Units = 1
+				if plan.Metadata.MinUnits > 1 {
+					catalog.Services[sx].Plans[px].Metadata.Units = plan.Metadata.MinUnits
 				}
-				if len(plan.Name) == 0 {
-					log.Errorf("service #%d, plan #%d: name is missing in catalog %s", sx, px, filename)
-					log.Fatalln(catalog)
+			}
+			if plan.Metadata.MinUnits < 0 || plan.Metadata.MaxUnits < 0 || plan.Metadata.UnitsStep < 0 ||
+				(plan.Metadata.MaxUnits > 0 && plan.Metadata.MinUnits > plan.Metadata.MaxUnits) {
+				return nil, fmt.Errorf("service #%d, plan #%d: invalid min_units, max_units or units_step in catalog %s", sx, px, filename)
+			}
+			if reason := catalog.Services[sx].Plans[px].checkUnits(catalog.Services[sx].Plans[px].Metadata.Units); len(reason) > 0 {
+				return nil, fmt.Errorf("service #%d, plan #%d: units do not fit in catalog %s: %s", sx, px, filename, reason)
+			}
+
+			if plan.MaintenanceInfo != nil && len(plan.MaintenanceInfo.Version) == 0 {
+				return nil, fmt.Errorf("service #%d, plan #%d: maintenance_info version is missing in catalog %s", sx, px, filename)
+			}
+
+			// plans without their own parameter schemas get the default ones
+			schemas := defaultSchemas()
+			if plan.Schemas != nil {
+				if len(plan.Schemas.ServiceInstance.Create.Parameters) > 0 {
+					schemas.ServiceInstance.Create.Parameters = jsonCompatible(plan.Schemas.ServiceInstance.Create.Parameters).(map[string]interface{})
 				}
-				if plan.Metadata.Units < 1 {
-					catalog.Services[sx].Plans[px].Metadata.Units = 1
+				if len(plan.Schemas.ServiceInstance.Update.Parameters) > 0 {
+					schemas.ServiceInstance.Update.Parameters = jsonCompatible(plan.Schemas.ServiceInstance.Update.Parameters).(map[string]interface{})
 				}
 			}
+			unitsSchema(schemas.ServiceInstance.Create.Parameters, plan)
+			unitsSchema(schemas.ServiceInstance.Update.Parameters, plan)
+			catalog.Services[sx].Plans[px].Schemas = &schemas
 		}
+	}
+	return &catalog, nil
+}
 
-	} else {
-		log.Errorf("could not load %s", filename)
-		log.Fatalln(err)
+// Plan returns the plan of a service from the catalog, or nil if there is no such plan
+func (c *ServiceCatalog) Plan(serviceID, planID string) (*Service, *ServicePlan) {
+	for sx, service := range c.Services {
+		if service.ID == serviceID {
+			for px, plan := range service.Plans {
+				if plan.ID == planID {
+					return &c.Services[sx], &c.Services[sx].Plans[px]
+				}
+			}
+		}
 	}
-	return &catalog
+	return nil, nil
 }
 
 func (b *Broker) Catalog(rw http.ResponseWriter, req *http.Request) {
 	// filter catalog by /databases api response, trim everything that is not at least "stable" or "beta"
-	databases, err := b.Client.GetDatabases()
+	databases, err := b.Client.GetDatabasesContext(req.Context())
 	if err != nil {
-		log.Errorf("could not filter services for catalog: %v", err)
-		b.Error(rw, req, 500, "UnknownError", "Could not filter services for catalog")
+		log.Ctx(req.Context()).Errorf("could not filter services for catalog: %v", err)
+		b.apiError(rw, req, err, 500, "UnknownError", "Could not filter services for catalog")
 		return
 	}
 
+	version := apiVersion(req.Context())
 	filteredServices := make([]Service, 0)
-	for _, service := range b.ServiceCatalog.Services {
+	for _, service := range b.ServiceCatalog().Services {
 		for _, database := range databases {
 			if service.Name == database.DatabaseType {
 				// only allow stable or beta service offerings
 				if database.Status == "stable" || database.Status == "beta" {
-					filteredServices = append(filteredServices, service)
+					filteredServices = append(filteredServices, catalogService(service, version))
 				}
 			}
 		}
 	}
-	b.ServiceCatalog.Services = filteredServices
 
-	b.write(rw, req, 200, b.ServiceCatalog)
+	b.write(rw, req, 200, ServiceCatalog{Services: filteredServices})
+}
+
+// catalogService leaves out what the platform does not know about yet in the Open Service Broker API version it speaks
+func catalogService(service Service, version APIVersion) Service {
+	if !version.AtLeast(14) {
+		// fetching service instances and bindings was introduced with 2.14
+		service.InstancesRetrievable = false
+		service.BindingsRetrievable = false
+	}
+	if !version.AtLeast(15) {
+		plans := make([]ServicePlan, len(service.Plans))
+		for px, plan := range service.Plans {
+			plan.MaintenanceInfo = nil // introduced with 2.15
+			if !version.AtLeast(13) {
+				plan.Schemas = nil // introduced with 2.13
+			}
+			plans[px] = plan
+		}
+		service.Plans = plans
+	}
+	return service
 }
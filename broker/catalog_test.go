@@ -21,7 +21,7 @@ func TestBroker_Catalog(t *testing.T) {
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("GET", "/v2/catalog", nil)
@@ -29,6 +29,7 @@ func TestBroker_Catalog(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 200, rec.Code)
@@ -51,7 +52,7 @@ func TestBroker_Catalog_Trimmed(t *testing.T) {
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("GET", "/v2/catalog", nil)
@@ -59,6 +60,7 @@ func TestBroker_Catalog_Trimmed(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 200, rec.Code)
@@ -0,0 +1,217 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JamesClonk/compose-broker/api"
+	"github.com/JamesClonk/compose-broker/log"
+	"github.com/JamesClonk/compose-broker/metrics"
+)
+
+// Drift is a deployment whose scaling does not match what its service plan or parameters say it should be,
+// usually because someone rescaled it in the Compose.io web UI
+type Drift struct {
+	InstanceID     string `json:"instance_id"`
+	DeploymentID   string `json:"deployment_id"`
+	ServiceID      string `json:"service_id"`
+	PlanID         string `json:"plan_id"`
+	ExpectedUnits  int    `json:"expected_units"`
+	AllocatedUnits int    `json:"allocated_units"`
+	Correction     string `json:"correction,omitempty"` // ID of the scaling recipe started to correct the drift
+}
+type DriftReport struct {
+	CheckedAt time.Time `json:"checked_at"`
+	Drift     []Drift   `json:"drift"`
+}
+
+type driftState struct {
+	report *DriftReport
+	mutex  sync.RWMutex
+}
+
+// deploymentNotes are "serviceID-planID", followed by where the service instance lives and who provisioned it if the platform told
+func deploymentNotes(ctx context.Context, serviceID, planID string, platform *PlatformContext) string {
+	notes := fmt.Sprintf("%s-%s", serviceID, planID)
+	if platform != nil {
+		if len(platform.InstanceName) > 0 {
+			notes = fmt.Sprintf("%s for %s", notes, platform.InstanceName)
+		}
+		notes = fmt.Sprintf("%s in %s", notes, platform)
+	}
+	if identity := originatingIdentity(ctx); identity != nil {
+		notes = fmt.Sprintf("%s provisioned by %s", notes, identity)
+	}
+	return notes
+}
+
+// planFromNotes reads service and plan ID from the notes of a deployment, see deploymentNotes
+func (b *Broker) planFromNotes(notes string) (*Service, *ServicePlan) {
+	if fields := strings.Fields(notes); len(fields) > 0 {
+		notes = fields[0]
+	}
+	catalog := b.ServiceCatalog()
+	for _, service := range catalog.Services {
+		if strings.HasPrefix(notes, service.ID+"-") {
+			return catalog.Plan(service.ID, strings.TrimPrefix(notes, service.ID+"-"))
+		}
+	}
+	return nil, nil
+}
+
+// updatePlanNotes replaces service and plan ID at the start of the notes of a deployment after a plan change, see deploymentNotes,
+// notes that don't start with the service ID were not written by this service broker and are left alone
+func (b *Broker) updatePlanNotes(ctx context.Context, deployment *api.Deployment, serviceID, planID string) {
+	if !strings.HasPrefix(deployment.Notes, serviceID+"-") {
+		return
+	}
+	notes := fmt.Sprintf("%s-%s", serviceID, planID)
+	if i := strings.Index(deployment.Notes, " "); i >= 0 {
+		notes = notes + deployment.Notes[i:]
+	}
+	if notes == deployment.Notes {
+		return
+	}
+	if _, err := b.Client.UpdateDeploymentContext(ctx, deployment.ID, api.DeploymentUpdate{Notes: notes}); err != nil {
+		log.Ctx(ctx).Warnf("could not update notes of deployment %s to plan %s: %v", deployment.ID, planID, err)
+		return
+	}
+	deployment.Notes = notes
+}
+
+// expectedUnits is what a deployment should be scaled to, units given as parameter take precedence over the plan
+func expectedUnits(plan *ServicePlan, stored *Instance) int {
+	units := plan.Metadata.Units
+	if stored != nil {
+		var parameters struct {
+			Units int `json:"units"`
+		}
+		if err := json.Unmarshal(stored.Parameters, &parameters); err == nil && parameters.Units > 0 {
+			units = parameters.Units
+		}
+	}
+	return units
+}
+
+// findDrift compares the scaling of all deployments of service instances with their service plans,
+// the plan recorded in the store takes precedence over the deployment notes
+func (b *Broker) findDrift(ctx context.Context) ([]Drift, error) {
+	managed, err := b.managedDeployments(ctx)
+	if err != nil {
+		return nil, err
+	}
+	b.updateDeploymentMetrics(managed)
+
+	drift := make([]Drift, 0)
+	for _, m := range managed {
+		if m.Scaling == nil || m.Plan.Metadata.Units < 1 {
+			continue // gone in the meantime, or its plan is gone from the catalog
+		}
+		// a deployment that is being provisioned or migrated is expected to differ
+		if len(m.Recipes) > 0 && (m.Recipes[0].Status == "running" || m.Recipes[0].Status == "waiting") {
+			continue
+		}
+
+		if units := expectedUnits(m.Plan, m.Stored); m.Scaling.AllocatedUnits != units {
+			drift = append(drift, Drift{
+				InstanceID:     m.Deployment.Name,
+				DeploymentID:   m.Deployment.ID,
+				ServiceID:      m.Service.ID,
+				PlanID:         m.Plan.ID,
+				ExpectedUnits:  units,
+				AllocatedUnits: m.Scaling.AllocatedUnits,
+			})
+		}
+	}
+	return drift, nil
+}
+
+// reconcileDrift reports all drift, and scales the deployments back to what they should be if auto-correct is enabled
+func (b *Broker) reconcileDrift(ctx context.Context) (*DriftReport, error) {
+	drift, err := b.findDrift(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, d := range drift {
+		log.Ctx(ctx).Warnf("deployment %s of service instance %s has %d units allocated instead of %d according to plan %s",
+			d.DeploymentID, d.InstanceID, d.AllocatedUnits, d.ExpectedUnits, d.PlanID)
+		if !b.Drift.AutoCorrect {
+			continue
+		}
+		// the notes of a deployment might be outdated, only a plan recorded in the store is trusted enough to scale a deployment
+		stored, err := b.Store.GetInstance(d.InstanceID)
+		if err != nil {
+			log.Ctx(ctx).Warnf("not scaling deployment %s back, service instance %s is only known from its notes", d.DeploymentID, d.InstanceID)
+			continue
+		}
+		// an update that is still running or has failed might have left the deployment in between plans, scaling it would redo that update
+		if len(stored.Operation) > 0 {
+			log.Ctx(ctx).Warnf("not scaling deployment %s back, service instance %s has a pending or failed update operation %s", d.DeploymentID, d.InstanceID, stored.Operation)
+			continue
+		}
+
+		recipe, err := b.Client.UpdateScalingContext(ctx, d.DeploymentID, d.ExpectedUnits)
+		if err != nil {
+			log.Ctx(ctx).Errorf("could not scale deployment %s of service instance %s back to %d units: %v", d.DeploymentID, d.InstanceID, d.ExpectedUnits, err)
+			metrics.DriftCorrections.WithLabelValues("failure").Inc()
+			continue
+		}
+		log.Ctx(ctx).Infof("scaling deployment %s of service instance %s back to %d units: %s", d.DeploymentID, d.InstanceID, d.ExpectedUnits, recipe.ID)
+		metrics.DriftCorrections.WithLabelValues("success").Inc()
+		drift[i].Correction = recipe.ID
+	}
+	return b.saveDriftReport(drift), nil
+}
+
+// saveDriftReport remembers the drift found by a check, for DriftStatus
+func (b *Broker) saveDriftReport(drift []Drift) *DriftReport {
+	metrics.DriftedDeployments.Set(float64(len(drift)))
+
+	report := &DriftReport{CheckedAt: time.Now(), Drift: drift}
+	b.lastDrift.mutex.Lock()
+	b.lastDrift.report = report
+	b.lastDrift.mutex.Unlock()
+	return report
+}
+
+// WatchDrift keeps looking for drift in the background, until stop is closed
+func (b *Broker) WatchDrift(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			if _, err := b.reconcileDrift(ctx); err != nil {
+				log.Warnf("could not look for drift between plans and deployments: %v", err)
+			}
+			cancel()
+		}
+	}
+}
+
+// DriftStatus shows the drift found by the last check, or checks right away without correcting anything if there was none yet
+func (b *Broker) DriftStatus(rw http.ResponseWriter, req *http.Request) {
+	b.lastDrift.mutex.RLock()
+	report := b.lastDrift.report
+	b.lastDrift.mutex.RUnlock()
+
+	if report == nil {
+		drift, err := b.findDrift(req.Context())
+		if err != nil {
+			log.Ctx(req.Context()).Errorf("could not look for drift between plans and deployments: %v", err)
+			b.apiError(rw, req, err, 500, "UnknownError", "Could not look for drift between plans and deployments")
+			return
+		}
+		report = &DriftReport{CheckedAt: time.Now(), Drift: drift}
+	}
+	b.write(rw, req, 200, report)
+}
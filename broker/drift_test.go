@@ -0,0 +1,203 @@
+package broker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/JamesClonk/compose-broker/api"
+	"github.com/JamesClonk/compose-broker/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func driftTestCases(scaled func(string)) []util.HttpTestCase {
+	return []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments", Code: 200, Body: util.Body("../_fixtures/api_get_deployments_for_drift.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5c2e5f3a4b5c6d001a3e8001/recipes", Code: 200, Body: util.Body("../_fixtures/api_get_recipes_for_last_operation_succeeded.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5c2e5f3a4b5c6d001a3e8001/scalings", Code: 200, Body: util.Body("../_fixtures/api_get_scaling.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5c2e5f3a4b5c6d001a3e8002/recipes", Code: 200, Body: util.Body("../_fixtures/api_get_recipes_for_last_operation_succeeded.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5c2e5f3a4b5c6d001a3e8002/scalings", Code: 200, Body: util.Body("../_fixtures/api_get_scaling_for_service_provision.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5c2e5f3a4b5c6d001a3e8004/recipes", Code: 200, Body: util.Body("../_fixtures/api_get_recipes_for_last_operation_succeeded.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5c2e5f3a4b5c6d001a3e8004/scalings", Code: 200, Body: util.Body("../_fixtures/api_get_scaling.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5c2e5f3a4b5c6d001a3e8005/recipes", Code: 200, Body: util.Body("../_fixtures/api_get_recipes_for_service_provision_in_progress.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5c2e5f3a4b5c6d001a3e8005/scalings", Code: 200, Body: util.Body("../_fixtures/api_get_scaling.json"), Test: nil},
+		util.HttpTestCase{Method: "POST", Path: "/deployments/5c2e5f3a4b5c6d001a3e8001/scalings", Code: 200, Body: util.Body("../_fixtures/api_update_scaling.json"), Test: func(body string) {
+			scaled("5c2e5f3a4b5c6d001a3e8001: " + body)
+		}},
+		util.HttpTestCase{Method: "POST", Path: "/deployments/5c2e5f3a4b5c6d001a3e8004/scalings", Code: 200, Body: util.Body("../_fixtures/api_update_scaling.json"), Test: func(body string) {
+			scaled("5c2e5f3a4b5c6d001a3e8004: " + body)
+		}},
+	}
+}
+
+func TestBroker_FindDrift(t *testing.T) {
+	apiServer := util.TestServer("deadbeef", driftTestCases(func(string) {
+		t.Error("must not scale any deployment")
+	}))
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+
+	// the plan of the notes is overruled by the units parameter of the stored service instance
+	b.saveInstance(context.Background(), Instance{
+		ID:         "3d7e1b2a-9c4f-4a6e-b8d1-5f2a7c9e0b04",
+		ServiceID:  "9b4ee86b-3876-469f-a531-062e71bc5859",
+		PlanID:     "d6222855-17c6-448c-885a-e9d931cd221b",
+		Parameters: []byte(`{"units":4}`),
+	})
+
+	drift, err := b.findDrift(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []Drift{
+		Drift{
+			InstanceID:     "3d7e1b2a-9c4f-4a6e-b8d1-5f2a7c9e0b01",
+			DeploymentID:   "5c2e5f3a4b5c6d001a3e8001",
+			ServiceID:      "9b4ee86b-3876-469f-a531-062e71bc5859",
+			PlanID:         "d6222855-17c6-448c-885a-e9d931cd221b",
+			ExpectedUnits:  1,
+			AllocatedUnits: 4,
+		},
+	}, drift)
+}
+
+func TestBroker_ReconcileDrift_AutoCorrect(t *testing.T) {
+	scalings := make([]string, 0)
+	apiServer := util.TestServer("deadbeef", driftTestCases(func(body string) {
+		scalings = append(scalings, body)
+	}))
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	b.Drift.AutoCorrect = true
+	b.saveInstance(context.Background(), Instance{
+		ID:        "3d7e1b2a-9c4f-4a6e-b8d1-5f2a7c9e0b01",
+		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
+		PlanID:    "d6222855-17c6-448c-885a-e9d931cd221b",
+	})
+
+	report, err := b.reconcileDrift(context.Background())
+	assert.NoError(t, err)
+	// without a stored service instance only the plan of the notes is known, which is reported but not corrected
+	if assert.Equal(t, 2, len(report.Drift)) {
+		assert.Equal(t, "570bcb3fee4cde000e000002", report.Drift[0].Correction)
+		assert.Equal(t, "5c2e5f3a4b5c6d001a3e8004", report.Drift[1].DeploymentID)
+		assert.Empty(t, report.Drift[1].Correction)
+	}
+	assert.Equal(t, []string{
+		`5c2e5f3a4b5c6d001a3e8001: {"deployment":{"units":1}}`,
+	}, scalings)
+}
+
+func TestBroker_ReconcileDrift_PendingUpdate(t *testing.T) {
+	apiServer := util.TestServer("deadbeef", driftTestCases(func(string) {
+		t.Error("must not scale a deployment whose update is pending or has failed")
+	}))
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	b.Drift.AutoCorrect = true
+	b.saveInstance(context.Background(), Instance{
+		ID:        "3d7e1b2a-9c4f-4a6e-b8d1-5f2a7c9e0b01",
+		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
+		PlanID:    "d6222855-17c6-448c-885a-e9d931cd221b",
+		Operation: "570bcb3fee4cde000e000002",
+	})
+
+	report, err := b.reconcileDrift(context.Background())
+	assert.NoError(t, err)
+	if assert.Equal(t, 2, len(report.Drift)) {
+		assert.Equal(t, "5c2e5f3a4b5c6d001a3e8001", report.Drift[0].DeploymentID)
+		assert.Empty(t, report.Drift[0].Correction)
+	}
+}
+
+func TestBroker_WatchDrift(t *testing.T) {
+	b := NewBroker(util.TestConfig(""))
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		b.WatchDrift(time.Hour, stop)
+		close(stopped)
+	}()
+
+	close(stop)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Error("must stop looking for drift")
+	}
+}
+
+func TestBroker_UpdatePlanNotes(t *testing.T) {
+	notes := make([]string, 0)
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "PATCH", Path: "/deployments/5c2e5f3a4b5c6d001a3e8001", Code: 200, Body: util.Body("../_fixtures/api_get_deployment.json"), Test: func(body string) {
+			notes = append(notes, body)
+		}},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+
+	deployment := &api.Deployment{ID: "5c2e5f3a4b5c6d001a3e8001", Notes: "9b4ee86b-3876-469f-a531-062e71bc5859-d6222855-17c6-448c-885a-e9d931cd221b for my-db in space dev of organization acme"}
+	b.updatePlanNotes(context.Background(), deployment, "9b4ee86b-3876-469f-a531-062e71bc5859", "a7e2bcb4-4f5c-4c4f-9a3e-6c1d2b8f0e35")
+	assert.Equal(t, "9b4ee86b-3876-469f-a531-062e71bc5859-a7e2bcb4-4f5c-4c4f-9a3e-6c1d2b8f0e35 for my-db in space dev of organization acme", deployment.Notes)
+
+	// unchanged plans and notes not written by the service broker are left alone
+	b.updatePlanNotes(context.Background(), deployment, "9b4ee86b-3876-469f-a531-062e71bc5859", "a7e2bcb4-4f5c-4c4f-9a3e-6c1d2b8f0e35")
+	b.updatePlanNotes(context.Background(), &api.Deployment{ID: "5c2e5f3a4b5c6d001a3e8001", Notes: "managed by the data team"}, "9b4ee86b-3876-469f-a531-062e71bc5859", "a7e2bcb4-4f5c-4c4f-9a3e-6c1d2b8f0e35")
+	assert.Equal(t, []string{
+		`{"deployment":{"notes":"9b4ee86b-3876-469f-a531-062e71bc5859-a7e2bcb4-4f5c-4c4f-9a3e-6c1d2b8f0e35 for my-db in space dev of organization acme"}}`,
+	}, notes)
+}
+
+func TestBroker_DriftStatus(t *testing.T) {
+	apiServer := util.TestServer("deadbeef", driftTestCases(func(string) {
+		t.Error("must not scale any deployment")
+	}))
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	b.Drift.AutoCorrect = true // only the background check corrects drift
+	r := NewRouter(b)
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/admin/drift", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("admin", "adminpw")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 200, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"deployment_id": "5c2e5f3a4b5c6d001a3e8001"`)
+	assert.Contains(t, rec.Body.String(), `"expected_units": 1`)
+	assert.Contains(t, rec.Body.String(), `"allocated_units": 4`)
+}
+
+func TestBroker_UpdateDeploymentMetrics(t *testing.T) {
+	apiServer := util.TestServer("deadbeef", driftTestCases(func(string) {
+		t.Error("must not scale any deployment")
+	}))
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	r := NewRouter(b)
+
+	_, err := b.findDrift(context.Background())
+	assert.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Contains(t, rec.Body.String(), `compose_broker_deployments{plan="default",service="postgresql"} 3`)
+	assert.Contains(t, rec.Body.String(), `compose_broker_allocated_units{plan="default",service="postgresql"} 12`)
+	assert.Contains(t, rec.Body.String(), `compose_broker_allocated_units{plan="default",service="scylla"} 5`)
+	assert.Contains(t, rec.Body.String(), `compose_broker_recipes_in_progress{plan="default",service="postgresql"} 1`)
+	assert.Contains(t, rec.Body.String(), `compose_broker_recipes_in_progress{plan="default",service="scylla"} 0`)
+	assert.Contains(t, rec.Body.String(), `compose_broker_api_requests_total{code="200",endpoint="deployments/{id}/scalings",method="GET"}`)
+}
@@ -0,0 +1,94 @@
+package broker
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/JamesClonk/compose-broker/log"
+)
+
+// OriginatingIdentity is the platform user on whose behalf a request was made
+type OriginatingIdentity struct {
+	Platform string `json:"platform"`
+	UserID   string `json:"user_id,omitempty"`  // user_id on Cloud Foundry, uid on Kubernetes
+	Username string `json:"username,omitempty"` // Kubernetes only
+}
+
+func (i OriginatingIdentity) String() string {
+	if len(i.Username) > 0 {
+		return fmt.Sprintf("%s user %s", i.Platform, i.Username)
+	}
+	return fmt.Sprintf("%s user %s", i.Platform, i.UserID)
+}
+
+// parseOriginatingIdentity decodes the X-Broker-API-Originating-Identity header, which is the platform followed by base64 encoded JSON
+func parseOriginatingIdentity(header string) (*OriginatingIdentity, error) {
+	parts := strings.Fields(header)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid originating identity: %s", header)
+	}
+	data, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid originating identity value: %v", err)
+	}
+	var value struct {
+		UserID   string `json:"user_id"`  // cloudfoundry
+		UID      string `json:"uid"`      // kubernetes
+		Username string `json:"username"` // kubernetes
+	}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil, fmt.Errorf("invalid originating identity value: %v", err)
+	}
+
+	identity := &OriginatingIdentity{Platform: parts[0]}
+	switch identity.Platform {
+	case "cloudfoundry":
+		identity.UserID = value.UserID
+	case "kubernetes":
+		identity.UserID = value.UID
+		identity.Username = value.Username
+	default:
+		identity.UserID = value.UserID
+		identity.Username = value.Username
+	}
+	if len(identity.UserID) == 0 && len(identity.Username) == 0 {
+		return nil, fmt.Errorf("originating identity of platform %s has no user", identity.Platform)
+	}
+	return identity, nil
+}
+
+type identityKey struct{}
+
+// originatingIdentity returns the platform user a request was made for, or nil if the platform did not tell
+func originatingIdentity(ctx context.Context) *OriginatingIdentity {
+	if identity, ok := ctx.Value(identityKey{}).(*OriginatingIdentity); ok {
+		return identity
+	}
+	return nil
+}
+
+// OriginatingIdentity remembers the platform user a request was made for and tags all logging of the request with it,
+// a request without or with an invalid identity is still served, since the header is optional
+func (b *Broker) OriginatingIdentity(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		header := req.Header.Get("X-Broker-API-Originating-Identity")
+		if len(header) == 0 {
+			handler.ServeHTTP(rw, req)
+			return
+		}
+		identity, err := parseOriginatingIdentity(header)
+		if err != nil {
+			log.Ctx(req.Context()).Warnf("could not decode X-Broker-API-Originating-Identity header: %v", err)
+			handler.ServeHTTP(rw, req)
+			return
+		}
+
+		ctx := context.WithValue(req.Context(), identityKey{}, identity)
+		ctx = log.WithFields(ctx, log.Fields{"originating_identity": identity.String()})
+		handler.ServeHTTP(rw, req.WithContext(ctx))
+	})
+}
@@ -0,0 +1,106 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/JamesClonk/compose-broker/log"
+	"github.com/JamesClonk/compose-broker/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+}
+
+func TestBroker_ParseOriginatingIdentity(t *testing.T) {
+	// {"user_id": "683ea748-3092-4ff4-b656-39cacc4d5360"}
+	identity, err := parseOriginatingIdentity("cloudfoundry eyJ1c2VyX2lkIjogIjY4M2VhNzQ4LTMwOTItNGZmNC1iNjU2LTM5Y2FjYzRkNTM2MCJ9")
+	assert.NoError(t, err)
+	assert.Equal(t, &OriginatingIdentity{Platform: "cloudfoundry", UserID: "683ea748-3092-4ff4-b656-39cacc4d5360"}, identity)
+	assert.Equal(t, "cloudfoundry user 683ea748-3092-4ff4-b656-39cacc4d5360", identity.String())
+
+	// {"username": "duke", "uid": "c2dde242-5ce4-11e7-988c-000c2946f14f", "groups": ["admin", "dev"]}
+	identity, err = parseOriginatingIdentity("kubernetes eyJ1c2VybmFtZSI6ICJkdWtlIiwgInVpZCI6ICJjMmRkZTI0Mi01Y2U0LTExZTctOTg4Yy0wMDBjMjk0NmYxNGYiLCAiZ3JvdXBzIjogWyJhZG1pbiIsICJkZXYiXX0=")
+	assert.NoError(t, err)
+	assert.Equal(t, &OriginatingIdentity{Platform: "kubernetes", UserID: "c2dde242-5ce4-11e7-988c-000c2946f14f", Username: "duke"}, identity)
+	assert.Equal(t, "kubernetes user duke", identity.String())
+
+	for _, header := range []string{
+		"",
+		"cloudfoundry",
+		"cloudfoundry !!!",
+		"cloudfoundry bm90IGpzb24=", // not json
+		"cloudfoundry e30=",         // {}
+	} {
+		_, err = parseOriginatingIdentity(header)
+		assert.Error(t, err, header)
+	}
+}
+
+func TestBroker_OriginatingIdentity(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "POST", Path: "/deployments", Code: 202, Body: util.Body("../_fixtures/api_create_deployment_for_service_provisioning.json"), Test: func(body string) {
+			assert.Contains(t, body, `"notes":"9b4ee86b-3876-469f-a531-062e71bc5859-d6222855-17c6-448c-885a-e9d931cd221b provisioned by cloudfoundry user 683ea748-3092-4ff4-b656-39cacc4d5360"`)
+		}},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	r := NewRouter(b)
+
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	defer log.SetOutput(ioutil.Discard)
+
+	provisioning := ServiceInstanceProvisioning{
+		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
+		PlanID:    "d6222855-17c6-448c-885a-e9d931cd221b",
+	}
+	data, _ := json.MarshalIndent(provisioning, "", "  ")
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("PUT", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26?accepts_incomplete=true", bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	req.Header.Set("X-Broker-API-Originating-Identity", "cloudfoundry eyJ1c2VyX2lkIjogIjY4M2VhNzQ4LTMwOTItNGZmNC1iNjU2LTM5Y2FjYzRkNTM2MCJ9")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 202, rec.Code)
+	assert.Contains(t, output.String(), `originating_identity="cloudfoundry user 683ea748-3092-4ff4-b656-39cacc4d5360"`)
+
+	// the deployment is still recognized by its notes
+	service, plan := b.planFromNotes("9b4ee86b-3876-469f-a531-062e71bc5859-d6222855-17c6-448c-885a-e9d931cd221b provisioned by cloudfoundry user 683ea748-3092-4ff4-b656-39cacc4d5360")
+	if assert.NotNil(t, plan) {
+		assert.Equal(t, "9b4ee86b-3876-469f-a531-062e71bc5859", service.ID)
+		assert.Equal(t, "d6222855-17c6-448c-885a-e9d931cd221b", plan.ID)
+	}
+}
+
+func TestBroker_OriginatingIdentity_Invalid(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/databases", Code: 200, Body: util.Body("../_fixtures/api_get_databases.json"), Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/v2/catalog", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	req.Header.Set("X-Broker-API-Originating-Identity", "cloudfoundry yolo")
+
+	// the header is optional, an invalid one is ignored
+	NewRouter(NewBroker(util.TestConfig(apiServer.URL))).ServeHTTP(rec, req)
+	assert.Equal(t, 200, rec.Code)
+}
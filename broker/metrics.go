@@ -0,0 +1,83 @@
+package broker
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/JamesClonk/compose-broker/log"
+	"github.com/JamesClonk/compose-broker/metrics"
+	"github.com/gorilla/mux"
+)
+
+// statusRecorder remembers the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Instrument counts and times all requests by route, the route being the path template and not the path itself
+func (b *Broker) Instrument(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		route := req.URL.Path
+		if current := mux.CurrentRoute(req); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: rw, code: http.StatusOK}
+		handler.ServeHTTP(recorder, req)
+
+		metrics.HTTPRequestDuration.WithLabelValues(route, req.Method).Observe(time.Since(start).Seconds())
+		metrics.HTTPRequests.WithLabelValues(route, req.Method, strconv.Itoa(recorder.code)).Inc()
+	})
+}
+
+// updateDeploymentMetrics replaces the deployment gauges with what is currently known about the deployments
+func (b *Broker) updateDeploymentMetrics(managed []managedDeployment) {
+	metrics.Deployments.Reset()
+	metrics.AllocatedUnits.Reset()
+	metrics.RecipesInProgress.Reset()
+
+	for _, m := range managed {
+		service, plan := m.Service.Name, m.Plan.Name
+		if len(service) == 0 {
+			service = m.Service.ID
+		}
+		if len(plan) == 0 {
+			plan = m.Plan.ID
+		}
+
+		metrics.Deployments.WithLabelValues(service, plan).Inc()
+		metrics.RecipesInProgress.WithLabelValues(service, plan).Add(0)
+		if m.Scaling != nil {
+			metrics.AllocatedUnits.WithLabelValues(service, plan).Add(float64(m.Scaling.AllocatedUnits))
+		}
+		for _, recipe := range m.Recipes {
+			if recipe.Status == "running" || recipe.Status == "waiting" {
+				metrics.RecipesInProgress.WithLabelValues(service, plan).Inc()
+			}
+		}
+	}
+}
+
+// watchDeployments keeps the deployment gauges up to date in the background
+func (b *Broker) watchDeployments(interval time.Duration) {
+	for range time.Tick(interval) {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		if managed, err := b.managedDeployments(ctx); err != nil {
+			log.Warnf("could not update deployment metrics: %v", err)
+		} else {
+			b.updateDeploymentMetrics(managed)
+		}
+		cancel()
+	}
+}
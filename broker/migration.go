@@ -0,0 +1,198 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/JamesClonk/compose-broker/api"
+	"github.com/JamesClonk/compose-broker/log"
+)
+
+// deploymentState describes a deployment as it currently is, or as it should be after a plan change,
+// empty values are unknown and therefore not compared
+type deploymentState struct {
+	Type       string
+	Datacenter string
+	Version    string
+	Units      int
+	CacheMode  bool
+}
+
+// currentState collects what is known about a deployment, from the Compose.io API and from the store
+func (b *Broker) currentState(deployment *api.Deployment, scaling *api.Scaling, stored *Instance) deploymentState {
+	state := deploymentState{
+		Type:    deployment.Type,
+		Version: deployment.Version,
+		Units:   scaling.AllocatedUnits,
+	}
+	if stored == nil {
+		return state
+	}
+
+	// datacenter and cache mode can't be read from the API, they are whatever the instance was provisioned with
+	if _, plan := b.ServiceCatalog().Plan(stored.ServiceID, stored.PlanID); plan != nil {
+		state.Datacenter = plan.Metadata.Datacenter
+		state.CacheMode = plan.Metadata.CacheMode
+	}
+	var parameters struct {
+		Datacenter string `json:"datacenter"`
+		CacheMode  bool   `json:"cache_mode"`
+	}
+	if err := json.Unmarshal(stored.Parameters, &parameters); err == nil {
+		if len(parameters.Datacenter) > 0 {
+			state.Datacenter = parameters.Datacenter
+		}
+		if parameters.CacheMode {
+			state.CacheMode = true
+		}
+	}
+	if len(state.Datacenter) == 0 {
+		state.Datacenter = b.APIConfig.DefaultDatacenter
+	}
+	return state
+}
+
+// targetState is the deployment as described by a service plan
+func (b *Broker) targetState(service *Service, plan *ServicePlan) deploymentState {
+	state := deploymentState{
+		Type:       service.Name,
+		Datacenter: plan.Metadata.Datacenter,
+		Version:    plan.Metadata.Version,
+		Units:      plan.Metadata.Units,
+		CacheMode:  plan.Metadata.CacheMode,
+	}
+	if len(state.Datacenter) == 0 {
+		state.Datacenter = b.APIConfig.DefaultDatacenter
+	}
+	return state
+}
+
+// migrationSteps compares both states and returns the steps needed to get from one to the other,
+// or an error describing why the deployment can't be migrated at all
+func migrationSteps(current, target deploymentState, compareCacheMode bool) ([]Step, error) {
+	if len(target.Type) > 0 && len(current.Type) > 0 && target.Type != current.Type {
+		return nil, fmt.Errorf("Cannot change a %s deployment into %s", current.Type, target.Type)
+	}
+	if len(target.Datacenter) > 0 && len(current.Datacenter) > 0 && target.Datacenter != current.Datacenter {
+		return nil, fmt.Errorf("Cannot move a deployment from datacenter %s to %s", current.Datacenter, target.Datacenter)
+	}
+	if compareCacheMode && target.CacheMode != current.CacheMode {
+		return nil, fmt.Errorf("Cache mode can only be chosen when a deployment is created")
+	}
+
+	steps := make([]Step, 0)
+	if target.Units > 0 && target.Units != current.Units {
+		steps = append(steps, Step{Units: target.Units})
+	}
+	if len(target.Version) > 0 && !sameVersion(current.Version, target.Version) {
+		steps = append(steps, Step{Version: target.Version})
+	}
+	return steps, nil
+}
+
+// sameVersion treats a plan version like "9.6" as satisfied by any deployment version "9.6.x"
+func sameVersion(current, target string) bool {
+	return current == target || strings.HasPrefix(current, target+".")
+}
+
+// checkVersion verifies that a deployment can be upgraded to the given version, it returns the reason why not,
+// or an error if the Compose.io API could not be asked
+func (b *Broker) checkVersion(ctx context.Context, deployment *api.Deployment, version string) (string, error) {
+	databases, err := b.Client.GetDatabasesContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	available := false
+	for _, database := range databases {
+		if database.DatabaseType != deployment.Type {
+			continue
+		}
+		for _, v := range database.Embedded.Versions {
+			if sameVersion(v.Version, version) && v.Status != "deprecated" {
+				available = true
+			}
+		}
+	}
+	if !available {
+		return fmt.Sprintf("Version %s is not available for %s", version, deployment.Type), nil
+	}
+
+	transitions, err := b.Client.GetVersionTransitionsContext(ctx, deployment.ID)
+	if err != nil {
+		return "", err
+	}
+	versions := make([]string, 0)
+	for _, transition := range transitions {
+		if sameVersion(transition.ToVersion, version) {
+			return "", nil
+		}
+		versions = append(versions, transition.ToVersion)
+	}
+	if len(versions) == 0 {
+		return fmt.Sprintf("There are no upgrades available for version %s", deployment.Version), nil
+	}
+	return fmt.Sprintf("Cannot upgrade from version %s to %s, possible versions are: %s", deployment.Version, version, strings.Join(versions, ", ")), nil
+}
+
+func (b *Broker) startStep(ctx context.Context, deploymentID string, step Step) (*api.Recipe, error) {
+	if step.Backup {
+		return b.Client.StartBackupContext(ctx, deploymentID)
+	}
+	if len(step.WhitelistAdd) > 0 && len(step.WhitelistBinding) > 0 {
+		return b.Client.AddWhitelistContext(ctx, deploymentID, step.WhitelistAdd, bindingWhitelistDescription(step.WhitelistBinding))
+	}
+	if len(step.WhitelistAdd) > 0 {
+		return b.Client.AddWhitelistContext(ctx, deploymentID, step.WhitelistAdd, whitelistDescription)
+	}
+	if len(step.WhitelistRemove) > 0 {
+		return b.Client.DeleteWhitelistContext(ctx, deploymentID, step.WhitelistRemove)
+	}
+	if len(step.Version) > 0 {
+		return b.Client.UpdateVersionContext(ctx, deploymentID, step.Version)
+	}
+	return b.Client.UpdateScalingContext(ctx, deploymentID, step.Units)
+}
+
+// continueMigration starts the next pending step of an operation once the current recipe has completed,
+// it returns the recipe that is now the current one
+func (b *Broker) continueMigration(ctx context.Context, operation *Operation, deploymentID string, recipe *api.Recipe) (*api.Recipe, error) {
+	for recipe.Status == "complete" && len(operation.Steps) > 0 {
+		next, err := b.startStep(ctx, deploymentID, operation.Steps[0])
+		if err != nil {
+			return recipe, err
+		}
+		log.Ctx(ctx).Infof("started next step of %s operation %s for service instance %s: %s", operation.Type, operation.ID, operation.InstanceID, next.Name)
+
+		operation.RecipeID = next.ID
+		operation.Steps = operation.Steps[1:]
+		if err := b.Store.PutOperation(*operation); err != nil {
+			log.Ctx(ctx).Warnf("could not save %s operation %s of service instance %s to store: %v", operation.Type, operation.ID, operation.InstanceID, err)
+		}
+		recipe = next
+	}
+	return recipe, nil
+}
+
+// saveSteps remembers an operation together with the steps that still have to follow its recipe,
+// and the update that is only applied to the service instance after the last of them
+func (b *Broker) saveSteps(ctx context.Context, operationType, instanceID, recipeID string, steps []Step, update *ServiceInstanceUpdate) *Operation {
+	operation := &Operation{
+		ID:         recipeID,
+		Type:       operationType,
+		InstanceID: instanceID,
+		RecipeID:   recipeID,
+		Steps:      steps,
+		Update:     update,
+		CreatedAt:  time.Now(),
+	}
+	if len(recipeID) == 0 {
+		return operation
+	}
+	if err := b.Store.PutOperation(*operation); err != nil {
+		log.Ctx(ctx).Warnf("could not save %s operation %s of service instance %s to store: %v", operationType, recipeID, instanceID, err)
+	}
+	return operation
+}
@@ -0,0 +1,44 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBroker_MigrationSteps(t *testing.T) {
+	current := deploymentState{Type: "postgresql", Datacenter: "gce:europe-west1", Version: "9.6.3", Units: 4}
+
+	steps, err := migrationSteps(current, deploymentState{Type: "postgresql", Datacenter: "gce:europe-west1", Units: 4}, true)
+	assert.NoError(t, err)
+	assert.Len(t, steps, 0)
+
+	steps, err = migrationSteps(current, deploymentState{Type: "postgresql", Datacenter: "gce:europe-west1", Version: "9.6", Units: 4}, true)
+	assert.NoError(t, err)
+	assert.Len(t, steps, 0)
+
+	steps, err = migrationSteps(current, deploymentState{Type: "postgresql", Datacenter: "gce:europe-west1", Version: "9.6.12", Units: 2}, true)
+	assert.NoError(t, err)
+	assert.Equal(t, []Step{Step{Units: 2}, Step{Version: "9.6.12"}}, steps)
+
+	steps, err = migrationSteps(current, deploymentState{Units: 6}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []Step{Step{Units: 6}}, steps)
+}
+
+func TestBroker_MigrationSteps_Impossible(t *testing.T) {
+	current := deploymentState{Type: "postgresql", Datacenter: "gce:europe-west1", Version: "9.6.3", Units: 4}
+
+	_, err := migrationSteps(current, deploymentState{Type: "redis", Datacenter: "gce:europe-west1", Units: 4}, true)
+	assert.EqualError(t, err, "Cannot change a postgresql deployment into redis")
+
+	_, err = migrationSteps(current, deploymentState{Type: "postgresql", Datacenter: "aws:eu-central-1", Units: 4}, true)
+	assert.EqualError(t, err, "Cannot move a deployment from datacenter gce:europe-west1 to aws:eu-central-1")
+
+	_, err = migrationSteps(current, deploymentState{Type: "postgresql", Datacenter: "gce:europe-west1", Units: 4, CacheMode: true}, true)
+	assert.EqualError(t, err, "Cache mode can only be chosen when a deployment is created")
+
+	// cache mode of a deployment without stored plan is unknown
+	_, err = migrationSteps(current, deploymentState{Type: "postgresql", Units: 4, CacheMode: true}, false)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,141 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/JamesClonk/compose-broker/api"
+	"github.com/JamesClonk/compose-broker/log"
+	"github.com/JamesClonk/compose-broker/metrics"
+)
+
+// deployments of service instances are named after the instance ID, which the platform always generates as a GUID
+var instanceIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// Orphan is a deployment of a service instance that nobody owns anymore, but is still running and billed
+type Orphan struct {
+	DeploymentID string `json:"deployment_id"`
+	Name         string `json:"name"`
+	Reason       string `json:"reason"`
+}
+
+// findOrphans looks for deployments of service instances in the store whose provisioning has failed,
+// whose provisioning the platform has given up on, or which were created even though the Compose.io API did not tell us so
+func (b *Broker) findOrphans(ctx context.Context) ([]Orphan, error) {
+	deployments, err := b.Client.GetDeploymentsContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	orphans := make([]Orphan, 0)
+	for _, deployment := range deployments {
+		if !instanceIDPattern.MatchString(deployment.Name) {
+			continue
+		}
+
+		// deployments the store has never heard of are left alone, they might belong to another service broker
+		stored, err := b.Store.GetInstance(deployment.Name)
+		if err != nil {
+			continue
+		}
+
+		recipes, err := b.Client.GetRecipesContext(ctx, deployment.ID)
+		if err != nil {
+			if api.IsNotFound(err) {
+				continue // already gone
+			}
+			return nil, err
+		}
+		busy := false
+		for _, recipe := range recipes {
+			if recipe.Status == "running" || recipe.Status == "waiting" {
+				busy = true
+			}
+		}
+		if busy {
+			continue
+		}
+
+		if provision := provisionRecipe(recipes); provision != nil && provision.Status == "failed" {
+			orphans = append(orphans, Orphan{
+				DeploymentID: deployment.ID,
+				Name:         deployment.Name,
+				Reason:       fmt.Sprintf("provision recipe %s failed", provision.ID),
+			})
+			continue
+		}
+		if stored.Abandoned {
+			orphans = append(orphans, Orphan{
+				DeploymentID: deployment.ID,
+				Name:         deployment.Name,
+				Reason:       "the platform gave up on provisioning it",
+			})
+		} else if len(stored.DeploymentID) == 0 && time.Since(deployment.CreatedAt) > b.Orphans.GracePeriod {
+			orphans = append(orphans, Orphan{
+				DeploymentID: deployment.ID,
+				Name:         deployment.Name,
+				Reason:       "creating it seemingly failed",
+			})
+		}
+	}
+	return orphans, nil
+}
+
+// provisionRecipe returns the most recent recipe that provisioned a deployment, if there is any
+func provisionRecipe(recipes api.Recipes) *api.Recipe {
+	for i, recipe := range recipes {
+		if recipe.Name == "Provision" {
+			return &recipes[i] // recipes are sorted by most recently updated first
+		}
+	}
+	return nil
+}
+
+// mitigateOrphans deletes all orphaned deployments, or only logs them in dry-run mode
+func (b *Broker) mitigateOrphans(ctx context.Context, dryRun bool) ([]Orphan, error) {
+	orphans, err := b.findOrphans(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, orphan := range orphans {
+		if dryRun {
+			log.Ctx(ctx).Warnf("dry-run: would delete orphaned deployment %s of service instance %s: %s", orphan.DeploymentID, orphan.Name, orphan.Reason)
+			metrics.OrphanedDeployments.WithLabelValues("dry_run").Inc()
+			continue
+		}
+
+		log.Ctx(ctx).Warnf("deleting orphaned deployment %s of service instance %s: %s", orphan.DeploymentID, orphan.Name, orphan.Reason)
+		if _, err := b.Client.DeleteDeploymentContext(ctx, orphan.DeploymentID); err != nil && !api.IsNotFound(err) {
+			log.Ctx(ctx).Errorf("could not delete orphaned deployment %s of service instance %s: %v", orphan.DeploymentID, orphan.Name, err)
+			metrics.OrphanedDeployments.WithLabelValues("failure").Inc()
+			continue
+		}
+		if err := b.Store.DeleteInstance(orphan.Name); err != nil {
+			log.Ctx(ctx).Warnf("could not remove service instance %s from store: %v", orphan.Name, err)
+		}
+		log.Ctx(ctx).Infof("deleted orphaned deployment %s of service instance %s", orphan.DeploymentID, orphan.Name)
+		metrics.OrphanedDeployments.WithLabelValues("deleted").Inc()
+	}
+	return orphans, nil
+}
+
+// ReconcileOrphans keeps looking for orphaned deployments in the background, until stop is closed
+func (b *Broker) ReconcileOrphans(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			if _, err := b.mitigateOrphans(ctx, b.Orphans.DryRun); err != nil {
+				log.Warnf("could not look for orphaned deployments: %v", err)
+			}
+			cancel()
+		}
+	}
+}
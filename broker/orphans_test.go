@@ -0,0 +1,125 @@
+package broker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/JamesClonk/compose-broker/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func orphanTestCases(deleted func(string)) []util.HttpTestCase {
+	return []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments", Code: 200, Body: util.Body("../_fixtures/api_get_deployments_for_orphans.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5c1d4e2f3a4b5c001a3e7001/recipes", Code: 200, Body: util.Body("../_fixtures/api_get_recipes_for_failed_provision.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5c1d4e2f3a4b5c001a3e7002/recipes", Code: 200, Body: util.Body("../_fixtures/api_get_recipes_for_last_operation_succeeded.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5c1d4e2f3a4b5c001a3e7003/recipes", Code: 200, Body: util.Body("../_fixtures/api_get_recipes_for_last_operation_succeeded.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5c1d4e2f3a4b5c001a3e7004/recipes", Code: 200, Body: util.Body("../_fixtures/api_get_recipes_for_last_operation_succeeded.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5c1d4e2f3a4b5c001a3e7005/recipes", Code: 200, Body: util.Body("../_fixtures/api_get_recipes_for_service_provision_in_progress.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5c1d4e2f3a4b5c001a3e7007/recipes", Code: 200, Body: util.Body("../_fixtures/api_get_recipes_for_last_operation_succeeded.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5c1d4e2f3a4b5c001a3e7006/recipes", Code: 500, Body: "", Test: func(string) {
+			deleted("deployments not named after a service instance must be ignored")
+		}},
+		util.HttpTestCase{Method: "DELETE", Path: "/deployments/5c1d4e2f3a4b5c001a3e7001", Code: 202, Body: util.Body("../_fixtures/api_delete_deployment_for_service_deprovision.json"), Test: func(string) {
+			deleted("5c1d4e2f3a4b5c001a3e7001")
+		}},
+		util.HttpTestCase{Method: "DELETE", Path: "/deployments/5c1d4e2f3a4b5c001a3e7002", Code: 202, Body: util.Body("../_fixtures/api_delete_deployment_for_service_deprovision.json"), Test: func(string) {
+			deleted("5c1d4e2f3a4b5c001a3e7002")
+		}},
+		util.HttpTestCase{Method: "DELETE", Path: "/deployments/5c1d4e2f3a4b5c001a3e7003", Code: 202, Body: util.Body("../_fixtures/api_delete_deployment_for_service_deprovision.json"), Test: func(string) {
+			deleted("5c1d4e2f3a4b5c001a3e7003")
+		}},
+	}
+}
+
+// storeOrphanTestInstances puts the service instances of the deployments in api_get_deployments_for_orphans.json into the store
+func storeOrphanTestInstances(b *Broker) {
+	b.saveInstance(context.Background(), Instance{ID: "0f6c1a7e-2b3d-4c5e-8f9a-1b2c3d4e5f01", DeploymentID: "5c1d4e2f3a4b5c001a3e7001"})
+	b.saveInstance(context.Background(), Instance{ID: "0f6c1a7e-2b3d-4c5e-8f9a-1b2c3d4e5f02"}) // creation failed
+	b.saveInstance(context.Background(), Instance{ID: "0f6c1a7e-2b3d-4c5e-8f9a-1b2c3d4e5f03", DeploymentID: "5c1d4e2f3a4b5c001a3e7003", Abandoned: true})
+	b.saveInstance(context.Background(), Instance{ID: "0f6c1a7e-2b3d-4c5e-8f9a-1b2c3d4e5f04"}) // creation failed, but still within grace period
+	b.saveInstance(context.Background(), Instance{ID: "0f6c1a7e-2b3d-4c5e-8f9a-1b2c3d4e5f05", DeploymentID: "5c1d4e2f3a4b5c001a3e7005", Abandoned: true})
+	b.saveInstance(context.Background(), Instance{ID: "0f6c1a7e-2b3d-4c5e-8f9a-1b2c3d4e5f07", DeploymentID: "5c1d4e2f3a4b5c001a3e7007"})
+}
+
+func TestBroker_FindOrphans(t *testing.T) {
+	apiServer := util.TestServer("deadbeef", orphanTestCases(func(msg string) { t.Error(msg) }))
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+
+	// deployments unknown to the store are never orphans, not even if their provisioning failed
+	orphans, err := b.findOrphans(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, orphans)
+}
+
+func TestBroker_FindOrphans_Store(t *testing.T) {
+	apiServer := util.TestServer("deadbeef", orphanTestCases(func(msg string) { t.Error(msg) }))
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	b.Orphans.GracePeriod = time.Hour
+	storeOrphanTestInstances(b)
+
+	orphans, err := b.findOrphans(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []Orphan{
+		Orphan{DeploymentID: "5c1d4e2f3a4b5c001a3e7001", Name: "0f6c1a7e-2b3d-4c5e-8f9a-1b2c3d4e5f01", Reason: "provision recipe 5c1d4e2f3a4b5c001a3e7101 failed"},
+		Orphan{DeploymentID: "5c1d4e2f3a4b5c001a3e7002", Name: "0f6c1a7e-2b3d-4c5e-8f9a-1b2c3d4e5f02", Reason: "creating it seemingly failed"},
+		Orphan{DeploymentID: "5c1d4e2f3a4b5c001a3e7003", Name: "0f6c1a7e-2b3d-4c5e-8f9a-1b2c3d4e5f03", Reason: "the platform gave up on provisioning it"},
+	}, orphans)
+}
+
+func TestBroker_MitigateOrphans(t *testing.T) {
+	deleted := make([]string, 0)
+	apiServer := util.TestServer("deadbeef", orphanTestCases(func(msg string) { deleted = append(deleted, msg) }))
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	b.Orphans.GracePeriod = time.Hour
+	storeOrphanTestInstances(b)
+
+	orphans, err := b.mitigateOrphans(context.Background(), false)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(orphans))
+	assert.Equal(t, []string{"5c1d4e2f3a4b5c001a3e7001", "5c1d4e2f3a4b5c001a3e7002", "5c1d4e2f3a4b5c001a3e7003"}, deleted)
+
+	_, err = b.Store.GetInstance("0f6c1a7e-2b3d-4c5e-8f9a-1b2c3d4e5f03")
+	assert.Equal(t, ErrNotFound, err)
+	_, err = b.Store.GetInstance("0f6c1a7e-2b3d-4c5e-8f9a-1b2c3d4e5f07")
+	assert.NoError(t, err)
+}
+
+func TestBroker_MitigateOrphans_DryRun(t *testing.T) {
+	apiServer := util.TestServer("deadbeef", orphanTestCases(func(msg string) {
+		t.Errorf("must not delete anything in dry-run mode: %s", msg)
+	}))
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	b.Orphans.GracePeriod = time.Hour
+	storeOrphanTestInstances(b)
+
+	orphans, err := b.mitigateOrphans(context.Background(), true)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(orphans))
+
+	_, err = b.Store.GetInstance("0f6c1a7e-2b3d-4c5e-8f9a-1b2c3d4e5f03")
+	assert.NoError(t, err)
+}
+
+func TestBroker_ReconcileOrphans(t *testing.T) {
+	b := NewBroker(util.TestConfig(""))
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		b.ReconcileOrphans(time.Hour, stop)
+		close(stopped)
+	}()
+
+	close(stop)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Error("must stop looking for orphaned deployments")
+	}
+}
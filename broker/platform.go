@@ -0,0 +1,140 @@
+package broker
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PlatformContext is where on the platform a service instance lives, as given by the context object of a request,
+// the json keys are those of the cloudfoundry and kubernetes profiles of the Open Service Broker API
+type PlatformContext struct {
+	Platform         string `json:"platform"`
+	OrganizationGUID string `json:"organization_guid,omitempty"` // cloudfoundry
+	OrganizationName string `json:"organization_name,omitempty"` // cloudfoundry
+	SpaceGUID        string `json:"space_guid,omitempty"`        // cloudfoundry
+	SpaceName        string `json:"space_name,omitempty"`        // cloudfoundry
+	Namespace        string `json:"namespace,omitempty"`         // kubernetes
+	ClusterID        string `json:"clusterid,omitempty"`         // kubernetes
+	InstanceName     string `json:"instance_name,omitempty"`
+}
+
+// platformContext combines the context object of a provisioning request with the deprecated organization_guid and space_guid
+// fields, which older platforms send instead, it returns nil if the platform did not tell where the service instance lives
+func platformContext(provisioning ServiceInstanceProvisioning) *PlatformContext {
+	platform := &PlatformContext{}
+	if provisioning.Context != nil {
+		*platform = *provisioning.Context
+	}
+	if len(platform.OrganizationGUID) == 0 {
+		platform.OrganizationGUID = provisioning.OrganizationGUID
+	}
+	if len(platform.SpaceGUID) == 0 {
+		platform.SpaceGUID = provisioning.SpaceGUID
+	}
+	if len(platform.Platform) == 0 && (len(platform.OrganizationGUID) > 0 || len(platform.SpaceGUID) > 0) {
+		platform.Platform = "cloudfoundry"
+	}
+	if len(platform.Platform) == 0 {
+		return nil
+	}
+	return platform
+}
+
+// updatePlatformContext applies the context object of an update request to the stored one, keeping what it leaves out
+func updatePlatformContext(stored *PlatformContext, update PlatformContext) *PlatformContext {
+	if stored == nil {
+		return &update
+	}
+	platform := *stored
+	for _, field := range []struct {
+		value  *string
+		update string
+	}{
+		{&platform.Platform, update.Platform},
+		{&platform.OrganizationGUID, update.OrganizationGUID},
+		{&platform.OrganizationName, update.OrganizationName},
+		{&platform.SpaceGUID, update.SpaceGUID},
+		{&platform.SpaceName, update.SpaceName},
+		{&platform.Namespace, update.Namespace},
+		{&platform.ClusterID, update.ClusterID},
+		{&platform.InstanceName, update.InstanceName},
+	} {
+		if len(field.update) > 0 {
+			*field.value = field.update
+		}
+	}
+	return &platform
+}
+
+// Organization is the name of the organization or namespace, or its GUID if the name is not known
+func (p PlatformContext) Organization() string {
+	if len(p.Namespace) > 0 {
+		return p.Namespace
+	}
+	if len(p.OrganizationName) > 0 {
+		return p.OrganizationName
+	}
+	return p.OrganizationGUID
+}
+
+// Space is the name of the space or namespace, or its GUID if the name is not known
+func (p PlatformContext) Space() string {
+	if len(p.Namespace) > 0 {
+		return p.Namespace
+	}
+	if len(p.SpaceName) > 0 {
+		return p.SpaceName
+	}
+	return p.SpaceGUID
+}
+
+// Scope identifies the space or namespace of a service instance, service instances in the same scope may share backups
+func (p PlatformContext) Scope() string {
+	if len(p.Namespace) > 0 {
+		return fmt.Sprintf("%s/%s", p.ClusterID, p.Namespace)
+	}
+	return p.SpaceGUID
+}
+
+func (p PlatformContext) String() string {
+	if len(p.Namespace) > 0 {
+		if len(p.ClusterID) > 0 {
+			return fmt.Sprintf("namespace %s of cluster %s", p.Namespace, p.ClusterID)
+		}
+		return fmt.Sprintf("namespace %s", p.Namespace)
+	}
+	return fmt.Sprintf("space %s of organization %s", p.Space(), p.Organization())
+}
+
+// billingCode fills in the placeholders of the configured customer billing code template for a new deployment
+func billingCode(template string, p *PlatformContext) string {
+	if p == nil {
+		p = &PlatformContext{}
+	}
+	return strings.NewReplacer(
+		"{platform}", p.Platform,
+		"{organization_guid}", p.OrganizationGUID,
+		"{organization_name}", p.Organization(),
+		"{space_guid}", p.SpaceGUID,
+		"{space_name}", p.Space(),
+		"{namespace}", p.Namespace,
+		"{cluster_id}", p.ClusterID,
+		"{instance_name}", p.InstanceName,
+	).Replace(template)
+}
+
+// platform is where a stored service instance lives, service instances stored before the context was kept only know their GUIDs
+func (i Instance) platform() *PlatformContext {
+	if i.Context != nil || (len(i.OrganizationGUID) == 0 && len(i.SpaceGUID) == 0) {
+		return i.Context
+	}
+	return &PlatformContext{Platform: "cloudfoundry", OrganizationGUID: i.OrganizationGUID, SpaceGUID: i.SpaceGUID}
+}
+
+// scope is the space or namespace of a stored service instance, see PlatformContext.Scope
+func (i Instance) scope() string {
+	if i.Context != nil {
+		return i.Context.Scope()
+	}
+	return i.SpaceGUID
+}
@@ -0,0 +1,222 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/JamesClonk/compose-broker/log"
+	"github.com/JamesClonk/compose-broker/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+}
+
+func TestBroker_PlatformContext(t *testing.T) {
+	var provisioning ServiceInstanceProvisioning
+	err := json.Unmarshal([]byte(`{
+		"service_id": "9b4ee86b-3876-469f-a531-062e71bc5859",
+		"plan_id": "d6222855-17c6-448c-885a-e9d931cd221b",
+		"organization_guid": "7c3a5f2e-9b41-4d8e-a6f0-1e2d3c4b5a69",
+		"space_guid": "1b6f5f44-0b51-4a2e-8f0e-bc7c1d0b5d3e",
+		"context": {
+			"platform": "cloudfoundry",
+			"organization_guid": "7c3a5f2e-9b41-4d8e-a6f0-1e2d3c4b5a69",
+			"organization_name": "acme",
+			"space_guid": "1b6f5f44-0b51-4a2e-8f0e-bc7c1d0b5d3e",
+			"space_name": "dev",
+			"instance_name": "my-db"
+		}
+	}`), &provisioning)
+	assert.NoError(t, err)
+	platform := platformContext(provisioning)
+	if assert.NotNil(t, platform) {
+		assert.Equal(t, "acme", platform.Organization())
+		assert.Equal(t, "dev", platform.Space())
+		assert.Equal(t, "1b6f5f44-0b51-4a2e-8f0e-bc7c1d0b5d3e", platform.Scope())
+		assert.Equal(t, "space dev of organization acme", platform.String())
+		assert.Equal(t, "acme-dev-my-db", billingCode("{organization_name}-{space_name}-{instance_name}", platform))
+	}
+
+	// older platforms only send the GUIDs
+	platform = platformContext(ServiceInstanceProvisioning{
+		OrganizationGUID: "7c3a5f2e-9b41-4d8e-a6f0-1e2d3c4b5a69",
+		SpaceGUID:        "1b6f5f44-0b51-4a2e-8f0e-bc7c1d0b5d3e",
+	})
+	if assert.NotNil(t, platform) {
+		assert.Equal(t, "cloudfoundry", platform.Platform)
+		assert.Equal(t, "space 1b6f5f44-0b51-4a2e-8f0e-bc7c1d0b5d3e of organization 7c3a5f2e-9b41-4d8e-a6f0-1e2d3c4b5a69", platform.String())
+	}
+
+	err = json.Unmarshal([]byte(`{
+		"service_id": "9b4ee86b-3876-469f-a531-062e71bc5859",
+		"plan_id": "d6222855-17c6-448c-885a-e9d931cd221b",
+		"context": {
+			"platform": "kubernetes",
+			"namespace": "shop",
+			"clusterid": "8263feba-9b8a-23ae-99ed-abcd1234feda"
+		}
+	}`), &provisioning)
+	assert.NoError(t, err)
+	platform = platformContext(provisioning)
+	if assert.NotNil(t, platform) {
+		assert.Equal(t, "shop", platform.Organization())
+		assert.Equal(t, "shop", platform.Space())
+		assert.Equal(t, "8263feba-9b8a-23ae-99ed-abcd1234feda/shop", platform.Scope())
+		assert.Equal(t, "namespace shop of cluster 8263feba-9b8a-23ae-99ed-abcd1234feda", platform.String())
+	}
+
+	assert.Nil(t, platformContext(ServiceInstanceProvisioning{}))
+	assert.Equal(t, "compose-", billingCode("compose-{organization_name}", nil))
+}
+
+func TestBroker_UpdatePlatformContext(t *testing.T) {
+	stored := &PlatformContext{
+		Platform:         "cloudfoundry",
+		OrganizationGUID: "7c3a5f2e-9b41-4d8e-a6f0-1e2d3c4b5a69",
+		OrganizationName: "acme",
+		SpaceGUID:        "1b6f5f44-0b51-4a2e-8f0e-bc7c1d0b5d3e",
+		SpaceName:        "dev",
+	}
+	updated := updatePlatformContext(stored, PlatformContext{Platform: "cloudfoundry", OrganizationName: "acme-corp", InstanceName: "my-db"})
+	assert.Equal(t, &PlatformContext{
+		Platform:         "cloudfoundry",
+		OrganizationGUID: "7c3a5f2e-9b41-4d8e-a6f0-1e2d3c4b5a69",
+		OrganizationName: "acme-corp",
+		SpaceGUID:        "1b6f5f44-0b51-4a2e-8f0e-bc7c1d0b5d3e",
+		SpaceName:        "dev",
+		InstanceName:     "my-db",
+	}, updated)
+	assert.Equal(t, "acme", stored.OrganizationName)
+
+	assert.Equal(t, &PlatformContext{Platform: "kubernetes", Namespace: "shop"}, updatePlatformContext(nil, PlatformContext{Platform: "kubernetes", Namespace: "shop"}))
+}
+
+func TestBroker_ProvisionServiceInstance_WithPlatformContext(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "POST", Path: "/deployments", Code: 202, Body: util.Body("../_fixtures/api_create_deployment_for_service_provisioning.json"), Test: func(body string) {
+			assert.Contains(t, body, `"notes":"9b4ee86b-3876-469f-a531-062e71bc5859-d6222855-17c6-448c-885a-e9d931cd221b for my-db in space dev of organization acme"`)
+			assert.Contains(t, body, `"customer_billing_code":"cf-acme"`)
+		}},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	c := util.TestConfig(apiServer.URL)
+	c.API.BillingCode = "cf-{organization_name}"
+	b := NewBroker(c)
+	r := NewRouter(b)
+
+	provisioning := ServiceInstanceProvisioning{
+		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
+		PlanID:    "d6222855-17c6-448c-885a-e9d931cd221b",
+		Context: &PlatformContext{
+			Platform:         "cloudfoundry",
+			OrganizationGUID: "7c3a5f2e-9b41-4d8e-a6f0-1e2d3c4b5a69",
+			OrganizationName: "acme",
+			SpaceGUID:        "1b6f5f44-0b51-4a2e-8f0e-bc7c1d0b5d3e",
+			SpaceName:        "dev",
+			InstanceName:     "my-db",
+		},
+	}
+	data, _ := json.MarshalIndent(provisioning, "", "  ")
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("PUT", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26?accepts_incomplete=true", bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 202, rec.Code)
+
+	instance, err := b.Store.GetInstance("8dcdf609-36c9-4b22-bb16-d97e48c50f26")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "7c3a5f2e-9b41-4d8e-a6f0-1e2d3c4b5a69", instance.OrganizationGUID)
+		assert.Equal(t, "1b6f5f44-0b51-4a2e-8f0e-bc7c1d0b5d3e", instance.SpaceGUID)
+		assert.Equal(t, provisioning.Context, instance.Context)
+	}
+}
+
+func TestBroker_FetchServiceInstance_WithPlatformContext(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/recipes", Code: 200, Body: util.Body("../_fixtures/api_get_recipes_for_service_fetch.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/scalings", Code: 200, Body: util.Body("../_fixtures/api_get_scaling.json"), Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	_ = b.Store.PutInstance(Instance{
+		ID:           "8dcdf609-36c9-4b22-bb16-d97e48c50f26",
+		DeploymentID: "5854017e89d50f424e000192",
+		ServiceID:    "9b4ee86b-3876-469f-a531-062e71bc5859",
+		PlanID:       "d6222855-17c6-448c-885a-e9d931cd221b",
+		Context: &PlatformContext{
+			Platform:  "kubernetes",
+			Namespace: "shop",
+			ClusterID: "8263feba-9b8a-23ae-99ed-abcd1234feda",
+		},
+	})
+	r := NewRouter(b)
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 200, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"context": {
+      "platform": "kubernetes",
+      "namespace": "shop",
+      "clusterid": "8263feba-9b8a-23ae-99ed-abcd1234feda"
+    }`)
+}
+
+func TestBroker_ProvisionServiceInstance_RestoreFromBackupOfOtherNamespace(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/backups/5a3a1f5e8c3c8f001a3e4d21", Code: 200, Body: util.Body("../_fixtures/api_get_backup.json"), Test: func(body string) {
+			t.Error("must not look at backups of service instances in other namespaces")
+		}},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	_ = b.Store.PutInstance(Instance{
+		ID:           "8dcdf609-36c9-4b22-bb16-d97e48c50f26",
+		DeploymentID: "5854017e89d50f424e000192",
+		ServiceID:    "9b4ee86b-3876-469f-a531-062e71bc5859",
+		PlanID:       "d6222855-17c6-448c-885a-e9d931cd221b",
+		Context:      &PlatformContext{Platform: "kubernetes", Namespace: "shop", ClusterID: "8263feba-9b8a-23ae-99ed-abcd1234feda"},
+	})
+	r := NewRouter(b)
+
+	provisioning := ServiceInstanceProvisioning{
+		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
+		PlanID:    "d6222855-17c6-448c-885a-e9d931cd221b",
+		Context:   &PlatformContext{Platform: "kubernetes", Namespace: "billing", ClusterID: "8263feba-9b8a-23ae-99ed-abcd1234feda"},
+	}
+	provisioning.Parameters.RestoreFromBackup = "5a3a1f5e8c3c8f001a3e4d21"
+	data, _ := json.MarshalIndent(provisioning, "", "  ")
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("PUT", "/v2/service_instances/c9f2a0b4-6e1d-4f7a-9b3c-2d8e5f1a7b60?accepts_incomplete=true", bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 400, rec.Code)
+}
@@ -0,0 +1,215 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/JamesClonk/compose-broker/api"
+	"github.com/JamesClonk/compose-broker/log"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Quotas limit what the organizations, spaces and namespaces of the platform can provision
+type Quotas struct {
+	Default       *Quota           `yaml:"default,omitempty"`       // for all organizations and namespaces without their own quota
+	Organizations map[string]Quota `yaml:"organizations,omitempty"` // by organization GUID or name
+	Spaces        map[string]Quota `yaml:"spaces,omitempty"`        // by space GUID or name
+	Namespaces    map[string]Quota `yaml:"namespaces,omitempty"`    // by namespace
+}
+type Quota struct {
+	Instances int      `yaml:"instances,omitempty"` // maximum number of service instances, 0 means unlimited
+	Units     int      `yaml:"units,omitempty"`     // maximum number of units allocated by all service instances together, 0 means unlimited
+	Services  []string `yaml:"services,omitempty"`  // service IDs or names that can be provisioned, all if empty
+	Plans     []string `yaml:"plans,omitempty"`     // plan IDs or names that can be used, all if empty
+}
+
+// quotaScope is an organization, space or namespace together with the quota that applies to it
+type quotaScope struct {
+	name   string
+	quota  Quota
+	member func(instance Instance) bool
+}
+
+func LoadQuotas(filename string) *Quotas {
+	var quotas Quotas
+	if len(filename) == 0 {
+		return &quotas
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		log.Errorf("could not load %s", filename)
+		log.Fatalln(err)
+	}
+	if err := yaml.UnmarshalStrict(data, &quotas); err != nil {
+		log.Errorf("could not parse %s", filename)
+		log.Fatalln(err)
+	}
+	return &quotas
+}
+
+// scopes are all quotas that apply to a service instance, the organization or namespace it lives in and its space
+func (q *Quotas) scopes(platform *PlatformContext) []quotaScope {
+	if platform == nil {
+		return nil
+	}
+
+	scopes := make([]quotaScope, 0)
+	lookup := func(quotas map[string]Quota, keys ...string) (Quota, bool) {
+		for _, key := range keys {
+			if quota, ok := quotas[key]; ok && len(key) > 0 {
+				return quota, true
+			}
+		}
+		return Quota{}, false
+	}
+
+	if len(platform.Namespace) > 0 {
+		quota, ok := lookup(q.Namespaces, platform.Namespace)
+		if !ok && q.Default != nil {
+			quota, ok = *q.Default, true
+		}
+		if ok {
+			namespace, clusterID := platform.Namespace, platform.ClusterID
+			scopes = append(scopes, quotaScope{
+				name:  fmt.Sprintf("namespace %s", namespace),
+				quota: quota,
+				member: func(instance Instance) bool {
+					return instance.Context != nil && instance.Context.Namespace == namespace && instance.Context.ClusterID == clusterID
+				},
+			})
+		}
+		return scopes
+	}
+
+	if len(platform.OrganizationGUID) > 0 {
+		quota, ok := lookup(q.Organizations, platform.OrganizationGUID, platform.OrganizationName)
+		if !ok && q.Default != nil {
+			quota, ok = *q.Default, true
+		}
+		if ok {
+			organizationGUID := platform.OrganizationGUID
+			scopes = append(scopes, quotaScope{
+				name:  fmt.Sprintf("organization %s", platform.Organization()),
+				quota: quota,
+				member: func(instance Instance) bool {
+					return instance.OrganizationGUID == organizationGUID
+				},
+			})
+		}
+	}
+	if len(platform.SpaceGUID) > 0 {
+		if quota, ok := lookup(q.Spaces, platform.SpaceGUID, platform.SpaceName); ok {
+			spaceGUID := platform.SpaceGUID
+			scopes = append(scopes, quotaScope{
+				name:  fmt.Sprintf("space %s", platform.Space()),
+				quota: quota,
+				member: func(instance Instance) bool {
+					return instance.SpaceGUID == spaceGUID
+				},
+			})
+		}
+	}
+	return scopes
+}
+
+// allows checks whether a quota permits a service and plan, it returns why not or an empty string if it does
+func (q Quota) allows(service *Service, plan *ServicePlan) string {
+	contains := func(values []string, id, name string) bool {
+		for _, value := range values {
+			if value == id || value == name {
+				return true
+			}
+		}
+		return false
+	}
+	if len(q.Services) > 0 && !contains(q.Services, service.ID, service.Name) {
+		return fmt.Sprintf("service %s", service.Name)
+	}
+	if len(q.Plans) > 0 && !contains(q.Plans, plan.ID, plan.Name) {
+		return fmt.Sprintf("plan %s", plan.Name)
+	}
+	return ""
+}
+
+// checkPlanQuota returns why the quotas of a service instance do not permit a service and plan, or an empty string if they do
+func (b *Broker) checkPlanQuota(platform *PlatformContext, service *Service, plan *ServicePlan) string {
+	for _, scope := range b.Quotas.scopes(platform) {
+		if denied := scope.quota.allows(service, plan); len(denied) > 0 {
+			return fmt.Sprintf("The %s can not be used in %s", denied, scope.name)
+		}
+	}
+	return ""
+}
+
+// checkQuota returns why a service instance would exceed the quotas of where it lives if it had the given units,
+// or an empty string if it would not, usage is taken from the deployments that currently exist on Compose.io,
+// without the ones whose provisioning has failed, an existing service instance is never refused because of the number of service instances,
+// callers hold quotaMutex until the service instance or its new units are stored, so that concurrent requests can't both use up the same quota
+func (b *Broker) checkQuota(ctx context.Context, instanceID string, platform *PlatformContext, units int) (string, error) {
+	scopes := b.Quotas.scopes(platform)
+	if len(scopes) == 0 {
+		return "", nil
+	}
+	instances, err := b.Store.GetInstances()
+	if err != nil {
+		return "", err
+	}
+	deployments, err := b.Client.GetDeploymentsContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	existing := make(map[string]string)
+	for _, deployment := range deployments {
+		existing[deployment.Name] = deployment.ID
+	}
+
+	// only the store knows where a service instance lives, but only Compose.io knows whether it still exists and how big it is
+	failed := make(map[string]bool)
+	allocated := make(map[string]int)
+	for _, scope := range scopes {
+		count, total, exists := 1, units, false
+		for _, instance := range instances {
+			if instance.ID == instanceID {
+				exists = true
+				continue
+			}
+			deploymentID, ok := existing[instance.ID]
+			if !ok || instance.Abandoned || !scope.member(instance) {
+				continue
+			}
+			if _, ok := failed[deploymentID]; !ok {
+				recipes, err := b.Client.GetRecipesContext(ctx, deploymentID)
+				if err != nil && !api.IsNotFound(err) {
+					return "", err
+				}
+				provision := provisionRecipe(recipes)
+				failed[deploymentID] = err != nil || (provision != nil && provision.Status == "failed")
+			}
+			if failed[deploymentID] {
+				continue
+			}
+			count++
+			if scope.quota.Units == 0 {
+				continue
+			}
+			if _, ok := allocated[deploymentID]; !ok {
+				scaling, err := b.Client.GetScalingContext(ctx, deploymentID)
+				if err != nil {
+					return "", err
+				}
+				allocated[deploymentID] = scaling.AllocatedUnits
+			}
+			total += allocated[deploymentID]
+		}
+
+		if scope.quota.Instances > 0 && count > scope.quota.Instances && !exists {
+			return fmt.Sprintf("The quota of %s allows for %d service instances, which are all in use", scope.name, scope.quota.Instances), nil
+		}
+		if scope.quota.Units > 0 && total > scope.quota.Units {
+			return fmt.Sprintf("The quota of %s allows for %d units, %d units would be allocated", scope.name, scope.quota.Units, total), nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,305 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/JamesClonk/compose-broker/log"
+	"github.com/JamesClonk/compose-broker/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+}
+
+var acme = &PlatformContext{
+	Platform:         "cloudfoundry",
+	OrganizationGUID: "7c3a5f2e-9b41-4d8e-a6f0-1e2d3c4b5a69",
+	OrganizationName: "acme",
+	SpaceGUID:        "1b6f5f44-0b51-4a2e-8f0e-bc7c1d0b5d3e",
+	SpaceName:        "dev",
+}
+
+func TestBroker_LoadQuotas(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compose-broker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "quotas.yml")
+	if err := ioutil.WriteFile(filename, []byte(`
+default:
+  instances: 5
+  units: 10
+organizations:
+  acme:
+    instances: 20
+    plans: [default]
+spaces:
+  1b6f5f44-0b51-4a2e-8f0e-bc7c1d0b5d3e:
+    services: [postgresql]
+namespaces:
+  shop:
+    units: 4
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	quotas := LoadQuotas(filename)
+	assert.Equal(t, &Quota{Instances: 5, Units: 10}, quotas.Default)
+	assert.Equal(t, Quota{Instances: 20, Plans: []string{"default"}}, quotas.Organizations["acme"])
+	assert.Equal(t, Quota{Services: []string{"postgresql"}}, quotas.Spaces["1b6f5f44-0b51-4a2e-8f0e-bc7c1d0b5d3e"])
+	assert.Equal(t, Quota{Units: 4}, quotas.Namespaces["shop"])
+
+	scopes := quotas.scopes(acme)
+	if assert.Len(t, scopes, 2) {
+		assert.Equal(t, "organization acme", scopes[0].name)
+		assert.Equal(t, 20, scopes[0].quota.Instances)
+		assert.Equal(t, "space dev", scopes[1].name)
+	}
+
+	// organizations without their own quota get the default one
+	scopes = quotas.scopes(&PlatformContext{Platform: "cloudfoundry", OrganizationGUID: "e5a8f2c1-3d4b-4e6f-9a7b-8c9d0e1f2a3b"})
+	if assert.Len(t, scopes, 1) {
+		assert.Equal(t, Quota{Instances: 5, Units: 10}, scopes[0].quota)
+	}
+
+	scopes = quotas.scopes(&PlatformContext{Platform: "kubernetes", Namespace: "shop", ClusterID: "8263feba-9b8a-23ae-99ed-abcd1234feda"})
+	if assert.Len(t, scopes, 1) {
+		assert.Equal(t, "namespace shop", scopes[0].name)
+		assert.Equal(t, Quota{Units: 4}, scopes[0].quota)
+		assert.True(t, scopes[0].member(Instance{Context: &PlatformContext{Platform: "kubernetes", Namespace: "shop", ClusterID: "8263feba-9b8a-23ae-99ed-abcd1234feda"}}))
+		assert.False(t, scopes[0].member(Instance{Context: &PlatformContext{Platform: "kubernetes", Namespace: "shop", ClusterID: "0b1c2d3e-4f5a-6b7c-8d9e-0f1a2b3c4d5e"}}))
+	}
+
+	// without knowing where a service instance lives there is no quota
+	assert.Len(t, quotas.scopes(nil), 0)
+	assert.Len(t, LoadQuotas("").scopes(acme), 0)
+}
+
+func TestBroker_ProvisionServiceInstance_QuotaInstancesExceeded(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments", Code: 200, Body: util.Body("../_fixtures/api_get_deployments.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/recipes", Code: 200, Body: util.Body("../_fixtures/api_get_recipes_for_service_fetch.json"), Test: nil},
+		util.HttpTestCase{Method: "POST", Path: "/deployments", Code: 500, Body: "", Test: func(body string) {
+			t.Error("must not create a deployment beyond the quota")
+		}},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	b.Quotas = &Quotas{Organizations: map[string]Quota{"acme": Quota{Instances: 1}}}
+	_ = b.Store.PutInstance(Instance{
+		ID:               "8dcdf609-36c9-4b22-bb16-d97e48c50f26",
+		ServiceID:        "9b4ee86b-3876-469f-a531-062e71bc5859",
+		PlanID:           "d6222855-17c6-448c-885a-e9d931cd221b",
+		OrganizationGUID: acme.OrganizationGUID,
+		SpaceGUID:        acme.SpaceGUID,
+		Context:          acme,
+	})
+	r := NewRouter(b)
+
+	provisioning := ServiceInstanceProvisioning{
+		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
+		PlanID:    "d6222855-17c6-448c-885a-e9d931cd221b",
+		Context:   acme,
+	}
+	data, _ := json.MarshalIndent(provisioning, "", "  ")
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("PUT", "/v2/service_instances/c9f2a0b4-6e1d-4f7a-9b3c-2d8e5f1a7b60?accepts_incomplete=true", bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 403, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"error": "QuotaExceeded"`)
+	assert.Contains(t, rec.Body.String(), `"description": "The quota of organization acme allows for 1 service instances, which are all in use"`)
+
+	_, err = b.Store.GetInstance("c9f2a0b4-6e1d-4f7a-9b3c-2d8e5f1a7b60")
+	assert.Error(t, err)
+}
+
+func TestBroker_ProvisionServiceInstance_QuotaFailedProvision(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments", Code: 200, Body: util.Body("../_fixtures/api_get_deployments.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/recipes", Code: 200, Body: util.Body("../_fixtures/api_get_recipes_for_failed_provision.json"), Test: nil},
+		util.HttpTestCase{Method: "POST", Path: "/deployments", Code: 202, Body: util.Body("../_fixtures/api_create_deployment.json"), Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	b.Quotas = &Quotas{Organizations: map[string]Quota{"acme": Quota{Instances: 1}}}
+	// neither a failed provisioning nor a service instance without a deployment count against the quota
+	_ = b.Store.PutInstance(Instance{
+		ID:               "8dcdf609-36c9-4b22-bb16-d97e48c50f26",
+		DeploymentID:     "5854017e89d50f424e000192",
+		ServiceID:        "9b4ee86b-3876-469f-a531-062e71bc5859",
+		PlanID:           "d6222855-17c6-448c-885a-e9d931cd221b",
+		OrganizationGUID: acme.OrganizationGUID,
+		SpaceGUID:        acme.SpaceGUID,
+	})
+	_ = b.Store.PutInstance(Instance{
+		ID:               "f3c1d2e4-5a6b-4c7d-8e9f-0a1b2c3d4e5f",
+		ServiceID:        "9b4ee86b-3876-469f-a531-062e71bc5859",
+		PlanID:           "d6222855-17c6-448c-885a-e9d931cd221b",
+		OrganizationGUID: acme.OrganizationGUID,
+		SpaceGUID:        acme.SpaceGUID,
+	})
+	r := NewRouter(b)
+
+	provisioning := ServiceInstanceProvisioning{
+		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
+		PlanID:    "d6222855-17c6-448c-885a-e9d931cd221b",
+		Context:   acme,
+	}
+	data, _ := json.MarshalIndent(provisioning, "", "  ")
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("PUT", "/v2/service_instances/c9f2a0b4-6e1d-4f7a-9b3c-2d8e5f1a7b60?accepts_incomplete=true", bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 202, rec.Code)
+}
+
+func TestBroker_ProvisionServiceInstance_QuotaUnitsExceeded(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments", Code: 200, Body: util.Body("../_fixtures/api_get_deployments.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/recipes", Code: 200, Body: util.Body("../_fixtures/api_get_recipes_for_service_fetch.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/scalings", Code: 200, Body: util.Body("../_fixtures/api_get_scaling.json"), Test: nil},
+		util.HttpTestCase{Method: "POST", Path: "/deployments", Code: 500, Body: "", Test: func(body string) {
+			t.Error("must not create a deployment beyond the quota")
+		}},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	b.Quotas = &Quotas{Spaces: map[string]Quota{"dev": Quota{Units: 6}}}
+	_ = b.Store.PutInstance(Instance{
+		ID:               "8dcdf609-36c9-4b22-bb16-d97e48c50f26",
+		DeploymentID:     "5854017e89d50f424e000192",
+		ServiceID:        "9b4ee86b-3876-469f-a531-062e71bc5859",
+		PlanID:           "d6222855-17c6-448c-885a-e9d931cd221b",
+		OrganizationGUID: acme.OrganizationGUID,
+		SpaceGUID:        acme.SpaceGUID,
+	})
+	r := NewRouter(b)
+
+	provisioning := ServiceInstanceProvisioning{
+		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
+		PlanID:    "d6222855-17c6-448c-885a-e9d931cd221b",
+		Context:   acme,
+	}
+	provisioning.Parameters.Units = 3
+	data, _ := json.MarshalIndent(provisioning, "", "  ")
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("PUT", "/v2/service_instances/c9f2a0b4-6e1d-4f7a-9b3c-2d8e5f1a7b60?accepts_incomplete=true", bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 403, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"description": "The quota of space dev allows for 6 units, 7 units would be allocated"`)
+}
+
+func TestBroker_ProvisionServiceInstance_QuotaPlanNotPermitted(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "POST", Path: "/deployments", Code: 500, Body: "", Test: func(body string) {
+			t.Error("must not create a deployment of a service that is not permitted")
+		}},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	b.Quotas = &Quotas{Default: &Quota{Services: []string{"redis"}}}
+	r := NewRouter(b)
+
+	provisioning := ServiceInstanceProvisioning{
+		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
+		PlanID:    "d6222855-17c6-448c-885a-e9d931cd221b",
+		Context:   acme,
+	}
+	data, _ := json.MarshalIndent(provisioning, "", "  ")
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("PUT", "/v2/service_instances/c9f2a0b4-6e1d-4f7a-9b3c-2d8e5f1a7b60?accepts_incomplete=true", bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 400, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"error": "PlanNotPermitted"`)
+	assert.Contains(t, rec.Body.String(), `"description": "The service postgresql can not be used in organization acme"`)
+}
+
+func TestBroker_UpdateServiceInstance_QuotaUnitsExceeded(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments", Code: 200, Body: util.Body("../_fixtures/api_get_deployments.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/recipes", Code: 200, Body: util.Body("../_fixtures/api_get_recipes_for_service_fetch.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/scalings", Code: 200, Body: util.Body("../_fixtures/api_get_scaling.json"), Test: nil},
+		util.HttpTestCase{Method: "POST", Path: "/deployments/5854017e89d50f424e000192/scalings", Code: 500, Body: "", Test: func(body string) {
+			t.Error("must not scale a deployment beyond the quota")
+		}},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	b.Quotas = &Quotas{Organizations: map[string]Quota{acme.OrganizationGUID: Quota{Instances: 1, Units: 6}}}
+	_ = b.Store.PutInstance(Instance{
+		ID:               "8dcdf609-36c9-4b22-bb16-d97e48c50f26",
+		DeploymentID:     "5854017e89d50f424e000192",
+		ServiceID:        "9b4ee86b-3876-469f-a531-062e71bc5859",
+		PlanID:           "d6222855-17c6-448c-885a-e9d931cd221b",
+		OrganizationGUID: acme.OrganizationGUID,
+		SpaceGUID:        acme.SpaceGUID,
+	})
+	r := NewRouter(b)
+
+	update := func(units int) *httptest.ResponseRecorder {
+		update := ServiceInstanceUpdate{ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859"}
+		update.Parameters.Units = units
+		data, _ := json.MarshalIndent(update, "", "  ")
+
+		rec := httptest.NewRecorder()
+		req, err := http.NewRequest("PATCH", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26?accepts_incomplete=true", bytes.NewBuffer(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("broker", "pw")
+		req.Header.Set("X-Broker-API-Version", "2.15")
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := update(8)
+	assert.Equal(t, 403, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"description": "The quota of organization 7c3a5f2e-9b41-4d8e-a6f0-1e2d3c4b5a69 allows for 6 units, 8 units would be allocated"`)
+
+	// the service instance itself does not count against the quota of service instances, and keeping the units is fine
+	rec = update(4)
+	assert.Equal(t, 200, rec.Code)
+}
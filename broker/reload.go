@@ -0,0 +1,99 @@
+package broker
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/JamesClonk/compose-broker/log"
+	"github.com/JamesClonk/compose-broker/metrics"
+)
+
+type catalogState struct {
+	filename string
+	catalog  *ServiceCatalog
+	modTime  time.Time // of the catalog file when it was last read
+	mutex    sync.RWMutex
+}
+
+// ServiceCatalog is the catalog currently in use, it is replaced as a whole whenever the catalog file is reloaded
+func (b *Broker) ServiceCatalog() *ServiceCatalog {
+	b.catalog.mutex.RLock()
+	defer b.catalog.mutex.RUnlock()
+	return b.catalog.catalog
+}
+
+// loadServiceCatalog reads the catalog file on startup, which must not fail
+func (b *Broker) loadServiceCatalog(filename string) {
+	b.catalog.filename = filename
+	b.catalog.catalog = LoadServiceCatalog(filename)
+	if info, err := os.Stat(filename); err == nil {
+		b.catalog.modTime = info.ModTime()
+	}
+}
+
+// ReloadServiceCatalog reads the catalog file again and starts using it, an invalid catalog is refused and the current one kept
+func (b *Broker) ReloadServiceCatalog() error {
+	var modTime time.Time
+	if info, err := os.Stat(b.catalog.filename); err == nil {
+		modTime = info.ModTime()
+	}
+	catalog, err := ParseServiceCatalog(b.catalog.filename)
+
+	b.catalog.mutex.Lock()
+	b.catalog.modTime = modTime // a broken catalog file is not read again until it changes
+	if err == nil {
+		b.catalog.catalog = catalog
+	}
+	b.catalog.mutex.Unlock()
+
+	if err != nil {
+		metrics.CatalogReloads.WithLabelValues("failure").Inc()
+		log.Errorf("could not reload %s, keeping the current catalog: %v", b.catalog.filename, err)
+		return err
+	}
+	metrics.CatalogReloads.WithLabelValues("success").Inc()
+	log.Infof("reloaded %s with %d service offerings", b.catalog.filename, len(catalog.Services))
+	return nil
+}
+
+// catalogChanged tells whether the catalog file has been modified since it was last read
+func (b *Broker) catalogChanged() bool {
+	info, err := os.Stat(b.catalog.filename)
+	if err != nil {
+		return false
+	}
+	b.catalog.mutex.RLock()
+	defer b.catalog.mutex.RUnlock()
+	return !info.ModTime().Equal(b.catalog.modTime)
+}
+
+// WatchCatalog reloads the catalog when the service broker receives a SIGHUP, and when its file has changed if interval is set,
+// until stop is closed
+func (b *Broker) WatchCatalog(interval time.Duration, stop <-chan struct{}) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-stop:
+			return
+		case <-hangup:
+			log.Infof("received SIGHUP, reloading %s", b.catalog.filename)
+			_ = b.ReloadServiceCatalog()
+		case <-tick:
+			if b.catalogChanged() {
+				_ = b.ReloadServiceCatalog()
+			}
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package broker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/JamesClonk/compose-broker/log"
+	"github.com/JamesClonk/compose-broker/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+}
+
+const reloadedCatalog = `
+services:
+- id: 9b4ee86b-3876-469f-a531-062e71bc5859
+  name: postgresql
+  description: PostgreSQL
+  plans:
+  - id: d6222855-17c6-448c-885a-e9d931cd221b
+    name: default
+    description: PostgreSQL
+    metadata:
+      units: 3
+`
+
+func writeCatalog(t *testing.T, filename, catalog string, modTime time.Time) {
+	if err := ioutil.WriteFile(filename, []byte(catalog), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filename, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBroker_ParseServiceCatalog_Invalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compose-broker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "catalog.yml")
+
+	for catalog, message := range map[string]string{
+		`services: [`:  "could not parse",
+		`services: []`: "no service offerings defined",
+		"services:\n- id: 9b4ee86b-3876-469f-a531-062e71bc5859\n  plans: []": "service #0: name is missing",
+		"services:\n- id: 9b4ee86b-3876-469f-a531-062e71bc5859\n  name: postgresql\n  plans:\n  - id: d6222855-17c6-448c-885a-e9d931cd221b\n    name: default\n    metadata:\n      min_units: 4\n      max_units: 2": "invalid min_units, max_units or units_step",
+	} {
+		writeCatalog(t, filename, catalog, time.Now())
+		_, err := ParseServiceCatalog(filename)
+		if assert.Error(t, err, catalog) {
+			assert.Contains(t, err.Error(), message)
+		}
+	}
+
+	_, err = ParseServiceCatalog(filepath.Join(dir, "missing.yml"))
+	assert.Error(t, err)
+}
+
+func TestBroker_ReloadServiceCatalog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compose-broker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "catalog.yml")
+	data, err := ioutil.ReadFile("../catalog.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeCatalog(t, filename, string(data), time.Now().Add(-time.Hour))
+
+	c := util.TestConfig("")
+	c.CatalogFilename = filename
+	b := NewBroker(c)
+	assert.True(t, len(b.ServiceCatalog().Services) > 1)
+	assert.False(t, b.catalogChanged())
+
+	writeCatalog(t, filename, reloadedCatalog, time.Now().Add(-time.Minute))
+	assert.True(t, b.catalogChanged())
+	assert.NoError(t, b.ReloadServiceCatalog())
+	assert.False(t, b.catalogChanged())
+	if assert.Len(t, b.ServiceCatalog().Services, 1) {
+		_, plan := b.ServiceCatalog().Plan("9b4ee86b-3876-469f-a531-062e71bc5859", "d6222855-17c6-448c-885a-e9d931cd221b")
+		if assert.NotNil(t, plan) {
+			assert.Equal(t, 3, plan.Metadata.Units)
+		}
+	}
+
+	// an invalid catalog is refused, and not read again until it changes
+	current := b.ServiceCatalog()
+	writeCatalog(t, filename, `services: []`, time.Now())
+	assert.Error(t, b.ReloadServiceCatalog())
+	assert.True(t, current == b.ServiceCatalog())
+	assert.False(t, b.catalogChanged())
+}
+
+func TestBroker_WatchCatalog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compose-broker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "catalog.yml")
+	data, err := ioutil.ReadFile("../catalog.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeCatalog(t, filename, string(data), time.Now().Add(-time.Hour))
+
+	c := util.TestConfig("")
+	c.CatalogFilename = filename
+	b := NewBroker(c)
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		b.WatchCatalog(10*time.Millisecond, stop)
+		close(stopped)
+	}()
+
+	writeCatalog(t, filename, reloadedCatalog, time.Now())
+	assert.Eventually(t, func() bool {
+		return len(b.ServiceCatalog().Services) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	close(stop)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Error("must stop watching the catalog")
+	}
+}
@@ -1,31 +1,48 @@
 package broker
 
 import (
-	"github.com/JamesClonk/compose-broker/config"
+	"github.com/JamesClonk/compose-broker/metrics"
 	"github.com/gorilla/mux"
 )
 
-func NewRouter(c *config.Config) *mux.Router {
-	b := NewBroker(c)
-
+func NewRouter(b *Broker) *mux.Router {
 	// mux router
 	r := mux.NewRouter()
+	r.Use(b.RequestID)
+	r.Use(b.Instrument)
+	r.Use(b.Deadline)
 
 	// routes
 	r.HandleFunc("/", b.BasicAuth(b.Health)).Methods("GET")
 	r.PathPrefix("/health").HandlerFunc(b.Health)
-
-	r.HandleFunc("/v2/catalog", b.BasicAuth(b.Catalog)).Methods("GET")
-
-	r.HandleFunc("/v2/service_instances/{instanceID}", b.BasicAuth(b.ProvisionInstance)).Methods("PUT")
-	r.HandleFunc("/v2/service_instances/{instanceID}/last_operation", b.BasicAuth(b.LastOperationOnInstance)).Methods("GET")
-	r.HandleFunc("/v2/service_instances/{instanceID}", b.BasicAuth(b.FetchInstance)).Methods("GET")
-	r.HandleFunc("/v2/service_instances/{instanceID}", b.BasicAuth(b.UpdateInstance)).Methods("PATCH")
-	r.HandleFunc("/v2/service_instances/{instanceID}", b.BasicAuth(b.DeprovisionInstance)).Methods("DELETE")
-
-	r.HandleFunc("/v2/service_instances/{instanceID}/service_bindings/{bindingID}", b.BasicAuth(b.Bind)).Methods("PUT")
-	r.HandleFunc("/v2/service_instances/{instanceID}/service_bindings/{bindingID}", b.BasicAuth(b.FetchBinding)).Methods("GET")
-	r.HandleFunc("/v2/service_instances/{instanceID}/service_bindings/{bindingID}", b.BasicAuth(b.Unbind)).Methods("DELETE")
+	r.HandleFunc("/metrics", b.BasicAuth(metrics.Handler().ServeHTTP)).Methods("GET")
+
+	// Open Service Broker API, only for platforms that speak a version of it this service broker implements
+	v2 := r.PathPrefix("/v2").Subrouter()
+	v2.Use(b.NegotiateAPIVersion)
+	v2.Use(b.OriginatingIdentity)
+	v2.HandleFunc("/catalog", b.BasicAuth(b.Catalog)).Methods("GET")
+
+	v2.HandleFunc("/service_instances/{instanceID}", b.BasicAuth(b.Audited("provision", b.ProvisionInstance))).Methods("PUT")
+	v2.HandleFunc("/service_instances/{instanceID}/last_operation", b.BasicAuth(b.LastOperationOnInstance)).Methods("GET")
+	v2.HandleFunc("/service_instances/{instanceID}", b.BasicAuth(b.FetchInstance)).Methods("GET")
+	v2.HandleFunc("/service_instances/{instanceID}", b.BasicAuth(b.Audited("update", b.UpdateInstance))).Methods("PATCH")
+	v2.HandleFunc("/service_instances/{instanceID}", b.BasicAuth(b.Audited("deprovision", b.DeprovisionInstance))).Methods("DELETE")
+
+	v2.HandleFunc("/service_instances/{instanceID}/service_bindings/{bindingID}", b.BasicAuth(b.Audited("bind", b.Bind))).Methods("PUT")
+	v2.HandleFunc("/service_instances/{instanceID}/service_bindings/{bindingID}/last_operation", b.BasicAuth(b.LastOperationOnBinding)).Methods("GET")
+	v2.HandleFunc("/service_instances/{instanceID}/service_bindings/{bindingID}", b.BasicAuth(b.FetchBinding)).Methods("GET")
+	v2.HandleFunc("/service_instances/{instanceID}/service_bindings/{bindingID}", b.BasicAuth(b.Audited("unbind", b.Unbind))).Methods("DELETE")
+
+	// admin API, only available if it has credentials of its own
+	if len(b.AdminPassword) > 0 {
+		r.HandleFunc("/admin/deployments", b.AdminAuth(b.AdminDeployments)).Methods("GET")
+		r.HandleFunc("/admin/deployments/{deploymentID}", b.AdminAuth(b.AdminDeployment)).Methods("GET")
+		r.HandleFunc("/admin/deployments/{deploymentID}/recipes/{recipeID}/retry", b.AdminAuth(b.AdminRetryRecipe)).Methods("POST")
+		r.HandleFunc("/admin/drift", b.AdminAuth(b.DriftStatus)).Methods("GET")
+		r.HandleFunc("/admin/refresh", b.AdminAuth(b.AdminRefresh)).Methods("POST")
+		r.HandleFunc("/admin/orphans/purge", b.AdminAuth(b.AdminPurgeOrphans)).Methods("POST")
+	}
 
 	return r
 }
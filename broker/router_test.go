@@ -22,7 +22,7 @@ func TestBroker_Health(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	NewRouter(util.TestConfig("")).ServeHTTP(rec, req)
+	NewRouter(NewBroker(util.TestConfig(""))).ServeHTTP(rec, req)
 	assert.Equal(t, 200, rec.Code)
 	assert.Contains(t, rec.Body.String(), `"status": "ok"`)
 }
@@ -34,8 +34,9 @@ func TestBroker_BasicAuth(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 
-	NewRouter(util.TestConfig("")).ServeHTTP(rec, req)
+	NewRouter(NewBroker(util.TestConfig(""))).ServeHTTP(rec, req)
 	assert.Equal(t, 200, rec.Code)
 	assert.Contains(t, rec.Body.String(), `"status": "ok"`)
 }
@@ -47,8 +48,43 @@ func TestBroker_BasicAuth_Unauthorized(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	NewRouter(util.TestConfig("")).ServeHTTP(rec, req)
+	NewRouter(NewBroker(util.TestConfig(""))).ServeHTTP(rec, req)
 	assert.Equal(t, 401, rec.Code)
 	assert.Contains(t, rec.Body.String(), `"error": "Unauthorized"`)
 	assert.Contains(t, rec.Body.String(), `"description": "You are not authorized to access this service broker"`)
 }
+
+func TestBroker_Metrics(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/databases", Code: 200, Body: util.Body("../_fixtures/api_get_databases.json"), Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
+	r.ServeHTTP(rec, req)
+	assert.Equal(t, 200, rec.Code)
+	assert.Contains(t, rec.Body.String(), `compose_broker_deployment_index_entries`)
+
+	// requests are counted by route
+	catalogReq, err := http.NewRequest("GET", "/v2/catalog", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	catalogReq.SetBasicAuth("broker", "pw")
+	catalogReq.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(httptest.NewRecorder(), catalogReq)
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	assert.Equal(t, 200, rec.Code)
+	assert.Contains(t, rec.Body.String(), `compose_broker_http_requests_total{code="200",method="GET",route="/v2/catalog"}`)
+	assert.Contains(t, rec.Body.String(), `compose_broker_http_request_duration_seconds_count{method="GET",route="/v2/catalog"}`)
+}
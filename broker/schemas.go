@@ -0,0 +1,165 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/JamesClonk/compose-broker/log"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+type ServicePlanSchemas struct {
+	ServiceInstance struct {
+		Create ServicePlanSchema `json:"create" yaml:"create"`
+		Update ServicePlanSchema `json:"update" yaml:"update"`
+	} `json:"service_instance" yaml:"service_instance"`
+}
+type ServicePlanSchema struct {
+	Parameters map[string]interface{} `json:"parameters,omitempty" yaml:"parameters,omitempty"`
+}
+
+// defaultSchemas returns the schemas of all parameters the service broker understands, used for plans without their own schemas in the catalog
+func defaultSchemas() ServicePlanSchemas {
+	var schemas ServicePlanSchemas
+	schemas.ServiceInstance.Create.Parameters = map[string]interface{}{
+		"$schema":              "http://json-schema.org/draft-04/schema#",
+		"type":                 "object",
+		"additionalProperties": false,
+		"properties": map[string]interface{}{
+			"account_id": map[string]interface{}{
+				"type":        "string",
+				"description": "Compose.io account to create the deployment in",
+			},
+			"datacenter": map[string]interface{}{
+				"type":        "string",
+				"description": "Datacenter to create the deployment in, for example aws:eu-central-1",
+			},
+			"version": map[string]interface{}{
+				"type":        "string",
+				"description": "Version of the database to deploy",
+			},
+			"units": map[string]interface{}{
+				"type":        "integer",
+				"minimum":     1,
+				"description": "Number of resource units to allocate",
+			},
+			"cache_mode": map[string]interface{}{
+				"type":        "boolean",
+				"description": "Optimize the deployment to be used as a cache, Redis only",
+			},
+			"restore_from_backup": map[string]interface{}{
+				"type":        "string",
+				"description": "ID of a backup of another service instance in the same space to create the deployment from",
+			},
+			"whitelist": map[string]interface{}{
+				"type":        "array",
+				"items":       map[string]interface{}{"type": "string"},
+				"description": "IP addresses or ranges in CIDR notation that may connect to the deployment",
+			},
+		},
+	}
+	schemas.ServiceInstance.Update.Parameters = map[string]interface{}{
+		"$schema":              "http://json-schema.org/draft-04/schema#",
+		"type":                 "object",
+		"additionalProperties": false,
+		"properties": map[string]interface{}{
+			"version": map[string]interface{}{
+				"type":        "string",
+				"description": "Version of the database to upgrade to",
+			},
+			"on_demand_backup": map[string]interface{}{
+				"type":        "boolean",
+				"description": "Take a backup of the deployment",
+			},
+			"whitelist": map[string]interface{}{
+				"type":        "array",
+				"items":       map[string]interface{}{"type": "string"},
+				"description": "IP addresses or ranges in CIDR notation that may connect to the deployment",
+			},
+			"units": map[string]interface{}{
+				"type":        "integer",
+				"minimum":     1,
+				"description": "Number of resource units to allocate",
+			},
+		},
+	}
+	return schemas
+}
+
+// validateParameters checks the parameters of a request against a schema and returns all violations
+func validateParameters(schema map[string]interface{}, parameters json.RawMessage) ([]string, error) {
+	if len(schema) == 0 {
+		return nil, nil
+	}
+	if len(parameters) == 0 || string(parameters) == "null" {
+		parameters = json.RawMessage("{}")
+	}
+
+	result, err := gojsonschema.Validate(gojsonschema.NewGoLoader(schema), gojsonschema.NewBytesLoader(parameters))
+	if err != nil {
+		return nil, err
+	}
+	violations := make([]string, 0)
+	for _, violation := range result.Errors() {
+		violations = append(violations, fmt.Sprintf("%s: %s", violation.Field(), violation.Description()))
+	}
+	sort.Strings(violations)
+	return violations, nil
+}
+
+// jsonCompatible converts the generic maps read from YAML into maps that can be marshalled into JSON
+func jsonCompatible(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{})
+		for key, value := range v {
+			m[fmt.Sprintf("%v", key)] = jsonCompatible(value)
+		}
+		return m
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = jsonCompatible(value)
+		}
+		return v
+	case []interface{}:
+		for i, value := range v {
+			v[i] = jsonCompatible(value)
+		}
+		return v
+	}
+	return value
+}
+
+// planSchemas returns the parameter schemas of a plan, or the default schemas if the plan is unknown
+func (b *Broker) planSchemas(serviceID, planID string) ServicePlanSchemas {
+	if _, plan := b.ServiceCatalog().Plan(serviceID, planID); plan != nil && plan.Schemas != nil {
+		return *plan.Schemas
+	}
+	return defaultSchemas()
+}
+
+// checkParameters answers the request with all schema violations of its parameters, if there are any
+func (b *Broker) checkParameters(rw http.ResponseWriter, req *http.Request, instanceID string, schema map[string]interface{}, parameters json.RawMessage) bool {
+	violations, err := validateParameters(schema, parameters)
+	if err != nil {
+		log.Ctx(req.Context()).Errorf("could not validate parameters for service instance %s: %v", instanceID, err)
+		b.Error(rw, req, 500, "UnknownError", "Could not validate parameters")
+		return false
+	}
+	if len(violations) > 0 {
+		log.Ctx(req.Context()).Errorf("invalid parameters for service instance %s: %v", instanceID, violations)
+		b.Error(rw, req, 400, "ValidationError", fmt.Sprintf("Invalid parameters: %s", strings.Join(violations, "; ")))
+		return false
+	}
+	return true
+}
+
+// schemaRequest contains everything needed to validate the parameters of a provisioning or update request
+type schemaRequest struct {
+	ServiceID  string          `json:"service_id"`
+	PlanID     string          `json:"plan_id"`
+	Parameters json.RawMessage `json:"parameters"`
+}
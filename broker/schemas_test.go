@@ -0,0 +1,54 @@
+package broker
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBroker_LoadServiceCatalog_Schemas(t *testing.T) {
+	catalog := LoadServiceCatalog("../_fixtures/catalog_with_schemas.yml")
+
+	// own schema from the catalog, with the default update schema
+	_, plan := catalog.Plan("9b4ee86b-3876-469f-a531-062e71bc5859", "d6222855-17c6-448c-885a-e9d931cd221b")
+	if assert.NotNil(t, plan) && assert.NotNil(t, plan.Schemas) {
+		data, err := json.Marshal(plan.Schemas.ServiceInstance.Create.Parameters)
+		assert.NoError(t, err)
+		assert.Contains(t, string(data), `"maximum":4`)
+		assert.Equal(t, defaultSchemas().ServiceInstance.Update, plan.Schemas.ServiceInstance.Update)
+	}
+
+	// default schemas
+	_, plan = catalog.Plan("9b4ee86b-3876-469f-a531-062e71bc5859", "3ad5b9a1-9c2c-4e6b-9e7e-5ac4f7d5d7a3")
+	if assert.NotNil(t, plan) && assert.NotNil(t, plan.Schemas) {
+		assert.Equal(t, defaultSchemas(), *plan.Schemas)
+	}
+
+	service, plan := catalog.Plan("9b4ee86b-3876-469f-a531-062e71bc5859", "unknown")
+	assert.Nil(t, service)
+	assert.Nil(t, plan)
+}
+
+func TestBroker_ValidateParameters(t *testing.T) {
+	schema := defaultSchemas().ServiceInstance.Create.Parameters
+
+	violations, err := validateParameters(schema, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, violations)
+
+	violations, err = validateParameters(schema, json.RawMessage(`{"units": 4, "datacenter": "aws:eu-central-1", "cache_mode": true}`))
+	assert.NoError(t, err)
+	assert.Empty(t, violations)
+
+	violations, err = validateParameters(schema, json.RawMessage(`{"unit": 4, "units": "four", "cache_mode": "yes"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"(root): Additional property unit is not allowed",
+		"cache_mode: Invalid type. Expected: boolean, given: string",
+		"units: Invalid type. Expected: integer, given: string",
+	}, violations)
+
+	_, err = validateParameters(schema, json.RawMessage(`{"units": `))
+	assert.Error(t, err)
+}
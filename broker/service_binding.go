@@ -1,18 +1,32 @@
 package broker
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/JamesClonk/compose-broker/api"
+	"github.com/JamesClonk/compose-broker/credentials"
 	"github.com/JamesClonk/compose-broker/log"
 	"github.com/gorilla/mux"
 )
 
+type ServiceBinding struct {
+	ServiceID  string `json:"service_id"`
+	PlanID     string `json:"plan_id"`
+	Parameters struct {
+		Whitelist []string `json:"whitelist,omitempty"`
+	} `json:"parameters"`
+}
 type ServiceBindingResponse struct {
 	Credentials ServiceBindingResponseCredentials `json:"credentials"`
 	Endpoints   []ServiceBindingResponseEndpoint  `json:"endpoints"`
@@ -46,46 +60,451 @@ type ServiceBindingResponseParameters struct {
 	Scaling    api.Scaling    `json:"scaling,omitempty"`
 }
 
+type ServiceBindingOperationResponse struct {
+	Operation string `json:"operation,omitempty"`
+}
+
 func (b *Broker) Bind(rw http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	instanceID := vars["instanceID"]
+	bindingID := vars["bindingID"]
 
-	instance, err := b.Client.GetDeploymentByName(instanceID)
+	instance, err := b.getDeployment(req.Context(), instanceID)
+	if lookupFailed(err) {
+		log.Ctx(req.Context()).Errorf("could not query service instance %s: %v", instanceID, err)
+		b.apiError(rw, req, err, 500, "UnknownError", "Could not query service instance")
+		return
+	}
 	if err != nil || instance.Name != instanceID {
-		log.Errorf("could not query service instance %s: %v", instanceID, err)
+		log.Ctx(req.Context()).Errorf("could not query service instance %s: %v", instanceID, err)
 		b.Error(rw, req, 400, "MissingServiceInstance", "The service instance does not exist")
 		return
 	}
-	b.write(rw, req, 200, b.getBinding(instance))
+
+	// the binding can bring its own IP ranges, which are added to the whitelist of the deployment
+	var bindRequest ServiceBinding
+	if req.Body != nil {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			log.Ctx(req.Context()).Errorln(err)
+			log.Ctx(req.Context()).Errorf("error reading binding request for service binding %s: %v", bindingID, req)
+			b.Error(rw, req, 400, "MalformedRequest", "Could not read binding request")
+			return
+		}
+		if len(body) > 0 {
+			if err := json.Unmarshal(body, &bindRequest); err != nil {
+				log.Ctx(req.Context()).Errorln(err)
+				log.Ctx(req.Context()).Errorf("could not unmarshal binding request body for service binding %s: %v", bindingID, string(body))
+				b.Error(rw, req, 400, "MalformedRequest", "Could not unmarshal binding request")
+				return
+			}
+		}
+	}
+	whitelist, err := normalizeWhitelist(bindRequest.Parameters.Whitelist)
+	if err != nil {
+		log.Ctx(req.Context()).Errorf("invalid whitelist for service binding %s: %v", bindingID, err)
+		b.Error(rw, req, 400, "MalformedRequest", err.Error())
+		return
+	}
+
+	// if the platform allows it the binding waits for any ongoing recipe of the deployment to finish first
+	if asyncBinding(req) {
+		if recipe := b.ongoingRecipe(req.Context(), instance); recipe != nil {
+			log.Ctx(req.Context()).Infof("service binding %s has to wait for ongoing recipe %s of service instance %s", bindingID, recipe.ID, instanceID)
+			operation := bindingOperation("bind", recipe.ID)
+			binding := Binding{ID: bindingID, InstanceID: instanceID, Parameters: bindingParameters(whitelist), Operation: operation, CreatedAt: time.Now()}
+			if err := b.Store.PutBinding(binding); err != nil {
+				log.Ctx(req.Context()).Warnf("could not save service binding %s of service instance %s to store: %v", bindingID, instanceID, err)
+			}
+			b.saveOperation(req.Context(), "bind", instanceID, bindingID, recipe.ID)
+			b.write(rw, req, 202, ServiceBindingOperationResponse{Operation: operation})
+			return
+		}
+	}
+
+	// each whitelist entry is a recipe of its own, they are started one after another and the binding is only created after the last one
+	steps, err := b.bindingWhitelistSteps(req.Context(), instance, bindingID, whitelist)
+	if err != nil {
+		log.Ctx(req.Context()).Errorf("could not query whitelist of service instance %s: %v", instanceID, err)
+		b.apiError(rw, req, err, 500, "UnknownError", "Could not query whitelist of service instance")
+		return
+	}
+	if len(steps) > 0 {
+		if !asyncBinding(req) {
+			log.Ctx(req.Context()).Errorf("whitelisting IP ranges of service binding %s requires async / accepts_incomplete=true and API version 2.14", bindingID)
+			b.Error(rw, req, 422, "AsyncRequired", "Whitelisting the IP ranges of a service binding requires an asynchronous operation")
+			return
+		}
+		operation, err := b.startBindingSteps(req.Context(), instance, "bind", "", instanceID, bindingID, steps)
+		if err != nil {
+			log.Ctx(req.Context()).Errorf("could not whitelist IP ranges of service binding %s on service instance %s: %v", bindingID, instanceID, err)
+			b.apiError(rw, req, err, 500, "UnknownError", "Could not whitelist IP ranges of service binding")
+			return
+		}
+		binding := Binding{ID: bindingID, InstanceID: instanceID, Parameters: bindingParameters(whitelist), Operation: operation, CreatedAt: time.Now()}
+		if err := b.Store.PutBinding(binding); err != nil {
+			log.Ctx(req.Context()).Warnf("could not save service binding %s of service instance %s to store: %v", bindingID, instanceID, err)
+		}
+		b.write(rw, req, 202, ServiceBindingOperationResponse{Operation: operation})
+		return
+	}
+
+	user, err := b.createBinding(req.Context(), instance, instanceID, bindingID, whitelist)
+	if err != nil {
+		log.Ctx(req.Context()).Errorf("could not create credentials for service binding %s on service instance %s: %v", bindingID, instanceID, err)
+		b.Error(rw, req, 500, "UnknownError", "Could not create service binding credentials")
+		return
+	}
+	b.write(rw, req, 201, b.getBinding(req.Context(), instance, user))
+}
+
+func (b *Broker) LastOperationOnBinding(rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	instanceID := vars["instanceID"]
+	bindingID := vars["bindingID"]
+
+	instance, err := b.getDeployment(req.Context(), instanceID)
+	if lookupFailed(err) {
+		log.Ctx(req.Context()).Errorf("could not query service instance %s: %v", instanceID, err)
+		b.apiError(rw, req, err, 500, "UnknownError", "Could not query service instance")
+		return
+	}
+	if err != nil || instance.Name != instanceID {
+		log.Ctx(req.Context()).Errorf("could not query service instance %s: %v", instanceID, err)
+		b.Error(rw, req, 410, "MissingServiceInstance", "The service instance does not exist")
+		return
+	}
+
+	// without an operation we can still check if the binding is waiting for a recipe
+	operation := req.URL.Query().Get("operation")
+	binding, _ := b.Store.GetBinding(instanceID, bindingID)
+	if len(operation) == 0 && binding != nil {
+		operation = binding.Operation
+	}
+	if len(operation) == 0 {
+		b.write(rw, req, 200, ServiceInstanceOperationResponse{
+			State:       "succeeded",
+			Description: "No operation to be performed on service binding",
+		})
+		return
+	}
+
+	// whitelisting moves an operation on to the recipes of its later steps
+	operationType, recipeID := parseBindingOperation(operation)
+	stored, _ := b.Store.GetOperation(operation)
+	if stored != nil && stored.InstanceID == instanceID && stored.BindingID == bindingID && len(stored.RecipeID) > 0 {
+		recipeID = stored.RecipeID
+	}
+	recipe, err := b.Client.GetRecipeContext(req.Context(), recipeID)
+	if err != nil && !api.IsNotFound(err) {
+		log.Ctx(req.Context()).Errorf("could not query recipe %s for service binding %s: %v", recipeID, bindingID, err)
+		b.apiError(rw, req, err, 500, "UnknownError", "Could not query service binding operation")
+		return
+	}
+	if err != nil || recipe.DeploymentID != instance.ID {
+		log.Ctx(req.Context()).Errorf("recipe %s does not belong to service instance %s: %v", recipeID, instanceID, err)
+		b.Error(rw, req, 400, "MalformedRequest", "Unknown operation")
+		return
+	}
+
+	if stored != nil && stored.InstanceID == instanceID && stored.BindingID == bindingID && len(stored.Steps) > 0 {
+		recipe, err = b.continueMigration(req.Context(), stored, instance.ID, recipe)
+		if err != nil {
+			log.Ctx(req.Context()).Errorf("could not continue whitelisting of service binding %s: %v", bindingID, err)
+			if api.IsValidation(err) || api.IsConflict(err) {
+				b.forgetOperation(req.Context(), operation)
+				b.write(rw, req, 200, ServiceInstanceOperationResponse{
+					State:       "failed",
+					Description: fmt.Sprintf("Failure: could not continue whitelisting: %v", err),
+				})
+				return
+			}
+			b.apiError(rw, req, err, 500, "UnknownError", "Could not continue service binding operation")
+			return
+		}
+	}
+
+	// the binding itself is only finished after its backing recipes, creating or deleting users is idempotent
+	response := recipeOperationResponse(*recipe)
+	if response.State == "succeeded" && (operationType == "bind" || operationType == "unbind") {
+		// a binding that had to wait for another recipe still has to whitelist its IP ranges, or remove them again
+		var steps []Step
+		if operationType == "bind" {
+			steps, err = b.bindingWhitelistSteps(req.Context(), instance, bindingID, bindingWhitelist(binding))
+		} else {
+			steps, err = b.unbindWhitelistSteps(req.Context(), instance, instanceID, bindingID, bindingWhitelist(binding))
+		}
+		if err == nil && len(steps) > 0 {
+			_, err = b.startBindingSteps(req.Context(), instance, operationType, operation, instanceID, bindingID, steps)
+			if err == nil {
+				b.write(rw, req, 200, ServiceInstanceOperationResponse{State: "in progress", Description: "Updating whitelist"})
+				return
+			}
+		}
+		if err != nil {
+			log.Ctx(req.Context()).Errorf("could not update whitelist for service binding %s on service instance %s: %v", bindingID, instanceID, err)
+			b.apiError(rw, req, err, 500, "UnknownError", "Could not update whitelist of service instance")
+			return
+		}
+	}
+	switch {
+	case response.State == "succeeded" && operationType == "bind":
+		if _, err := b.createBinding(req.Context(), instance, instanceID, bindingID, bindingWhitelist(binding)); err != nil {
+			log.Ctx(req.Context()).Errorf("could not create credentials for service binding %s on service instance %s: %v", bindingID, instanceID, err)
+			response = ServiceInstanceOperationResponse{State: "failed", Description: "Could not create service binding credentials"}
+		}
+	case response.State == "succeeded" && operationType == "unbind":
+		if _, err := b.deleteBinding(req.Context(), instance, instanceID, bindingID); err != nil {
+			log.Ctx(req.Context()).Errorf("could not delete credentials of service binding %s on service instance %s: %v", bindingID, instanceID, err)
+			response = ServiceInstanceOperationResponse{State: "failed", Description: "Could not delete service binding credentials"}
+		}
+	case response.State == "failed" && operationType == "bind":
+		if err := b.Store.DeleteBinding(instanceID, bindingID); err != nil {
+			log.Ctx(req.Context()).Warnf("could not remove service binding %s of service instance %s from store: %v", bindingID, instanceID, err)
+		}
+	}
+	if stored != nil && (response.State == "succeeded" || response.State == "failed") {
+		b.forgetOperation(req.Context(), operation)
+	}
+	b.write(rw, req, 200, response)
 }
 
 func (b *Broker) FetchBinding(rw http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	instanceID := vars["instanceID"]
+	bindingID := vars["bindingID"]
 
-	instance, err := b.Client.GetDeploymentByName(instanceID)
+	instance, err := b.getDeployment(req.Context(), instanceID)
+	if lookupFailed(err) {
+		log.Ctx(req.Context()).Errorf("could not query service instance %s: %v", instanceID, err)
+		b.apiError(rw, req, err, 500, "UnknownError", "Could not query service instance")
+		return
+	}
 	if err != nil || instance.Name != instanceID {
-		log.Errorf("could not query service instance %s: %v", instanceID, err)
+		log.Ctx(req.Context()).Errorf("could not query service instance %s: %v", instanceID, err)
 		b.Error(rw, req, 404, "MissingServiceInstance", "The service instance does not exist")
 		return
 	}
-	b.write(rw, req, 200, b.getBinding(instance))
+	if binding, err := b.Store.GetBinding(instanceID, bindingID); err == nil && len(binding.Operation) > 0 {
+		log.Ctx(req.Context()).Warnf("service binding %s is still waiting for operation %s", bindingID, binding.Operation)
+		b.Error(rw, req, 404, "ConcurrencyError", "The service binding is still being created")
+		return
+	}
+	b.write(rw, req, 200, b.getBinding(req.Context(), instance, b.getBindingUser(instance, bindingID)))
 }
 
 func (b *Broker) Unbind(rw http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	instanceID := vars["instanceID"]
+	bindingID := vars["bindingID"]
 
-	instance, err := b.Client.GetDeploymentByName(instanceID)
+	instance, err := b.getDeployment(req.Context(), instanceID)
+	if lookupFailed(err) {
+		log.Ctx(req.Context()).Errorf("could not query service instance %s: %v", instanceID, err)
+		b.apiError(rw, req, err, 500, "UnknownError", "Could not query service instance")
+		return
+	}
 	if err != nil || instance.Name != instanceID {
-		log.Errorf("could not query service instance %s: %v", instanceID, err)
+		log.Ctx(req.Context()).Errorf("could not query service instance %s: %v", instanceID, err)
 		b.Error(rw, req, 410, "MissingServiceInstance", "The service instance does not exist")
 		return
 	}
+
+	// without a database user the binding can only be known from the store
+	binding, _ := b.Store.GetBinding(instanceID, bindingID)
+	if binding == nil && b.getBindingUser(instance, bindingID) == nil {
+		log.Ctx(req.Context()).Errorf("could not find service binding %s of service instance %s", bindingID, instanceID)
+		b.Error(rw, req, 410, "MissingServiceBinding", "The service binding does not exist")
+		return
+	}
+
+	// if the platform allows it the unbinding waits for any ongoing recipe of the deployment to finish first
+	if asyncBinding(req) {
+		if recipe := b.ongoingRecipe(req.Context(), instance); recipe != nil {
+			log.Ctx(req.Context()).Infof("deleting service binding %s has to wait for ongoing recipe %s of service instance %s", bindingID, recipe.ID, instanceID)
+			b.saveOperation(req.Context(), "unbind", instanceID, bindingID, recipe.ID)
+			b.write(rw, req, 202, ServiceBindingOperationResponse{Operation: bindingOperation("unbind", recipe.ID)})
+			return
+		}
+	}
+
+	// whitelist entries are removed one after another as well, before the binding user is deleted
+	steps, err := b.unbindWhitelistSteps(req.Context(), instance, instanceID, bindingID, bindingWhitelist(binding))
+	if err != nil {
+		log.Ctx(req.Context()).Errorf("could not query whitelist of service instance %s: %v", instanceID, err)
+		b.apiError(rw, req, err, 500, "UnknownError", "Could not query whitelist of service instance")
+		return
+	}
+	if len(steps) > 0 {
+		if !asyncBinding(req) {
+			log.Ctx(req.Context()).Errorf("removing whitelisted IP ranges of service binding %s requires async / accepts_incomplete=true and API version 2.14", bindingID)
+			b.Error(rw, req, 422, "AsyncRequired", "Removing the whitelisted IP ranges of a service binding requires an asynchronous operation")
+			return
+		}
+		operation, err := b.startBindingSteps(req.Context(), instance, "unbind", "", instanceID, bindingID, steps)
+		if err != nil {
+			log.Ctx(req.Context()).Errorf("could not remove whitelisted IP ranges of service binding %s on service instance %s: %v", bindingID, instanceID, err)
+			b.apiError(rw, req, err, 500, "UnknownError", "Could not remove whitelisted IP ranges of service binding")
+			return
+		}
+		b.write(rw, req, 202, ServiceBindingOperationResponse{Operation: operation})
+		return
+	}
+
+	found, err := b.deleteBinding(req.Context(), instance, instanceID, bindingID)
+	if err != nil {
+		log.Ctx(req.Context()).Errorf("could not delete credentials of service binding %s on service instance %s: %v", bindingID, instanceID, err)
+		b.Error(rw, req, 500, "UnknownError", "Could not delete service binding credentials")
+		return
+	}
+	if !found && binding == nil {
+		log.Ctx(req.Context()).Errorf("could not find service binding %s of service instance %s", bindingID, instanceID)
+		b.Error(rw, req, 410, "MissingServiceBinding", "The service binding does not exist")
+		return
+	}
 	b.write(rw, req, 200, map[string]string{})
 }
 
-func (b *Broker) getBinding(deployment *api.Deployment) ServiceBindingResponse {
+// createBinding creates the database user of a binding if the deployment type supports it, and remembers the binding,
+// its IP ranges must have been whitelisted already
+func (b *Broker) createBinding(ctx context.Context, deployment *api.Deployment, instanceID, bindingID string, whitelist []string) (*credentials.User, error) {
+	user := b.getBindingUser(deployment, bindingID)
+	if user != nil {
+		if err := b.Provisioners[deployment.Type].CreateUser(deployment, *user); err != nil {
+			return nil, err
+		}
+	}
+	binding := Binding{ID: bindingID, InstanceID: instanceID, Parameters: bindingParameters(whitelist), CreatedAt: time.Now()}
+	if err := b.Store.PutBinding(binding); err != nil {
+		log.Ctx(ctx).Warnf("could not save service binding %s of service instance %s to store: %v", bindingID, instanceID, err)
+	}
+	return user, nil
+}
+
+// deleteBinding drops the database user of a binding and forgets about it, the deployment admin credentials are left untouched,
+// its whitelist entries must have been removed already. It tells whether the deployment had a user for the binding.
+func (b *Broker) deleteBinding(ctx context.Context, deployment *api.Deployment, instanceID, bindingID string) (bool, error) {
+	found := false
+	if user := b.getBindingUser(deployment, bindingID); user != nil {
+		err := b.Provisioners[deployment.Type].DeleteUser(deployment, *user)
+		if err != nil && !errors.Is(err, credentials.ErrUserNotFound) {
+			return false, err
+		}
+		found = err == nil
+	}
+	if err := b.Store.DeleteBinding(instanceID, bindingID); err != nil {
+		log.Ctx(ctx).Warnf("could not remove service binding %s of service instance %s from store: %v", bindingID, instanceID, err)
+	}
+	return found, nil
+}
+
+func bindingParameters(whitelist []string) json.RawMessage {
+	if len(whitelist) == 0 {
+		return nil
+	}
+	var binding ServiceBinding
+	binding.Parameters.Whitelist = whitelist
+	parameters, _ := json.Marshal(binding.Parameters)
+	return parameters
+}
+
+// bindingWhitelist returns the IP ranges a stored binding has added to the whitelist
+func bindingWhitelist(stored *Binding) []string {
+	var binding ServiceBinding
+	if stored == nil || len(stored.Parameters) == 0 {
+		return nil
+	}
+	_ = json.Unmarshal(stored.Parameters, &binding.Parameters)
+	return binding.Parameters.Whitelist
+}
+
+// asyncBinding tells if a binding request may be answered asynchronously, which platforms only support since version 2.14
+func asyncBinding(req *http.Request) bool {
+	return req.URL.Query().Get("accepts_incomplete") == "true" && apiVersion(req.Context()).AtLeast(14)
+}
+
+// startBindingSteps starts the first step of a binding operation and remembers the others, which last_operation continues with,
+// it returns the operation, which is named after its first recipe unless an existing one is continued
+func (b *Broker) startBindingSteps(ctx context.Context, deployment *api.Deployment, operationType, operationID, instanceID, bindingID string, steps []Step) (string, error) {
+	recipe, err := b.startStep(ctx, deployment.ID, steps[0])
+	if err != nil {
+		return "", err
+	}
+	log.Ctx(ctx).Infof("started whitelist step of %s operation for service binding %s on service instance %s: %s", operationType, bindingID, instanceID, recipe.Name)
+
+	if len(operationID) == 0 {
+		operationID = bindingOperation(operationType, recipe.ID)
+	}
+	operation := Operation{
+		ID:         operationID,
+		Type:       operationType,
+		InstanceID: instanceID,
+		BindingID:  bindingID,
+		RecipeID:   recipe.ID,
+		Steps:      steps[1:],
+		CreatedAt:  time.Now(),
+	}
+	if err := b.Store.PutOperation(operation); err != nil {
+		log.Ctx(ctx).Warnf("could not save %s operation %s of service instance %s to store: %v", operationType, operationID, instanceID, err)
+	}
+	return operationID, nil
+}
+
+// ongoingRecipe returns the currently running or waiting recipe of a deployment, if there is any
+func (b *Broker) ongoingRecipe(ctx context.Context, deployment *api.Deployment) *api.Recipe {
+	recipes, err := b.Client.GetRecipesContext(ctx, deployment.ID)
+	if err != nil {
+		log.Ctx(ctx).Warnf("could not fetch any recipes for service instance %s: %v", deployment.Name, err)
+		return nil
+	}
+	if len(recipes) > 0 {
+		recipes.SortByUpdatedAt()
+		if recipes[0].Status == "running" ||
+			recipes[0].Status == "waiting" {
+			return &recipes[0]
+		}
+	}
+	return nil
+}
+
+// bindingOperation returns the operation of a binding, which is the recipe it depends on prefixed with the operation type
+func bindingOperation(operationType, recipeID string) string {
+	return operationType + ":" + recipeID
+}
+
+func parseBindingOperation(operation string) (string, string) {
+	if parts := strings.SplitN(operation, ":", 2); len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return "", operation
+}
+
+// getBindingUser returns the database user of a binding, or nil if the deployment only has its admin credentials to offer
+func (b *Broker) getBindingUser(deployment *api.Deployment, bindingID string) *credentials.User {
+	provisioner, ok := b.Provisioners[deployment.Type]
+	if !ok || !provisioner.Supports(deployment) {
+		return nil
+	}
+	user := credentials.NewUser(b.BindingSecret, bindingID)
+	return &user
+}
+
+func (b *Broker) getBinding(ctx context.Context, deployment *api.Deployment, user *credentials.User) ServiceBindingResponse {
+	if user != nil {
+		// never hand out any of the admin connection strings together with a binding user
+		binding := *deployment
+		binding.ConnectionStrings.Direct = make([]string, 0)
+		for _, connstr := range deployment.ConnectionStrings.Direct {
+			binding.ConnectionStrings.Direct = append(binding.ConnectionStrings.Direct, user.ConnectionString(connstr))
+		}
+		binding.ConnectionStrings.CLI = nil
+		binding.ConnectionStrings.Maps = nil
+		binding.ConnectionStrings.SSH = nil
+		binding.ConnectionStrings.Health = nil
+		binding.ConnectionStrings.Admin = nil
+		deployment = &binding
+	}
+
 	credentials := ServiceBindingResponseCredentials{
 		Direct:        deployment.ConnectionStrings.Direct,
 		CLI:           deployment.ConnectionStrings.CLI,
@@ -136,9 +555,9 @@ func (b *Broker) getBinding(deployment *api.Deployment) ServiceBindingResponse {
 		}
 	}
 
-	scaling, err := b.Client.GetScaling(deployment.ID)
+	scaling, err := b.Client.GetScalingContext(ctx, deployment.ID)
 	if err != nil {
-		log.Warnf("could not query scaling parameters for service instance %s: %v", deployment.ID, err)
+		log.Ctx(ctx).Warnf("could not query scaling parameters for service instance %s: %v", deployment.ID, err)
 		scaling = &api.Scaling{}
 	}
 
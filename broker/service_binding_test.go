@@ -1,11 +1,15 @@
 package broker
 
 import (
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"github.com/JamesClonk/compose-broker/api"
+	"github.com/JamesClonk/compose-broker/credentials"
 	"github.com/JamesClonk/compose-broker/log"
 	"github.com/JamesClonk/compose-broker/util"
 	"github.com/stretchr/testify/assert"
@@ -23,7 +27,9 @@ func TestBroker_BindBinding(t *testing.T) {
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	b.Provisioners = credentials.Provisioners{}
+	r := NewRouter(b)
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("PUT", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26/service_bindings/deadbeef", nil)
@@ -31,9 +37,10 @@ func TestBroker_BindBinding(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
-	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, 201, rec.Code)
 	assert.Equal(t, util.Body("../_fixtures/broker_fetch_service_binding.json"), rec.Body.String())
 }
 
@@ -43,7 +50,9 @@ func TestBroker_BindBinding_NotFound(t *testing.T) {
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	b.Provisioners = credentials.Provisioners{}
+	r := NewRouter(b)
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("PUT", "/v2/service_instances/52551d5f-1350-4f7d-9ddd-710a47ef9b72/service_bindings/deadbeef", nil)
@@ -51,6 +60,7 @@ func TestBroker_BindBinding_NotFound(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 400, rec.Code)
@@ -66,7 +76,9 @@ func TestBroker_BindBinding_NoScaling(t *testing.T) {
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	b.Provisioners = credentials.Provisioners{}
+	r := NewRouter(b)
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("PUT", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26/service_bindings/deadbeef", nil)
@@ -74,9 +86,10 @@ func TestBroker_BindBinding_NoScaling(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
-	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, 201, rec.Code)
 	assert.Equal(t, util.Body("../_fixtures/broker_fetch_service_binding_without_scaling.json"), rec.Body.String())
 }
 
@@ -88,7 +101,9 @@ func TestBroker_FetchBinding(t *testing.T) {
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	b.Provisioners = credentials.Provisioners{}
+	r := NewRouter(b)
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("GET", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26/service_bindings/deadbeef", nil)
@@ -96,6 +111,7 @@ func TestBroker_FetchBinding(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 200, rec.Code)
@@ -108,7 +124,9 @@ func TestBroker_FetchBinding_NotFound(t *testing.T) {
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	b.Provisioners = credentials.Provisioners{}
+	r := NewRouter(b)
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("GET", "/v2/service_instances/52551d5f-1350-4f7d-9ddd-710a47ef9b72/service_bindings/deadbeef", nil)
@@ -116,6 +134,7 @@ func TestBroker_FetchBinding_NotFound(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 404, rec.Code)
@@ -131,7 +150,9 @@ func TestBroker_FetchBinding_NoScaling(t *testing.T) {
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	b.Provisioners = credentials.Provisioners{}
+	r := NewRouter(b)
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("GET", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26/service_bindings/deadbeef", nil)
@@ -139,6 +160,7 @@ func TestBroker_FetchBinding_NoScaling(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 200, rec.Code)
@@ -152,7 +174,10 @@ func TestBroker_UnbindBinding(t *testing.T) {
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	b.Provisioners = credentials.Provisioners{}
+	_ = b.Store.PutBinding(Binding{ID: "deadbeef", InstanceID: "8dcdf609-36c9-4b22-bb16-d97e48c50f26"})
+	r := NewRouter(b)
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("DELETE", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26/service_bindings/deadbeef", nil)
@@ -160,10 +185,47 @@ func TestBroker_UnbindBinding(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 200, rec.Code)
 	assert.Equal(t, `{}`, rec.Body.String())
+	_, err = b.Store.GetBinding("8dcdf609-36c9-4b22-bb16-d97e48c50f26", "deadbeef")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestBroker_UnbindBinding_Gone(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments", Code: 200, Body: util.Body("../_fixtures/api_get_deployments.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment.json"), Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	r := NewRouter(b)
+
+	unbind := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req, err := http.NewRequest("DELETE", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26/service_bindings/deadbeef", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("broker", "pw")
+		req.Header.Set("X-Broker-API-Version", "2.15")
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// neither the store nor a database user of the deployment knows the binding
+	b.Provisioners = credentials.Provisioners{}
+	rec := unbind()
+	assert.Equal(t, 410, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"error": "MissingServiceBinding"`)
+
+	b.Provisioners = credentials.Provisioners{"postgresql": credentials.NewFake()}
+	rec = unbind()
+	assert.Equal(t, 410, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"error": "MissingServiceBinding"`)
 }
 
 func TestBroker_UnbindBinding_NotFound(t *testing.T) {
@@ -172,7 +234,9 @@ func TestBroker_UnbindBinding_NotFound(t *testing.T) {
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	b.Provisioners = credentials.Provisioners{}
+	r := NewRouter(b)
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("DELETE", "/v2/service_instances/52551d5f-1350-4f7d-9ddd-710a47ef9b72/service_bindings/deadbeef", nil)
@@ -180,9 +244,557 @@ func TestBroker_UnbindBinding_NotFound(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 410, rec.Code)
 	assert.Contains(t, rec.Body.String(), `"error": "MissingServiceInstance"`)
 	assert.Contains(t, rec.Body.String(), `"description": "The service instance does not exist"`)
 }
+
+func TestBroker_BindBinding_WithUser(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments", Code: 200, Body: util.Body("../_fixtures/api_get_deployments.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment_for_service_binding.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/scalings", Code: 200, Body: util.Body("../_fixtures/api_get_scaling_for_service_binding.json"), Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	fake := credentials.NewFake()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	b.Provisioners = credentials.Provisioners{"postgresql": fake}
+	r := NewRouter(b)
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("PUT", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26/service_bindings/deadbeef", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 201, rec.Code)
+	assert.Equal(t, util.Body("../_fixtures/broker_fetch_service_binding_with_user.json"), rec.Body.String())
+	assert.True(t, fake.HasUser(&api.Deployment{ID: "5854017e89d50f424e000192"}, credentials.NewUser("secret", "deadbeef").Username))
+	assert.NotContains(t, rec.Body.String(), "XXXX")
+	assert.NotContains(t, rec.Body.String(), "YYYY")
+
+	binding, err := b.Store.GetBinding("8dcdf609-36c9-4b22-bb16-d97e48c50f26", "deadbeef")
+	assert.NoError(t, err)
+	assert.Equal(t, "deadbeef", binding.ID)
+}
+
+func TestBroker_BindBinding_WithUserFailure(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments", Code: 200, Body: util.Body("../_fixtures/api_get_deployments.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment_for_service_binding.json"), Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	fake := credentials.NewFake()
+	fake.Err = errors.New("connection refused")
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	b.Provisioners = credentials.Provisioners{"postgresql": fake}
+	r := NewRouter(b)
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("PUT", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26/service_bindings/deadbeef", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 500, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"error": "UnknownError"`)
+	assert.Contains(t, rec.Body.String(), `"description": "Could not create service binding credentials"`)
+}
+
+func TestBroker_FetchBinding_WithUser(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments", Code: 200, Body: util.Body("../_fixtures/api_get_deployments.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment_for_service_binding.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/scalings", Code: 200, Body: util.Body("../_fixtures/api_get_scaling_for_service_binding.json"), Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	b.Provisioners = credentials.Provisioners{"postgresql": credentials.NewFake()}
+	r := NewRouter(b)
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26/service_bindings/deadbeef", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, util.Body("../_fixtures/broker_fetch_service_binding_with_user.json"), rec.Body.String())
+}
+
+func TestBroker_UnbindBinding_WithUser(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments", Code: 200, Body: util.Body("../_fixtures/api_get_deployments.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment_for_service_binding.json"), Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	deployment := &api.Deployment{ID: "5854017e89d50f424e000192"}
+	fake := credentials.NewFake()
+	_ = fake.CreateUser(deployment, credentials.NewUser("secret", "deadbeef"))
+	_ = fake.CreateUser(deployment, credentials.NewUser("secret", "beefdead"))
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	b.Provisioners = credentials.Provisioners{"postgresql": fake}
+	r := NewRouter(b)
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("DELETE", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26/service_bindings/deadbeef", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, `{}`, rec.Body.String())
+	assert.False(t, fake.HasUser(deployment, credentials.NewUser("secret", "deadbeef").Username))
+	assert.True(t, fake.HasUser(deployment, credentials.NewUser("secret", "beefdead").Username)) // other bindings must keep their access
+}
+
+func TestBroker_BindBinding_Async(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments", Code: 200, Body: util.Body("../_fixtures/api_get_deployments.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment_for_service_binding.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/recipes", Code: 200, Body: util.Body("../_fixtures/api_get_recipes_for_concurrency_error_422.json"), Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	fake := credentials.NewFake()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	b.Provisioners = credentials.Provisioners{"postgresql": fake}
+	r := NewRouter(b)
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("PUT", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26/service_bindings/deadbeef?accepts_incomplete=true", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 202, rec.Code)
+	assert.JSONEq(t, `{"operation": "bind:570bf60a70ea13000d000000"}`, rec.Body.String())
+	assert.False(t, fake.HasUser(&api.Deployment{ID: "5854017e89d50f424e000192"}, credentials.NewUser("secret", "deadbeef").Username))
+
+	operation, err := b.Store.GetOperation("bind:570bf60a70ea13000d000000")
+	assert.NoError(t, err)
+	assert.Equal(t, "deadbeef", operation.BindingID)
+	assert.Equal(t, "570bf60a70ea13000d000000", operation.RecipeID)
+
+	// the binding must not be retrievable yet
+	rec = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26/service_bindings/deadbeef", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 404, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"error": "ConcurrencyError"`)
+}
+
+func TestBroker_BindBinding_AsyncBeforeVersion14(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments", Code: 200, Body: util.Body("../_fixtures/api_get_deployments.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment_for_service_binding.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/recipes", Code: 200, Body: util.Body("../_fixtures/api_get_recipes_for_concurrency_error_422.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/scalings", Code: 200, Body: util.Body("../_fixtures/api_get_scaling_for_service_binding.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/whitelist", Code: 200, Body: util.Body("../_fixtures/api_get_whitelist.json"), Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	b.Provisioners = credentials.Provisioners{}
+	r := NewRouter(b)
+
+	// platforms before version 2.14 can't poll the last operation of a binding, it is created right away
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("PUT", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26/service_bindings/deadbeef?accepts_incomplete=true", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.13")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 201, rec.Code)
+	_, err = b.Store.GetOperation("bind:570bf60a70ea13000d000000")
+	assert.Equal(t, ErrNotFound, err)
+
+	// and can't get an IP range whitelisted
+	rec = httptest.NewRecorder()
+	req, err = http.NewRequest("PUT", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26/service_bindings/beefdead?accepts_incomplete=true", strings.NewReader(`{
+  "parameters": { "whitelist": [ "35.157.12.40" ] }
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.13")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 422, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"error": "AsyncRequired"`)
+}
+
+func TestBroker_BindBinding_AsyncNoOngoingRecipe(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments", Code: 200, Body: util.Body("../_fixtures/api_get_deployments.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment_for_service_binding.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/recipes", Code: 200, Body: util.Body("../_fixtures/api_get_recipes_for_last_operation_succeeded.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/scalings", Code: 200, Body: util.Body("../_fixtures/api_get_scaling_for_service_binding.json"), Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	b.Provisioners = credentials.Provisioners{}
+	r := NewRouter(b)
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("PUT", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26/service_bindings/deadbeef?accepts_incomplete=true", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 201, rec.Code)
+	assert.Equal(t, util.Body("../_fixtures/broker_fetch_service_binding.json"), rec.Body.String())
+}
+
+func TestBroker_LastOperationBinding(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments", Code: 200, Body: util.Body("../_fixtures/api_get_deployments.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment_for_service_binding.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/recipes/5821fd28a4b549d06e39886d", Code: 200, Body: util.Body("../_fixtures/api_get_recipe.json"), Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	fake := credentials.NewFake()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	b.Provisioners = credentials.Provisioners{"postgresql": fake}
+	_ = b.Store.PutBinding(Binding{ID: "deadbeef", InstanceID: "8dcdf609-36c9-4b22-bb16-d97e48c50f26", Operation: "bind:5821fd28a4b549d06e39886d"})
+	r := NewRouter(b)
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26/service_bindings/deadbeef/last_operation?operation=bind:5821fd28a4b549d06e39886d", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 200, rec.Code)
+	assert.JSONEq(t, `{"state": "succeeded", "description": "Provision complete"}`, rec.Body.String())
+	assert.True(t, fake.HasUser(&api.Deployment{ID: "5854017e89d50f424e000192"}, credentials.NewUser("secret", "deadbeef").Username))
+
+	binding, err := b.Store.GetBinding("8dcdf609-36c9-4b22-bb16-d97e48c50f26", "deadbeef")
+	assert.NoError(t, err)
+	assert.Empty(t, binding.Operation)
+}
+
+func TestBroker_LastOperationBinding_InProgress(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments", Code: 200, Body: util.Body("../_fixtures/api_get_deployments.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment_for_service_binding.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/recipes/570bf60a70ea13000d000000", Code: 200, Body: util.Body("../_fixtures/api_get_recipe_for_service_deprovision.json"), Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	fake := credentials.NewFake()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	b.Provisioners = credentials.Provisioners{"postgresql": fake}
+	_ = b.Store.PutBinding(Binding{ID: "deadbeef", InstanceID: "8dcdf609-36c9-4b22-bb16-d97e48c50f26", Operation: "bind:570bf60a70ea13000d000000"})
+	r := NewRouter(b)
+
+	// the operation of the binding is known from the store
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26/service_bindings/deadbeef/last_operation", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 200, rec.Code)
+	assert.JSONEq(t, `{"state": "in progress", "description": "Deprovision operation in progress [1/2]"}`, rec.Body.String())
+	assert.False(t, fake.HasUser(&api.Deployment{ID: "5854017e89d50f424e000192"}, credentials.NewUser("secret", "deadbeef").Username))
+}
+
+func TestBroker_UnbindBinding_Async(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments", Code: 200, Body: util.Body("../_fixtures/api_get_deployments.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment_for_service_binding.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/recipes", Code: 200, Body: util.Body("../_fixtures/api_get_recipes_for_concurrency_error_422.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/recipes/5821fd28a4b549d06e39886d", Code: 200, Body: util.Body("../_fixtures/api_get_recipe.json"), Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	deployment := &api.Deployment{ID: "5854017e89d50f424e000192"}
+	fake := credentials.NewFake()
+	_ = fake.CreateUser(deployment, credentials.NewUser("secret", "deadbeef"))
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	b.Provisioners = credentials.Provisioners{"postgresql": fake}
+	r := NewRouter(b)
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("DELETE", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26/service_bindings/deadbeef?accepts_incomplete=true", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 202, rec.Code)
+	assert.JSONEq(t, `{"operation": "unbind:570bf60a70ea13000d000000"}`, rec.Body.String())
+	assert.True(t, fake.HasUser(deployment, credentials.NewUser("secret", "deadbeef").Username))
+
+	rec = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26/service_bindings/deadbeef/last_operation?operation=unbind:5821fd28a4b549d06e39886d", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 200, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"state": "succeeded"`)
+	assert.False(t, fake.HasUser(deployment, credentials.NewUser("secret", "deadbeef").Username))
+}
+
+func TestBroker_BindBinding_Whitelist(t *testing.T) {
+	added := make([]string, 0)
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments", Code: 200, Body: util.Body("../_fixtures/api_get_deployments.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment_for_service_binding.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/scalings", Code: 200, Body: util.Body("../_fixtures/api_get_scaling_for_service_binding.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/whitelist", Code: 200, Body: util.Body("../_fixtures/api_get_whitelist.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/recipes/5a4b1c2d3e4f5a001a3e6101", Code: 200, Body: util.Body("../_fixtures/api_get_recipe_for_whitelist.json"), Test: nil},
+		util.HttpTestCase{Method: "POST", Path: "/deployments/5854017e89d50f424e000192/whitelist", Code: 202, Body: util.Body("../_fixtures/api_add_whitelist.json"), Test: func(body string) {
+			added = append(added, body)
+		}},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	b.Provisioners = credentials.Provisioners{}
+	r := NewRouter(b)
+
+	// 10.0.0.0/8 is already whitelisted for the whole service instance, the other ranges are added one after another
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("PUT", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26/service_bindings/deadbeef?accepts_incomplete=true", strings.NewReader(`{
+  "service_id": "9b4ee86b-3876-469f-a531-062e71bc5859",
+  "plan_id": "d6222855-17c6-448c-885a-e9d931cd221b",
+  "parameters": { "whitelist": [ "35.157.12.40", "35.157.12.41", "10.0.0.0/8" ] }
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 202, rec.Code)
+	assert.JSONEq(t, `{"operation": "bind:5a4b1c2d3e4f5a001a3e6101"}`, rec.Body.String())
+	assert.Equal(t, []string{`{"deployment":{"whitelist":{"ip":"35.157.12.40/32","description":"compose-broker binding deadbeef"}}}`}, added)
+	binding, err := b.Store.GetBinding("8dcdf609-36c9-4b22-bb16-d97e48c50f26", "deadbeef")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"35.157.12.40/32", "35.157.12.41/32", "10.0.0.0/8"}, bindingWhitelist(binding))
+		assert.Equal(t, "bind:5a4b1c2d3e4f5a001a3e6101", binding.Operation)
+	}
+	operation, err := b.Store.GetOperation("bind:5a4b1c2d3e4f5a001a3e6101")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []Step{Step{WhitelistAdd: "35.157.12.41/32", WhitelistBinding: "deadbeef"}}, operation.Steps)
+	}
+
+	// the next range is only whitelisted once the first recipe has completed
+	rec = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26/service_bindings/deadbeef/last_operation?operation=bind:5a4b1c2d3e4f5a001a3e6101", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 200, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"state": "in progress"`)
+	if assert.Len(t, added, 2) {
+		assert.Equal(t, `{"deployment":{"whitelist":{"ip":"35.157.12.41/32","description":"compose-broker binding deadbeef"}}}`, added[1])
+	}
+	operation, err = b.Store.GetOperation("bind:5a4b1c2d3e4f5a001a3e6101")
+	if assert.NoError(t, err) {
+		assert.Empty(t, operation.Steps)
+	}
+}
+
+func TestBroker_BindBinding_WhitelistNotAsync(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments", Code: 200, Body: util.Body("../_fixtures/api_get_deployments.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment_for_service_binding.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/whitelist", Code: 200, Body: util.Body("../_fixtures/api_get_whitelist.json"), Test: nil},
+		util.HttpTestCase{Method: "POST", Path: "/deployments/5854017e89d50f424e000192/whitelist", Code: 202, Body: util.Body("../_fixtures/api_add_whitelist.json"), Test: func(body string) {
+			t.Error("must not whitelist anything without accepts_incomplete=true")
+		}},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	b.Provisioners = credentials.Provisioners{}
+	r := NewRouter(b)
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("PUT", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26/service_bindings/deadbeef", strings.NewReader(`{
+  "parameters": { "whitelist": [ "35.157.12.40" ] }
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 422, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"error": "AsyncRequired"`)
+	_, err = b.Store.GetBinding("8dcdf609-36c9-4b22-bb16-d97e48c50f26", "deadbeef")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestBroker_BindBinding_InvalidWhitelist(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments", Code: 200, Body: util.Body("../_fixtures/api_get_deployments.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment_for_service_binding.json"), Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("PUT", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26/service_bindings/deadbeef", strings.NewReader(`{
+  "parameters": { "whitelist": [ "my-app.example.com" ] }
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 400, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"description": "Invalid whitelist entry my-app.example.com, must be an IP address or range in CIDR notation"`)
+}
+
+func TestBroker_UnbindBinding_Whitelist(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments", Code: 200, Body: util.Body("../_fixtures/api_get_deployments.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/whitelist", Code: 200, Body: util.Body("../_fixtures/api_get_whitelist.json"), Test: nil},
+		util.HttpTestCase{Method: "DELETE", Path: "/deployments/5854017e89d50f424e000192/whitelist/5a4b1c2d3e4f5a001a3e6003", Code: 202, Body: util.Body("../_fixtures/api_delete_whitelist.json"), Test: nil},
+		util.HttpTestCase{Method: "DELETE", Path: "/deployments/5854017e89d50f424e000192/whitelist/5a4b1c2d3e4f5a001a3e6001", Code: 500, Body: "", Test: func(body string) {
+			t.Error("must only remove the whitelist entries of the service binding")
+		}},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	b.Provisioners = credentials.Provisioners{}
+	_ = b.Store.PutBinding(Binding{
+		ID:         "3f2a9c1e-7b4d-4e8a-a1f6-9c0d2b5e8f17",
+		InstanceID: "8dcdf609-36c9-4b22-bb16-d97e48c50f26",
+		Parameters: bindingParameters([]string{"52.28.10.5/32"}),
+	})
+	r := NewRouter(b)
+
+	// removing the whitelist entry is a recipe, the binding is only forgotten once it has completed
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("DELETE", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26/service_bindings/3f2a9c1e-7b4d-4e8a-a1f6-9c0d2b5e8f17?accepts_incomplete=true", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 202, rec.Code)
+	assert.JSONEq(t, `{"operation": "unbind:5a4b1c2d3e4f5a001a3e6102"}`, rec.Body.String())
+	_, err = b.Store.GetBinding("8dcdf609-36c9-4b22-bb16-d97e48c50f26", "3f2a9c1e-7b4d-4e8a-a1f6-9c0d2b5e8f17")
+	assert.NoError(t, err)
+
+	// without accepts_incomplete=true the whitelist entry can't be removed
+	rec = httptest.NewRecorder()
+	req, err = http.NewRequest("DELETE", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26/service_bindings/3f2a9c1e-7b4d-4e8a-a1f6-9c0d2b5e8f17", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 422, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"error": "AsyncRequired"`)
+}
+
+func TestBroker_UnbindBinding_WhitelistShared(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments", Code: 200, Body: util.Body("../_fixtures/api_get_deployments.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/whitelist", Code: 200, Body: util.Body("../_fixtures/api_get_whitelist.json"), Test: nil},
+		util.HttpTestCase{Method: "DELETE", Path: "/deployments/5854017e89d50f424e000192/whitelist/5a4b1c2d3e4f5a001a3e6003", Code: 500, Body: "", Test: func(body string) {
+			t.Error("must not remove a whitelist entry another service binding still uses")
+		}},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	b.Provisioners = credentials.Provisioners{}
+	_ = b.Store.PutBinding(Binding{
+		ID:         "3f2a9c1e-7b4d-4e8a-a1f6-9c0d2b5e8f17",
+		InstanceID: "8dcdf609-36c9-4b22-bb16-d97e48c50f26",
+		Parameters: bindingParameters([]string{"52.28.10.5/32"}),
+	})
+	_ = b.Store.PutBinding(Binding{
+		ID:         "deadbeef",
+		InstanceID: "8dcdf609-36c9-4b22-bb16-d97e48c50f26",
+		Parameters: bindingParameters([]string{"52.28.10.5/32"}),
+	})
+	r := NewRouter(b)
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("DELETE", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26/service_bindings/3f2a9c1e-7b4d-4e8a-a1f6-9c0d2b5e8f17", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 200, rec.Code)
+	_, err = b.Store.GetBinding("8dcdf609-36c9-4b22-bb16-d97e48c50f26", "3f2a9c1e-7b4d-4e8a-a1f6-9c0d2b5e8f17")
+	assert.Equal(t, ErrNotFound, err)
+	_, err = b.Store.GetBinding("8dcdf609-36c9-4b22-bb16-d97e48c50f26", "deadbeef")
+	assert.NoError(t, err)
+}
@@ -1,11 +1,13 @@
 package broker
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/JamesClonk/compose-broker/api"
 	"github.com/JamesClonk/compose-broker/log"
@@ -13,18 +15,24 @@ import (
 )
 
 type ServiceInstanceProvisioning struct {
-	ServiceID  string `json:"service_id"`
-	PlanID     string `json:"plan_id"`
-	Parameters struct {
-		AccountID  string `json:"account_id"`
-		Datacenter string `json:"datacenter"`
-		Version    string `json:"version"`
-		Units      int    `json:"units"`
-		CacheMode  bool   `json:"cache_mode"`
+	ServiceID        string           `json:"service_id"`
+	PlanID           string           `json:"plan_id"`
+	OrganizationGUID string           `json:"organization_guid,omitempty"` // deprecated in favor of context
+	SpaceGUID        string           `json:"space_guid,omitempty"`        // deprecated in favor of context
+	Context          *PlatformContext `json:"context,omitempty"`
+	Parameters       struct {
+		AccountID         string   `json:"account_id,omitempty"`
+		Datacenter        string   `json:"datacenter,omitempty"`
+		Version           string   `json:"version,omitempty"`
+		Units             int      `json:"units,omitempty"`
+		CacheMode         bool     `json:"cache_mode,omitempty"`
+		RestoreFromBackup string   `json:"restore_from_backup,omitempty"`
+		Whitelist         []string `json:"whitelist,omitempty"`
 	} `json:"parameters"`
 }
 type ServiceInstanceProvisioningResponse struct {
 	DashboardURL string `json:"dashboard_url"`
+	Operation    string `json:"operation,omitempty"`
 }
 
 type ServiceInstanceOperationResponse struct {
@@ -33,23 +41,35 @@ type ServiceInstanceOperationResponse struct {
 }
 
 type ServiceInstanceFetchResponse struct {
+	ServiceID    string                                 `json:"service_id,omitempty"`
+	PlanID       string                                 `json:"plan_id,omitempty"`
 	DashboardURL string                                 `json:"dashboard_url"`
 	Parameters   ServiceInstanceFetchResponseParameters `json:"parameters"`
 }
 type ServiceInstanceFetchResponseParameters struct {
-	Deployment api.Deployment `json:"deployment"`
-	Scaling    api.Scaling    `json:"scaling"`
+	Deployment api.Deployment   `json:"deployment"`
+	Scaling    api.Scaling      `json:"scaling"`
+	Context    *PlatformContext `json:"context,omitempty"`
 }
 
 type ServiceInstanceUpdate struct {
-	ServiceID  string `json:"service_id"`
-	PlanID     string `json:"plan_id"`
+	ServiceID  string           `json:"service_id"`
+	PlanID     string           `json:"plan_id"`
+	Context    *PlatformContext `json:"context,omitempty"`
 	Parameters struct {
-		Units int `json:"units"`
+		Units          int      `json:"units,omitempty"`
+		Version        string   `json:"version,omitempty"`
+		OnDemandBackup bool     `json:"on_demand_backup,omitempty"`
+		Whitelist      []string `json:"whitelist,omitempty"`
 	} `json:"parameters"`
 }
 type ServiceInstanceUpdateResponse struct {
 	DashboardURL string `json:"dashboard_url"`
+	Operation    string `json:"operation,omitempty"`
+}
+
+type ServiceInstanceDeprovisionResponse struct {
+	Operation string `json:"operation,omitempty"`
 }
 
 func (b *Broker) ProvisionInstance(rw http.ResponseWriter, req *http.Request) {
@@ -59,20 +79,20 @@ func (b *Broker) ProvisionInstance(rw http.ResponseWriter, req *http.Request) {
 	// verify request is async, must have query param "?accepts_incomplete=true"
 	incomplete := req.URL.Query().Get("accepts_incomplete")
 	if incomplete != "true" {
-		log.Errorf("creating service instance %s requires async / accepts_incomplete=true", instanceID)
+		log.Ctx(req.Context()).Errorf("creating service instance %s requires async / accepts_incomplete=true", instanceID)
 		b.Error(rw, req, 422, "AsyncRequired", "Service instance provisioning requires an asynchronous operation")
 		return
 	}
 
 	if req.Body == nil {
-		log.Errorf("error reading provisioning request for service instance %s: %v", instanceID, req)
+		log.Ctx(req.Context()).Errorf("error reading provisioning request for service instance %s: %v", instanceID, req)
 		b.Error(rw, req, 400, "MalformedRequest", "Could not read provisioning request")
 		return
 	}
 	body, err := ioutil.ReadAll(req.Body)
 	if err != nil {
-		log.Errorln(err)
-		log.Errorf("error reading provisioning request for service instance %s: %v", instanceID, req)
+		log.Ctx(req.Context()).Errorln(err)
+		log.Ctx(req.Context()).Errorf("error reading provisioning request for service instance %s: %v", instanceID, req)
 		b.Error(rw, req, 400, "MalformedRequest", "Could not read provisioning request")
 		return
 	}
@@ -80,10 +100,19 @@ func (b *Broker) ProvisionInstance(rw http.ResponseWriter, req *http.Request) {
 		body = []byte("{}")
 	}
 
+	// validate parameters against the schema of the plan before interpreting them
+	var schemaReq schemaRequest
+	if err := json.Unmarshal([]byte(body), &schemaReq); err == nil {
+		schemas := b.planSchemas(schemaReq.ServiceID, schemaReq.PlanID)
+		if !b.checkParameters(rw, req, instanceID, schemas.ServiceInstance.Create.Parameters, schemaReq.Parameters) {
+			return
+		}
+	}
+
 	var provisioning ServiceInstanceProvisioning
 	if err := json.Unmarshal([]byte(body), &provisioning); err != nil {
-		log.Errorln(err)
-		log.Errorf("could not unmarshal provisioning request body for service instance %s: %v", instanceID, string(body))
+		log.Ctx(req.Context()).Errorln(err)
+		log.Ctx(req.Context()).Errorf("could not unmarshal provisioning request body for service instance %s: %v", instanceID, string(body))
 		b.Error(rw, req, 400, "MalformedRequest", "Could not unmarshal provisioning request")
 		return
 	}
@@ -94,7 +123,7 @@ func (b *Broker) ProvisionInstance(rw http.ResponseWriter, req *http.Request) {
 	var units int
 	if len(provisioning.PlanID) > 0 {
 		// get plan values
-		for _, service := range b.ServiceCatalog.Services {
+		for _, service := range b.ServiceCatalog().Services {
 			if provisioning.ServiceID == service.ID {
 				for _, plan := range service.Plans {
 					if provisioning.PlanID == plan.ID {
@@ -108,7 +137,7 @@ func (b *Broker) ProvisionInstance(rw http.ResponseWriter, req *http.Request) {
 			}
 		}
 		if len(deploymentType) == 0 {
-			log.Errorf("could not find plan_id %s for provisioning service instance %s", provisioning.PlanID, instanceID)
+			log.Ctx(req.Context()).Errorf("could not find plan_id %s for provisioning service instance %s", provisioning.PlanID, instanceID)
 			b.Error(rw, req, 400, "MalformedRequest", "Unknown plan_id")
 			return
 		}
@@ -120,10 +149,18 @@ func (b *Broker) ProvisionInstance(rw http.ResponseWriter, req *http.Request) {
 	}
 	// verify scaling target value (units)
 	if units < 1 {
-		log.Errorf("units value %d must be greater than 0 for provisioning service instance %s", units, instanceID)
+		log.Ctx(req.Context()).Errorf("units value %d must be greater than 0 for provisioning service instance %s", units, instanceID)
 		b.Error(rw, req, 400, "MissingParameters", "Units parameter is missing for service instance provisioning")
 		return
 	}
+	// units must stay within the bounds of the plan
+	if _, plan := b.ServiceCatalog().Plan(provisioning.ServiceID, provisioning.PlanID); plan != nil {
+		if reason := plan.checkUnits(units); len(reason) > 0 {
+			log.Ctx(req.Context()).Errorf("units value %d not permitted for provisioning service instance %s: %s", units, instanceID, reason)
+			b.Error(rw, req, 400, "ValidationError", reason)
+			return
+		}
+	}
 
 	// account_id can be set to a global default value
 	if len(b.APIConfig.DefaultAccountID) > 0 {
@@ -135,10 +172,10 @@ func (b *Broker) ProvisionInstance(rw http.ResponseWriter, req *http.Request) {
 	}
 	if len(accountID) == 0 {
 		// get accountID from API
-		accounts, err := b.Client.GetAccounts()
+		accounts, err := b.Client.GetAccountsContext(req.Context())
 		if err != nil {
-			log.Errorf("could not fetch accounts: %v", err)
-			b.Error(rw, req, 409, "UnknownError", "Could not read Compose.io accounts")
+			log.Ctx(req.Context()).Errorf("could not fetch accounts: %v", err)
+			b.apiError(rw, req, err, 409, "UnknownError", "Could not read Compose.io accounts")
 			return
 		}
 		if len(accounts) > 0 {
@@ -146,7 +183,7 @@ func (b *Broker) ProvisionInstance(rw http.ResponseWriter, req *http.Request) {
 		}
 	}
 	if len(accountID) == 0 {
-		log.Errorf("account_id for provisioning service instance %s could not be determined", instanceID)
+		log.Ctx(req.Context()).Errorf("account_id for provisioning service instance %s could not be determined", instanceID)
 		b.Error(rw, req, 400, "MissingParameters", "AccountID is missing for service instance provisioning")
 		return
 	}
@@ -170,11 +207,35 @@ func (b *Broker) ProvisionInstance(rw http.ResponseWriter, req *http.Request) {
 		cacheMode = provisioning.Parameters.CacheMode
 	}
 
+	// whitelist can also be provided as provisioning parameter, takes precedence over the default whitelist
+	whitelist := b.APIConfig.DefaultWhitelist
+	if provisioning.Parameters.Whitelist != nil {
+		var err error
+		if whitelist, err = normalizeWhitelist(provisioning.Parameters.Whitelist); err != nil {
+			log.Ctx(req.Context()).Errorf("invalid whitelist for provisioning service instance %s: %v", instanceID, err)
+			b.Error(rw, req, 400, "MalformedRequest", err.Error())
+			return
+		}
+	}
+
 	// check if it already exists
-	if instance, err := b.Client.GetDeploymentByName(instanceID); err == nil && instance.Name == instanceID {
-		recipes, err := b.Client.GetRecipes(instance.ID)
+	instance, err := b.getDeployment(req.Context(), instanceID)
+	if lookupFailed(err) {
+		log.Ctx(req.Context()).Errorf("could not query service instance %s: %v", instanceID, err)
+		b.apiError(rw, req, err, 500, "UnknownError", "Could not query service instance")
+		return
+	}
+	if err == nil && instance.Name == instanceID {
+		// the platform is asking for this service instance again, so it is no orphan after all
+		if stored, err := b.Store.GetInstance(instanceID); err == nil && (len(stored.DeploymentID) == 0 || stored.Abandoned) {
+			stored.DeploymentID = instance.ID
+			stored.Abandoned = false
+			b.saveInstance(req.Context(), *stored)
+		}
+
+		recipes, err := b.Client.GetRecipesContext(req.Context(), instance.ID)
 		if err != nil {
-			log.Warnf("could not fetch any recipes for service instance %s: %v", instanceID, err)
+			log.Ctx(req.Context()).Warnf("could not fetch any recipes for service instance %s: %v", instanceID, err)
 		}
 		if len(recipes) > 0 {
 			recipes.SortByUpdatedAt()
@@ -186,48 +247,155 @@ func (b *Broker) ProvisionInstance(rw http.ResponseWriter, req *http.Request) {
 			if recipes[0].Name == "Provision" &&
 				(recipes[0].Status == "running" ||
 					recipes[0].Status == "waiting") {
-				log.Infof("service instance %s is already ongoing provisioning, nothing to do", instanceID)
+				log.Ctx(req.Context()).Infof("service instance %s is already ongoing provisioning, nothing to do", instanceID)
+				provisionResponse.Operation = recipes[0].ID
 				b.write(rw, req, 202, provisionResponse)
 				return
 			}
 			if recipes[0].Status == "complete" {
-				if scaling, err := b.Client.GetScaling(instance.ID); err == nil && scaling.AllocatedUnits == units {
-					log.Infof("service instance %s already exists and has same scaling, nothing to do", instanceID)
+				if scaling, err := b.Client.GetScalingContext(req.Context(), instance.ID); err == nil && scaling.AllocatedUnits == units {
+					log.Ctx(req.Context()).Infof("service instance %s already exists and has same scaling, nothing to do", instanceID)
 					b.write(rw, req, 200, provisionResponse)
 					return
 				}
 			}
 		}
-		log.Errorf("could not create service instance %s: %v", instanceID, err)
+		log.Ctx(req.Context()).Errorf("could not create service instance %s: %v", instanceID, err)
 		b.Error(rw, req, 409, "UnknownError", "Could not create service instance")
 		return
 	}
 
+	parameters, _ := json.Marshal(provisioning.Parameters)
+	stored := Instance{
+		ID:         instanceID,
+		ServiceID:  provisioning.ServiceID,
+		PlanID:     provisioning.PlanID,
+		Context:    platformContext(provisioning),
+		Parameters: parameters,
+	}
+	if stored.Context != nil {
+		stored.OrganizationGUID = stored.Context.OrganizationGUID
+		stored.SpaceGUID = stored.Context.SpaceGUID
+	}
+
+	// a backup can only be restored from another service instance of the same service in the same space or namespace
+	var backup *api.Backup
+	if len(provisioning.Parameters.RestoreFromBackup) > 0 {
+		backup, err = b.findBackup(req.Context(), provisioning.ServiceID, stored.scope(), provisioning.Parameters.RestoreFromBackup)
+		if err != nil {
+			log.Ctx(req.Context()).Errorf("could not query backup %s for service instance %s: %v", provisioning.Parameters.RestoreFromBackup, instanceID, err)
+			b.apiError(rw, req, err, 500, "UnknownError", "Could not query backup")
+			return
+		}
+		if backup == nil {
+			log.Ctx(req.Context()).Errorf("backup %s for service instance %s not found in %s", provisioning.Parameters.RestoreFromBackup, instanceID, stored.scope())
+			b.Error(rw, req, 400, "MalformedRequest", fmt.Sprintf("Backup %s does not belong to any service instance of this service in the same space", provisioning.Parameters.RestoreFromBackup))
+			return
+		}
+		if !backup.IsRestorable || backup.Status != "complete" {
+			log.Ctx(req.Context()).Errorf("backup %s for service instance %s is not restorable: %s", backup.ID, instanceID, backup.Status)
+			b.Error(rw, req, 400, "MalformedRequest", fmt.Sprintf("Backup %s can not be restored", backup.ID))
+			return
+		}
+	}
+
+	// the organization, space or namespace must permit the plan and have enough quota left for the service instance
+	if service, plan := b.ServiceCatalog().Plan(provisioning.ServiceID, provisioning.PlanID); plan != nil {
+		if reason := b.checkPlanQuota(stored.Context, service, plan); len(reason) > 0 {
+			log.Ctx(req.Context()).Errorf("could not create service instance %s: %s", instanceID, reason)
+			b.Error(rw, req, 400, "PlanNotPermitted", reason)
+			return
+		}
+	}
+	if len(b.Quotas.scopes(stored.Context)) > 0 {
+		b.quotaMutex.Lock() // until the deployment has been created
+		defer b.quotaMutex.Unlock()
+	}
+	reason, err := b.checkQuota(req.Context(), instanceID, stored.Context, units)
+	if err != nil {
+		log.Ctx(req.Context()).Errorf("could not check quota for service instance %s: %v", instanceID, err)
+		b.apiError(rw, req, err, 500, "UnknownError", "Could not check quota")
+		return
+	}
+	if len(reason) > 0 {
+		log.Ctx(req.Context()).Errorf("could not create service instance %s: %s", instanceID, reason)
+		b.Error(rw, req, 403, "QuotaExceeded", reason)
+		return
+	}
+
+	// remember the service instance before creating its deployment, so that a deployment whose creation
+	// seemingly failed can later be recognized as orphaned
+	b.saveInstance(req.Context(), stored)
+
 	// provision service instance
-	newDeployment := api.NewDeployment{
-		Name:       instanceID,
-		AccountID:  accountID,
-		Datacenter: datacenter,
-		Type:       deploymentType,
-		Version:    version,
-		Units:      units,
-		CacheMode:  cacheMode,
-		Notes:      fmt.Sprintf("%s-%s", provisioning.ServiceID, provisioning.PlanID),
-	}
-	deployment, err := b.Client.CreateDeployment(newDeployment)
+	var deployment *api.Deployment
+	if backup != nil {
+		deployment, err = b.Client.RestoreBackupContext(req.Context(), backup.DeploymentID, backup.ID, api.RestoredDeployment{
+			Name:       instanceID,
+			Datacenter: datacenter,
+			Version:    version,
+		})
+	} else {
+		deployment, err = b.Client.CreateDeploymentContext(req.Context(), api.NewDeployment{
+			Name:                instanceID,
+			AccountID:           accountID,
+			Datacenter:          datacenter,
+			Type:                deploymentType,
+			Version:             version,
+			Units:               units,
+			CacheMode:           cacheMode,
+			Notes:               deploymentNotes(req.Context(), provisioning.ServiceID, provisioning.PlanID, stored.Context),
+			CustomerBillingCode: billingCode(b.APIConfig.BillingCode, stored.Context),
+		})
+	}
 	if err != nil {
-		log.Errorf("could not create service instance %s: %v", instanceID, err)
-		b.Error(rw, req, 500, "UnknownError", "Could not create service instance")
+		// only if Compose.io refused the request it is certain that there is no deployment
+		if api.IsValidation(err) || api.IsConflict(err) || api.IsUnauthorized(err) {
+			if err := b.Store.DeleteInstance(instanceID); err != nil {
+				log.Ctx(req.Context()).Warnf("could not remove service instance %s from store: %v", instanceID, err)
+			}
+		}
+		log.Ctx(req.Context()).Errorf("could not create service instance %s: %v", instanceID, err)
+		b.apiError(rw, req, err, 500, "UnknownError", "Could not create service instance")
 		return
 	}
 
+	stored.DeploymentID = deployment.ID
+	b.saveInstance(req.Context(), stored)
+
+	// a restored deployment can't be given notes, a billing code or units, it is annotated right away and scaled once it is restored
+	steps := make([]Step, 0)
+	if backup != nil {
+		if _, err := b.Client.UpdateDeploymentContext(req.Context(), deployment.ID, api.DeploymentUpdate{
+			Notes:               deploymentNotes(req.Context(), provisioning.ServiceID, provisioning.PlanID, stored.Context),
+			CustomerBillingCode: billingCode(b.APIConfig.BillingCode, stored.Context),
+		}); err != nil {
+			log.Ctx(req.Context()).Warnf("could not annotate restored deployment %s of service instance %s: %v", deployment.ID, instanceID, err)
+		}
+		steps = append(steps, Step{Units: units})
+	}
+
+	// the whitelist can only be set up once the deployment has been provisioned
+	for _, cidr := range whitelist {
+		steps = append(steps, Step{WhitelistAdd: cidr})
+	}
+	operation := b.saveSteps(req.Context(), "provision", instanceID, deployment.ProvisionRecipeID, steps, nil)
+
 	if len(deployment.ProvisionRecipeID) > 0 {
-		if state, err := b.Client.GetRecipe(deployment.ProvisionRecipeID); err == nil {
+		if state, err := b.Client.GetRecipeContext(req.Context(), deployment.ProvisionRecipeID); err == nil {
+			if state, err = b.continueMigration(req.Context(), operation, deployment.ID, state); err != nil {
+				log.Ctx(req.Context()).Errorf("could not set up whitelist of service instance %s: %v", instanceID, err)
+				b.apiError(rw, req, err, 500, "UnknownError", "Could not set up service instance whitelist")
+				return
+			}
+			if state.Status == "complete" || state.Status == "failed" {
+				b.forgetOperation(req.Context(), operation.ID) // the platform won't ask for it
+			}
 			if state.Status == "complete" {
 				b.write(rw, req, 201, map[string]string{}) // provisioning already done
 				return
 			} else if state.Status == "failed" {
-				log.Errorf("could not create service instance %s, recipe %s failed", instanceID, deployment.ProvisionRecipeID)
+				log.Ctx(req.Context()).Errorf("could not create service instance %s, recipe %s failed", instanceID, deployment.ProvisionRecipeID)
 				b.Error(rw, req, 400, "ProvisionFailure", "Could not create service instance") // provisioning immediately failed
 				return
 			}
@@ -237,6 +405,7 @@ func (b *Broker) ProvisionInstance(rw http.ResponseWriter, req *http.Request) {
 	// response JSON
 	provisionResponse := ServiceInstanceProvisioningResponse{
 		DashboardURL: strings.TrimSuffix(deployment.Links.ComposeWebUI.HREF, "{?embed}"),
+		Operation:    operation.ID,
 	}
 	b.write(rw, req, 202, provisionResponse) // default async response
 }
@@ -245,43 +414,75 @@ func (b *Broker) LastOperationOnInstance(rw http.ResponseWriter, req *http.Reque
 	vars := mux.Vars(req)
 	instanceID := vars["instanceID"]
 
-	instance, err := b.Client.GetDeploymentByName(instanceID)
+	instance, err := b.getDeployment(req.Context(), instanceID)
+	if lookupFailed(err) {
+		log.Ctx(req.Context()).Errorf("could not query service instance %s: %v", instanceID, err)
+		b.apiError(rw, req, err, 500, "UnknownError", "Could not query service instance")
+		return
+	}
 	if err != nil || instance.Name != instanceID {
-		log.Errorf("could not query service instance %s: %v", instanceID, err)
+		log.Ctx(req.Context()).Errorf("could not query service instance %s: %v", instanceID, err)
 		b.Error(rw, req, 410, "MissingServiceInstance", "The service instance does not exist")
 		return
 	}
 
-	recipes, err := b.Client.GetRecipes(instance.ID)
-	if err != nil {
-		log.Warnf("could not query recipes for service instance %s: %v", instanceID, err)
-	}
-	if len(recipes) > 0 {
-		recipes.SortByUpdatedAt()
-		if recipes[0].Status == "complete" {
-			b.write(rw, req, 200, ServiceInstanceOperationResponse{
-				State:       "succeeded",
-				Description: fmt.Sprintf("%s complete", recipes[0].Name),
-			})
+	// the operation is the ID of the recipe that was started by the corresponding request
+	if operation := req.URL.Query().Get("operation"); len(operation) > 0 {
+		// a plan migration keeps its first recipe ID as operation, while moving on to the recipes of its later steps
+		recipeID := operation
+		stored, _ := b.Store.GetOperation(operation)
+		if stored != nil && stored.InstanceID == instanceID && len(stored.RecipeID) > 0 {
+			recipeID = stored.RecipeID
+		}
+
+		recipe, err := b.Client.GetRecipeContext(req.Context(), recipeID)
+		if err != nil && !api.IsNotFound(err) {
+			log.Ctx(req.Context()).Errorf("could not query recipe %s for service instance %s: %v", recipeID, instanceID, err)
+			b.apiError(rw, req, err, 500, "UnknownError", "Could not query service instance operation")
 			return
 		}
-		if recipes[0].Status == "failed" {
-			b.write(rw, req, 200, ServiceInstanceOperationResponse{
-				State:       "failed",
-				Description: fmt.Sprintf("Failure: %s", recipes[0].Template),
-			})
+		if err != nil || recipe.DeploymentID != instance.ID {
+			log.Ctx(req.Context()).Errorf("recipe %s does not belong to service instance %s: %v", recipeID, instanceID, err)
+			b.Error(rw, req, 400, "MalformedRequest", "Unknown operation")
 			return
 		}
-		if recipes[0].Status == "running" ||
-			recipes[0].Status == "waiting" {
-			description := fmt.Sprintf("%s operation in progress", recipes[0].Name)
-			if recipes[0].OperationsTotal > 0 {
-				description = description + fmt.Sprintf(" [%d/%d]", recipes[0].OperationsComplete, recipes[0].OperationsTotal)
+
+		if stored != nil && stored.InstanceID == instanceID && len(stored.Steps) > 0 {
+			recipe, err = b.continueMigration(req.Context(), stored, instance.ID, recipe)
+			if err != nil {
+				log.Ctx(req.Context()).Errorf("could not continue plan migration %s of service instance %s: %v", operation, instanceID, err)
+				if api.IsValidation(err) || api.IsConflict(err) {
+					b.forgetOperation(req.Context(), operation)
+					b.write(rw, req, 200, ServiceInstanceOperationResponse{
+						State:       "failed",
+						Description: fmt.Sprintf("Failure: could not continue plan migration: %v", err),
+					})
+					return
+				}
+				b.apiError(rw, req, err, 500, "UnknownError", "Could not continue service instance update")
+				return
 			}
-			b.write(rw, req, 200, ServiceInstanceOperationResponse{
-				State:       "in progress",
-				Description: description,
-			})
+		}
+		response := recipeOperationResponse(*recipe)
+		if stored != nil && stored.Update != nil && response.State == "succeeded" {
+			b.completeUpdate(req.Context(), instanceID, instance, *stored.Update)
+		}
+		if stored != nil && (response.State == "succeeded" || response.State == "failed") {
+			b.forgetOperation(req.Context(), operation)
+		}
+		b.write(rw, req, 200, response)
+		return
+	}
+
+	// without an operation the most recently updated recipe is the best guess we have
+	recipes, err := b.Client.GetRecipesContext(req.Context(), instance.ID)
+	if err != nil {
+		log.Ctx(req.Context()).Warnf("could not query recipes for service instance %s: %v", instanceID, err)
+	}
+	if len(recipes) > 0 {
+		recipes.SortByUpdatedAt()
+		if response := recipeOperationResponse(recipes[0]); len(response.State) > 0 {
+			b.write(rw, req, 200, response)
 			return
 		}
 	}
@@ -292,28 +493,59 @@ func (b *Broker) LastOperationOnInstance(rw http.ResponseWriter, req *http.Reque
 	})
 }
 
+// recipeOperationResponse maps the status of a recipe to an OSB operation state
+func recipeOperationResponse(recipe api.Recipe) ServiceInstanceOperationResponse {
+	switch recipe.Status {
+	case "complete":
+		return ServiceInstanceOperationResponse{
+			State:       "succeeded",
+			Description: fmt.Sprintf("%s complete", recipe.Name),
+		}
+	case "failed":
+		return ServiceInstanceOperationResponse{
+			State:       "failed",
+			Description: fmt.Sprintf("Failure: %s", recipe.Template),
+		}
+	case "running", "waiting":
+		description := fmt.Sprintf("%s operation in progress", recipe.Name)
+		if recipe.OperationsTotal > 0 {
+			description = description + fmt.Sprintf(" [%d/%d]", recipe.OperationsComplete, recipe.OperationsTotal)
+		}
+		return ServiceInstanceOperationResponse{
+			State:       "in progress",
+			Description: description,
+		}
+	}
+	return ServiceInstanceOperationResponse{}
+}
+
 func (b *Broker) FetchInstance(rw http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	instanceID := vars["instanceID"]
 
-	instance, err := b.Client.GetDeploymentByName(instanceID)
+	instance, err := b.getDeployment(req.Context(), instanceID)
+	if lookupFailed(err) {
+		log.Ctx(req.Context()).Errorf("could not query service instance %s: %v", instanceID, err)
+		b.apiError(rw, req, err, 500, "UnknownError", "Could not query service instance")
+		return
+	}
 	if err != nil || instance.Name != instanceID {
-		log.Errorf("could not fetch service instance %s: %v", instanceID, err)
+		log.Ctx(req.Context()).Errorf("could not fetch service instance %s: %v", instanceID, err)
 		b.Error(rw, req, 404, "MissingServiceInstance", "The service instance does not exist")
 		return
 	}
 
-	recipes, err := b.Client.GetRecipes(instance.ID)
+	recipes, err := b.Client.GetRecipesContext(req.Context(), instance.ID)
 	if err != nil {
-		log.Errorf("could not fetch recipes for service instance %s: %v", instanceID, err)
-		b.Error(rw, req, 404, "MissingRecipes", "The service instance recipes could not be found")
+		log.Ctx(req.Context()).Errorf("could not fetch recipes for service instance %s: %v", instanceID, err)
+		b.apiError(rw, req, err, 404, "MissingRecipes", "The service instance recipes could not be found")
 		return
 	}
 	if len(recipes) > 0 {
 		recipes.SortByUpdatedAt()
 		if recipes[0].Status == "running" ||
 			recipes[0].Status == "waiting" {
-			log.Warnf("service instance %s has currently an ongoing recipe", instanceID)
+			log.Ctx(req.Context()).Warnf("service instance %s has currently an ongoing recipe", instanceID)
 			if recipes[0].Name == "Provision" {
 				b.Error(rw, req, 404, "ConcurrencyError", "The service instance provisioning is still in progress")
 				return
@@ -324,10 +556,10 @@ func (b *Broker) FetchInstance(rw http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	scaling, err := b.Client.GetScaling(instance.ID)
+	scaling, err := b.Client.GetScalingContext(req.Context(), instance.ID)
 	if err != nil {
-		log.Errorf("could not fetch scaling parameters for service instance %s: %v", instanceID, err)
-		b.Error(rw, req, 404, "MissingScalingParameters", "The service instance scaling parameters do not exist")
+		log.Ctx(req.Context()).Errorf("could not fetch scaling parameters for service instance %s: %v", instanceID, err)
+		b.apiError(rw, req, err, 404, "MissingScalingParameters", "The service instance scaling parameters do not exist")
 		return
 	}
 
@@ -339,6 +571,11 @@ func (b *Broker) FetchInstance(rw http.ResponseWriter, req *http.Request) {
 			Scaling:    *scaling,
 		},
 	}
+	if stored, err := b.Store.GetInstance(instanceID); err == nil {
+		fetchResponse.ServiceID = stored.ServiceID
+		fetchResponse.PlanID = stored.PlanID
+		fetchResponse.Parameters.Context = stored.Context
+	}
 	b.write(rw, req, 200, fetchResponse)
 }
 
@@ -349,20 +586,20 @@ func (b *Broker) UpdateInstance(rw http.ResponseWriter, req *http.Request) {
 	// verify request is async, must have query param "?accepts_incomplete=true"
 	incomplete := req.URL.Query().Get("accepts_incomplete")
 	if incomplete != "true" {
-		log.Errorf("updating service instance %s requires async / accepts_incomplete=true", instanceID)
+		log.Ctx(req.Context()).Errorf("updating service instance %s requires async / accepts_incomplete=true", instanceID)
 		b.Error(rw, req, 422, "AsyncRequired", "Service instance updating requires an asynchronous operation")
 		return
 	}
 
 	if req.Body == nil {
-		log.Errorf("error reading update request for service instance %s: %v", instanceID, req)
+		log.Ctx(req.Context()).Errorf("error reading update request for service instance %s: %v", instanceID, req)
 		b.Error(rw, req, 400, "MalformedRequest", "Could not read update request")
 		return
 	}
 	body, err := ioutil.ReadAll(req.Body)
 	if err != nil {
-		log.Errorln(err)
-		log.Errorf("error reading update request for service instance %s: %v", instanceID, req)
+		log.Ctx(req.Context()).Errorln(err)
+		log.Ctx(req.Context()).Errorf("error reading update request for service instance %s: %v", instanceID, req)
 		b.Error(rw, req, 400, "MalformedRequest", "Could not read update request")
 		return
 	}
@@ -370,91 +607,236 @@ func (b *Broker) UpdateInstance(rw http.ResponseWriter, req *http.Request) {
 		body = []byte("{}")
 	}
 
+	// validate parameters against the schema of the new plan, or the current one if the plan does not change
+	var schemaReq schemaRequest
+	if err := json.Unmarshal([]byte(body), &schemaReq); err == nil {
+		if stored, err := b.Store.GetInstance(instanceID); err == nil && len(schemaReq.PlanID) == 0 {
+			schemaReq.PlanID = stored.PlanID
+		}
+		schemas := b.planSchemas(schemaReq.ServiceID, schemaReq.PlanID)
+		if !b.checkParameters(rw, req, instanceID, schemas.ServiceInstance.Update.Parameters, schemaReq.Parameters) {
+			return
+		}
+	}
+
 	var update ServiceInstanceUpdate
 	if err := json.Unmarshal([]byte(body), &update); err != nil {
-		log.Errorln(err)
-		log.Errorf("could not unmarshal update request body for service instance %s: %v", instanceID, string(body))
+		log.Ctx(req.Context()).Errorln(err)
+		log.Ctx(req.Context()).Errorf("could not unmarshal update request body for service instance %s: %v", instanceID, string(body))
 		b.Error(rw, req, 400, "MalformedRequest", "Could not unmarshal update request")
 		return
 	}
 
-	// verify scaling target value (units), by either taking value of plan or by provided parameter
-	var units int
+	// a plan change needs to know about both the service and the plan it changes to
+	var service *Service
+	var plan *ServicePlan
 	if len(update.PlanID) > 0 {
-		// get units if plan was specified
-		for _, service := range b.ServiceCatalog.Services {
-			if update.ServiceID == service.ID {
-				for _, plan := range service.Plans {
-					if update.PlanID == plan.ID {
-						units = plan.Metadata.Units
-					}
-				}
-			}
-		}
-		if units == 0 {
-			log.Errorf("could not find plan_id %s for updating service instance %s", update.PlanID, instanceID)
+		service, plan = b.ServiceCatalog().Plan(update.ServiceID, update.PlanID)
+		if plan == nil {
+			log.Ctx(req.Context()).Errorf("could not find plan_id %s for updating service instance %s", update.PlanID, instanceID)
 			b.Error(rw, req, 400, "MalformedRequest", "Unknown plan_id")
 			return
 		}
-	}
-	if update.Parameters.Units > 0 {
-		units = update.Parameters.Units
-	}
-	if units < 1 {
-		log.Errorf("units value %d must be greater than 0 for updating service instance %s", units, instanceID)
+	} else if update.Parameters.Units < 1 && len(update.Parameters.Version) == 0 && !update.Parameters.OnDemandBackup && update.Parameters.Whitelist == nil {
+		log.Ctx(req.Context()).Errorf("units value %d must be greater than 0 for updating service instance %s", update.Parameters.Units, instanceID)
 		b.Error(rw, req, 400, "MissingParameters", "Units parameter is missing for service instance update")
 		return
 	}
 
-	instance, err := b.Client.GetDeploymentByName(instanceID)
+	whitelist, err := normalizeWhitelist(update.Parameters.Whitelist)
+	if err != nil {
+		log.Ctx(req.Context()).Errorf("invalid whitelist for updating service instance %s: %v", instanceID, err)
+		b.Error(rw, req, 400, "MalformedRequest", err.Error())
+		return
+	}
+
+	instance, err := b.getDeployment(req.Context(), instanceID)
+	if lookupFailed(err) {
+		log.Ctx(req.Context()).Errorf("could not query service instance %s: %v", instanceID, err)
+		b.apiError(rw, req, err, 500, "UnknownError", "Could not query service instance")
+		return
+	}
 	if err != nil || instance.Name != instanceID {
-		log.Errorf("could not fetch service instance %s: %v", instanceID, err)
+		log.Ctx(req.Context()).Errorf("could not fetch service instance %s: %v", instanceID, err)
 		b.Error(rw, req, 404, "ServiceInstanceNotFound", "The service instance does not exist")
 		return
 	}
 
-	// would it actually do anything?
-	scaling, err := b.Client.GetScaling(instance.ID)
+	scaling, err := b.Client.GetScalingContext(req.Context(), instance.ID)
 	if err != nil {
-		log.Errorf("could not fetch scaling parameters for service instance %s: %v", instanceID, err)
-		b.Error(rw, req, 409, "UnknownError", "Could not read service instance scaling")
+		log.Ctx(req.Context()).Errorf("could not fetch scaling parameters for service instance %s: %v", instanceID, err)
+		b.apiError(rw, req, err, 409, "UnknownError", "Could not read service instance scaling")
 		return
 	}
-	if scaling.AllocatedUnits == units {
-		log.Warnf("service instance %s already has %d units", instanceID, units)
+
+	// compare the deployment as it is now with what the plan and parameters ask for
+	stored, _ := b.Store.GetInstance(instanceID)
+	if stored != nil && plan != nil && len(stored.ServiceID) > 0 && stored.ServiceID != update.ServiceID {
+		log.Ctx(req.Context()).Errorf("service instance %s can not change from service %s to %s", instanceID, stored.ServiceID, update.ServiceID)
+		b.Error(rw, req, 400, "MalformedRequest", "Cannot change the service of a service instance")
+		return
+	}
+	current := b.currentState(instance, scaling, stored)
+	target := deploymentState{}
+	if plan != nil {
+		target = b.targetState(service, plan)
+	}
+	if update.Parameters.Units > 0 {
+		target.Units = update.Parameters.Units
+	}
+	// version can also be provided as update parameter, takes precedence over plan value
+	if len(update.Parameters.Version) > 0 {
+		target.Version = update.Parameters.Version
+	}
+	// units must stay within the bounds of the plan, and Compose.io can't scale a deployment below what its data needs
+	if target.Units > 0 {
+		unitsPlan := plan
+		if unitsPlan == nil && stored != nil {
+			_, unitsPlan = b.ServiceCatalog().Plan(stored.ServiceID, stored.PlanID)
+		}
+		if unitsPlan != nil {
+			if reason := unitsPlan.checkUnits(target.Units); len(reason) > 0 {
+				log.Ctx(req.Context()).Errorf("units value %d not permitted for updating service instance %s: %s", target.Units, instanceID, reason)
+				b.Error(rw, req, 400, "ValidationError", reason)
+				return
+			}
+		}
+		if target.Units < current.Units && target.Units < scaling.MinimumUnits {
+			log.Ctx(req.Context()).Errorf("service instance %s can not be scaled down to %d units, it needs at least %d units", instanceID, target.Units, scaling.MinimumUnits)
+			b.Error(rw, req, 400, "ValidationError", fmt.Sprintf("The service instance needs at least %d units for its data, it can not be scaled down to %d units", scaling.MinimumUnits, target.Units))
+			return
+		}
+	}
+	steps, err := migrationSteps(current, target, plan != nil && stored != nil)
+	if err != nil {
+		log.Ctx(req.Context()).Errorf("could not update service instance %s from plan %v to %s: %v", instanceID, stored, update.PlanID, err)
+		b.Error(rw, req, 400, "MalformedRequest", err.Error())
+		return
+	}
+
+	// the organization, space or namespace must permit the new plan and have enough quota left for more units
+	var platform *PlatformContext
+	if stored != nil {
+		platform = stored.platform()
+	}
+	if update.Context != nil {
+		platform = updatePlatformContext(platform, *update.Context)
+	}
+	if plan != nil {
+		if reason := b.checkPlanQuota(platform, service, plan); len(reason) > 0 {
+			log.Ctx(req.Context()).Errorf("could not update service instance %s: %s", instanceID, reason)
+			b.Error(rw, req, 400, "PlanNotPermitted", reason)
+			return
+		}
+	}
+	if target.Units > current.Units && len(b.Quotas.scopes(platform)) > 0 {
+		b.quotaMutex.Lock() // until the deployment is being scaled
+		defer b.quotaMutex.Unlock()
+	}
+	if target.Units > current.Units {
+		reason, err := b.checkQuota(req.Context(), instanceID, platform, target.Units)
+		if err != nil {
+			log.Ctx(req.Context()).Errorf("could not check quota for service instance %s: %v", instanceID, err)
+			b.apiError(rw, req, err, 500, "UnknownError", "Could not check quota")
+			return
+		}
+		if len(reason) > 0 {
+			log.Ctx(req.Context()).Errorf("could not update service instance %s: %s", instanceID, reason)
+			b.Error(rw, req, 403, "QuotaExceeded", reason)
+			return
+		}
+	}
+
+	// a backup is taken before anything else is changed
+	if update.Parameters.OnDemandBackup {
+		steps = append([]Step{Step{Backup: true}}, steps...)
+	}
+
+	// the whitelist parameter replaces all whitelist entries managed by the broker, except those of bindings
+	if update.Parameters.Whitelist != nil {
+		entries, err := b.Client.GetWhitelistContext(req.Context(), instance.ID)
+		if err != nil {
+			log.Ctx(req.Context()).Errorf("could not fetch whitelist of service instance %s: %v", instanceID, err)
+			b.apiError(rw, req, err, 500, "UnknownError", "Could not read service instance whitelist")
+			return
+		}
+		steps = append(steps, whitelistSteps(entries, whitelist)...)
+	}
+
+	// a version upgrade must be offered by Compose.io for the current version of the deployment
+	for _, step := range steps {
+		if len(step.Version) == 0 {
+			continue
+		}
+		reason, err := b.checkVersion(req.Context(), instance, step.Version)
+		if err != nil {
+			log.Ctx(req.Context()).Errorf("could not query versions for service instance %s: %v", instanceID, err)
+			b.apiError(rw, req, err, 500, "UnknownError", "Could not query service instance versions")
+			return
+		}
+		if len(reason) > 0 {
+			log.Ctx(req.Context()).Errorf("could not upgrade service instance %s to version %s: %s", instanceID, step.Version, reason)
+			b.Error(rw, req, 400, "MalformedRequest", reason)
+			return
+		}
+	}
+
+	// would it actually do anything?
+	if len(steps) == 0 {
+		log.Ctx(req.Context()).Warnf("service instance %s already matches plan %s with %d units", instanceID, update.PlanID, current.Units)
+		b.completeUpdate(req.Context(), instanceID, instance, update)
 		b.write(rw, req, 200, map[string]string{}) // update would have no effect
 		return
 	}
 
 	// return concurrency error if there is still/already another recipe ongoing for this deployment
-	recipes, err := b.Client.GetRecipes(instance.ID)
+	recipes, err := b.Client.GetRecipesContext(req.Context(), instance.ID)
 	if err != nil {
-		log.Warnf("could not fetch any recipes for service instance %s: %v", instanceID, err)
+		log.Ctx(req.Context()).Warnf("could not fetch any recipes for service instance %s: %v", instanceID, err)
 	}
 	if len(recipes) > 0 {
 		recipes.SortByUpdatedAt()
 		if recipes[0].Status == "running" ||
 			recipes[0].Status == "waiting" {
-			log.Errorf("updating service instance %s not possible due to an ongoing recipe", instanceID)
+			log.Ctx(req.Context()).Errorf("updating service instance %s not possible due to an ongoing recipe", instanceID)
 			b.Error(rw, req, 422, "ConcurrencyError", "The service instance is currently being updated")
 			return
 		}
 	}
 
-	recipe, err := b.Client.UpdateScaling(instance.ID, units)
+	// recipes can't run in parallel on a deployment, start the first step and continue with the others on last_operation
+	recipe, err := b.startStep(req.Context(), instance.ID, steps[0])
 	if err != nil {
-		log.Errorf("could not update service instance %s: %v", instanceID, err)
-		b.Error(rw, req, 409, "UnknownError", "Could not update service instance")
+		log.Ctx(req.Context()).Errorf("could not update service instance %s: %v", instanceID, err)
+		b.apiError(rw, req, err, 409, "UnknownError", "Could not update service instance")
 		return
 	}
+	// the new plan and parameters only apply once all steps completed, a failed update leaves the service instance as it was
+	if len(recipe.ID) == 0 {
+		b.completeUpdate(req.Context(), instanceID, instance, update)
+	}
+	operation := b.saveSteps(req.Context(), "update", instanceID, recipe.ID, steps[1:], &update)
+	if stored != nil && len(recipe.ID) > 0 {
+		stored.Operation = operation.ID
+		b.saveInstance(req.Context(), *stored)
+	}
 
 	if len(recipe.ID) > 0 {
-		if state, err := b.Client.GetRecipe(recipe.ID); err == nil {
+		if state, err := b.Client.GetRecipeContext(req.Context(), recipe.ID); err == nil {
+			if state, err = b.continueMigration(req.Context(), operation, instance.ID, state); err != nil {
+				log.Ctx(req.Context()).Errorf("could not continue updating service instance %s: %v", instanceID, err)
+				b.apiError(rw, req, err, 409, "UnknownError", "Could not update service instance")
+				return
+			}
+			if state.Status == "complete" || state.Status == "failed" {
+				b.forgetOperation(req.Context(), operation.ID) // the platform won't ask for it
+			}
 			if state.Status == "complete" {
+				b.completeUpdate(req.Context(), instanceID, instance, update)
 				b.write(rw, req, 200, map[string]string{}) // update already done
 				return
 			} else if state.Status == "failed" {
-				log.Errorf("could not update service instance %s, recipe %s failed", instanceID, recipe.ID)
+				log.Ctx(req.Context()).Errorf("could not update service instance %s, recipe %s failed", instanceID, state.ID)
 				b.Error(rw, req, 409, "UpdateFailure", "Could not update service instance") // update immediately failed
 				return
 			}
@@ -464,6 +846,7 @@ func (b *Broker) UpdateInstance(rw http.ResponseWriter, req *http.Request) {
 	// response JSON
 	updateResponse := ServiceInstanceUpdateResponse{
 		DashboardURL: strings.TrimSuffix(instance.Links.ComposeWebUI.HREF, "{?embed}"),
+		Operation:    operation.ID,
 	}
 	b.write(rw, req, 202, updateResponse) // default async response
 }
@@ -475,52 +858,194 @@ func (b *Broker) DeprovisionInstance(rw http.ResponseWriter, req *http.Request)
 	// verify request is async, must have query param "?accepts_incomplete=true"
 	incomplete := req.URL.Query().Get("accepts_incomplete")
 	if incomplete != "true" {
-		log.Errorf("deleting service instance %s requires async / accepts_incomplete=true", instanceID)
+		log.Ctx(req.Context()).Errorf("deleting service instance %s requires async / accepts_incomplete=true", instanceID)
 		b.Error(rw, req, 422, "AsyncRequired", "Service instance deprovisioning requires an asynchronous operation")
 		return
 	}
 
-	instance, err := b.Client.GetDeploymentByName(instanceID)
+	instance, err := b.getDeployment(req.Context(), instanceID)
+	if lookupFailed(err) {
+		log.Ctx(req.Context()).Errorf("could not query service instance %s: %v", instanceID, err)
+		b.apiError(rw, req, err, 500, "UnknownError", "Could not query service instance")
+		return
+	}
 	if err != nil || instance.Name != instanceID {
-		log.Errorf("could not find service instance %s: %v", instanceID, err)
+		log.Ctx(req.Context()).Errorf("could not find service instance %s: %v", instanceID, err)
 		b.Error(rw, req, 410, "MissingServiceInstance", "The service instance does not exist")
 		return
 	}
 
 	// return concurrency error if there is still/already another recipe ongoing for this deployment
-	recipes, err := b.Client.GetRecipes(instance.ID)
+	recipes, err := b.Client.GetRecipesContext(req.Context(), instance.ID)
 	if err != nil {
-		log.Warnf("could not fetch any recipes for service instance %s: %v", instanceID, err)
+		log.Ctx(req.Context()).Warnf("could not fetch any recipes for service instance %s: %v", instanceID, err)
 	}
 	if len(recipes) > 0 {
 		recipes.SortByUpdatedAt()
 		if recipes[0].Status == "running" ||
 			recipes[0].Status == "waiting" {
-			log.Errorf("deleting service instance %s not possible due to an ongoing recipe", instanceID)
+			log.Ctx(req.Context()).Errorf("deleting service instance %s not possible due to an ongoing recipe", instanceID)
+			if recipes[0].Name == "Provision" {
+				b.abandonInstance(req.Context(), instanceID, instance.ID)
+			}
 			b.Error(rw, req, 422, "ConcurrencyError", "The service instance is currently being updated")
 			return
 		}
 	}
 
 	// deprovision service instance
-	recipe, err := b.Client.DeleteDeployment(instance.ID)
+	recipe, err := b.Client.DeleteDeploymentContext(req.Context(), instance.ID)
+	if api.IsNotFound(err) {
+		log.Ctx(req.Context()).Errorf("service instance %s is already gone: %v", instanceID, err)
+		if err := b.Store.DeleteInstance(instanceID); err != nil {
+			log.Ctx(req.Context()).Warnf("could not remove service instance %s from store: %v", instanceID, err)
+		}
+		b.Error(rw, req, 410, "MissingServiceInstance", "The service instance does not exist")
+		return
+	}
 	if err != nil {
-		log.Errorf("could not delete service instance %s: %v", instanceID, err)
-		b.Error(rw, req, 500, "UnknownError", "Could not delete service instance")
+		log.Ctx(req.Context()).Errorf("could not delete service instance %s: %v", instanceID, err)
+		b.apiError(rw, req, err, 500, "UnknownError", "Could not delete service instance")
 		return
 	}
+	if err := b.Store.DeleteInstance(instanceID); err != nil {
+		log.Ctx(req.Context()).Warnf("could not remove service instance %s from store: %v", instanceID, err)
+	}
+	b.saveOperation(req.Context(), "deprovision", instanceID, "", recipe.ID)
 
 	if len(recipe.ID) > 0 {
-		if state, err := b.Client.GetRecipe(recipe.ID); err == nil {
+		if state, err := b.Client.GetRecipeContext(req.Context(), recipe.ID); err == nil {
+			if state.Status == "complete" || state.Status == "failed" {
+				b.forgetOperation(req.Context(), recipe.ID) // the platform won't ask for it
+			}
 			if state.Status == "complete" {
 				b.write(rw, req, 200, map[string]string{}) // deletion already done
 				return
 			} else if state.Status == "failed" {
-				log.Errorf("could not delete service instance %s, recipe %s failed", instanceID, recipe.ID)
+				log.Ctx(req.Context()).Errorf("could not delete service instance %s, recipe %s failed", instanceID, recipe.ID)
 				b.Error(rw, req, 500, "DeprovisionFailure", "Could not delete service instance") // deletion immediately failed
 				return
 			}
 		}
 	}
-	b.write(rw, req, 202, map[string]string{}) // default async response
+	b.write(rw, req, 202, ServiceInstanceDeprovisionResponse{Operation: recipe.ID}) // default async response
+}
+
+// getDeployment looks up the deployment of a service instance, consulting the store before the Compose.io API
+func (b *Broker) getDeployment(ctx context.Context, instanceID string) (*api.Deployment, error) {
+	if instance, err := b.Store.GetInstance(instanceID); err == nil && len(instance.DeploymentID) > 0 {
+		deployment, err := b.Client.GetDeploymentContext(ctx, instance.DeploymentID)
+		if err == nil && deployment.Name == instanceID {
+			return deployment, nil
+		}
+		log.Ctx(ctx).Warnf("could not find deployment %s of service instance %s in store: %v", instance.DeploymentID, instanceID, err)
+	}
+	return b.Client.GetDeploymentByNameContext(ctx, instanceID)
+}
+
+func (b *Broker) saveInstance(ctx context.Context, instance Instance) {
+	now := time.Now()
+	if existing, err := b.Store.GetInstance(instance.ID); err == nil {
+		instance.CreatedAt = existing.CreatedAt
+	} else {
+		instance.CreatedAt = now
+	}
+	instance.UpdatedAt = now
+
+	if err := b.Store.PutInstance(instance); err != nil {
+		log.Ctx(ctx).Warnf("could not save service instance %s to store: %v", instance.ID, err)
+	}
+}
+
+// abandonInstance remembers that the platform wanted to get rid of a service instance while it was still being provisioned,
+// which it does when it gives up waiting for provisioning to finish, its deployment is then left to the orphan mitigation
+func (b *Broker) abandonInstance(ctx context.Context, instanceID, deploymentID string) {
+	instance, err := b.Store.GetInstance(instanceID)
+	if err != nil {
+		instance = &Instance{ID: instanceID}
+	}
+	instance.DeploymentID = deploymentID
+	instance.Abandoned = true
+	b.saveInstance(ctx, *instance)
+}
+
+// completeUpdate records the plan and parameters of a successful update in the store and in the deployment notes
+func (b *Broker) completeUpdate(ctx context.Context, instanceID string, deployment *api.Deployment, update ServiceInstanceUpdate) {
+	b.updateInstance(ctx, instanceID, deployment.ID, update)
+	if len(update.PlanID) > 0 {
+		b.updatePlanNotes(ctx, deployment, update.ServiceID, update.PlanID)
+	}
+}
+
+func (b *Broker) updateInstance(ctx context.Context, instanceID, deploymentID string, update ServiceInstanceUpdate) {
+	instance, err := b.Store.GetInstance(instanceID)
+	if err != nil {
+		instance = &Instance{ID: instanceID, ServiceID: update.ServiceID}
+	}
+	instance.DeploymentID = deploymentID
+	instance.Operation = ""
+	if len(update.PlanID) > 0 && update.PlanID != instance.PlanID && update.Parameters.Units == 0 {
+		// the deployment has been scaled to the new plan, units given as parameter before no longer apply
+		var parameters map[string]interface{}
+		if err := json.Unmarshal(instance.Parameters, &parameters); err == nil {
+			delete(parameters, "units")
+			instance.Parameters, _ = json.Marshal(parameters)
+		}
+	}
+	if len(update.PlanID) > 0 {
+		instance.PlanID = update.PlanID
+	}
+	if update.Context != nil {
+		// organizations, spaces and service instances can be renamed, the platform tells the current names on every update
+		instance.Context = updatePlatformContext(instance.Context, *update.Context)
+	}
+	if update.Parameters.Units > 0 || len(update.Parameters.Version) > 0 || update.Parameters.Whitelist != nil {
+		// parameters only given at provisioning, like datacenter or cache_mode, are kept
+		parameters := make(map[string]interface{})
+		if len(instance.Parameters) > 0 {
+			if err := json.Unmarshal(instance.Parameters, &parameters); err != nil {
+				log.Ctx(ctx).Warnf("could not unmarshal stored parameters of service instance %s: %v", instanceID, err)
+				parameters = make(map[string]interface{})
+			}
+		}
+		if update.Parameters.Units > 0 {
+			parameters["units"] = update.Parameters.Units
+		}
+		if len(update.Parameters.Version) > 0 {
+			parameters["version"] = update.Parameters.Version
+		}
+		if update.Parameters.Whitelist != nil {
+			parameters["whitelist"] = update.Parameters.Whitelist
+		}
+		instance.Parameters, _ = json.Marshal(parameters)
+	}
+	b.saveInstance(ctx, *instance)
+}
+
+func (b *Broker) saveOperation(ctx context.Context, operationType, instanceID, bindingID, recipeID string) {
+	if len(recipeID) == 0 {
+		return
+	}
+	operationID := recipeID
+	if len(bindingID) > 0 {
+		operationID = bindingOperation(operationType, recipeID) // binding operations share their recipe with the instance
+	}
+	operation := Operation{
+		ID:         operationID,
+		Type:       operationType,
+		InstanceID: instanceID,
+		BindingID:  bindingID,
+		RecipeID:   recipeID,
+		CreatedAt:  time.Now(),
+	}
+	if err := b.Store.PutOperation(operation); err != nil {
+		log.Ctx(ctx).Warnf("could not save %s operation %s of service instance %s to store: %v", operationType, operationID, instanceID, err)
+	}
+}
+
+// forgetOperation removes an operation from the store once the platform has been told its final state
+func (b *Broker) forgetOperation(ctx context.Context, operationID string) {
+	if err := b.Store.DeleteOperation(operationID); err != nil {
+		log.Ctx(ctx).Warnf("could not remove operation %s from store: %v", operationID, err)
+	}
 }
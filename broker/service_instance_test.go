@@ -2,11 +2,14 @@ package broker
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/JamesClonk/compose-broker/log"
 	"github.com/JamesClonk/compose-broker/util"
@@ -32,7 +35,8 @@ func TestBroker_ProvisionServiceInstance(t *testing.T) {
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	r := NewRouter(b)
 
 	provisioning := ServiceInstanceProvisioning{
 		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
@@ -46,10 +50,17 @@ func TestBroker_ProvisionServiceInstance(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 202, rec.Code)
 	assert.Equal(t, util.Body("../_fixtures/broker_provision_service_instance.json"), rec.Body.String())
+
+	instance, err := b.Store.GetInstance("8dcdf609-36c9-4b22-bb16-d97e48c50f26")
+	assert.NoError(t, err)
+	assert.Equal(t, "9b4ee86b-3876-469f-a531-062e71bc5859", instance.ServiceID)
+	assert.Equal(t, "d6222855-17c6-448c-885a-e9d931cd221b", instance.PlanID)
+	assert.NotEmpty(t, instance.DeploymentID)
 }
 
 func TestBroker_ProvisionServiceInstance_WithProvisionParameters(t *testing.T) {
@@ -67,7 +78,7 @@ func TestBroker_ProvisionServiceInstance_WithProvisionParameters(t *testing.T) {
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
 
 	provisioning := ServiceInstanceProvisioning{
 		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
@@ -86,6 +97,7 @@ func TestBroker_ProvisionServiceInstance_WithProvisionParameters(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 202, rec.Code)
@@ -106,7 +118,7 @@ func TestBroker_ProvisionServiceInstance_WithPlanParameters(t *testing.T) {
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
 
 	provisioning := ServiceInstanceProvisioning{
 		ServiceID: "e27ea95a-3883-44f2-8ca4-01101f39d50c",
@@ -120,6 +132,7 @@ func TestBroker_ProvisionServiceInstance_WithPlanParameters(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 202, rec.Code)
@@ -127,7 +140,7 @@ func TestBroker_ProvisionServiceInstance_WithPlanParameters(t *testing.T) {
 }
 
 func TestBroker_ProvisionServiceInstance_AsyncRequired(t *testing.T) {
-	r := NewRouter(util.TestConfig(""))
+	r := NewRouter(NewBroker(util.TestConfig("")))
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("PUT", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26", nil)
@@ -135,6 +148,7 @@ func TestBroker_ProvisionServiceInstance_AsyncRequired(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 422, rec.Code) // a provisioning request must be async
@@ -143,7 +157,7 @@ func TestBroker_ProvisionServiceInstance_AsyncRequired(t *testing.T) {
 }
 
 func TestBroker_ProvisionServiceInstance_EmptyBody(t *testing.T) {
-	r := NewRouter(util.TestConfig(""))
+	r := NewRouter(NewBroker(util.TestConfig("")))
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("PUT", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26?accepts_incomplete=true", nil)
@@ -151,6 +165,7 @@ func TestBroker_ProvisionServiceInstance_EmptyBody(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 400, rec.Code)
@@ -159,7 +174,7 @@ func TestBroker_ProvisionServiceInstance_EmptyBody(t *testing.T) {
 }
 
 func TestBroker_ProvisionServiceInstance_UnknownPlan(t *testing.T) {
-	r := NewRouter(util.TestConfig(""))
+	r := NewRouter(NewBroker(util.TestConfig("")))
 
 	provisioning := ServiceInstanceProvisioning{
 		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
@@ -173,6 +188,7 @@ func TestBroker_ProvisionServiceInstance_UnknownPlan(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 400, rec.Code)
@@ -181,7 +197,7 @@ func TestBroker_ProvisionServiceInstance_UnknownPlan(t *testing.T) {
 }
 
 func TestBroker_ProvisionServiceInstance_UnitsMissing(t *testing.T) {
-	r := NewRouter(util.TestConfig(""))
+	r := NewRouter(NewBroker(util.TestConfig("")))
 
 	provisioning := ServiceInstanceProvisioning{
 		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
@@ -194,6 +210,7 @@ func TestBroker_ProvisionServiceInstance_UnitsMissing(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 400, rec.Code)
@@ -210,7 +227,7 @@ func TestBroker_ProvisionServiceInstance_AccountsNotReadable(t *testing.T) {
 
 	config := util.TestConfig(apiServer.URL)
 	config.API.DefaultAccountID = "" // clear
-	r := NewRouter(config)
+	r := NewRouter(NewBroker(config))
 
 	provisioning := ServiceInstanceProvisioning{
 		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
@@ -224,6 +241,7 @@ func TestBroker_ProvisionServiceInstance_AccountsNotReadable(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 409, rec.Code)
@@ -250,7 +268,7 @@ func TestBroker_ProvisionServiceInstance_AccountIDFromAPI(t *testing.T) {
 
 	config := util.TestConfig(apiServer.URL)
 	config.API.DefaultAccountID = "" // clear
-	r := NewRouter(config)
+	r := NewRouter(NewBroker(config))
 
 	provisioning := ServiceInstanceProvisioning{
 		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
@@ -264,6 +282,7 @@ func TestBroker_ProvisionServiceInstance_AccountIDFromAPI(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 202, rec.Code)
@@ -279,7 +298,7 @@ func TestBroker_ProvisionServiceInstance_AccountIDMissing(t *testing.T) {
 
 	config := util.TestConfig(apiServer.URL)
 	config.API.DefaultAccountID = "" // clear
-	r := NewRouter(config)
+	r := NewRouter(NewBroker(config))
 
 	provisioning := ServiceInstanceProvisioning{
 		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
@@ -293,6 +312,7 @@ func TestBroker_ProvisionServiceInstance_AccountIDMissing(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 400, rec.Code)
@@ -309,7 +329,7 @@ func TestBroker_ProvisionServiceInstance_AlreadyExistsWithSameScaling(t *testing
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
 
 	provisioning := ServiceInstanceProvisioning{
 		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
@@ -324,6 +344,7 @@ func TestBroker_ProvisionServiceInstance_AlreadyExistsWithSameScaling(t *testing
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 200, rec.Code)
@@ -338,7 +359,7 @@ func TestBroker_ProvisionServiceInstance_AlreadyExistsWithOngoingRecipe(t *testi
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
 
 	provisioning := ServiceInstanceProvisioning{
 		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
@@ -352,10 +373,11 @@ func TestBroker_ProvisionServiceInstance_AlreadyExistsWithOngoingRecipe(t *testi
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 202, rec.Code)
-	assert.Equal(t, util.Body("../_fixtures/broker_provision_service_instance_existing.json"), rec.Body.String())
+	assert.Equal(t, util.Body("../_fixtures/broker_provision_service_instance_in_progress.json"), rec.Body.String())
 }
 
 func TestBroker_ProvisionServiceInstance_AlreadyExistsButNoRecipes(t *testing.T) {
@@ -365,7 +387,7 @@ func TestBroker_ProvisionServiceInstance_AlreadyExistsButNoRecipes(t *testing.T)
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
 
 	provisioning := ServiceInstanceProvisioning{
 		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
@@ -379,6 +401,7 @@ func TestBroker_ProvisionServiceInstance_AlreadyExistsButNoRecipes(t *testing.T)
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 409, rec.Code)
@@ -392,7 +415,8 @@ func TestBroker_ProvisionServiceInstance_Error(t *testing.T) {
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	r := NewRouter(b)
 
 	provisioning := ServiceInstanceProvisioning{
 		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
@@ -406,11 +430,18 @@ func TestBroker_ProvisionServiceInstance_Error(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 500, rec.Code)
 	assert.Contains(t, rec.Body.String(), `"error": "UnknownError"`)
 	assert.Contains(t, rec.Body.String(), `"description": "Could not create service instance"`)
+
+	// the deployment might have been created anyway, which is left to the orphan mitigation
+	stored, err := b.Store.GetInstance("8dcdf609-36c9-4b22-bb16-d97e48c50f26")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "", stored.DeploymentID)
+	}
 }
 
 func TestBroker_ProvisionServiceInstance_ImmediateCreation(t *testing.T) {
@@ -420,7 +451,7 @@ func TestBroker_ProvisionServiceInstance_ImmediateCreation(t *testing.T) {
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
 
 	provisioning := ServiceInstanceProvisioning{
 		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
@@ -434,6 +465,7 @@ func TestBroker_ProvisionServiceInstance_ImmediateCreation(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 201, rec.Code) // provisioning could be fast and be immediately done
@@ -447,7 +479,7 @@ func TestBroker_ProvisionServiceInstance_ImmediateFailure(t *testing.T) {
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
 
 	provisioning := ServiceInstanceProvisioning{
 		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
@@ -461,6 +493,7 @@ func TestBroker_ProvisionServiceInstance_ImmediateFailure(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 400, rec.Code)
@@ -475,7 +508,7 @@ func TestBroker_LastOperationServiceInstance(t *testing.T) {
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("GET", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26/last_operation", nil)
@@ -483,6 +516,7 @@ func TestBroker_LastOperationServiceInstance(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 200, rec.Code)
@@ -497,7 +531,7 @@ func TestBroker_LastOperationServiceInstance_Succeeded(t *testing.T) {
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("GET", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26/last_operation", nil)
@@ -505,6 +539,7 @@ func TestBroker_LastOperationServiceInstance_Succeeded(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 200, rec.Code)
@@ -519,7 +554,7 @@ func TestBroker_LastOperationServiceInstance_Failed(t *testing.T) {
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("GET", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26/last_operation", nil)
@@ -527,6 +562,7 @@ func TestBroker_LastOperationServiceInstance_Failed(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 200, rec.Code)
@@ -541,7 +577,7 @@ func TestBroker_LastOperationServiceInstance_InProgress(t *testing.T) {
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("GET", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26/last_operation", nil)
@@ -549,19 +585,122 @@ func TestBroker_LastOperationServiceInstance_InProgress(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 200, rec.Code)
 	assert.Equal(t, util.Body("../_fixtures/broker_last_operation_on_service_instance_in_progress.json"), rec.Body.String())
 }
 
+func TestBroker_LastOperationServiceInstance_WithOperation(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments", Code: 200, Body: util.Body("../_fixtures/api_get_deployments.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/recipes", Code: 200, Body: util.Body("../_fixtures/api_get_recipes_for_last_operation_failed.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/recipes/5821fd28a4b549d06e39886d", Code: 200, Body: util.Body("../_fixtures/api_get_recipe.json"), Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26/last_operation?operation=5821fd28a4b549d06e39886d", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 200, rec.Code) // an unrelated failed recipe on the same deployment must not matter
+	assert.Equal(t, `{
+  "state": "succeeded",
+  "description": "Provision complete"
+}`, rec.Body.String())
+}
+
+func TestBroker_LastOperationServiceInstance_ForgetsOperation(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments", Code: 200, Body: util.Body("../_fixtures/api_get_deployments.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/recipes/5821fd28a4b549d06e39886d", Code: 200, Body: util.Body("../_fixtures/api_get_recipe.json"), Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	b.saveOperation(context.Background(), "provision", "8dcdf609-36c9-4b22-bb16-d97e48c50f26", "", "5821fd28a4b549d06e39886d")
+	r := NewRouter(b)
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26/last_operation?operation=5821fd28a4b549d06e39886d", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	// once the platform knows the final state the operation is no longer needed
+	assert.Equal(t, 200, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"state": "succeeded"`)
+	_, err = b.Store.GetOperation("5821fd28a4b549d06e39886d")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestBroker_LastOperationServiceInstance_WithOperationInProgress(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments", Code: 200, Body: util.Body("../_fixtures/api_get_deployments.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/recipes/570bf60a70ea13000d000000", Code: 200, Body: util.Body("../_fixtures/api_get_recipe_for_service_deprovision.json"), Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26/last_operation?operation=570bf60a70ea13000d000000", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 200, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"state": "in progress"`)
+}
+
+func TestBroker_LastOperationServiceInstance_WithUnknownOperation(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments", Code: 200, Body: util.Body("../_fixtures/api_get_deployments.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/recipes/5821fd28a4b549d06e39886d", Code: 200, Body: util.Body("../_fixtures/api_get_recipe_for_other_deployment.json"), Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26/last_operation?operation=5821fd28a4b549d06e39886d", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 400, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"error": "MalformedRequest"`)
+	assert.Contains(t, rec.Body.String(), `"description": "Unknown operation"`)
+}
+
 func TestBroker_LastOperationServiceInstance_NotFound(t *testing.T) {
 	test := []util.HttpTestCase{
 		util.HttpTestCase{Method: "GET", Path: "/deployments", Code: 404, Body: util.Body("../_fixtures/api_get_deployments.json"), Test: nil},
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("GET", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26/last_operation", nil)
@@ -569,6 +708,7 @@ func TestBroker_LastOperationServiceInstance_NotFound(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 410, rec.Code)
@@ -585,7 +725,7 @@ func TestBroker_FetchServiceInstance(t *testing.T) {
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("GET", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26", nil)
@@ -593,19 +733,52 @@ func TestBroker_FetchServiceInstance(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 200, rec.Code)
 	assert.Equal(t, util.Body("../_fixtures/broker_fetch_service_instance.json"), rec.Body.String())
 }
 
+func TestBroker_FetchServiceInstance_FromStore(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/recipes", Code: 200, Body: util.Body("../_fixtures/api_get_recipes_for_service_fetch.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/scalings", Code: 200, Body: util.Body("../_fixtures/api_get_scaling.json"), Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	_ = b.Store.PutInstance(Instance{
+		ID:           "8dcdf609-36c9-4b22-bb16-d97e48c50f26",
+		DeploymentID: "5854017e89d50f424e000192",
+		ServiceID:    "9b4ee86b-3876-469f-a531-062e71bc5859",
+		PlanID:       "d6222855-17c6-448c-885a-e9d931cd221b",
+	})
+	r := NewRouter(b)
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 200, rec.Code) // must not need to list all deployments
+	assert.Contains(t, rec.Body.String(), `"service_id": "9b4ee86b-3876-469f-a531-062e71bc5859"`)
+	assert.Contains(t, rec.Body.String(), `"plan_id": "d6222855-17c6-448c-885a-e9d931cd221b"`)
+	assert.Contains(t, rec.Body.String(), `"id": "5854017e89d50f424e000192"`)
+}
+
 func TestBroker_FetchServiceInstance_NotFound(t *testing.T) {
 	test := []util.HttpTestCase{
 		util.HttpTestCase{Method: "GET", Path: "/deployments", Code: 404, Body: util.Body("../_fixtures/api_get_deployments.json"), Test: nil},
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("GET", "/v2/service_instances/52551d5f-1350-4f7d-9ddd-710a47ef9b72", nil)
@@ -613,6 +786,7 @@ func TestBroker_FetchServiceInstance_NotFound(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 404, rec.Code)
@@ -627,7 +801,7 @@ func TestBroker_FetchServiceInstance_RecipesNotFound(t *testing.T) {
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("GET", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26", nil)
@@ -635,6 +809,7 @@ func TestBroker_FetchServiceInstance_RecipesNotFound(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 404, rec.Code)
@@ -650,7 +825,7 @@ func TestBroker_FetchServiceInstance_ScalingsNotFound(t *testing.T) {
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("GET", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26", nil)
@@ -658,6 +833,7 @@ func TestBroker_FetchServiceInstance_ScalingsNotFound(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 404, rec.Code)
@@ -673,7 +849,7 @@ func TestBroker_FetchServiceInstance_ConcurrencyError422(t *testing.T) {
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("GET", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26", nil)
@@ -681,6 +857,7 @@ func TestBroker_FetchServiceInstance_ConcurrencyError422(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 422, rec.Code)
@@ -696,7 +873,7 @@ func TestBroker_FetchServiceInstance_ConcurrencyError404(t *testing.T) {
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("GET", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26", nil)
@@ -704,6 +881,7 @@ func TestBroker_FetchServiceInstance_ConcurrencyError404(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 404, rec.Code)
@@ -723,7 +901,7 @@ func TestBroker_UpdateServiceInstance(t *testing.T) {
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
 
 	update := ServiceInstanceUpdate{
 		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
@@ -737,6 +915,7 @@ func TestBroker_UpdateServiceInstance(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 202, rec.Code)
@@ -751,7 +930,7 @@ func TestBroker_UpdateServiceInstance_NoUpdate(t *testing.T) {
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
 
 	update := ServiceInstanceUpdate{
 		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
@@ -765,6 +944,7 @@ func TestBroker_UpdateServiceInstance_NoUpdate(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 200, rec.Code)
@@ -784,7 +964,7 @@ func TestBroker_UpdateServiceInstance_ImmediateUpdate(t *testing.T) {
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
 
 	update := ServiceInstanceUpdate{
 		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
@@ -798,6 +978,7 @@ func TestBroker_UpdateServiceInstance_ImmediateUpdate(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 200, rec.Code)
@@ -817,7 +998,7 @@ func TestBroker_UpdateServiceInstance_ImmediateFailure(t *testing.T) {
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
 
 	update := ServiceInstanceUpdate{
 		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
@@ -831,6 +1012,7 @@ func TestBroker_UpdateServiceInstance_ImmediateFailure(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 409, rec.Code)
@@ -850,7 +1032,7 @@ func TestBroker_UpdateServiceInstance_WithUnitsParameter(t *testing.T) {
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
 
 	update := ServiceInstanceUpdate{
 		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
@@ -865,6 +1047,7 @@ func TestBroker_UpdateServiceInstance_WithUnitsParameter(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 202, rec.Code)
@@ -872,7 +1055,7 @@ func TestBroker_UpdateServiceInstance_WithUnitsParameter(t *testing.T) {
 }
 
 func TestBroker_UpdateServiceInstance_AsyncRequired(t *testing.T) {
-	r := NewRouter(util.TestConfig(""))
+	r := NewRouter(NewBroker(util.TestConfig("")))
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("PATCH", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26", nil)
@@ -880,6 +1063,7 @@ func TestBroker_UpdateServiceInstance_AsyncRequired(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 422, rec.Code) // an update request must be async
@@ -888,7 +1072,7 @@ func TestBroker_UpdateServiceInstance_AsyncRequired(t *testing.T) {
 }
 
 func TestBroker_UpdateServiceInstance_EmptyBody(t *testing.T) {
-	r := NewRouter(util.TestConfig(""))
+	r := NewRouter(NewBroker(util.TestConfig("")))
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("PATCH", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26?accepts_incomplete=true", nil)
@@ -896,6 +1080,7 @@ func TestBroker_UpdateServiceInstance_EmptyBody(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 400, rec.Code)
@@ -904,7 +1089,7 @@ func TestBroker_UpdateServiceInstance_EmptyBody(t *testing.T) {
 }
 
 func TestBroker_UpdateServiceInstance_UnknownPlan(t *testing.T) {
-	r := NewRouter(util.TestConfig(""))
+	r := NewRouter(NewBroker(util.TestConfig("")))
 
 	update := ServiceInstanceUpdate{
 		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
@@ -918,6 +1103,7 @@ func TestBroker_UpdateServiceInstance_UnknownPlan(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 400, rec.Code)
@@ -926,7 +1112,7 @@ func TestBroker_UpdateServiceInstance_UnknownPlan(t *testing.T) {
 }
 
 func TestBroker_UpdateServiceInstance_UnitsMissing(t *testing.T) {
-	r := NewRouter(util.TestConfig(""))
+	r := NewRouter(NewBroker(util.TestConfig("")))
 
 	update := ServiceInstanceUpdate{
 		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
@@ -939,6 +1125,7 @@ func TestBroker_UpdateServiceInstance_UnitsMissing(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 400, rec.Code)
@@ -952,7 +1139,7 @@ func TestBroker_UpdateServiceInstance_NotFound(t *testing.T) {
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
 
 	update := ServiceInstanceUpdate{
 		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
@@ -966,6 +1153,7 @@ func TestBroker_UpdateServiceInstance_NotFound(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 404, rec.Code)
@@ -981,7 +1169,7 @@ func TestBroker_UpdateServiceInstance_ScalingNotFound(t *testing.T) {
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
 
 	update := ServiceInstanceUpdate{
 		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
@@ -995,6 +1183,7 @@ func TestBroker_UpdateServiceInstance_ScalingNotFound(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 409, rec.Code)
@@ -1011,7 +1200,7 @@ func TestBroker_UpdateServiceInstance_ConcurrencyError(t *testing.T) {
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
 
 	update := ServiceInstanceUpdate{
 		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
@@ -1025,6 +1214,7 @@ func TestBroker_UpdateServiceInstance_ConcurrencyError(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 422, rec.Code)
@@ -1044,7 +1234,7 @@ func TestBroker_UpdateServiceInstance_Error(t *testing.T) {
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
 
 	update := ServiceInstanceUpdate{
 		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
@@ -1058,6 +1248,7 @@ func TestBroker_UpdateServiceInstance_Error(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 409, rec.Code)
@@ -1075,7 +1266,7 @@ func TestBroker_DeprovisionServiceInstance(t *testing.T) {
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("DELETE", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26?accepts_incomplete=true", nil)
@@ -1083,10 +1274,13 @@ func TestBroker_DeprovisionServiceInstance(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 202, rec.Code) // a normal deprovisioning should be async
-	assert.Equal(t, "{}", rec.Body.String())
+	assert.Equal(t, `{
+  "operation": "5821fd28a4b549d06e39886d"
+}`, rec.Body.String())
 }
 
 func TestBroker_DeprovisionServiceInstance_ImmediateDeletion(t *testing.T) {
@@ -1099,7 +1293,7 @@ func TestBroker_DeprovisionServiceInstance_ImmediateDeletion(t *testing.T) {
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("DELETE", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26?accepts_incomplete=true", nil)
@@ -1107,6 +1301,7 @@ func TestBroker_DeprovisionServiceInstance_ImmediateDeletion(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 200, rec.Code) // deprovisioning could be fast and be immediately done
@@ -1123,7 +1318,7 @@ func TestBroker_DeprovisionServiceInstance_ImmediateFailure(t *testing.T) {
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("DELETE", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26?accepts_incomplete=true", nil)
@@ -1131,6 +1326,7 @@ func TestBroker_DeprovisionServiceInstance_ImmediateFailure(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 500, rec.Code)
@@ -1139,7 +1335,7 @@ func TestBroker_DeprovisionServiceInstance_ImmediateFailure(t *testing.T) {
 }
 
 func TestBroker_DeprovisionServiceInstance_AsyncRequired(t *testing.T) {
-	r := NewRouter(util.TestConfig(""))
+	r := NewRouter(NewBroker(util.TestConfig("")))
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("DELETE", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26", nil)
@@ -1147,6 +1343,7 @@ func TestBroker_DeprovisionServiceInstance_AsyncRequired(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 422, rec.Code) // a deprovisioning request must be async
@@ -1160,7 +1357,7 @@ func TestBroker_DeprovisionServiceInstance_NotFound(t *testing.T) {
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("DELETE", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26?accepts_incomplete=true", nil)
@@ -1168,6 +1365,7 @@ func TestBroker_DeprovisionServiceInstance_NotFound(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 410, rec.Code)
@@ -1183,7 +1381,7 @@ func TestBroker_DeprovisionServiceInstance_ConcurrencyError(t *testing.T) {
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("DELETE", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26?accepts_incomplete=true", nil)
@@ -1191,6 +1389,7 @@ func TestBroker_DeprovisionServiceInstance_ConcurrencyError(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 422, rec.Code)
@@ -1198,6 +1397,37 @@ func TestBroker_DeprovisionServiceInstance_ConcurrencyError(t *testing.T) {
 	assert.Contains(t, rec.Body.String(), `"description": "The service instance is currently being updated"`)
 }
 
+func TestBroker_DeprovisionServiceInstance_DuringProvisioning(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments", Code: 200, Body: util.Body("../_fixtures/api_get_deployments.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/recipes", Code: 200, Body: util.Body("../_fixtures/api_get_recipes_for_service_provision_in_progress.json"), Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	r := NewRouter(b)
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("DELETE", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26?accepts_incomplete=true", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 422, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"error": "ConcurrencyError"`)
+
+	// the platform gave up on provisioning, which is left to the orphan mitigation
+	stored, err := b.Store.GetInstance("8dcdf609-36c9-4b22-bb16-d97e48c50f26")
+	if assert.NoError(t, err) {
+		assert.True(t, stored.Abandoned)
+		assert.Equal(t, "5854017e89d50f424e000192", stored.DeploymentID)
+	}
+}
+
 func TestBroker_DeprovisionServiceInstance_Error(t *testing.T) {
 	test := []util.HttpTestCase{
 		util.HttpTestCase{Method: "GET", Path: "/deployments", Code: 200, Body: util.Body("../_fixtures/api_get_deployments.json"), Test: nil},
@@ -1207,7 +1437,7 @@ func TestBroker_DeprovisionServiceInstance_Error(t *testing.T) {
 	}
 	apiServer := util.TestServer("deadbeef", test)
 	defer apiServer.Close()
-	r := NewRouter(util.TestConfig(apiServer.URL))
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("DELETE", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26?accepts_incomplete=true", nil)
@@ -1215,9 +1445,899 @@ func TestBroker_DeprovisionServiceInstance_Error(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
 	r.ServeHTTP(rec, req)
 
 	assert.Equal(t, 500, rec.Code)
 	assert.Contains(t, rec.Body.String(), `"error": "UnknownError"`)
 	assert.Contains(t, rec.Body.String(), `"description": "Could not delete service instance"`)
 }
+
+func TestBroker_DeprovisionServiceInstance_Timeout(t *testing.T) {
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer apiServer.Close()
+	config := util.TestConfig(apiServer.URL)
+	config.RequestTimeout = 50 * time.Millisecond
+	r := NewRouter(NewBroker(config))
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("DELETE", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26?accepts_incomplete=true", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	// must not be answered with 410 Gone, the service instance could very well still exist
+	assert.Equal(t, 504, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"error": "Timeout"`)
+	assert.Contains(t, rec.Body.String(), `"description": "The Compose.io API did not answer in time"`)
+}
+
+func TestBroker_ProvisionServiceInstance_ValidationError(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "POST", Path: "/deployments", Code: 422, Body: `{"errors":{"units":["must be less than 100"]}}`, Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	r := NewRouter(b)
+
+	provisioning := ServiceInstanceProvisioning{
+		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
+		PlanID:    "d6222855-17c6-448c-885a-e9d931cd221b",
+	}
+	data, _ := json.MarshalIndent(provisioning, "", "  ")
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("PUT", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26?accepts_incomplete=true", bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 400, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"error": "ValidationError"`)
+	assert.Contains(t, rec.Body.String(), `"description": "units: must be less than 100"`)
+
+	_, err = b.Store.GetInstance("8dcdf609-36c9-4b22-bb16-d97e48c50f26")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestBroker_UpdateServiceInstance_Conflict(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments", Code: 200, Body: util.Body("../_fixtures/api_get_deployments.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/scalings", Code: 200, Body: util.Body("../_fixtures/api_get_scaling.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/recipes", Code: 200, Body: util.Body("../_fixtures/api_get_recipes_for_service_update.json"), Test: nil},
+		util.HttpTestCase{Method: "POST", Path: "/deployments/5854017e89d50f424e000192/scalings", Code: 409, Body: `{"errors":"deployment is locked"}`, Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
+
+	update := ServiceInstanceUpdate{
+		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
+		PlanID:    "d6222855-17c6-448c-885a-e9d931cd221b",
+	}
+	data, _ := json.MarshalIndent(update, "", "  ")
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("PATCH", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26?accepts_incomplete=true", bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 422, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"error": "ConcurrencyError"`)
+	assert.Contains(t, rec.Body.String(), `"description": "deployment is locked"`)
+}
+
+func TestBroker_DeprovisionServiceInstance_APIFailure(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments", Code: 500, Body: util.Body("../_fixtures/api_example_error.json"), Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("DELETE", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26?accepts_incomplete=true", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	// a failing Compose.io API does not mean the service instance is gone
+	assert.Equal(t, 500, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"description": "Could not query service instance"`)
+}
+
+func TestBroker_ProvisionServiceInstance_InvalidParameters(t *testing.T) {
+	r := NewRouter(NewBroker(util.TestConfig("")))
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("PUT", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26?accepts_incomplete=true", bytes.NewBufferString(`{
+  "service_id": "9b4ee86b-3876-469f-a531-062e71bc5859",
+  "plan_id": "d6222855-17c6-448c-885a-e9d931cd221b",
+  "parameters": { "unit": 4, "units": 0 }
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 400, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"error": "ValidationError"`)
+	assert.Contains(t, rec.Body.String(), `"description": "Invalid parameters: (root): Additional property unit is not allowed; units: Must be greater than or equal to 1"`)
+}
+
+func TestBroker_UpdateServiceInstance_InvalidParameters(t *testing.T) {
+	r := NewRouter(NewBroker(util.TestConfig("")))
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("PATCH", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26?accepts_incomplete=true", bytes.NewBufferString(`{
+  "service_id": "9b4ee86b-3876-469f-a531-062e71bc5859",
+  "parameters": { "datacenter": "aws:us-east-1" }
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 400, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"description": "Invalid parameters: (root): Additional property datacenter is not allowed"`)
+}
+
+func TestBroker_UpdateServiceInstance_PlanMigration(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments", Code: 200, Body: util.Body("../_fixtures/api_get_deployments.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/scalings", Code: 200, Body: util.Body("../_fixtures/api_get_scaling.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/databases", Code: 200, Body: util.Body("../_fixtures/api_get_databases.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/versions", Code: 200, Body: util.Body("../_fixtures/api_get_version_transitions.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/recipes", Code: 200, Body: util.Body("../_fixtures/api_get_recipes_for_service_update.json"), Test: nil},
+		util.HttpTestCase{Method: "POST", Path: "/deployments/5854017e89d50f424e000192/scalings", Code: 200, Body: util.Body("../_fixtures/api_update_scaling.json"), Test: func(body string) {
+			assert.Contains(t, body, `{"deployment":{"units":2}}`)
+		}},
+		util.HttpTestCase{Method: "GET", Path: "/recipes/570bcb3fee4cde000e000002", Code: 200, Body: util.Body("../_fixtures/api_update_scaling.json"), Test: nil},
+		util.HttpTestCase{Method: "PATCH", Path: "/deployments/5854017e89d50f424e000192/versions", Code: 200, Body: util.Body("../_fixtures/api_update_version.json"), Test: func(body string) {
+			assert.Contains(t, body, `{"deployment":{"version":"9.6.12"}}`)
+		}},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	config := util.TestConfig(apiServer.URL)
+	config.CatalogFilename = "../_fixtures/catalog_with_migrations.yml"
+	b := NewBroker(config)
+	r := NewRouter(b)
+
+	update := ServiceInstanceUpdate{
+		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
+		PlanID:    "0b0a4ba0-5ac1-4c4b-8f4e-2a6f3c0e9c11",
+	}
+	data, _ := json.MarshalIndent(update, "", "  ")
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("PATCH", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26?accepts_incomplete=true", bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	// scaling was done immediately, the version upgrade is still running
+	assert.Equal(t, 202, rec.Code)
+	assert.Equal(t, util.Body("../_fixtures/broker_update_service_instance.json"), rec.Body.String())
+
+	operation, err := b.Store.GetOperation("570bcb3fee4cde000e000002")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "5a2f0e1b7c9d4e000e000003", operation.RecipeID)
+		assert.Len(t, operation.Steps, 0)
+	}
+}
+
+func TestBroker_UpdateServiceInstance_VersionOnly(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments", Code: 200, Body: util.Body("../_fixtures/api_get_deployments.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/scalings", Code: 200, Body: util.Body("../_fixtures/api_get_scaling.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/databases", Code: 200, Body: util.Body("../_fixtures/api_get_databases.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/versions", Code: 200, Body: util.Body("../_fixtures/api_get_version_transitions.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/recipes", Code: 200, Body: util.Body("../_fixtures/api_get_recipes_for_service_update.json"), Test: nil},
+		util.HttpTestCase{Method: "POST", Path: "/deployments/5854017e89d50f424e000192/scalings", Code: 500, Body: "", Test: func(body string) {
+			t.Error("must not scale a deployment that already has the units of the plan")
+		}},
+		util.HttpTestCase{Method: "PATCH", Path: "/deployments/5854017e89d50f424e000192/versions", Code: 200, Body: util.Body("../_fixtures/api_update_version.json"), Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	config := util.TestConfig(apiServer.URL)
+	config.CatalogFilename = "../_fixtures/catalog_with_migrations.yml"
+	r := NewRouter(NewBroker(config))
+
+	update := ServiceInstanceUpdate{
+		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
+		PlanID:    "6f3e2f53-4b9d-4d8c-a7a5-0f4c1b0d5e22",
+	}
+	data, _ := json.MarshalIndent(update, "", "  ")
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("PATCH", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26?accepts_incomplete=true", bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 202, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"operation": "5a2f0e1b7c9d4e000e000003"`)
+}
+
+func TestBroker_UpdateServiceInstance_DatacenterChange(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/scalings", Code: 200, Body: util.Body("../_fixtures/api_get_scaling.json"), Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	config := util.TestConfig(apiServer.URL)
+	config.CatalogFilename = "../_fixtures/catalog_with_migrations.yml"
+	b := NewBroker(config)
+	_ = b.Store.PutInstance(Instance{
+		ID:           "8dcdf609-36c9-4b22-bb16-d97e48c50f26",
+		DeploymentID: "5854017e89d50f424e000192",
+		ServiceID:    "9b4ee86b-3876-469f-a531-062e71bc5859",
+		PlanID:       "d6222855-17c6-448c-885a-e9d931cd221b",
+	})
+	r := NewRouter(b)
+
+	update := ServiceInstanceUpdate{
+		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
+		PlanID:    "8c1d5f0a-2e7b-4a3c-9f6d-1b2a3c4d5e33",
+	}
+	data, _ := json.MarshalIndent(update, "", "  ")
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("PATCH", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26?accepts_incomplete=true", bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 400, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"description": "Cannot move a deployment from datacenter gce:europe-west1 to aws:eu-central-1"`)
+}
+
+func TestBroker_UpdateServiceInstance_DifferentService(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments", Code: 200, Body: util.Body("../_fixtures/api_get_deployments.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/scalings", Code: 200, Body: util.Body("../_fixtures/api_get_scaling.json"), Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	config := util.TestConfig(apiServer.URL)
+	config.CatalogFilename = "../_fixtures/catalog_with_migrations.yml"
+	r := NewRouter(NewBroker(config))
+
+	update := ServiceInstanceUpdate{
+		ServiceID: "e27ea95a-3883-44f2-8ca4-01101f39d50c",
+		PlanID:    "ae2bda53-fe15-4335-9422-774aae3e7e32",
+	}
+	data, _ := json.MarshalIndent(update, "", "  ")
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("PATCH", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26?accepts_incomplete=true", bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 400, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"description": "Cannot change a postgresql deployment into redis"`)
+}
+
+func TestBroker_LastOperationServiceInstance_PlanMigration(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/recipes/570bcb3fee4cde000e000002", Code: 200, Body: util.Body("../_fixtures/api_update_scaling.json"), Test: nil},
+		util.HttpTestCase{Method: "PATCH", Path: "/deployments/5854017e89d50f424e000192/versions", Code: 200, Body: util.Body("../_fixtures/api_update_version.json"), Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	_ = b.Store.PutInstance(Instance{ID: "8dcdf609-36c9-4b22-bb16-d97e48c50f26", DeploymentID: "5854017e89d50f424e000192"})
+	_ = b.Store.PutOperation(Operation{
+		ID:         "570bcb3fee4cde000e000002",
+		Type:       "update",
+		InstanceID: "8dcdf609-36c9-4b22-bb16-d97e48c50f26",
+		RecipeID:   "570bcb3fee4cde000e000002",
+		Steps:      []Step{Step{Version: "9.6.12"}},
+	})
+	r := NewRouter(b)
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26/last_operation?operation=570bcb3fee4cde000e000002", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	// the scaling has completed, but the plan migration goes on with the version upgrade
+	assert.Equal(t, 200, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"state": "in progress"`)
+	assert.Contains(t, rec.Body.String(), `"description": "Upgrade deployment to 9.6.12 operation in progress"`)
+
+	operation, err := b.Store.GetOperation("570bcb3fee4cde000e000002")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "5a2f0e1b7c9d4e000e000003", operation.RecipeID)
+		assert.Len(t, operation.Steps, 0)
+	}
+}
+
+func TestBroker_LastOperationServiceInstance_PlanMigrationRejected(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/recipes/570bcb3fee4cde000e000002", Code: 200, Body: util.Body("../_fixtures/api_update_scaling.json"), Test: nil},
+		util.HttpTestCase{Method: "PATCH", Path: "/deployments/5854017e89d50f424e000192/versions", Code: 422, Body: `{"errors":"version 9.6.12 is not a valid upgrade target"}`, Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	_ = b.Store.PutInstance(Instance{ID: "8dcdf609-36c9-4b22-bb16-d97e48c50f26", DeploymentID: "5854017e89d50f424e000192"})
+	_ = b.Store.PutOperation(Operation{
+		ID:         "570bcb3fee4cde000e000002",
+		Type:       "update",
+		InstanceID: "8dcdf609-36c9-4b22-bb16-d97e48c50f26",
+		RecipeID:   "570bcb3fee4cde000e000002",
+		Steps:      []Step{Step{Version: "9.6.12"}},
+	})
+	r := NewRouter(b)
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26/last_operation?operation=570bcb3fee4cde000e000002", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 200, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"state": "failed"`)
+	assert.Contains(t, rec.Body.String(), `version 9.6.12 is not a valid upgrade target`)
+}
+
+func TestBroker_UpdateServiceInstance_FailedScalingKeepsPlan(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/scalings", Code: 200, Body: util.Body("../_fixtures/api_get_scaling.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/databases", Code: 200, Body: util.Body("../_fixtures/api_get_databases.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/versions", Code: 200, Body: util.Body("../_fixtures/api_get_version_transitions.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/recipes", Code: 200, Body: util.Body("../_fixtures/api_get_recipes_for_service_update.json"), Test: nil},
+		util.HttpTestCase{Method: "POST", Path: "/deployments/5854017e89d50f424e000192/scalings", Code: 200, Body: util.Body("../_fixtures/api_update_scaling_for_service_update.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/recipes/5821fd28a4b549d06e39886d", Code: 200, Body: util.Body("../_fixtures/api_get_recipe_for_immediate_service_update_failure.json"), Test: nil},
+		util.HttpTestCase{Method: "PATCH", Path: "/deployments/5854017e89d50f424e000192", Code: 500, Body: "", Test: func(body string) {
+			t.Error("must not change the deployment notes to a plan the update failed to migrate to")
+		}},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	config := util.TestConfig(apiServer.URL)
+	config.CatalogFilename = "../_fixtures/catalog_with_migrations.yml"
+	b := NewBroker(config)
+	_ = b.Store.PutInstance(Instance{
+		ID:           "8dcdf609-36c9-4b22-bb16-d97e48c50f26",
+		DeploymentID: "5854017e89d50f424e000192",
+		ServiceID:    "9b4ee86b-3876-469f-a531-062e71bc5859",
+		PlanID:       "d6222855-17c6-448c-885a-e9d931cd221b",
+	})
+	r := NewRouter(b)
+
+	update := ServiceInstanceUpdate{
+		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
+		PlanID:    "0b0a4ba0-5ac1-4c4b-8f4e-2a6f3c0e9c11",
+	}
+	data, _ := json.MarshalIndent(update, "", "  ")
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("PATCH", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26?accepts_incomplete=true", bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 409, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"error": "UpdateFailure"`)
+
+	stored, err := b.Store.GetInstance("8dcdf609-36c9-4b22-bb16-d97e48c50f26")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "d6222855-17c6-448c-885a-e9d931cd221b", stored.PlanID)
+		assert.Equal(t, "5821fd28a4b549d06e39886d", stored.Operation) // the deployment might be left in between plans
+	}
+}
+
+func TestBroker_LastOperationServiceInstance_FailedUpdateKeepsPlan(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/recipes/5821fd28a4b549d06e39886d", Code: 200, Body: util.Body("../_fixtures/api_get_recipe_for_immediate_service_update_failure.json"), Test: nil},
+		util.HttpTestCase{Method: "PATCH", Path: "/deployments/5854017e89d50f424e000192", Code: 500, Body: "", Test: func(body string) {
+			t.Error("must not change the deployment notes to a plan the update failed to migrate to")
+		}},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	_ = b.Store.PutInstance(Instance{
+		ID:           "8dcdf609-36c9-4b22-bb16-d97e48c50f26",
+		DeploymentID: "5854017e89d50f424e000192",
+		ServiceID:    "9b4ee86b-3876-469f-a531-062e71bc5859",
+		PlanID:       "d6222855-17c6-448c-885a-e9d931cd221b",
+		Operation:    "5821fd28a4b549d06e39886d",
+	})
+	update := &ServiceInstanceUpdate{ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859"}
+	update.Parameters.Units = 3
+	b.saveSteps(context.Background(), "update", "8dcdf609-36c9-4b22-bb16-d97e48c50f26", "5821fd28a4b549d06e39886d", nil, update)
+	r := NewRouter(b)
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26/last_operation?operation=5821fd28a4b549d06e39886d", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 200, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"state": "failed"`)
+
+	stored, err := b.Store.GetInstance("8dcdf609-36c9-4b22-bb16-d97e48c50f26")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "d6222855-17c6-448c-885a-e9d931cd221b", stored.PlanID)
+		assert.NotContains(t, string(stored.Parameters), "units")
+		assert.Equal(t, "5821fd28a4b549d06e39886d", stored.Operation)
+	}
+}
+
+func TestBroker_LastOperationServiceInstance_CompletedUpdate(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/recipes/5821fd28a4b549d06e39886d", Code: 200, Body: util.Body("../_fixtures/api_get_recipe_for_immediate_service_update.json"), Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	_ = b.Store.PutInstance(Instance{
+		ID:           "8dcdf609-36c9-4b22-bb16-d97e48c50f26",
+		DeploymentID: "5854017e89d50f424e000192",
+		ServiceID:    "9b4ee86b-3876-469f-a531-062e71bc5859",
+		PlanID:       "d6222855-17c6-448c-885a-e9d931cd221b",
+		Operation:    "5821fd28a4b549d06e39886d",
+	})
+	update := &ServiceInstanceUpdate{ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859"}
+	update.Parameters.Units = 3
+	update.Parameters.OnDemandBackup = true
+	b.saveSteps(context.Background(), "update", "8dcdf609-36c9-4b22-bb16-d97e48c50f26", "5821fd28a4b549d06e39886d", nil, update)
+	r := NewRouter(b)
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26/last_operation?operation=5821fd28a4b549d06e39886d", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 200, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"state": "succeeded"`)
+
+	stored, err := b.Store.GetInstance("8dcdf609-36c9-4b22-bb16-d97e48c50f26")
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(stored.Parameters), `"units":3`)
+		assert.NotContains(t, string(stored.Parameters), "on_demand_backup")
+		assert.Empty(t, stored.Operation)
+	}
+}
+
+func TestBroker_UpdateServiceInstance_WithVersionParameter(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments", Code: 200, Body: util.Body("../_fixtures/api_get_deployments.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/scalings", Code: 200, Body: util.Body("../_fixtures/api_get_scaling.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/databases", Code: 200, Body: util.Body("../_fixtures/api_get_databases.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/versions", Code: 200, Body: util.Body("../_fixtures/api_get_version_transitions.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/recipes", Code: 200, Body: util.Body("../_fixtures/api_get_recipes_for_service_update.json"), Test: nil},
+		util.HttpTestCase{Method: "PATCH", Path: "/deployments/5854017e89d50f424e000192/versions", Code: 200, Body: util.Body("../_fixtures/api_update_version.json"), Test: func(body string) {
+			assert.Contains(t, body, `{"deployment":{"version":"9.6.12"}}`)
+		}},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	r := NewRouter(b)
+
+	update := ServiceInstanceUpdate{
+		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
+	}
+	update.Parameters.Version = "9.6.12"
+	data, _ := json.MarshalIndent(update, "", "  ")
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("PATCH", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26?accepts_incomplete=true", bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 202, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"operation": "5a2f0e1b7c9d4e000e000003"`)
+
+	operation, err := b.Store.GetOperation("5a2f0e1b7c9d4e000e000003")
+	if assert.NoError(t, err) && assert.NotNil(t, operation.Update) {
+		assert.Equal(t, "9.6.12", operation.Update.Parameters.Version)
+	}
+}
+
+func TestBroker_UpdateServiceInstance_UnavailableVersion(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments", Code: 200, Body: util.Body("../_fixtures/api_get_deployments.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/scalings", Code: 200, Body: util.Body("../_fixtures/api_get_scaling.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/databases", Code: 200, Body: util.Body("../_fixtures/api_get_databases.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/versions", Code: 200, Body: util.Body("../_fixtures/api_get_version_transitions.json"), Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	r := NewRouter(NewBroker(util.TestConfig(apiServer.URL)))
+
+	for version, description := range map[string]string{
+		"11.2":   "Version 11.2 is not available for postgresql",
+		"9.6.10": "Version 9.6.10 is not available for postgresql",
+		"9.5.16": "Cannot upgrade from version 9.6.3 to 9.5.16, possible versions are: 9.6.11, 9.6.12",
+	} {
+		update := ServiceInstanceUpdate{
+			ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
+		}
+		update.Parameters.Version = version
+		data, _ := json.MarshalIndent(update, "", "  ")
+
+		rec := httptest.NewRecorder()
+		req, err := http.NewRequest("PATCH", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26?accepts_incomplete=true", bytes.NewBuffer(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("broker", "pw")
+		req.Header.Set("X-Broker-API-Version", "2.15")
+		r.ServeHTTP(rec, req)
+
+		assert.Equal(t, 400, rec.Code)
+		assert.Contains(t, rec.Body.String(), fmt.Sprintf(`"description": "%s"`, description))
+	}
+}
+
+func TestBroker_ProvisionServiceInstance_RestoreFromBackup(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/backups/5a3a1f5e8c3c8f001a3e4d21", Code: 200, Body: util.Body("../_fixtures/api_get_backup.json"), Test: nil},
+		util.HttpTestCase{Method: "POST", Path: "/deployments/5854017e89d50f424e000192/backups/5a3a1f5e8c3c8f001a3e4d21/restore", Code: 202, Body: util.Body("../_fixtures/api_restore_backup.json"), Test: func(body string) {
+			assert.Equal(t, `{"deployment":{"name":"c9f2a0b4-6e1d-4f7a-9b3c-2d8e5f1a7b60","datacenter":"gce:europe-west1"}}`, body)
+		}},
+		util.HttpTestCase{Method: "PATCH", Path: "/deployments/5a3c0d4e7f2a1b001a3e5012", Code: 200, Body: util.Body("../_fixtures/api_restore_backup.json"), Test: func(body string) {
+			assert.Contains(t, body, `"notes":"`)
+		}},
+		util.HttpTestCase{Method: "POST", Path: "/deployments", Code: 500, Body: "", Test: func(body string) {
+			t.Error("must not create an empty deployment when restoring a backup")
+		}},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	_ = b.Store.PutInstance(Instance{
+		ID:           "8dcdf609-36c9-4b22-bb16-d97e48c50f26",
+		DeploymentID: "5854017e89d50f424e000192",
+		ServiceID:    "9b4ee86b-3876-469f-a531-062e71bc5859",
+		PlanID:       "d6222855-17c6-448c-885a-e9d931cd221b",
+		SpaceGUID:    "1b6f5f44-0b51-4a2e-8f0e-bc7c1d0b5d3e",
+	})
+	r := NewRouter(b)
+
+	provisioning := ServiceInstanceProvisioning{
+		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
+		PlanID:    "d6222855-17c6-448c-885a-e9d931cd221b",
+		SpaceGUID: "1b6f5f44-0b51-4a2e-8f0e-bc7c1d0b5d3e",
+	}
+	provisioning.Parameters.RestoreFromBackup = "5a3a1f5e8c3c8f001a3e4d21"
+	data, _ := json.MarshalIndent(provisioning, "", "  ")
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("PUT", "/v2/service_instances/c9f2a0b4-6e1d-4f7a-9b3c-2d8e5f1a7b60?accepts_incomplete=true", bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 202, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"operation": "5a3c0d4e7f2a1b001a3e5013"`)
+
+	instance, err := b.Store.GetInstance("c9f2a0b4-6e1d-4f7a-9b3c-2d8e5f1a7b60")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "5a3c0d4e7f2a1b001a3e5012", instance.DeploymentID)
+		assert.Equal(t, "1b6f5f44-0b51-4a2e-8f0e-bc7c1d0b5d3e", instance.SpaceGUID)
+	}
+
+	// the restored deployment is scaled to the plan once the restore has completed
+	operation, err := b.Store.GetOperation("5a3c0d4e7f2a1b001a3e5013")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []Step{Step{Units: 1}}, operation.Steps)
+	}
+}
+
+func TestBroker_ProvisionServiceInstance_RestoreFromBackupOfOtherSpace(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/backups/5a3a1f5e8c3c8f001a3e4d21", Code: 200, Body: util.Body("../_fixtures/api_get_backup.json"), Test: func(body string) {
+			t.Error("must not look at backups of service instances in other spaces")
+		}},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	_ = b.Store.PutInstance(Instance{
+		ID:           "8dcdf609-36c9-4b22-bb16-d97e48c50f26",
+		DeploymentID: "5854017e89d50f424e000192",
+		ServiceID:    "9b4ee86b-3876-469f-a531-062e71bc5859",
+		PlanID:       "d6222855-17c6-448c-885a-e9d931cd221b",
+		SpaceGUID:    "1b6f5f44-0b51-4a2e-8f0e-bc7c1d0b5d3e",
+	})
+	r := NewRouter(b)
+
+	provisioning := ServiceInstanceProvisioning{
+		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
+		PlanID:    "d6222855-17c6-448c-885a-e9d931cd221b",
+		SpaceGUID: "0e2b7c1a-5a4d-4c38-9d47-2f3c8a9b6e11",
+	}
+	provisioning.Parameters.RestoreFromBackup = "5a3a1f5e8c3c8f001a3e4d21"
+	data, _ := json.MarshalIndent(provisioning, "", "  ")
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("PUT", "/v2/service_instances/c9f2a0b4-6e1d-4f7a-9b3c-2d8e5f1a7b60?accepts_incomplete=true", bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 400, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"description": "Backup 5a3a1f5e8c3c8f001a3e4d21 does not belong to any service instance of this service in the same space"`)
+}
+
+func TestBroker_UpdateServiceInstance_OnDemandBackup(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments", Code: 200, Body: util.Body("../_fixtures/api_get_deployments.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/scalings", Code: 200, Body: util.Body("../_fixtures/api_get_scaling.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/recipes", Code: 200, Body: util.Body("../_fixtures/api_get_recipes_for_service_update.json"), Test: nil},
+		util.HttpTestCase{Method: "POST", Path: "/deployments/5854017e89d50f424e000192/backups", Code: 202, Body: util.Body("../_fixtures/api_start_backup.json"), Test: nil},
+		util.HttpTestCase{Method: "POST", Path: "/deployments/5854017e89d50f424e000192/scalings", Code: 500, Body: "", Test: func(body string) {
+			t.Error("must not scale before the backup has completed")
+		}},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	r := NewRouter(b)
+
+	update := ServiceInstanceUpdate{
+		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
+	}
+	update.Parameters.OnDemandBackup = true
+	update.Parameters.Units = 6
+	data, _ := json.MarshalIndent(update, "", "  ")
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("PATCH", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26?accepts_incomplete=true", bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 202, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"operation": "5a3b7e2c9b1e5d001a3e4f90"`)
+
+	operation, err := b.Store.GetOperation("5a3b7e2c9b1e5d001a3e4f90")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []Step{Step{Units: 6}}, operation.Steps)
+	}
+	_, err = b.Store.GetInstance("8dcdf609-36c9-4b22-bb16-d97e48c50f26")
+	assert.Equal(t, ErrNotFound, err) // nothing is recorded before the update completed
+}
+
+func TestBroker_ProvisionServiceInstance_Whitelist(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "POST", Path: "/deployments", Code: 202, Body: util.Body("../_fixtures/api_create_deployment_for_service_provisioning.json"), Test: nil},
+		util.HttpTestCase{Method: "POST", Path: "/whitelist", Code: 500, Body: "", Test: func(body string) {
+			t.Error("must not change the whitelist before the deployment has been provisioned")
+		}},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	config := util.TestConfig(apiServer.URL)
+	config.API.DefaultWhitelist = []string{"10.0.0.0/8"}
+	b := NewBroker(config)
+	r := NewRouter(b)
+
+	provisioning := ServiceInstanceProvisioning{
+		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
+		PlanID:    "d6222855-17c6-448c-885a-e9d931cd221b",
+	}
+	provisioning.Parameters.Whitelist = []string{"172.16.0.0/12", "35.157.12.40"}
+	data, _ := json.MarshalIndent(provisioning, "", "  ")
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("PUT", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26?accepts_incomplete=true", bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 202, rec.Code)
+	assert.Equal(t, util.Body("../_fixtures/broker_provision_service_instance.json"), rec.Body.String())
+
+	// the parameter replaces the default whitelist
+	operation, err := b.Store.GetOperation("59a6b3a5f32fb6001001ae6b")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []Step{Step{WhitelistAdd: "172.16.0.0/12"}, Step{WhitelistAdd: "35.157.12.40/32"}}, operation.Steps)
+	}
+}
+
+func TestBroker_ProvisionServiceInstance_DefaultWhitelist(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "POST", Path: "/deployments", Code: 202, Body: util.Body("../_fixtures/api_create_deployment_for_service_provisioning.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/recipes/59a6b3a5f32fb6001001ae6b", Code: 200, Body: util.Body("../_fixtures/api_get_recipe_for_immediate_service_provision.json"), Test: nil},
+		util.HttpTestCase{Method: "POST", Path: "/deployments/59a6b3a5f32fb6001001ae6c/whitelist", Code: 202, Body: util.Body("../_fixtures/api_add_whitelist.json"), Test: func(body string) {
+			assert.Equal(t, `{"deployment":{"whitelist":{"ip":"10.0.0.0/8","description":"compose-broker"}}}`, body)
+		}},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	config := util.TestConfig(apiServer.URL)
+	config.API.DefaultWhitelist = []string{"10.0.0.0/8"}
+	r := NewRouter(NewBroker(config))
+
+	provisioning := ServiceInstanceProvisioning{
+		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
+		PlanID:    "d6222855-17c6-448c-885a-e9d931cd221b",
+	}
+	data, _ := json.MarshalIndent(provisioning, "", "  ")
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("PUT", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26?accepts_incomplete=true", bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	// provisioning has already completed, but the whitelist is still being set up
+	assert.Equal(t, 202, rec.Code)
+	assert.Equal(t, util.Body("../_fixtures/broker_provision_service_instance.json"), rec.Body.String())
+}
+
+func TestBroker_UpdateServiceInstance_Whitelist(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments", Code: 200, Body: util.Body("../_fixtures/api_get_deployments.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/scalings", Code: 200, Body: util.Body("../_fixtures/api_get_scaling.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/recipes", Code: 200, Body: util.Body("../_fixtures/api_get_recipes_for_service_update.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/whitelist", Code: 200, Body: util.Body("../_fixtures/api_get_whitelist.json"), Test: nil},
+		util.HttpTestCase{Method: "POST", Path: "/deployments/5854017e89d50f424e000192/whitelist", Code: 202, Body: util.Body("../_fixtures/api_add_whitelist.json"), Test: func(body string) {
+			assert.Contains(t, body, `"ip":"172.16.0.0/12"`)
+		}},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	r := NewRouter(b)
+
+	update := ServiceInstanceUpdate{
+		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
+	}
+	update.Parameters.Whitelist = []string{"172.16.0.0/12"}
+	data, _ := json.MarshalIndent(update, "", "  ")
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("PATCH", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26?accepts_incomplete=true", bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 202, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"operation": "5a4b1c2d3e4f5a001a3e6101"`)
+
+	// 10.0.0.0/8 was added by the broker and is removed, the office network and binding entries stay
+	operation, err := b.Store.GetOperation("5a4b1c2d3e4f5a001a3e6101")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []Step{Step{WhitelistRemove: "5a4b1c2d3e4f5a001a3e6001"}}, operation.Steps)
+	}
+}
+
+func TestBroker_UpdateServiceInstance_PlanChangeDropsUnitsParameter(t *testing.T) {
+	b := NewBroker(util.TestConfig("http://localhost"))
+	b.saveInstance(context.Background(), Instance{
+		ID:         "8dcdf609-36c9-4b22-bb16-d97e48c50f26",
+		ServiceID:  "9b4ee86b-3876-469f-a531-062e71bc5859",
+		PlanID:     "d6222855-17c6-448c-885a-e9d931cd221b",
+		Parameters: []byte(`{"datacenter":"aws:eu-west-1","units":3}`),
+	})
+
+	update := ServiceInstanceUpdate{ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859", PlanID: "a7e2bcb4-4f5c-4c4f-9a3e-6c1d2b8f0e35"}
+	b.updateInstance(context.Background(), "8dcdf609-36c9-4b22-bb16-d97e48c50f26", "5854017e89d50f424e000192", update)
+
+	stored, err := b.Store.GetInstance("8dcdf609-36c9-4b22-bb16-d97e48c50f26")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "a7e2bcb4-4f5c-4c4f-9a3e-6c1d2b8f0e35", stored.PlanID)
+		assert.JSONEq(t, `{"datacenter":"aws:eu-west-1"}`, string(stored.Parameters))
+	}
+}
+
+func TestBroker_UpdateServiceInstance_KeepsProvisioningParameters(t *testing.T) {
+	b := NewBroker(util.TestConfig("http://localhost"))
+	b.saveInstance(context.Background(), Instance{
+		ID:         "8dcdf609-36c9-4b22-bb16-d97e48c50f26",
+		ServiceID:  "9b4ee86b-3876-469f-a531-062e71bc5859",
+		PlanID:     "d6222855-17c6-448c-885a-e9d931cd221b",
+		Parameters: []byte(`{"datacenter":"aws:eu-west-1","cache_mode":true,"account_id":"586eab527c65836dde5533e8","units":2,"whitelist":["10.0.0.0/8"]}`),
+	})
+
+	update := ServiceInstanceUpdate{ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859"}
+	update.Parameters.Units = 3
+	update.Parameters.OnDemandBackup = true
+	update.Parameters.Whitelist = []string{}
+	b.updateInstance(context.Background(), "8dcdf609-36c9-4b22-bb16-d97e48c50f26", "5854017e89d50f424e000192", update)
+
+	stored, err := b.Store.GetInstance("8dcdf609-36c9-4b22-bb16-d97e48c50f26")
+	if assert.NoError(t, err) {
+		assert.JSONEq(t, `{"datacenter":"aws:eu-west-1","cache_mode":true,"account_id":"586eab527c65836dde5533e8","units":3,"whitelist":[]}`, string(stored.Parameters))
+	}
+}
@@ -0,0 +1,89 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/JamesClonk/compose-broker/config"
+	"github.com/JamesClonk/compose-broker/log"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// Store remembers everything about service instances, bindings and operations the Compose.io API can't tell us,
+// it is consulted first by all handlers, with the Compose.io API being the fallback
+type Store interface {
+	GetInstance(instanceID string) (*Instance, error)
+	GetInstances() ([]Instance, error)
+	PutInstance(instance Instance) error
+	DeleteInstance(instanceID string) error
+
+	GetBinding(instanceID, bindingID string) (*Binding, error)
+	GetBindings(instanceID string) ([]Binding, error)
+	PutBinding(binding Binding) error
+	DeleteBinding(instanceID, bindingID string) error
+
+	GetOperation(operationID string) (*Operation, error)
+	PutOperation(operation Operation) error
+	DeleteOperation(operationID string) error
+
+	Close() error
+}
+
+type Instance struct {
+	ID               string           `json:"id"`
+	DeploymentID     string           `json:"deployment_id"`
+	ServiceID        string           `json:"service_id"`
+	PlanID           string           `json:"plan_id"`
+	OrganizationGUID string           `json:"organization_guid,omitempty"`
+	SpaceGUID        string           `json:"space_guid,omitempty"`
+	Context          *PlatformContext `json:"context,omitempty"`
+	Parameters       json.RawMessage  `json:"parameters,omitempty"`
+	Abandoned        bool             `json:"abandoned,omitempty"` // the platform gave up on it while it was being provisioned
+	Operation        string           `json:"operation,omitempty"` // set while an update is running, and kept if it failed halfway through
+	CreatedAt        time.Time        `json:"created_at"`
+	UpdatedAt        time.Time        `json:"updated_at"`
+}
+type Binding struct {
+	ID         string          `json:"id"`
+	InstanceID string          `json:"instance_id"`
+	Parameters json.RawMessage `json:"parameters,omitempty"`
+	Operation  string          `json:"operation,omitempty"` // set while the binding is still waiting for a recipe
+	CreatedAt  time.Time       `json:"created_at"`
+}
+type Operation struct {
+	ID         string                 `json:"id"`
+	Type       string                 `json:"type"` // can be provision, update, deprovision, bind or unbind
+	InstanceID string                 `json:"instance_id"`
+	BindingID  string                 `json:"binding_id,omitempty"`
+	RecipeID   string                 `json:"recipe_id,omitempty"`
+	Steps      []Step                 `json:"steps,omitempty"`  // pending steps of a plan migration, started one after another
+	Update     *ServiceInstanceUpdate `json:"update,omitempty"` // applied to the stored service instance once all steps completed
+	CreatedAt  time.Time              `json:"created_at"`
+}
+type Step struct {
+	Backup           bool   `json:"backup,omitempty"`
+	Units            int    `json:"units,omitempty"`
+	Version          string `json:"version,omitempty"`
+	WhitelistAdd     string `json:"whitelist_add,omitempty"`     // IP range to add to the whitelist
+	WhitelistBinding string `json:"whitelist_binding,omitempty"` // service binding the IP range is added for, if it is not for the whole service instance
+	WhitelistRemove  string `json:"whitelist_remove,omitempty"`  // ID of the whitelist entry to remove
+}
+
+func NewStore(c *config.Config) Store {
+	switch c.Store.Type {
+	case "bolt":
+		store, err := NewBoltStore(c.Store.Filename)
+		if err != nil {
+			log.Errorf("could not open store %s", c.Store.Filename)
+			log.Fatalln(err)
+		}
+		return store
+	case "memory", "":
+		return NewMemoryStore()
+	default:
+		log.Fatalf("unknown store type: %s", c.Store.Type)
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	instancesBucket  = []byte("instances")
+	bindingsBucket   = []byte("bindings")
+	operationsBucket = []byte("operations")
+)
+
+// BoltStore persists all records in a BoltDB file, bindings are keyed by "<instanceID>/<bindingID>"
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func NewBoltStore(filename string) (*BoltStore, error) {
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{instancesBucket, bindingsBucket, operationsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) GetInstance(instanceID string) (*Instance, error) {
+	instance := &Instance{}
+	if err := s.get(instancesBucket, instanceID, instance); err != nil {
+		return nil, err
+	}
+	return instance, nil
+}
+
+func (s *BoltStore) GetInstances() ([]Instance, error) {
+	instances := make([]Instance, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(instancesBucket).ForEach(func(_, value []byte) error {
+			var instance Instance
+			if err := json.Unmarshal(value, &instance); err != nil {
+				return err
+			}
+			instances = append(instances, instance)
+			return nil
+		})
+	})
+	return instances, err
+}
+
+func (s *BoltStore) PutInstance(instance Instance) error {
+	return s.put(instancesBucket, instance.ID, instance)
+}
+
+func (s *BoltStore) DeleteInstance(instanceID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(instancesBucket).Delete([]byte(instanceID)); err != nil {
+			return err
+		}
+
+		// remove all bindings of the instance too
+		prefix := []byte(instanceID + "/")
+		keys := make([][]byte, 0)
+		c := tx.Bucket(bindingsBucket).Cursor()
+		for key, _ := c.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = c.Next() {
+			keys = append(keys, append([]byte{}, key...))
+		}
+		for _, key := range keys {
+			if err := tx.Bucket(bindingsBucket).Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) GetBinding(instanceID, bindingID string) (*Binding, error) {
+	binding := &Binding{}
+	if err := s.get(bindingsBucket, instanceID+"/"+bindingID, binding); err != nil {
+		return nil, err
+	}
+	return binding, nil
+}
+
+func (s *BoltStore) GetBindings(instanceID string) ([]Binding, error) {
+	bindings := make([]Binding, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		prefix := []byte(instanceID + "/")
+		c := tx.Bucket(bindingsBucket).Cursor()
+		for key, value := c.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, value = c.Next() {
+			var binding Binding
+			if err := json.Unmarshal(value, &binding); err != nil {
+				return err
+			}
+			bindings = append(bindings, binding)
+		}
+		return nil
+	})
+	return bindings, err
+}
+
+func (s *BoltStore) PutBinding(binding Binding) error {
+	return s.put(bindingsBucket, binding.InstanceID+"/"+binding.ID, binding)
+}
+
+func (s *BoltStore) DeleteBinding(instanceID, bindingID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bindingsBucket).Delete([]byte(instanceID + "/" + bindingID))
+	})
+}
+
+func (s *BoltStore) GetOperation(operationID string) (*Operation, error) {
+	operation := &Operation{}
+	if err := s.get(operationsBucket, operationID, operation); err != nil {
+		return nil, err
+	}
+	return operation, nil
+}
+
+func (s *BoltStore) PutOperation(operation Operation) error {
+	return s.put(operationsBucket, operation.ID, operation)
+}
+
+func (s *BoltStore) DeleteOperation(operationID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(operationsBucket).Delete([]byte(operationID))
+	})
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *BoltStore) get(bucket []byte, key string, value interface{}) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucket).Get([]byte(key))
+		if data == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(data, value)
+	})
+}
+
+func (s *BoltStore) put(bucket []byte, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(key), data)
+	})
+}
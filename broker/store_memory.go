@@ -0,0 +1,139 @@
+package broker
+
+import (
+	"sort"
+	"sync"
+)
+
+// MemoryStore keeps all records only for the lifetime of the broker process
+type MemoryStore struct {
+	instances  map[string]Instance
+	bindings   map[string]map[string]Binding
+	operations map[string]Operation
+	mutex      sync.RWMutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		instances:  make(map[string]Instance),
+		bindings:   make(map[string]map[string]Binding),
+		operations: make(map[string]Operation),
+	}
+}
+
+func (s *MemoryStore) GetInstance(instanceID string) (*Instance, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	instance, ok := s.instances[instanceID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &instance, nil
+}
+
+func (s *MemoryStore) GetInstances() ([]Instance, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	instances := make([]Instance, 0)
+	for _, instance := range s.instances {
+		instances = append(instances, instance)
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].ID < instances[j].ID
+	})
+	return instances, nil
+}
+
+func (s *MemoryStore) PutInstance(instance Instance) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.instances[instance.ID] = instance
+	return nil
+}
+
+func (s *MemoryStore) DeleteInstance(instanceID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.instances, instanceID)
+	delete(s.bindings, instanceID)
+	return nil
+}
+
+func (s *MemoryStore) GetBinding(instanceID, bindingID string) (*Binding, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	binding, ok := s.bindings[instanceID][bindingID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &binding, nil
+}
+
+func (s *MemoryStore) GetBindings(instanceID string) ([]Binding, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	bindings := make([]Binding, 0)
+	for _, binding := range s.bindings[instanceID] {
+		bindings = append(bindings, binding)
+	}
+	sort.Slice(bindings, func(i, j int) bool {
+		return bindings[i].ID < bindings[j].ID
+	})
+	return bindings, nil
+}
+
+func (s *MemoryStore) PutBinding(binding Binding) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.bindings[binding.InstanceID]; !ok {
+		s.bindings[binding.InstanceID] = make(map[string]Binding)
+	}
+	s.bindings[binding.InstanceID][binding.ID] = binding
+	return nil
+}
+
+func (s *MemoryStore) DeleteBinding(instanceID, bindingID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.bindings[instanceID], bindingID)
+	return nil
+}
+
+func (s *MemoryStore) GetOperation(operationID string) (*Operation, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	operation, ok := s.operations[operationID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &operation, nil
+}
+
+func (s *MemoryStore) PutOperation(operation Operation) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.operations[operation.ID] = operation
+	return nil
+}
+
+func (s *MemoryStore) DeleteOperation(operationID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.operations, operationID)
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,99 @@
+package broker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testStore(t *testing.T, store Store) {
+	// instances
+	_, err := store.GetInstance("8dcdf609-36c9-4b22-bb16-d97e48c50f26")
+	assert.Equal(t, ErrNotFound, err)
+
+	assert.NoError(t, store.PutInstance(Instance{ID: "8dcdf609-36c9-4b22-bb16-d97e48c50f26", DeploymentID: "5854017e89d50f424e000192", ServiceID: "s1", PlanID: "p1", Parameters: []byte(`{"units":3}`)}))
+	assert.NoError(t, store.PutInstance(Instance{ID: "52551d5f-1350-4f7d-9ddd-710a47ef9b72", DeploymentID: "22de8c5fbdc3d1f777750492", ServiceID: "s1", PlanID: "p2"}))
+	instance, err := store.GetInstance("8dcdf609-36c9-4b22-bb16-d97e48c50f26")
+	assert.NoError(t, err)
+	assert.Equal(t, "5854017e89d50f424e000192", instance.DeploymentID)
+	assert.Equal(t, "p1", instance.PlanID)
+	assert.Equal(t, `{"units":3}`, string(instance.Parameters))
+
+	instances, err := store.GetInstances()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(instances))
+	assert.Equal(t, "52551d5f-1350-4f7d-9ddd-710a47ef9b72", instances[0].ID)
+
+	// bindings
+	assert.NoError(t, store.PutBinding(Binding{ID: "deadbeef", InstanceID: "8dcdf609-36c9-4b22-bb16-d97e48c50f26"}))
+	assert.NoError(t, store.PutBinding(Binding{ID: "beefdead", InstanceID: "8dcdf609-36c9-4b22-bb16-d97e48c50f26"}))
+	assert.NoError(t, store.PutBinding(Binding{ID: "deadbeef", InstanceID: "52551d5f-1350-4f7d-9ddd-710a47ef9b72"}))
+	bindings, err := store.GetBindings("8dcdf609-36c9-4b22-bb16-d97e48c50f26")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(bindings))
+	assert.Equal(t, "beefdead", bindings[0].ID)
+	assert.Equal(t, "deadbeef", bindings[1].ID)
+
+	assert.NoError(t, store.DeleteBinding("8dcdf609-36c9-4b22-bb16-d97e48c50f26", "beefdead"))
+	_, err = store.GetBinding("8dcdf609-36c9-4b22-bb16-d97e48c50f26", "beefdead")
+	assert.Equal(t, ErrNotFound, err)
+	binding, err := store.GetBinding("8dcdf609-36c9-4b22-bb16-d97e48c50f26", "deadbeef")
+	assert.NoError(t, err)
+	assert.Equal(t, "deadbeef", binding.ID)
+
+	// operations
+	assert.NoError(t, store.PutOperation(Operation{ID: "5821fd28a4b549d06e39886d", Type: "provision", InstanceID: "8dcdf609-36c9-4b22-bb16-d97e48c50f26", RecipeID: "5821fd28a4b549d06e39886d"}))
+	operation, err := store.GetOperation("5821fd28a4b549d06e39886d")
+	assert.NoError(t, err)
+	assert.Equal(t, "provision", operation.Type)
+	_, err = store.GetOperation("unknown")
+	assert.Equal(t, ErrNotFound, err)
+	assert.NoError(t, store.DeleteOperation("5821fd28a4b549d06e39886d"))
+	_, err = store.GetOperation("5821fd28a4b549d06e39886d")
+	assert.Equal(t, ErrNotFound, err)
+	assert.NoError(t, store.DeleteOperation("unknown"))
+
+	// deleting an instance also removes its bindings
+	assert.NoError(t, store.DeleteInstance("8dcdf609-36c9-4b22-bb16-d97e48c50f26"))
+	_, err = store.GetInstance("8dcdf609-36c9-4b22-bb16-d97e48c50f26")
+	assert.Equal(t, ErrNotFound, err)
+	bindings, err = store.GetBindings("8dcdf609-36c9-4b22-bb16-d97e48c50f26")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(bindings))
+	bindings, err = store.GetBindings("52551d5f-1350-4f7d-9ddd-710a47ef9b72")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(bindings))
+
+	assert.NoError(t, store.Close())
+}
+
+func TestStore_Memory(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestStore_Bolt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compose-broker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewBoltStore(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, store)
+
+	// records must survive reopening the file
+	store, err = NewBoltStore(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	instance, err := store.GetInstance("52551d5f-1350-4f7d-9ddd-710a47ef9b72")
+	assert.NoError(t, err)
+	assert.Equal(t, "22de8c5fbdc3d1f777750492", instance.DeploymentID)
+}
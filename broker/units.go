@@ -0,0 +1,38 @@
+package broker
+
+import "fmt"
+
+// checkUnits returns why a plan does not permit a number of units, or an empty string if it does
+func (p ServicePlan) checkUnits(units int) string {
+	if p.Metadata.MinUnits > 0 && units < p.Metadata.MinUnits {
+		return fmt.Sprintf("Plan %s requires at least %d units", p.Name, p.Metadata.MinUnits)
+	}
+	if p.Metadata.MaxUnits > 0 && units > p.Metadata.MaxUnits {
+		return fmt.Sprintf("Plan %s allows for at most %d units", p.Name, p.Metadata.MaxUnits)
+	}
+	if p.Metadata.UnitsStep > 0 && units%p.Metadata.UnitsStep != 0 {
+		return fmt.Sprintf("Plan %s requires units to be a multiple of %d", p.Name, p.Metadata.UnitsStep)
+	}
+	return ""
+}
+
+// unitsSchema publishes the units bounds of a plan in the units property of a parameter schema, if it has one
+func unitsSchema(schema map[string]interface{}, plan ServicePlan) {
+	properties, ok := schema["properties"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	units, ok := properties["units"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	if plan.Metadata.MinUnits > 0 {
+		units["minimum"] = plan.Metadata.MinUnits
+	}
+	if plan.Metadata.MaxUnits > 0 {
+		units["maximum"] = plan.Metadata.MaxUnits
+	}
+	if plan.Metadata.UnitsStep > 0 {
+		units["multipleOf"] = plan.Metadata.UnitsStep
+	}
+}
@@ -0,0 +1,183 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/JamesClonk/compose-broker/log"
+	"github.com/JamesClonk/compose-broker/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+}
+
+func TestBroker_CheckUnits(t *testing.T) {
+	plan := ServicePlan{Name: "small"}
+	plan.Metadata.MinUnits = 2
+	plan.Metadata.MaxUnits = 8
+	plan.Metadata.UnitsStep = 2
+
+	assert.Equal(t, "", plan.checkUnits(2))
+	assert.Equal(t, "", plan.checkUnits(8))
+	assert.Equal(t, "Plan small requires at least 2 units", plan.checkUnits(1))
+	assert.Equal(t, "Plan small allows for at most 8 units", plan.checkUnits(10))
+	assert.Equal(t, "Plan small requires units to be a multiple of 2", plan.checkUnits(5))
+
+	assert.Equal(t, "", ServicePlan{Name: "unbounded"}.checkUnits(500))
+}
+
+func TestBroker_LoadServiceCatalog_UnitsBounds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compose-broker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "catalog.yml")
+	if err := ioutil.WriteFile(filename, []byte(`
+services:
+- id: 9b4ee86b-3876-469f-a531-062e71bc5859
+  name: postgresql
+  description: PostgreSQL
+  plans:
+  - id: d6222855-17c6-448c-885a-e9d931cd221b
+    name: default
+    description: PostgreSQL
+    metadata:
+      min_units: 2
+      max_units: 8
+      units_step: 2
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	catalog := LoadServiceCatalog(filename)
+	plan := catalog.Services[0].Plans[0]
+	assert.Equal(t, 2, plan.Metadata.Units) // units default to min_units
+	for _, schema := range []map[string]interface{}{plan.Schemas.ServiceInstance.Create.Parameters, plan.Schemas.ServiceInstance.Update.Parameters} {
+		units := schema["properties"].(map[string]interface{})["units"].(map[string]interface{})
+		assert.Equal(t, 2, units["minimum"])
+		assert.Equal(t, 8, units["maximum"])
+		assert.Equal(t, 2, units["multipleOf"])
+	}
+
+	violations, err := validateParameters(plan.Schemas.ServiceInstance.Create.Parameters, json.RawMessage(`{"units": 500}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"units: Must be less than or equal to 8"}, violations)
+}
+
+func TestBroker_ProvisionServiceInstance_UnitsOutOfBounds(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "POST", Path: "/deployments", Code: 500, Body: "", Test: func(body string) {
+			t.Error("must not create a deployment with more units than the plan allows for")
+		}},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	_, plan := b.ServiceCatalog().Plan("9b4ee86b-3876-469f-a531-062e71bc5859", "d6222855-17c6-448c-885a-e9d931cd221b")
+	plan.Metadata.MaxUnits = 4
+	r := NewRouter(b)
+
+	provisioning := ServiceInstanceProvisioning{
+		ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859",
+		PlanID:    "d6222855-17c6-448c-885a-e9d931cd221b",
+	}
+	provisioning.Parameters.Units = 500
+	data, _ := json.MarshalIndent(provisioning, "", "  ")
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("PUT", "/v2/service_instances/c9f2a0b4-6e1d-4f7a-9b3c-2d8e5f1a7b60?accepts_incomplete=true", bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 400, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"error": "ValidationError"`)
+	assert.Contains(t, rec.Body.String(), `"description": "Plan default allows for at most 4 units"`)
+}
+
+func TestBroker_UpdateServiceInstance_UnitsOutOfBounds(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/scalings", Code: 200, Body: util.Body("../_fixtures/api_get_scaling.json"), Test: nil},
+		util.HttpTestCase{Method: "POST", Path: "/deployments/5854017e89d50f424e000192/scalings", Code: 500, Body: "", Test: func(body string) {
+			t.Error("must not scale a deployment beyond the bounds of its plan")
+		}},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	_, plan := b.ServiceCatalog().Plan("9b4ee86b-3876-469f-a531-062e71bc5859", "d6222855-17c6-448c-885a-e9d931cd221b")
+	plan.Metadata.UnitsStep = 2
+	_ = b.Store.PutInstance(Instance{
+		ID:           "8dcdf609-36c9-4b22-bb16-d97e48c50f26",
+		DeploymentID: "5854017e89d50f424e000192",
+		ServiceID:    "9b4ee86b-3876-469f-a531-062e71bc5859",
+		PlanID:       "d6222855-17c6-448c-885a-e9d931cd221b",
+	})
+	r := NewRouter(b)
+
+	update := ServiceInstanceUpdate{ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859"}
+	update.Parameters.Units = 5
+	data, _ := json.MarshalIndent(update, "", "  ")
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("PATCH", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26?accepts_incomplete=true", bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 400, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"description": "Plan default requires units to be a multiple of 2"`)
+}
+
+func TestBroker_UpdateServiceInstance_BelowMinimumUnits(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192", Code: 200, Body: util.Body("../_fixtures/api_get_deployment.json"), Test: nil},
+		util.HttpTestCase{Method: "GET", Path: "/deployments/5854017e89d50f424e000192/scalings", Code: 200, Body: `{"allocated_units": 4, "used_units": 3, "starting_units": 2, "minimum_units": 3}`, Test: nil},
+		util.HttpTestCase{Method: "POST", Path: "/deployments/5854017e89d50f424e000192/scalings", Code: 500, Body: "", Test: func(body string) {
+			t.Error("must not scale a deployment below the units its data needs")
+		}},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	_ = b.Store.PutInstance(Instance{
+		ID:           "8dcdf609-36c9-4b22-bb16-d97e48c50f26",
+		DeploymentID: "5854017e89d50f424e000192",
+		ServiceID:    "9b4ee86b-3876-469f-a531-062e71bc5859",
+		PlanID:       "d6222855-17c6-448c-885a-e9d931cd221b",
+	})
+	r := NewRouter(b)
+
+	update := ServiceInstanceUpdate{ServiceID: "9b4ee86b-3876-469f-a531-062e71bc5859"}
+	update.Parameters.Units = 2
+	data, _ := json.MarshalIndent(update, "", "  ")
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("PATCH", "/v2/service_instances/8dcdf609-36c9-4b22-bb16-d97e48c50f26?accepts_incomplete=true", bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("broker", "pw")
+	req.Header.Set("X-Broker-API-Version", "2.15")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, 400, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"description": "The service instance needs at least 3 units for its data, it can not be scaled down to 2 units"`)
+}
@@ -0,0 +1,81 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/JamesClonk/compose-broker/log"
+)
+
+// the latest Open Service Broker API version this service broker implements, older minor versions of it are supported too
+var BrokerAPIVersion = APIVersion{Major: 2, Minor: 15}
+
+// APIVersion is an Open Service Broker API version as sent by the platform in the X-Broker-API-Version header
+type APIVersion struct {
+	Major int
+	Minor int
+}
+
+func (v APIVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+// AtLeast tells if the platform speaks the given minor version of the Open Service Broker API or a later one
+func (v APIVersion) AtLeast(minor int) bool {
+	return v.Minor >= minor
+}
+
+func parseAPIVersion(header string) (APIVersion, error) {
+	parts := strings.Split(strings.TrimSpace(header), ".")
+	if len(parts) != 2 {
+		return APIVersion{}, fmt.Errorf("invalid version: %s", header)
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return APIVersion{}, fmt.Errorf("invalid major version: %s", header)
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return APIVersion{}, fmt.Errorf("invalid minor version: %s", header)
+	}
+	return APIVersion{Major: major, Minor: minor}, nil
+}
+
+type apiVersionKey struct{}
+
+// apiVersion returns the version negotiated with the platform, or the latest one if there was no negotiation
+func apiVersion(ctx context.Context) APIVersion {
+	if version, ok := ctx.Value(apiVersionKey{}).(APIVersion); ok {
+		return version
+	}
+	return BrokerAPIVersion
+}
+
+// NegotiateAPIVersion rejects requests of platforms that speak a major version of the Open Service Broker API this service broker does not implement,
+// and remembers which minor version to answer in, being the one of the platform or the latest one this service broker implements, whichever is older
+func (b *Broker) NegotiateAPIVersion(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		header := req.Header.Get("X-Broker-API-Version")
+		if len(header) == 0 {
+			log.Ctx(req.Context()).Errorf("missing X-Broker-API-Version header")
+			b.Error(rw, req, 412, "PreconditionFailed", fmt.Sprintf("The X-Broker-API-Version header is missing, this service broker implements version %s", BrokerAPIVersion))
+			return
+		}
+		version, err := parseAPIVersion(header)
+		if err != nil || version.Major != BrokerAPIVersion.Major {
+			log.Ctx(req.Context()).Errorf("unsupported X-Broker-API-Version %s: %v", header, err)
+			b.Error(rw, req, 412, "PreconditionFailed", fmt.Sprintf("Version %s of the Open Service Broker API is not supported, this service broker implements version %s", header, BrokerAPIVersion))
+			return
+		}
+		if version.Minor > BrokerAPIVersion.Minor {
+			version.Minor = BrokerAPIVersion.Minor
+		}
+
+		ctx := context.WithValue(req.Context(), apiVersionKey{}, version)
+		ctx = log.WithFields(ctx, log.Fields{"api_version": version.String()})
+		handler.ServeHTTP(rw, req.WithContext(ctx))
+	})
+}
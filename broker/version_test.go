@@ -0,0 +1,122 @@
+package broker
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/JamesClonk/compose-broker/log"
+	"github.com/JamesClonk/compose-broker/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+}
+
+func TestBroker_ParseAPIVersion(t *testing.T) {
+	version, err := parseAPIVersion("2.14")
+	assert.NoError(t, err)
+	assert.Equal(t, APIVersion{Major: 2, Minor: 14}, version)
+	assert.Equal(t, "2.14", version.String())
+	assert.True(t, version.AtLeast(13))
+	assert.True(t, version.AtLeast(14))
+	assert.False(t, version.AtLeast(15))
+
+	for _, header := range []string{"", "2", "2.x", "x.15", "2.15.1"} {
+		_, err = parseAPIVersion(header)
+		assert.Error(t, err, header)
+	}
+}
+
+func TestBroker_NegotiateAPIVersion_Unsupported(t *testing.T) {
+	r := NewRouter(NewBroker(util.TestConfig("")))
+
+	for header, description := range map[string]string{
+		"":     `"description": "The X-Broker-API-Version header is missing, this service broker implements version 2.15"`,
+		"1.0":  `"description": "Version 1.0 of the Open Service Broker API is not supported, this service broker implements version 2.15"`,
+		"3.0":  `"description": "Version 3.0 of the Open Service Broker API is not supported, this service broker implements version 2.15"`,
+		"yolo": `"description": "Version yolo of the Open Service Broker API is not supported, this service broker implements version 2.15"`,
+	} {
+		rec := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/v2/catalog", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("broker", "pw")
+		if len(header) > 0 {
+			req.Header.Set("X-Broker-API-Version", header)
+		}
+		r.ServeHTTP(rec, req)
+
+		assert.Equal(t, 412, rec.Code, header)
+		assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+		assert.Contains(t, rec.Body.String(), `"error": "PreconditionFailed"`)
+		assert.Contains(t, rec.Body.String(), description)
+	}
+
+	// everything outside of the Open Service Broker API does not care
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/health", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.ServeHTTP(rec, req)
+	assert.Equal(t, 200, rec.Code)
+}
+
+func TestBroker_NegotiateAPIVersion_Catalog(t *testing.T) {
+	test := []util.HttpTestCase{
+		util.HttpTestCase{Method: "GET", Path: "/databases", Code: 200, Body: util.Body("../_fixtures/api_get_databases.json"), Test: nil},
+	}
+	apiServer := util.TestServer("deadbeef", test)
+	defer apiServer.Close()
+	b := NewBroker(util.TestConfig(apiServer.URL))
+	b.ServiceCatalog().Services[0].Plans[0].MaintenanceInfo = &MaintenanceInfo{Version: "9.6.3", Description: "PostgreSQL 9.6.3"}
+	r := NewRouter(b)
+
+	catalog := func(version string) string {
+		rec := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/v2/catalog", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("broker", "pw")
+		req.Header.Set("X-Broker-API-Version", version)
+		r.ServeHTTP(rec, req)
+		assert.Equal(t, 200, rec.Code, version)
+		return rec.Body.String()
+	}
+
+	// newer minor versions are answered with the latest one this service broker implements
+	for _, version := range []string{"2.15", "2.16"} {
+		body := catalog(version)
+		assert.Contains(t, body, `"instances_retrievable": true`, version)
+		assert.Contains(t, body, `"bindings_retrievable": true`, version)
+		assert.Contains(t, body, `"maintenance_info": {`, version)
+		assert.Contains(t, body, `"version": "9.6.3"`, version)
+	}
+
+	body := catalog("2.14")
+	assert.Contains(t, body, `"instances_retrievable": true`)
+	assert.Contains(t, body, `"bindings_retrievable": true`)
+	assert.NotContains(t, body, `"maintenance_info"`)
+
+	body = catalog("2.13")
+	assert.NotContains(t, body, `"instances_retrievable": true`)
+	assert.NotContains(t, body, `"bindings_retrievable": true`)
+	assert.NotContains(t, body, `"maintenance_info"`)
+	assert.Contains(t, body, `"schemas": {`)
+
+	body = catalog("2.12")
+	assert.NotContains(t, body, `"instances_retrievable": true`)
+	assert.NotContains(t, body, `"maintenance_info"`)
+	assert.NotContains(t, body, `"schemas"`)
+
+	// the catalog itself stays untouched
+	body = catalog("2.15")
+	assert.Contains(t, body, `"instances_retrievable": true`)
+	assert.Contains(t, body, `"maintenance_info": {`)
+	assert.Contains(t, body, `"schemas": {`)
+}
@@ -0,0 +1,133 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/JamesClonk/compose-broker/api"
+)
+
+// whitelistDescription marks the whitelist entries managed by the service broker, all others are left alone
+const whitelistDescription = "compose-broker"
+
+// bindingWhitelistDescription marks the whitelist entries added by a binding, which are removed again on unbind
+func bindingWhitelistDescription(bindingID string) string {
+	return whitelistDescription + " binding " + bindingID
+}
+
+// normalizeWhitelist validates IP addresses and ranges, single addresses become a range of their own
+func normalizeWhitelist(ips []string) ([]string, error) {
+	whitelist := make([]string, 0)
+	for _, ip := range ips {
+		cidr := strings.TrimSpace(ip)
+		if !strings.Contains(cidr, "/") {
+			address := net.ParseIP(cidr)
+			if address == nil {
+				return nil, fmt.Errorf("Invalid whitelist entry %s, must be an IP address or range in CIDR notation", ip)
+			}
+			if address.To4() != nil {
+				cidr = cidr + "/32"
+			} else {
+				cidr = cidr + "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid whitelist entry %s, must be an IP address or range in CIDR notation", ip)
+		}
+		if !whitelisted(whitelist, network.String()) {
+			whitelist = append(whitelist, network.String())
+		}
+	}
+	return whitelist, nil
+}
+
+func whitelisted(whitelist []string, cidr string) bool {
+	for _, entry := range whitelist {
+		if entry == cidr {
+			return true
+		}
+	}
+	return false
+}
+
+// entryRange returns the normalized IP range of a whitelist entry
+func entryRange(entry api.WhitelistEntry) string {
+	if whitelist, err := normalizeWhitelist([]string{entry.IP}); err == nil && len(whitelist) > 0 {
+		return whitelist[0]
+	}
+	return entry.IP
+}
+
+// whitelistSteps returns the steps to turn the broker managed part of a deployment's whitelist into the given one
+func whitelistSteps(entries api.Whitelist, whitelist []string) []Step {
+	existing := make([]string, 0)
+	for _, entry := range entries {
+		existing = append(existing, entryRange(entry))
+	}
+
+	steps := make([]Step, 0)
+	for _, cidr := range whitelist {
+		if !whitelisted(existing, cidr) {
+			steps = append(steps, Step{WhitelistAdd: cidr})
+		}
+	}
+	for _, entry := range entries {
+		if entry.Description == whitelistDescription && !whitelisted(whitelist, entryRange(entry)) {
+			steps = append(steps, Step{WhitelistRemove: entry.ID})
+		}
+	}
+	return steps
+}
+
+// bindingWhitelistSteps returns the steps to add the IP ranges of a binding to the whitelist of the deployment, unless they are already on it
+func (b *Broker) bindingWhitelistSteps(ctx context.Context, deployment *api.Deployment, bindingID string, whitelist []string) ([]Step, error) {
+	if len(whitelist) == 0 {
+		return nil, nil
+	}
+	entries, err := b.Client.GetWhitelistContext(ctx, deployment.ID)
+	if err != nil {
+		return nil, err
+	}
+	steps := make([]Step, 0)
+	for _, step := range whitelistSteps(entries, whitelist) {
+		if len(step.WhitelistAdd) > 0 {
+			step.WhitelistBinding = bindingID
+			steps = append(steps, step)
+		}
+	}
+	return steps, nil
+}
+
+// unbindWhitelistSteps returns the steps to remove the IP ranges of a binding from the whitelist of the deployment,
+// a binding can rely on an entry added for another one with the same IP range, so entries are only removed with the last binding using them
+func (b *Broker) unbindWhitelistSteps(ctx context.Context, deployment *api.Deployment, instanceID, bindingID string, whitelist []string) ([]Step, error) {
+	if len(whitelist) == 0 {
+		return nil, nil
+	}
+	bindings, err := b.Store.GetBindings(instanceID)
+	if err != nil {
+		return nil, err
+	}
+	inUse := make([]string, 0)
+	for i := range bindings {
+		if bindings[i].ID != bindingID {
+			inUse = append(inUse, bindingWhitelist(&bindings[i])...)
+		}
+	}
+
+	entries, err := b.Client.GetWhitelistContext(ctx, deployment.ID)
+	if err != nil {
+		return nil, err
+	}
+	steps := make([]Step, 0)
+	for _, entry := range entries {
+		cidr := entryRange(entry)
+		if strings.HasPrefix(entry.Description, bindingWhitelistDescription("")) && whitelisted(whitelist, cidr) && !whitelisted(inUse, cidr) {
+			steps = append(steps, Step{WhitelistRemove: entry.ID})
+		}
+	}
+	return steps, nil
+}
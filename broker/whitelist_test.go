@@ -0,0 +1,34 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/JamesClonk/compose-broker/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBroker_NormalizeWhitelist(t *testing.T) {
+	whitelist, err := normalizeWhitelist([]string{"10.1.2.3/8", " 35.157.12.40 ", "2001:db8::1", "10.0.0.0/8"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.0/8", "35.157.12.40/32", "2001:db8::1/128"}, whitelist)
+
+	whitelist, err = normalizeWhitelist(nil)
+	assert.NoError(t, err)
+	assert.Len(t, whitelist, 0)
+
+	_, err = normalizeWhitelist([]string{"10.0.0.0/33"})
+	assert.EqualError(t, err, "Invalid whitelist entry 10.0.0.0/33, must be an IP address or range in CIDR notation")
+}
+
+func TestBroker_WhitelistSteps(t *testing.T) {
+	entries := api.Whitelist{
+		api.WhitelistEntry{ID: "1", IP: "10.0.0.0/8", Description: "compose-broker"},
+		api.WhitelistEntry{ID: "2", IP: "192.168.1.0/24", Description: "office network"},
+		api.WhitelistEntry{ID: "3", IP: "52.28.10.5", Description: "compose-broker binding deadbeef"},
+	}
+
+	// entries of bindings and those added by hand are left alone
+	assert.Equal(t, []Step{Step{WhitelistAdd: "172.16.0.0/12"}, Step{WhitelistRemove: "1"}}, whitelistSteps(entries, []string{"172.16.0.0/12", "52.28.10.5/32"}))
+	assert.Equal(t, []Step{}, whitelistSteps(entries, []string{"10.0.0.0/8"}))
+	assert.Equal(t, []Step{Step{WhitelistRemove: "1"}}, whitelistSteps(entries, []string{}))
+}
@@ -15,40 +15,168 @@ var (
 )
 
 type Config struct {
-	SkipSSL         bool
-	LogLevel        string
-	LogTimestamp    bool
-	Username        string
-	Password        string
-	CatalogFilename string
-	API             API
+	SkipSSL               bool
+	LogLevel              string
+	LogTimestamp          bool
+	LogFormat             string
+	LogRedactKeys         []string
+	Username              string
+	Password              string
+	AdminUsername         string
+	AdminPassword         string
+	BindingSecret         string
+	CatalogFilename       string
+	CatalogReloadInterval time.Duration
+	QuotasFilename        string
+	AuditLogFilename      string
+	RequestTimeout        time.Duration
+	MetricsInterval       time.Duration
+	Store                 Store
+	Orphans               Orphans
+	Drift                 Drift
+	API                   API
+}
+type Store struct {
+	Type     string
+	Filename string
+}
+type Orphans struct {
+	Interval    time.Duration
+	GracePeriod time.Duration
+	DryRun      bool
+}
+type Drift struct {
+	Interval    time.Duration
+	AutoCorrect bool
 }
 type API struct {
-	URL               string
-	Token             string
-	DefaultDatacenter string
-	DefaultAccountID  string
-	Retries           int
-	RetryInterval     time.Duration
+	URL                   string
+	Token                 string
+	DefaultDatacenter     string
+	DefaultAccountID      string
+	DefaultWhitelist      []string
+	BillingCode           string
+	Retries               int
+	RetryInterval         time.Duration
+	Timeout               time.Duration
+	RateLimit             float64
+	RateBurst             int
+	MaxConcurrentRequests int
+	IndexTTL              time.Duration
+	IndexRefreshInterval  time.Duration
 }
 
 func loadConfig() {
 	skipSSL, _ := strconv.ParseBool(env.Get("BROKER_SKIP_SSL_VALIDATION", "false"))
 	logTimestamp, _ := strconv.ParseBool(env.Get("BROKER_LOG_TIMESTAMP", "false"))
+	password := env.MustGet("BROKER_AUTH_PASSWORD")
+	requestTimeout, err := time.ParseDuration(env.Get("BROKER_REQUEST_TIMEOUT", "50s"))
+	if err != nil {
+		requestTimeout = 50 * time.Second
+	}
+	catalogReloadInterval, err := time.ParseDuration(env.Get("BROKER_CATALOG_RELOAD_INTERVAL", "1m"))
+	if err != nil {
+		catalogReloadInterval = time.Minute
+	}
+	metricsInterval, err := time.ParseDuration(env.Get("BROKER_METRICS_INTERVAL", "5m"))
+	if err != nil {
+		metricsInterval = 5 * time.Minute
+	}
+	orphanInterval, err := time.ParseDuration(env.Get("BROKER_ORPHAN_MITIGATION_INTERVAL", "15m"))
+	if err != nil {
+		orphanInterval = 15 * time.Minute
+	}
+	orphanGracePeriod, err := time.ParseDuration(env.Get("BROKER_ORPHAN_MITIGATION_GRACE_PERIOD", "2h"))
+	if err != nil {
+		orphanGracePeriod = 2 * time.Hour
+	}
+	orphanDryRun, _ := strconv.ParseBool(env.Get("BROKER_ORPHAN_MITIGATION_DRY_RUN", "true"))
+	driftInterval, err := time.ParseDuration(env.Get("BROKER_DRIFT_INTERVAL", "1h"))
+	if err != nil {
+		driftInterval = time.Hour
+	}
+	driftAutoCorrect, _ := strconv.ParseBool(env.Get("BROKER_DRIFT_AUTO_CORRECT", "false"))
+	apiTimeout, err := time.ParseDuration(env.Get("COMPOSE_API_TIMEOUT", "30s"))
+	if err != nil {
+		apiTimeout = 30 * time.Second
+	}
+	rateLimit, err := strconv.ParseFloat(env.Get("COMPOSE_API_RATE_LIMIT", "10"), 64)
+	if err != nil {
+		rateLimit = 10
+	}
+	rateBurst, err := strconv.Atoi(env.Get("COMPOSE_API_RATE_BURST", "10"))
+	if err != nil {
+		rateBurst = 10
+	}
+	maxConcurrentRequests, err := strconv.Atoi(env.Get("COMPOSE_API_MAX_CONCURRENT_REQUESTS", "4"))
+	if err != nil {
+		maxConcurrentRequests = 4
+	}
+	indexTTL, err := time.ParseDuration(env.Get("COMPOSE_API_INDEX_TTL", "5m"))
+	if err != nil {
+		indexTTL = 5 * time.Minute
+	}
+	indexRefreshInterval, err := time.ParseDuration(env.Get("COMPOSE_API_INDEX_REFRESH_INTERVAL", "1m"))
+	if err != nil {
+		indexRefreshInterval = time.Minute
+	}
+	defaultWhitelist := make([]string, 0)
+	for _, ip := range strings.Split(env.Get("COMPOSE_API_DEFAULT_WHITELIST", ""), ",") {
+		if ip = strings.TrimSpace(ip); len(ip) > 0 {
+			defaultWhitelist = append(defaultWhitelist, ip)
+		}
+	}
+	redactKeys := make([]string, 0)
+	for _, key := range strings.Split(env.Get("BROKER_LOG_REDACT_KEYS", ""), ",") {
+		if key = strings.TrimSpace(key); len(key) > 0 {
+			redactKeys = append(redactKeys, key)
+		}
+	}
 	config = Config{
-		SkipSSL:         skipSSL,
-		LogLevel:        env.Get("BROKER_LOG_LEVEL", "info"),
-		LogTimestamp:    logTimestamp,
-		Username:        env.MustGet("BROKER_AUTH_USERNAME"),
-		Password:        env.MustGet("BROKER_AUTH_PASSWORD"),
-		CatalogFilename: env.Get("BROKER_CATALOG_FILENAME", "catalog.yml"),
+		SkipSSL:               skipSSL,
+		LogLevel:              env.Get("BROKER_LOG_LEVEL", "info"),
+		LogTimestamp:          logTimestamp,
+		LogFormat:             env.Get("BROKER_LOG_FORMAT", "text"),
+		LogRedactKeys:         redactKeys,
+		Username:              env.MustGet("BROKER_AUTH_USERNAME"),
+		Password:              password,
+		AdminUsername:         env.Get("BROKER_ADMIN_USERNAME", "admin"),
+		AdminPassword:         env.Get("BROKER_ADMIN_PASSWORD", ""),
+		BindingSecret:         env.Get("BROKER_BINDING_SECRET", password),
+		CatalogFilename:       env.Get("BROKER_CATALOG_FILENAME", "catalog.yml"),
+		CatalogReloadInterval: catalogReloadInterval,
+		QuotasFilename:        env.Get("BROKER_QUOTAS_FILENAME", ""),
+		AuditLogFilename:      env.Get("BROKER_AUDIT_LOG_FILENAME", ""),
+		RequestTimeout:        requestTimeout,
+		MetricsInterval:       metricsInterval,
+		Store: Store{
+			Type:     env.Get("BROKER_STORE_TYPE", "memory"),
+			Filename: env.Get("BROKER_STORE_FILENAME", "compose-broker.db"),
+		},
+		Orphans: Orphans{
+			Interval:    orphanInterval,
+			GracePeriod: orphanGracePeriod,
+			DryRun:      orphanDryRun,
+		},
+		Drift: Drift{
+			Interval:    driftInterval,
+			AutoCorrect: driftAutoCorrect,
+		},
 		API: API{
-			URL:               strings.TrimSuffix(env.Get("COMPOSE_API_URL", "https://api.compose.io/2016-07"), "/"),
-			Token:             env.MustGet("COMPOSE_API_TOKEN"),
-			DefaultDatacenter: env.Get("COMPOSE_API_DEFAULT_DATACENTER", "aws:eu-central-1"),
-			DefaultAccountID:  env.Get("COMPOSE_API_DEFAULT_ACCOUNT_ID", ""),
-			Retries:           3,
-			RetryInterval:     3 * time.Second,
+			URL:                   strings.TrimSuffix(env.Get("COMPOSE_API_URL", "https://api.compose.io/2016-07"), "/"),
+			Token:                 env.MustGet("COMPOSE_API_TOKEN"),
+			DefaultDatacenter:     env.Get("COMPOSE_API_DEFAULT_DATACENTER", "aws:eu-central-1"),
+			DefaultAccountID:      env.Get("COMPOSE_API_DEFAULT_ACCOUNT_ID", ""),
+			DefaultWhitelist:      defaultWhitelist,
+			BillingCode:           env.Get("COMPOSE_API_BILLING_CODE", ""),
+			Retries:               3,
+			RetryInterval:         3 * time.Second,
+			Timeout:               apiTimeout,
+			RateLimit:             rateLimit,
+			RateBurst:             rateBurst,
+			MaxConcurrentRequests: maxConcurrentRequests,
+			IndexTTL:              indexTTL,
+			IndexRefreshInterval:  indexRefreshInterval,
 		},
 	}
 }
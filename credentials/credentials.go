@@ -0,0 +1,90 @@
+package credentials
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+
+	"github.com/JamesClonk/compose-broker/api"
+	"github.com/JamesClonk/compose-broker/config"
+	"github.com/JamesClonk/compose-broker/util"
+)
+
+// ErrUserNotFound is returned when deleting a user that does not exist (anymore)
+var ErrUserNotFound = errors.New("user not found")
+
+// Provisioner manages the database users handed out to service bindings,
+// there is one implementation per Compose.io deployment type
+type Provisioner interface {
+	Supports(deployment *api.Deployment) bool
+	CreateUser(deployment *api.Deployment, user User) error
+	DeleteUser(deployment *api.Deployment, user User) error
+}
+
+// Provisioners maps Compose.io deployment types to their credential provisioner
+type Provisioners map[string]Provisioner
+
+func NewProvisioners(c *config.Config) Provisioners {
+	return Provisioners{
+		"postgresql": &PostgreSQL{},
+		"mysql":      &MySQL{},
+		"rabbitmq":   &RabbitMQ{HTTPClient: util.NewHttpClient(c)},
+		"redis":      &Redis{},
+	}
+}
+
+type User struct {
+	Username string
+	Password string
+}
+
+// NewUser derives the database user of a service binding from its binding ID,
+// the same binding ID and secret will always result in the same username and password
+func NewUser(secret, bindingID string) User {
+	id := sha256.Sum256([]byte(bindingID))
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write([]byte(bindingID))
+
+	return User{
+		Username: "binding_" + hex.EncodeToString(id[:])[:24], // MySQL usernames can't be longer than 32 characters
+		Password: hex.EncodeToString(mac.Sum(nil))[:32],
+	}
+}
+
+// ConnectionString replaces the credentials of the given connection string URI with those of the user
+func (u User) ConnectionString(uri string) string {
+	parsed, err := url.Parse(uri)
+	if err != nil || parsed.User == nil {
+		return uri
+	}
+	parsed.User = url.UserPassword(u.Username, u.Password)
+	return parsed.String()
+}
+
+// connectionStrings converts one of the untyped Compose.io connection string fields into a list of strings
+func connectionStrings(value interface{}) []string {
+	strings := make([]string, 0)
+	switch v := value.(type) {
+	case string:
+		strings = append(strings, v)
+	case []string:
+		strings = append(strings, v...)
+	case []interface{}:
+		for _, s := range v {
+			if str, ok := s.(string); ok {
+				strings = append(strings, str)
+			}
+		}
+	}
+	return strings
+}
+
+func directConnectionString(deployment *api.Deployment) (*url.URL, error) {
+	if len(deployment.ConnectionStrings.Direct) == 0 {
+		return nil, errors.New("deployment has no direct connection string")
+	}
+	return url.Parse(deployment.ConnectionStrings.Direct[0])
+}
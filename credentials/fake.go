@@ -0,0 +1,57 @@
+package credentials
+
+import (
+	"sync"
+
+	"github.com/JamesClonk/compose-broker/api"
+)
+
+// Fake is an in-memory credential provisioner, to be used for testing
+type Fake struct {
+	Users map[string]User
+	Err   error
+	mutex sync.Mutex
+}
+
+func NewFake() *Fake {
+	return &Fake{
+		Users: make(map[string]User),
+	}
+}
+
+func (f *Fake) Supports(deployment *api.Deployment) bool {
+	return true
+}
+
+func (f *Fake) CreateUser(deployment *api.Deployment, user User) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.Err != nil {
+		return f.Err
+	}
+	f.Users[deployment.ID+"/"+user.Username] = user
+	return nil
+}
+
+func (f *Fake) DeleteUser(deployment *api.Deployment, user User) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.Err != nil {
+		return f.Err
+	}
+	if _, ok := f.Users[deployment.ID+"/"+user.Username]; !ok {
+		return ErrUserNotFound
+	}
+	delete(f.Users, deployment.ID+"/"+user.Username)
+	return nil
+}
+
+func (f *Fake) HasUser(deployment *api.Deployment, username string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	_, ok := f.Users[deployment.ID+"/"+username]
+	return ok
+}
@@ -0,0 +1,114 @@
+package credentials
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/JamesClonk/compose-broker/api"
+	"github.com/JamesClonk/compose-broker/log"
+	"github.com/go-sql-driver/mysql"
+)
+
+type MySQL struct{}
+
+func (m *MySQL) Supports(deployment *api.Deployment) bool {
+	return true
+}
+
+func (m *MySQL) CreateUser(deployment *api.Deployment, user User) error {
+	db, database, err := m.open(deployment)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	account := fmt.Sprintf("%s@'%%'", mysqlQuote(user.Username))
+	statements := []string{
+		fmt.Sprintf("CREATE USER IF NOT EXISTS %s IDENTIFIED BY %s", account, mysqlQuote(user.Password)),
+		fmt.Sprintf("ALTER USER %s IDENTIFIED BY %s", account, mysqlQuote(user.Password)),
+		fmt.Sprintf("GRANT ALL PRIVILEGES ON `%s`.* TO %s", strings.Replace(database, "`", "``", -1), account),
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			log.Errorf("could not create MySQL user %s on deployment %s: %s", user.Username, deployment.ID, err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MySQL) DeleteUser(deployment *api.Deployment, user User) error {
+	db, _, err := m.open(deployment)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM mysql.user WHERE User = ?)", user.Username).Scan(&exists); err != nil {
+		log.Errorf("could not query MySQL users of deployment %s: %s", deployment.ID, err)
+		return err
+	}
+	if !exists {
+		return ErrUserNotFound
+	}
+
+	if _, err := db.Exec(fmt.Sprintf("DROP USER IF EXISTS %s@'%%'", mysqlQuote(user.Username))); err != nil {
+		log.Errorf("could not delete MySQL user %s on deployment %s: %s", user.Username, deployment.ID, err)
+		return err
+	}
+	return nil
+}
+
+func (m *MySQL) open(deployment *api.Deployment) (*sql.DB, string, error) {
+	u, err := directConnectionString(deployment)
+	if err != nil {
+		log.Errorf("could not parse MySQL connection string of deployment %s: %s", deployment.ID, err)
+		return nil, "", err
+	}
+
+	config := mysql.NewConfig()
+	config.Net = "tcp"
+	config.Addr = u.Host
+	config.User = u.User.Username()
+	config.Passwd, _ = u.User.Password()
+	config.DBName = strings.TrimPrefix(u.Path, "/")
+	config.Timeout = 10 * time.Second
+	config.TLSConfig = "true"
+	if len(config.DBName) == 0 {
+		config.DBName = "compose"
+	}
+
+	// Compose.io deployments are secured by their own CA certificate
+	if len(deployment.CACertificateBase64) > 0 {
+		certificate, err := base64.StdEncoding.DecodeString(deployment.CACertificateBase64)
+		if err != nil {
+			log.Errorf("could not decode CA certificate of deployment %s: %s", deployment.ID, err)
+			return nil, "", err
+		}
+		pool := x509.NewCertPool()
+		if pool.AppendCertsFromPEM(certificate) {
+			config.TLSConfig = deployment.ID
+			if err := mysql.RegisterTLSConfig(config.TLSConfig, &tls.Config{RootCAs: pool, ServerName: u.Hostname()}); err != nil {
+				log.Errorf("could not register TLS configuration for deployment %s: %s", deployment.ID, err)
+				return nil, "", err
+			}
+		}
+	}
+
+	db, err := sql.Open("mysql", config.FormatDSN())
+	if err != nil {
+		log.Errorf("could not connect to MySQL deployment %s: %s", deployment.ID, err)
+		return nil, "", err
+	}
+	return db, config.DBName, nil
+}
+
+func mysqlQuote(value string) string {
+	return "'" + strings.Replace(strings.Replace(value, `\`, `\\`, -1), "'", `\'`, -1) + "'"
+}
@@ -0,0 +1,110 @@
+package credentials
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/JamesClonk/compose-broker/api"
+	"github.com/JamesClonk/compose-broker/log"
+	"github.com/lib/pq"
+)
+
+type PostgreSQL struct{}
+
+func (p *PostgreSQL) Supports(deployment *api.Deployment) bool {
+	return true
+}
+
+func (p *PostgreSQL) CreateUser(deployment *api.Deployment, user User) error {
+	db, database, err := p.open(deployment)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var exists bool
+	if err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM pg_roles WHERE rolname = $1)`, user.Username).Scan(&exists); err != nil {
+		log.Errorf("could not query PostgreSQL roles of deployment %s: %s", deployment.ID, err)
+		return err
+	}
+
+	statement := "CREATE ROLE %s WITH LOGIN PASSWORD %s"
+	if exists {
+		statement = "ALTER ROLE %s WITH LOGIN PASSWORD %s"
+	}
+	role := pq.QuoteIdentifier(user.Username)
+	statements := []string{
+		fmt.Sprintf(statement, role, pq.QuoteLiteral(user.Password)),
+		fmt.Sprintf("GRANT ALL PRIVILEGES ON DATABASE %s TO %s", pq.QuoteIdentifier(database), role),
+		fmt.Sprintf("GRANT ALL PRIVILEGES ON SCHEMA public TO %s", role),
+		fmt.Sprintf("GRANT ALL PRIVILEGES ON ALL TABLES IN SCHEMA public TO %s", role),
+		fmt.Sprintf("GRANT ALL PRIVILEGES ON ALL SEQUENCES IN SCHEMA public TO %s", role),
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			log.Errorf("could not create PostgreSQL role %s on deployment %s: %s", user.Username, deployment.ID, err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *PostgreSQL) DeleteUser(deployment *api.Deployment, user User) error {
+	db, _, err := p.open(deployment)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var exists bool
+	if err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM pg_roles WHERE rolname = $1)`, user.Username).Scan(&exists); err != nil {
+		log.Errorf("could not query PostgreSQL roles of deployment %s: %s", deployment.ID, err)
+		return err
+	}
+	if !exists {
+		return ErrUserNotFound
+	}
+
+	// hand over all objects of the role to the admin user, the data must survive unbinding
+	role := pq.QuoteIdentifier(user.Username)
+	statements := []string{
+		fmt.Sprintf("REASSIGN OWNED BY %s TO CURRENT_USER", role),
+		fmt.Sprintf("DROP OWNED BY %s", role),
+		fmt.Sprintf("DROP ROLE IF EXISTS %s", role),
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			log.Errorf("could not delete PostgreSQL role %s on deployment %s: %s", user.Username, deployment.ID, err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *PostgreSQL) open(deployment *api.Deployment) (*sql.DB, string, error) {
+	u, err := directConnectionString(deployment)
+	if err != nil {
+		log.Errorf("could not parse PostgreSQL connection string of deployment %s: %s", deployment.ID, err)
+		return nil, "", err
+	}
+	database := strings.TrimPrefix(u.Path, "/")
+	if len(database) == 0 {
+		database = "compose"
+		u.Path = "/" + database
+	}
+
+	query := u.Query()
+	if len(query.Get("sslmode")) == 0 {
+		query.Set("sslmode", "require")
+	}
+	query.Set("connect_timeout", "10")
+	u.RawQuery = query.Encode()
+
+	db, err := sql.Open("postgres", u.String())
+	if err != nil {
+		log.Errorf("could not connect to PostgreSQL deployment %s: %s", deployment.ID, err)
+		return nil, "", err
+	}
+	return db, database, nil
+}
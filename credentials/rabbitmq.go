@@ -0,0 +1,125 @@
+package credentials
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/JamesClonk/compose-broker/api"
+	"github.com/JamesClonk/compose-broker/log"
+)
+
+type RabbitMQ struct {
+	HTTPClient *http.Client
+}
+
+func (r *RabbitMQ) Supports(deployment *api.Deployment) bool {
+	return true
+}
+
+func (r *RabbitMQ) CreateUser(deployment *api.Deployment, user User) error {
+	management, vhost, err := r.endpoints(deployment)
+	if err != nil {
+		return err
+	}
+
+	userPayload := map[string]string{"password": user.Password, "tags": ""}
+	if err := r.do(management, "PUT", fmt.Sprintf("api/users/%s", url.PathEscape(user.Username)), userPayload); err != nil {
+		log.Errorf("could not create RabbitMQ user %s on deployment %s: %s", user.Username, deployment.ID, err)
+		return err
+	}
+
+	permissionsPayload := map[string]string{"configure": ".*", "write": ".*", "read": ".*"}
+	if err := r.do(management, "PUT", fmt.Sprintf("api/permissions/%s/%s", url.PathEscape(vhost), url.PathEscape(user.Username)), permissionsPayload); err != nil {
+		log.Errorf("could not set RabbitMQ permissions for user %s on deployment %s: %s", user.Username, deployment.ID, err)
+		return err
+	}
+	return nil
+}
+
+func (r *RabbitMQ) DeleteUser(deployment *api.Deployment, user User) error {
+	management, _, err := r.endpoints(deployment)
+	if err != nil {
+		return err
+	}
+
+	if err := r.do(management, "DELETE", fmt.Sprintf("api/users/%s", url.PathEscape(user.Username)), nil); err == ErrUserNotFound {
+		return err
+	} else if err != nil {
+		log.Errorf("could not delete RabbitMQ user %s on deployment %s: %s", user.Username, deployment.ID, err)
+		return err
+	}
+	return nil
+}
+
+// endpoints returns the management API URL and the vhost of the deployment
+func (r *RabbitMQ) endpoints(deployment *api.Deployment) (*url.URL, string, error) {
+	direct, err := directConnectionString(deployment)
+	if err != nil {
+		log.Errorf("could not parse RabbitMQ connection string of deployment %s: %s", deployment.ID, err)
+		return nil, "", err
+	}
+	vhost := strings.TrimPrefix(direct.Path, "/")
+	if len(vhost) == 0 {
+		vhost = "/"
+	}
+
+	admin := connectionStrings(deployment.ConnectionStrings.Admin)
+	if len(admin) == 0 {
+		log.Errorf("could not find RabbitMQ management connection string of deployment %s", deployment.ID)
+		return nil, "", errors.New("deployment has no management connection string")
+	}
+	management, err := url.Parse(admin[0])
+	if err != nil {
+		log.Errorf("could not parse RabbitMQ management connection string of deployment %s: %s", deployment.ID, err)
+		return nil, "", err
+	}
+	// management connection strings usually come without credentials, use the admin user of the direct connection
+	if management.User == nil {
+		management.User = direct.User
+	}
+	return management, vhost, nil
+}
+
+func (r *RabbitMQ) do(management *url.URL, method, endpoint string, payload interface{}) error {
+	var body []byte
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		body = data
+	}
+
+	password, _ := management.User.Password()
+	req, err := http.NewRequest(method, fmt.Sprintf("%s://%s/%s", management.Scheme, management.Host, endpoint), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(management.User.Username(), password)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := r.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if method == "DELETE" && resp.StatusCode == http.StatusNotFound {
+		return ErrUserNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status code: %d, %s", resp.StatusCode, string(data))
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package credentials
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/JamesClonk/compose-broker/api"
+	"github.com/JamesClonk/compose-broker/log"
+)
+
+// Redis manages ACL users, which are only available on Redis 6.0 and newer
+type Redis struct{}
+
+func (r *Redis) Supports(deployment *api.Deployment) bool {
+	major, err := strconv.Atoi(strings.Split(deployment.Version, ".")[0])
+	return err == nil && major >= 6
+}
+
+func (r *Redis) CreateUser(deployment *api.Deployment, user User) error {
+	conn, err := r.open(deployment)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.command("ACL", "SETUSER", user.Username, "reset", "on", ">"+user.Password, "~*", "+@all"); err != nil {
+		log.Errorf("could not create Redis ACL user %s on deployment %s: %s", user.Username, deployment.ID, err)
+		return err
+	}
+	return nil
+}
+
+func (r *Redis) DeleteUser(deployment *api.Deployment, user User) error {
+	conn, err := r.open(deployment)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	deleted, err := conn.command("ACL", "DELUSER", user.Username)
+	if err != nil {
+		log.Errorf("could not delete Redis ACL user %s on deployment %s: %s", user.Username, deployment.ID, err)
+		return err
+	}
+	if deleted == "0" {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (r *Redis) open(deployment *api.Deployment) (*redisConn, error) {
+	u, err := directConnectionString(deployment)
+	if err != nil {
+		log.Errorf("could not parse Redis connection string of deployment %s: %s", deployment.ID, err)
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	if u.Scheme == "rediss" {
+		config := &tls.Config{ServerName: u.Hostname()}
+
+		// Compose.io deployments are secured by their own CA certificate
+		if len(deployment.CACertificateBase64) > 0 {
+			certificate, err := base64.StdEncoding.DecodeString(deployment.CACertificateBase64)
+			if err != nil {
+				log.Errorf("could not decode CA certificate of deployment %s: %s", deployment.ID, err)
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if pool.AppendCertsFromPEM(certificate) {
+				config.RootCAs = pool
+			}
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", u.Host, config)
+	} else {
+		conn, err = dialer.Dial("tcp", u.Host)
+	}
+	if err != nil {
+		log.Errorf("could not connect to Redis deployment %s: %s", deployment.ID, err)
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	rc := &redisConn{Conn: conn, reader: bufio.NewReader(conn)}
+	if password, ok := u.User.Password(); ok {
+		if _, err := rc.command("AUTH", password); err != nil {
+			rc.Close()
+			log.Errorf("could not authenticate on Redis deployment %s: %s", deployment.ID, err)
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// redisConn speaks just enough of the Redis protocol (RESP) to send commands and read simple replies
+type redisConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *redisConn) command(args ...string) (string, error) {
+	cmd := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		cmd += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := c.Write([]byte(cmd)); err != nil {
+		return "", err
+	}
+
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return "", errors.New("empty Redis reply")
+	}
+
+	switch line[0] {
+	case '-':
+		return "", errors.New(line[1:])
+	case '+', ':':
+		return line[1:], nil
+	default:
+		return "", fmt.Errorf("unexpected Redis reply: %s", line)
+	}
+}
@@ -0,0 +1,157 @@
+package credentials
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/JamesClonk/compose-broker/api"
+	"github.com/stretchr/testify/assert"
+)
+
+// redisServer answers every command with the reply returned by the handler
+func redisServer(t *testing.T, handler func(args []string) string) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveRedis(listener, handler)
+	return listener
+}
+
+// redisTLSServer is a redisServer behind TLS with a self-signed certificate, which is returned as base64 encoded PEM
+func redisTLSServer(t *testing.T, handler func(args []string) string) (net.Listener, string) {
+	server := httptest.NewTLSServer(nil) // only for its certificate
+	server.Close()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: server.TLS.Certificates})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveRedis(listener, handler)
+
+	certificate := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	return listener, base64.StdEncoding.EncodeToString(certificate)
+}
+
+func serveRedis(listener net.Listener, handler func(args []string) string) {
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					var count int
+					if _, err := fmt.Sscanf(line, "*%d\r\n", &count); err != nil {
+						return
+					}
+					args := make([]string, 0)
+					for i := 0; i < count; i++ {
+						_, _ = reader.ReadString('\n') // $length
+						arg, _ := reader.ReadString('\n')
+						args = append(args, strings.TrimSuffix(arg, "\r\n"))
+					}
+					_, _ = conn.Write([]byte(handler(args) + "\r\n"))
+				}
+			}(conn)
+		}
+	}()
+}
+
+func TestRedis_Supports(t *testing.T) {
+	r := &Redis{}
+	assert.False(t, r.Supports(&api.Deployment{Version: "4.0.14"}))
+	assert.False(t, r.Supports(&api.Deployment{Version: ""}))
+	assert.True(t, r.Supports(&api.Deployment{Version: "6.0.5"}))
+}
+
+func TestRedis_CreateUser(t *testing.T) {
+	commands := make(chan string, 10)
+	listener := redisServer(t, func(args []string) string {
+		commands <- strings.Join(args, " ")
+		return "+OK"
+	})
+	defer listener.Close()
+
+	deployment := &api.Deployment{ID: "5854017e89d50f424e000192", Type: "redis", Version: "6.0.5"}
+	deployment.ConnectionStrings.Direct = []string{"redis://admin:XXXX@" + listener.Addr().String()}
+
+	r := &Redis{}
+	assert.NoError(t, r.CreateUser(deployment, User{Username: "binding", Password: "s3cr3t"}))
+	assert.Equal(t, "AUTH XXXX", <-commands)
+	assert.Equal(t, "ACL SETUSER binding reset on >s3cr3t ~* +@all", <-commands)
+}
+
+func TestRedis_CreateUser_TLS(t *testing.T) {
+	commands := make(chan string, 10)
+	listener, certificate := redisTLSServer(t, func(args []string) string {
+		commands <- strings.Join(args, " ")
+		return "+OK"
+	})
+	defer listener.Close()
+
+	deployment := &api.Deployment{ID: "5854017e89d50f424e000192", Type: "redis", Version: "6.0.5"}
+	deployment.ConnectionStrings.Direct = []string{"rediss://admin:XXXX@" + listener.Addr().String()}
+
+	// the self-signed certificate is only trusted with the CA certificate of the deployment
+	r := &Redis{}
+	assert.Error(t, r.CreateUser(deployment, User{Username: "binding", Password: "s3cr3t"}))
+
+	deployment.CACertificateBase64 = certificate
+	assert.NoError(t, r.CreateUser(deployment, User{Username: "binding", Password: "s3cr3t"}))
+	assert.Equal(t, "AUTH XXXX", <-commands)
+	assert.Equal(t, "ACL SETUSER binding reset on >s3cr3t ~* +@all", <-commands)
+}
+
+func TestRedis_DeleteUser(t *testing.T) {
+	users := map[string]bool{"binding": true}
+	listener := redisServer(t, func(args []string) string {
+		if args[0] == "AUTH" {
+			return "+OK"
+		}
+		if users[args[2]] {
+			delete(users, args[2])
+			return ":1"
+		}
+		return ":0"
+	})
+	defer listener.Close()
+
+	deployment := &api.Deployment{ID: "5854017e89d50f424e000192", Type: "redis", Version: "6.0.5"}
+	deployment.ConnectionStrings.Direct = []string{"redis://admin:XXXX@" + listener.Addr().String()}
+
+	r := &Redis{}
+	assert.NoError(t, r.DeleteUser(deployment, User{Username: "binding", Password: "s3cr3t"}))
+	assert.Equal(t, ErrUserNotFound, r.DeleteUser(deployment, User{Username: "binding", Password: "s3cr3t"}))
+}
+
+func TestRedis_DeleteUser_Failure(t *testing.T) {
+	listener := redisServer(t, func(args []string) string {
+		if args[0] == "AUTH" {
+			return "+OK"
+		}
+		return "-ERR unknown command 'ACL'"
+	})
+	defer listener.Close()
+
+	deployment := &api.Deployment{ID: "5854017e89d50f424e000192", Type: "redis", Version: "6.0.5"}
+	deployment.ConnectionStrings.Direct = []string{"redis://admin:XXXX@" + listener.Addr().String()}
+
+	r := &Redis{}
+	err := r.DeleteUser(deployment, User{Username: "binding", Password: "s3cr3t"})
+	assert.Error(t, err)
+	assert.Equal(t, "ERR unknown command 'ACL'", err.Error())
+}
@@ -3,14 +3,14 @@ module github.com/JamesClonk/compose-broker
 go 1.13
 
 require (
-	github.com/elazarl/goproxy v0.0.0-20191011121108-aa519ddbe484 // indirect
+	github.com/go-sql-driver/mysql v1.5.0
 	github.com/gorilla/mux v1.7.3
-	github.com/parnurzeal/gorequest v0.2.16
-	github.com/pkg/errors v0.8.1 // indirect
+	github.com/lib/pq v1.3.0
+	github.com/prometheus/client_golang v1.4.1
 	github.com/sirupsen/logrus v1.4.2
-	github.com/smartystreets/goconvey v1.6.4 // indirect
 	github.com/stretchr/testify v1.4.0
-	golang.org/x/net v0.0.0-20191126235420-ef20fe5d7933 // indirect
-	gopkg.in/yaml.v2 v2.2.2
-	moul.io/http2curl v1.0.0 // indirect
+	github.com/xeipuuv/gojsonschema v1.2.0
+	go.etcd.io/bbolt v1.3.5
+	golang.org/x/time v0.0.0-20191024005414-555d28b269f0
+	gopkg.in/yaml.v2 v2.2.5
 )
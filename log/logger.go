@@ -1,6 +1,7 @@
 package log
 
 import (
+	"context"
 	"io"
 	"log"
 	"os"
@@ -28,12 +29,25 @@ func newLogger(writer io.Writer) *logrus.Logger {
 	logger := logrus.New()
 	logger.SetOutput(writer)
 	logger.SetLevel(logLevel)
-	logger.SetFormatter(&logrus.TextFormatter{
-		QuoteEmptyFields: true,
-		DisableColors:    true,
-		FullTimestamp:    true,
-		DisableTimestamp: !config.Get().LogTimestamp,
-	})
+	switch config.Get().LogFormat {
+	case "json":
+		logger.SetFormatter(&logrus.JSONFormatter{
+			DisableTimestamp: !config.Get().LogTimestamp,
+		})
+	case "text", "":
+		logger.SetFormatter(&logrus.TextFormatter{
+			QuoteEmptyFields: true,
+			DisableColors:    true,
+			FullTimestamp:    true,
+			DisableTimestamp: !config.Get().LogTimestamp,
+		})
+	default:
+		log.Fatalf("unknown log format: %s", config.Get().LogFormat)
+	}
+
+	// nothing gets written without being redacted first
+	setSensitiveKeys(config.Get().LogRedactKeys)
+	logger.SetFormatter(&redactingFormatter{logger.Formatter})
 	return logger
 }
 
@@ -100,3 +114,70 @@ func Fatalf(format string, args ...interface{}) {
 func Fatalln(args ...interface{}) {
 	logger.Fatalln(args...)
 }
+
+type contextKey struct{}
+
+// WithFields returns a context carrying the given fields in addition to those it already carries,
+// everything logged with it through Ctx includes them
+func WithFields(ctx context.Context, fields Fields) context.Context {
+	merged := Fields{}
+	for key, value := range FieldsFromContext(ctx) {
+		merged[key] = value
+	}
+	for key, value := range fields {
+		merged[key] = value
+	}
+	return context.WithValue(ctx, contextKey{}, merged)
+}
+
+func FieldsFromContext(ctx context.Context) Fields {
+	if fields, ok := ctx.Value(contextKey{}).(Fields); ok {
+		return fields
+	}
+	return Fields{}
+}
+
+// Entry logs with the fields of a context, like the ID of the request it belongs to
+type Entry struct {
+	entry *logrus.Entry
+}
+
+func Ctx(ctx context.Context) *Entry {
+	return &Entry{entry: logger.WithFields(logrus.Fields(FieldsFromContext(ctx)))}
+}
+
+func (e *Entry) Infof(format string, args ...interface{}) {
+	e.entry.Infof(format, args...)
+}
+
+func (e *Entry) Infoln(args ...interface{}) {
+	e.entry.Infoln(args...)
+}
+
+func (e *Entry) InfoWithFields(fields Fields, args ...interface{}) {
+	e.entry.WithFields(logrus.Fields(fields)).Infoln(args...)
+}
+
+func (e *Entry) Warnf(format string, args ...interface{}) {
+	e.entry.Warnf(format, args...)
+}
+
+func (e *Entry) Warnln(args ...interface{}) {
+	e.entry.Warnln(args...)
+}
+
+func (e *Entry) Debugf(format string, args ...interface{}) {
+	e.entry.Debugf(format, args...)
+}
+
+func (e *Entry) Debugln(args ...interface{}) {
+	e.entry.Debugln(args...)
+}
+
+func (e *Entry) Errorf(format string, args ...interface{}) {
+	e.entry.Errorf(format, args...)
+}
+
+func (e *Entry) Errorln(args ...interface{}) {
+	e.entry.Errorln(args...)
+}
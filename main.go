@@ -1,7 +1,13 @@
 package main
 
 import (
+	"context"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/JamesClonk/compose-broker/broker"
 	"github.com/JamesClonk/compose-broker/config"
@@ -14,14 +20,74 @@ func main() {
 
 	log.Infoln("port:", port)
 	log.Infoln("log level:", config.Get().LogLevel)
+	log.Infoln("log format:", config.Get().LogFormat)
 	log.Infoln("broker username:", config.Get().Username)
+	if len(config.Get().AdminPassword) > 0 {
+		log.Infoln("broker admin username:", config.Get().AdminUsername)
+	}
 	log.Infoln("broker catalog filename:", config.Get().CatalogFilename)
+	log.Infoln("broker catalog reload interval:", config.Get().CatalogReloadInterval)
+	if len(config.Get().QuotasFilename) > 0 {
+		log.Infoln("broker quotas filename:", config.Get().QuotasFilename)
+	}
+	if len(config.Get().AuditLogFilename) > 0 {
+		log.Infoln("broker audit log filename:", config.Get().AuditLogFilename)
+	}
+	log.Infoln("broker store type:", config.Get().Store.Type)
+	if config.Get().Store.Type == "bolt" {
+		log.Infoln("broker store filename:", config.Get().Store.Filename)
+	}
+	log.Infoln("broker request timeout:", config.Get().RequestTimeout)
+	log.Infoln("broker metrics interval:", config.Get().MetricsInterval)
+	if config.Get().Orphans.Interval > 0 {
+		log.Infoln("broker orphan mitigation interval:", config.Get().Orphans.Interval)
+		log.Infoln("broker orphan mitigation dry-run:", config.Get().Orphans.DryRun)
+	}
+	if config.Get().Drift.Interval > 0 {
+		log.Infoln("broker drift check interval:", config.Get().Drift.Interval)
+		log.Infoln("broker drift auto-correct:", config.Get().Drift.AutoCorrect)
+	}
 	log.Infoln("api url:", config.Get().API.URL)
 	log.Infoln("api default datacenter:", config.Get().API.DefaultDatacenter)
+	log.Infoln("api deployment index ttl:", config.Get().API.IndexTTL)
 	if len(config.Get().API.DefaultAccountID) > 0 {
 		log.Infoln("api default account id:", config.Get().API.DefaultAccountID)
 	}
+	if len(config.Get().API.DefaultWhitelist) > 0 {
+		log.Infoln("api default whitelist:", strings.Join(config.Get().API.DefaultWhitelist, ", "))
+	}
 
-	// start listener
-	log.Fatalln(http.ListenAndServe(":"+port, broker.NewRouter(config.Get())))
+	b := broker.NewBroker(config.Get())
+
+	// the catalog is reloaded on SIGHUP, and whenever its file changes
+	stop := make(chan struct{})
+	go b.WatchCatalog(config.Get().CatalogReloadInterval, stop)
+
+	// orphans and drift are looked for in the background
+	if config.Get().Orphans.Interval > 0 {
+		go b.ReconcileOrphans(config.Get().Orphans.Interval, stop)
+	}
+	if config.Get().Drift.Interval > 0 {
+		go b.WatchDrift(config.Get().Drift.Interval, stop)
+	}
+
+	// start listener, everything running in the background is stopped on shutdown
+	server := &http.Server{Addr: ":" + port, Handler: broker.NewRouter(b)}
+	go func() {
+		shutdown := make(chan os.Signal, 1)
+		signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-shutdown
+		log.Infof("received %v, shutting down", sig)
+		close(stop)
+		b.Client.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Errorf("could not shut down listener: %v", err)
+		}
+	}()
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatalln(err)
+	}
 }
@@ -0,0 +1,167 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "compose_broker"
+
+var (
+	HTTPRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "requests_total",
+			Help:      "Number of HTTP requests handled by the service broker, by route, method and status code.",
+		},
+		[]string{"route", "method", "code"},
+	)
+	HTTPRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "request_duration_seconds",
+			Help:      "Duration of HTTP requests handled by the service broker, by route and method.",
+			Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+		},
+		[]string{"route", "method"},
+	)
+	APIRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "api",
+			Name:      "requests_total",
+			Help:      "Number of Compose.io API calls, by endpoint, method and status code (or error / cancelled), retries included.",
+		},
+		[]string{"endpoint", "method", "code"},
+	)
+	APIRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "api",
+			Name:      "request_duration_seconds",
+			Help:      "Duration of Compose.io API calls, by endpoint and method, retries included.",
+			Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+		},
+		[]string{"endpoint", "method"},
+	)
+	APIRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "api",
+			Name:      "retries_total",
+			Help:      "Number of retried Compose.io API requests, by endpoint and method.",
+		},
+		[]string{"endpoint", "method"},
+	)
+	Deployments = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "deployments",
+			Help:      "Number of deployments of the service broker, by service and plan.",
+		},
+		[]string{"service", "plan"},
+	)
+	AllocatedUnits = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "allocated_units",
+			Help:      "Total number of units allocated to deployments of the service broker, by service and plan.",
+		},
+		[]string{"service", "plan"},
+	)
+	RecipesInProgress = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "recipes_in_progress",
+			Help:      "Number of running or waiting recipes on deployments of the service broker, by service and plan.",
+		},
+		[]string{"service", "plan"},
+	)
+	DeploymentIndexLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "deployment_index",
+			Name:      "lookups_total",
+			Help:      "Number of deployment name lookups in the deployment index, by result (hit or miss).",
+		},
+		[]string{"result"},
+	)
+	DeploymentIndexRefreshes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "deployment_index",
+			Name:      "refreshes_total",
+			Help:      "Number of full refreshes of the deployment index, by result (success or failure).",
+		},
+		[]string{"result"},
+	)
+	DeploymentIndexSize = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "deployment_index",
+			Name:      "entries",
+			Help:      "Number of deployments currently in the deployment index.",
+		},
+	)
+	OrphanedDeployments = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "orphan_mitigation",
+			Name:      "deployments_total",
+			Help:      "Number of orphaned deployments found, by result (deleted, dry_run or failure).",
+		},
+		[]string{"result"},
+	)
+	DriftedDeployments = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "drift",
+			Name:      "deployments",
+			Help:      "Number of deployments whose scaling did not match their service plan at the last check.",
+		},
+	)
+	DriftCorrections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "drift",
+			Name:      "corrections_total",
+			Help:      "Number of deployments scaled back to their service plan, by result (success or failure).",
+		},
+		[]string{"result"},
+	)
+	CatalogReloads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "catalog",
+			Name:      "reloads_total",
+			Help:      "Number of reloads of the catalog file, by result (success or failure).",
+		},
+		[]string{"result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(HTTPRequests)
+	prometheus.MustRegister(HTTPRequestDuration)
+	prometheus.MustRegister(APIRequests)
+	prometheus.MustRegister(APIRequestDuration)
+	prometheus.MustRegister(APIRetries)
+	prometheus.MustRegister(Deployments)
+	prometheus.MustRegister(AllocatedUnits)
+	prometheus.MustRegister(RecipesInProgress)
+	prometheus.MustRegister(DeploymentIndexLookups)
+	prometheus.MustRegister(DeploymentIndexRefreshes)
+	prometheus.MustRegister(DeploymentIndexSize)
+	prometheus.MustRegister(OrphanedDeployments)
+	prometheus.MustRegister(DriftedDeployments)
+	prometheus.MustRegister(DriftCorrections)
+	prometheus.MustRegister(CatalogReloads)
+}
+
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -4,7 +4,6 @@ import (
 	"crypto/tls"
 	"net/http"
 	"os"
-	"time"
 
 	"github.com/JamesClonk/compose-broker/config"
 )
@@ -22,7 +21,7 @@ func NewHttpClient(c *config.Config) *http.Client {
 	}
 
 	return &http.Client{
-		Timeout:   time.Duration(33 * time.Second),
+		Timeout:   c.API.Timeout,
 		Transport: tr,
 	}
 }
@@ -16,16 +16,29 @@ func TestConfig(apiURL string) *config.Config {
 		SkipSSL:         true,
 		LogLevel:        "debug",
 		LogTimestamp:    true,
+		LogFormat:       "text",
 		Username:        "broker",
 		Password:        "pw",
+		AdminUsername:   "admin",
+		AdminPassword:   "adminpw",
+		BindingSecret:   "secret",
 		CatalogFilename: "../catalog.yml",
+		RequestTimeout:  10 * time.Second,
+		Store: config.Store{
+			Type: "memory",
+		},
 		API: config.API{
-			URL:               apiURL,
-			Token:             "deadbeef",
-			DefaultDatacenter: "gce:europe-west1",
-			DefaultAccountID:  "586eab527c65836dde5533e8",
-			Retries:           1,
-			RetryInterval:     10 * time.Millisecond,
+			URL:                   apiURL,
+			Token:                 "deadbeef",
+			DefaultDatacenter:     "gce:europe-west1",
+			DefaultAccountID:      "586eab527c65836dde5533e8",
+			Retries:               1,
+			RetryInterval:         10 * time.Millisecond,
+			Timeout:               5 * time.Second,
+			RateLimit:             1000,
+			RateBurst:             100,
+			MaxConcurrentRequests: 4,
+			IndexTTL:              time.Minute,
 		},
 	}
 }